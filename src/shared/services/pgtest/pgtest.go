@@ -20,6 +20,13 @@ package pgtest
 
 import (
 	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
 
 	"github.com/golang-migrate/migrate"
 	"github.com/golang-migrate/migrate/database/postgres"
@@ -33,21 +40,429 @@ import (
 	"px.dev/pixie/src/shared/services/pg"
 )
 
-// SetupTestDB sets up a test database instance and applies migrations.
+const (
+	dbName     = "testdb"
+	dbUser     = "postgres"
+	dbPassword = "secret"
+)
+
+// SchemaSourceFromFS creates a schema source from the migrations in the given directory of fsys, such as an
+// embed.FS. Only the .sql files in the directory are included.
+func SchemaSourceFromFS(fsys fs.FS, dir string) (*bindata.AssetSource, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations: %w", err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".sql") {
+			names = append(names, entry.Name())
+		}
+	}
+
+	return bindata.Resource(names, func(name string) ([]byte, error) {
+		return fs.ReadFile(fsys, path.Join(dir, name))
+	}), nil
+}
+
+// Instance describes how to connect to a test database.
+type Instance struct {
+	Hostname string
+	Port     string
+	User     string
+	Password string
+	DBName   string
+}
+
+// DSN returns the connection string for the database.
+func (i *Instance) DSN() string {
+	return fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=disable", i.User, i.Password, i.Hostname, i.Port, i.DBName)
+}
+
+// Options configures the postgres server started for a test database.
+type Options struct {
+	// Settings are postgresql.conf settings which the server is started with, such as "max_connections" or
+	// "timezone". Settings which must be set at startup, such as "shared_preload_libraries", are supported.
+	Settings map[string]string
+	// Extensions are created in the test database with CREATE EXTENSION before the migrations are applied.
+	Extensions []string
+}
+
+// SetupTestDB sets up a test database instance and applies all of the up migrations in the schema source.
+// If the schema source is nil, the database is left empty.
 func SetupTestDB(schemaSource *bindata.AssetSource) (*sqlx.DB, func(), error) {
+	db, _, teardown, err := setupTestDBInstance(schemaSource, nil)
+	return db, teardown, err
+}
+
+// SetupTestDBWithOptions is like SetupTestDB, but starts the server with the given settings and creates the
+// given extensions, to reproduce the configuration of a production database.
+func SetupTestDBWithOptions(schemaSource *bindata.AssetSource, opts *Options) (*sqlx.DB, func(), error) {
+	db, _, teardown, err := setupTestDBInstance(schemaSource, opts)
+	return db, teardown, err
+}
+
+// SetupTestDBInstance is like SetupTestDB, but also returns the connection info of the database, for code
+// which needs to create its own connections.
+func SetupTestDBInstance(schemaSource *bindata.AssetSource) (*sqlx.DB, *Instance, func(), error) {
+	return setupTestDBInstance(schemaSource, nil)
+}
+
+func setupTestDBInstance(schemaSource *bindata.AssetSource, opts *Options) (*sqlx.DB, *Instance, func(), error) {
+	pool, resource, db, err := startPostgres(opts)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	teardown := func() {
+		if db != nil {
+			db.Close()
+		}
+
+		if err := pool.Purge(resource); err != nil {
+			log.WithError(err).Error("could not purge docker resource")
+		}
+	}
+
+	if opts != nil {
+		if err = createExtensions(db, opts.Extensions); err != nil {
+			teardown()
+			return nil, nil, nil, err
+		}
+	}
+
+	if err = runMigrations(db, schemaSource); err != nil {
+		teardown()
+		return nil, nil, nil, err
+	}
+
+	return db, newInstance(resource, dbName), teardown, nil
+}
+
+// TemplateDB is a postgres instance with a migrated template database. The template can be
+// cheaply cloned into an isolated database for each test, rather than running the migrations
+// again for every test.
+type TemplateDB struct {
+	// db is a connection to the maintenance database, used to create and drop the clones.
+	db       *sqlx.DB
+	hostname string
+	port     string
+
+	mu        sync.Mutex
+	numClones int
+}
+
+// SetupTemplateDB sets up a test database instance and applies migrations to the template database.
+func SetupTemplateDB(schemaSource *bindata.AssetSource) (*TemplateDB, func(), error) {
+	pool, resource, db, err := startPostgres(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	purge := func() {
+		if err := pool.Purge(resource); err != nil {
+			log.WithError(err).Error("could not purge docker resource")
+		}
+	}
+
+	err = runMigrations(db, schemaSource)
+	// A database can't be used as a template while there are connections to it.
+	db.Close()
+	if err != nil {
+		purge()
+		return nil, nil, err
+	}
+
+	t := &TemplateDB{
+		hostname: resource.Container.NetworkSettings.Gateway,
+		port:     resource.GetPort("5432/tcp"),
+	}
+	t.db, err = t.connect("postgres")
+	if err != nil {
+		purge()
+		return nil, nil, err
+	}
+
+	return t, func() {
+		t.db.Close()
+		purge()
+	}, nil
+}
+
+// Clone creates a new database from the template and connects to it. Changes to the clone are not
+// visible in the template or any other clone. The returned function closes and drops the clone.
+func (t *TemplateDB) Clone() (*sqlx.DB, func(), error) {
+	t.mu.Lock()
+	t.numClones++
+	name := fmt.Sprintf("%s_clone_%d", dbName, t.numClones)
+	t.mu.Unlock()
+
+	_, err := t.db.Exec(fmt.Sprintf("CREATE DATABASE %s TEMPLATE %s", name, dbName))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to clone template database: %w", err)
+	}
+
+	db, err := t.connect(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return db, func() {
+		db.Close()
+		if _, err := t.db.Exec(fmt.Sprintf("DROP DATABASE IF EXISTS %s", name)); err != nil {
+			log.WithError(err).Error("could not drop cloned database")
+		}
+	}, nil
+}
+
+// SnapshotDB is a test database which can be reset to a saved state, so that the cases of a table-driven test
+// can share a single postgres instance. The state is saved and restored by copying the database with
+// CREATE DATABASE ... TEMPLATE, which requires closing the connection to it, so Snapshot and RestoreSnapshot
+// return a new connection which replaces the previous one.
+type SnapshotDB struct {
+	tmpl *TemplateDB
+	db   *sqlx.DB
+	// The name of the database used by the test, and of the copy of its saved state.
+	name         string
+	snapshotName string
+	hasSnapshot  bool
+}
+
+// SetupSnapshotDB sets up a test database instance, applies the migrations in the schema source, and returns a
+// database which can be snapshotted. Until Snapshot is called, RestoreSnapshot resets the database to its
+// migrated state. The returned function closes the database and stops the instance.
+func SetupSnapshotDB(schemaSource *bindata.AssetSource) (*SnapshotDB, func(), error) {
+	tmpl, teardownTmpl, err := SetupTemplateDB(schemaSource)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s := &SnapshotDB{
+		tmpl:         tmpl,
+		name:         dbName + "_snapshot_work",
+		snapshotName: dbName + "_snapshot",
+	}
+	if err := s.copyDatabase(dbName, s.name); err != nil {
+		teardownTmpl()
+		return nil, nil, err
+	}
+	if err := s.reconnect(); err != nil {
+		teardownTmpl()
+		return nil, nil, err
+	}
+
+	return s, func() {
+		s.close()
+		teardownTmpl()
+	}, nil
+}
+
+// DB returns the current connection to the database, or nil if it could not be reopened after a failed
+// Snapshot or RestoreSnapshot.
+func (s *SnapshotDB) DB() *sqlx.DB {
+	return s.db
+}
+
+// Snapshot saves the current state of the database, replacing any earlier snapshot. The connection returned by
+// DB is closed, and the returned connection should be used instead. If the snapshot fails, DB still returns a
+// new connection to the database.
+func (s *SnapshotDB) Snapshot() (*sqlx.DB, error) {
+	s.close()
+
+	err := s.copyDatabase(s.name, s.snapshotName)
+	if err == nil {
+		s.hasSnapshot = true
+	}
+	return s.reconnectAfter(err)
+}
+
+// RestoreSnapshot resets the database to the state saved by the last call to Snapshot, or to its migrated state if
+// Snapshot was never called. The connection returned by DB is closed, and the returned connection should be used
+// instead. If the restore fails, DB returns a new connection to the database if it still exists.
+func (s *SnapshotDB) RestoreSnapshot() (*sqlx.DB, error) {
+	s.close()
+
+	source := dbName
+	if s.hasSnapshot {
+		source = s.snapshotName
+	}
+	return s.reconnectAfter(s.copyDatabase(source, s.name))
+}
+
+// MustRestoreSnapshot is the same as RestoreSnapshot, but fails the test if the database can't be restored. It is
+// meant to be called at the start of each sub-test.
+func (s *SnapshotDB) MustRestoreSnapshot(t testing.TB) *sqlx.DB {
+	t.Helper()
+	db, err := s.RestoreSnapshot()
+	if err != nil {
+		t.Fatalf("failed to restore database snapshot: %v", err)
+	}
+	return db
+}
+
+// copyDatabase replaces the database named to with a copy of the database named from.
+func (s *SnapshotDB) copyDatabase(from string, to string) error {
+	// Any connections which the test opened itself would block dropping the database.
+	if _, err := s.tmpl.db.Exec(fmt.Sprintf("DROP DATABASE IF EXISTS %s WITH (FORCE)", to)); err != nil {
+		return fmt.Errorf("failed to drop database %s: %w", to, err)
+	}
+	if _, err := s.tmpl.db.Exec(fmt.Sprintf("CREATE DATABASE %s TEMPLATE %s", to, from)); err != nil {
+		return fmt.Errorf("failed to copy database %s to %s: %w", from, to, err)
+	}
+	return nil
+}
+
+func (s *SnapshotDB) reconnect() error {
+	db, err := s.tmpl.connect(s.name)
+	if err != nil {
+		return err
+	}
+	s.db = db
+	return nil
+}
+
+// reconnectAfter reconnects to the database after a copy which returned copyErr. The connection is reopened even
+// if the copy failed, so that the database stays usable.
+func (s *SnapshotDB) reconnectAfter(copyErr error) (*sqlx.DB, error) {
+	err := s.reconnect()
+	if copyErr != nil {
+		return nil, copyErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.db, nil
+}
+
+// close closes the connection to the database, if it is open. The connection is left closed by a copy or
+// reconnect which failed.
+func (s *SnapshotDB) close() {
+	if s.db != nil {
+		s.db.Close()
+		s.db = nil
+	}
+}
+
+// shared is the postgres instance which is started by the first call to SetupTestDBShared.
+var shared struct {
+	once     sync.Once
+	tmpl     *TemplateDB
+	teardown func()
+	err      error
+}
+
+// SetupTestDBShared creates an empty, isolated database for the caller on a postgres instance which is shared
+// by every test in the test binary. The instance is started on the first call. The returned function closes and
+// drops only the caller's database; the instance itself is stopped by TeardownShared.
+func SetupTestDBShared(t testing.TB) (*sqlx.DB, func()) {
+	shared.once.Do(func() {
+		shared.tmpl, shared.teardown, shared.err = SetupTemplateDB(nil)
+	})
+	if shared.err != nil {
+		t.Fatalf("failed to start shared test database: %v", shared.err)
+	}
+
+	db, teardown, err := shared.tmpl.Clone()
+	if err != nil {
+		t.Fatalf("failed to create test database: %v", err)
+	}
+	return db, teardown
+}
+
+// TeardownShared stops the postgres instance started by SetupTestDBShared, if any. It should be called from
+// TestMain once all of the tests have run. The instance also expires on its own if this is never called.
+func TeardownShared() {
+	if shared.teardown != nil {
+		shared.teardown()
+	}
+}
+
+// waitForRowInterval is the interval at which WaitForRow polls the database.
+const waitForRowInterval = 100 * time.Millisecond
+
+// WaitForRow polls the given query until it returns at least one row, for tests which wait on an asynchronous
+// writer. The test fails with the last error if the query returns no rows within the timeout.
+func WaitForRow(t testing.TB, db *sqlx.DB, query string, args []interface{}, timeout time.Duration) {
+	t.Helper()
+
+	var lastErr error
+	deadline := time.Now().Add(timeout)
+	for {
+		found, err := hasRow(db, query, args)
+		if found {
+			return
+		}
+		if err != nil {
+			lastErr = err
+		}
+		if time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(waitForRowInterval)
+	}
+
+	if lastErr != nil {
+		t.Fatalf("timed out waiting for a row from %q: %v", query, lastErr)
+	}
+	t.Fatalf("timed out waiting for a row from %q", query)
+}
+
+func hasRow(db *sqlx.DB, query string, args []interface{}) (bool, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	if rows.Next() {
+		return true, nil
+	}
+	return false, rows.Err()
+}
+
+func (t *TemplateDB) connect(name string) (*sqlx.DB, error) {
+	i := &Instance{Hostname: t.hostname, Port: t.port, User: dbUser, Password: dbPassword, DBName: name}
+	db, err := sqlx.Open("pgx", i.DSN())
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", name, err)
+	}
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to %s: %w", name, err)
+	}
+	return db, nil
+}
+
+func newInstance(resource *dockertest.Resource, name string) *Instance {
+	return &Instance{
+		Hostname: resource.Container.NetworkSettings.Gateway,
+		Port:     resource.GetPort("5432/tcp"),
+		User:     dbUser,
+		Password: dbPassword,
+		DBName:   name,
+	}
+}
+
+// startPostgres starts a postgres instance on docker and connects to its test database. The server is started
+// with the settings in opts, if any.
+func startPostgres(opts *Options) (*dockertest.Pool, *dockertest.Resource, *sqlx.DB, error) {
 	var db *sqlx.DB
 
 	pool, err := dockertest.NewPool("")
 	if err != nil {
-		return nil, nil, fmt.Errorf("connect to docker failed: %w", err)
+		return nil, nil, nil, fmt.Errorf("connect to docker failed: %w", err)
+	}
+
+	var cmd []string
+	if opts != nil && len(opts.Settings) > 0 {
+		cmd = serverCmd(opts.Settings)
 	}
 
-	const dbName = "testdb"
 	resource, err := pool.RunWithOptions(
 		&dockertest.RunOptions{
 			Repository: "postgres",
 			Tag:        "13.3",
-			Env:        []string{"POSTGRES_PASSWORD=secret", "POSTGRES_DB=" + dbName},
+			Env:        []string{"POSTGRES_PASSWORD=" + dbPassword, "POSTGRES_DB=" + dbName},
+			Cmd:        cmd,
 		}, func(config *docker.HostConfig) {
 			config.AutoRemove = true
 			config.RestartPolicy = docker.RestartPolicy{Name: "no"}
@@ -67,57 +482,87 @@ func SetupTestDB(schemaSource *bindata.AssetSource) (*sqlx.DB, func(), error) {
 		},
 	)
 	if err != nil {
-		return nil, nil, fmt.Errorf("Failed to run docker pool: %w", err)
+		return nil, nil, nil, fmt.Errorf("Failed to run docker pool: %w", err)
 	}
 	// Set a 5 minute expiration on resources.
 	err = resource.Expire(300)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
 	viper.Set("postgres_port", resource.GetPort("5432/tcp"))
 	viper.Set("postgres_hostname", resource.Container.NetworkSettings.Gateway)
 	viper.Set("postgres_db", dbName)
-	viper.Set("postgres_username", "postgres")
-	viper.Set("postgres_password", "secret")
+	viper.Set("postgres_username", dbUser)
+	viper.Set("postgres_password", dbPassword)
 
 	if err = pool.Retry(func() error {
 		log.Info("trying to connect")
 		db = pg.MustCreateDefaultPostgresDB()
 		return db.Ping()
 	}); err != nil {
-		return nil, nil, fmt.Errorf("failed to create postgres on docker: %w", err)
+		return nil, nil, nil, fmt.Errorf("failed to create postgres on docker: %w", err)
 	}
 
-	driver, err := postgres.WithInstance(db.DB, &postgres.Config{})
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to get postgres driver: %w", err)
+	return pool, resource, db, nil
+}
+
+// serverCmd returns the command which starts the postgres server with the given settings. The settings are
+// sorted, so that the command is the same for the same settings.
+func serverCmd(settings map[string]string) []string {
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
 	}
+	sort.Strings(names)
 
-	if schemaSource != nil {
-		d, err := bindata.WithInstance(schemaSource)
-		if err != nil {
-			return nil, nil, fmt.Errorf("failed to load schema: %w", err)
-		}
-		mg, err := migrate.NewWithInstance(
-			"go-bindata",
-			d, "postgres", driver)
+	cmd := []string{"postgres"}
+	for _, name := range names {
+		cmd = append(cmd, "-c", fmt.Sprintf("%s=%s", name, settings[name]))
+	}
+	return cmd
+}
+
+// createExtensions creates each of the given extensions in the database, if it doesn't exist yet.
+func createExtensions(db *sqlx.DB, extensions []string) error {
+	for _, ext := range extensions {
+		_, err := db.Exec(fmt.Sprintf("CREATE EXTENSION IF NOT EXISTS %s", quoteIdentifier(ext)))
 		if err != nil {
-			return nil, nil, fmt.Errorf("failed to load migrations: %w", err)
+			return fmt.Errorf("failed to create extension %s: %w", ext, err)
 		}
+	}
+	return nil
+}
 
-		if err = mg.Up(); err != nil {
-			return nil, nil, fmt.Errorf("migrations failed: %w", err)
-		}
+// quoteIdentifier quotes the name so that it can be used as an identifier in a query.
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// runMigrations applies all of the migrations in the schema source, if any, to the database.
+func runMigrations(db *sqlx.DB, schemaSource *bindata.AssetSource) error {
+	if schemaSource == nil {
+		return nil
 	}
 
-	return db, func() {
-		if db != nil {
-			db.Close()
-		}
+	driver, err := postgres.WithInstance(db.DB, &postgres.Config{})
+	if err != nil {
+		return fmt.Errorf("failed to get postgres driver: %w", err)
+	}
 
-		if err := pool.Purge(resource); err != nil {
-			log.WithError(err).Error("could not purge docker resource")
-		}
-	}, nil
+	d, err := bindata.WithInstance(schemaSource)
+	if err != nil {
+		return fmt.Errorf("failed to load schema: %w", err)
+	}
+	mg, err := migrate.NewWithInstance(
+		"go-bindata",
+		d, "postgres", driver)
+	if err != nil {
+		return fmt.Errorf("failed to load migrations: %w", err)
+	}
+
+	if err = mg.Up(); err != nil {
+		return fmt.Errorf("migrations failed: %w", err)
+	}
+	return nil
 }
@@ -19,14 +19,26 @@
 package pgtest_test
 
 import (
+	"fmt"
+	"os"
 	"testing"
+	"testing/fstest"
+	"time"
 
+	bindata "github.com/golang-migrate/migrate/source/go_bindata"
+	"github.com/jmoiron/sqlx"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"px.dev/pixie/src/shared/services/pgtest"
 )
 
+func TestMain(m *testing.M) {
+	code := m.Run()
+	pgtest.TeardownShared()
+	os.Exit(code)
+}
+
 func TestSetupTestDB(t *testing.T) {
 	db, teardown, err := pgtest.SetupTestDB(nil)
 
@@ -41,3 +53,152 @@ func TestSetupTestDB(t *testing.T) {
 	err = db.Ping()
 	require.NotNil(t, err)
 }
+
+func TestSetupTestDBInstance(t *testing.T) {
+	db, inst, teardown, err := pgtest.SetupTestDBInstance(nil)
+	require.NoError(t, err)
+	defer teardown()
+	assert.Nil(t, db.Ping())
+
+	// The instance should be usable to open a separate connection to the same database.
+	conn, err := sqlx.Open("pgx", inst.DSN())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	db.MustExec(`CREATE TABLE items (id int PRIMARY KEY)`)
+	var count int
+	require.NoError(t, conn.Get(&count, `SELECT count(*) FROM items`))
+	assert.Equal(t, 0, count)
+}
+
+func TestSetupTestDBWithOptions(t *testing.T) {
+	db, teardown, err := pgtest.SetupTestDBWithOptions(nil, &pgtest.Options{
+		Settings: map[string]string{
+			"max_connections": "42",
+			"timezone":        "America/New_York",
+		},
+		Extensions: []string{"pgcrypto"},
+	})
+	require.NoError(t, err)
+	defer teardown()
+
+	var setting string
+	require.NoError(t, db.Get(&setting, `SHOW max_connections`))
+	assert.Equal(t, "42", setting)
+	require.NoError(t, db.Get(&setting, `SHOW timezone`))
+	assert.Equal(t, "America/New_York", setting)
+
+	var count int
+	require.NoError(t, db.Get(&count, `SELECT count(*) FROM pg_extension WHERE extname = 'pgcrypto'`))
+	assert.Equal(t, 1, count)
+}
+
+func TestSchemaSourceFromFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"schema/1_create_items.up.sql":   {Data: []byte(`CREATE TABLE items (id int PRIMARY KEY);`)},
+		"schema/1_create_items.down.sql": {Data: []byte(`DROP TABLE items;`)},
+		"schema/README.md":               {Data: []byte(`Not a migration.`)},
+	}
+
+	s, err := pgtest.SchemaSourceFromFS(fsys, "schema")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"1_create_items.up.sql", "1_create_items.down.sql"}, s.Names)
+
+	b, err := s.AssetFunc("1_create_items.up.sql")
+	require.NoError(t, err)
+	assert.Equal(t, `CREATE TABLE items (id int PRIMARY KEY);`, string(b))
+
+	_, err = pgtest.SchemaSourceFromFS(fsys, "nonexistent")
+	assert.Error(t, err)
+}
+
+func TestSetupTemplateDB(t *testing.T) {
+	s := bindata.Resource([]string{"1_create_items.up.sql"}, func(name string) ([]byte, error) {
+		return []byte(`CREATE TABLE items (id int PRIMARY KEY);`), nil
+	})
+	tmpl, teardown, err := pgtest.SetupTemplateDB(s)
+	require.NoError(t, err)
+	defer teardown()
+
+	db1, dropDB1, err := tmpl.Clone()
+	require.NoError(t, err)
+	defer dropDB1()
+
+	// The clone should contain the seeded schema.
+	db1.MustExec(`INSERT INTO items (id) VALUES (1)`)
+	var count int
+	require.NoError(t, db1.Get(&count, `SELECT count(*) FROM items`))
+	assert.Equal(t, 1, count)
+
+	// Mutations to a clone should not leak back into the template.
+	db2, dropDB2, err := tmpl.Clone()
+	require.NoError(t, err)
+	defer dropDB2()
+
+	require.NoError(t, db2.Get(&count, `SELECT count(*) FROM items`))
+	assert.Equal(t, 0, count)
+}
+
+func TestSetupSnapshotDB(t *testing.T) {
+	s := bindata.Resource([]string{"1_create_items.up.sql"}, func(name string) ([]byte, error) {
+		return []byte(`CREATE TABLE items (id int PRIMARY KEY);`), nil
+	})
+	sdb, teardown, err := pgtest.SetupSnapshotDB(s)
+	require.NoError(t, err)
+	defer teardown()
+
+	// Without a snapshot, restoring should reset to the migrated state.
+	sdb.DB().MustExec(`INSERT INTO items (id) VALUES (1)`)
+	db := sdb.MustRestoreSnapshot(t)
+	var count int
+	require.NoError(t, db.Get(&count, `SELECT count(*) FROM items`))
+	assert.Equal(t, 0, count)
+
+	db.MustExec(`INSERT INTO items (id) VALUES (1)`)
+	_, err = sdb.Snapshot()
+	require.NoError(t, err)
+
+	for _, id := range []int{2, 3} {
+		t.Run(fmt.Sprintf("insert %d", id), func(t *testing.T) {
+			db := sdb.MustRestoreSnapshot(t)
+			db.MustExec(`INSERT INTO items (id) VALUES ($1)`, id)
+
+			// Each case should only see the seeded row and its own.
+			var ids []int
+			require.NoError(t, db.Select(&ids, `SELECT id FROM items ORDER BY id`))
+			assert.Equal(t, []int{1, id}, ids)
+		})
+	}
+}
+
+func TestSetupTestDBShared(t *testing.T) {
+	db1, teardown1 := pgtest.SetupTestDBShared(t)
+	db2, teardown2 := pgtest.SetupTestDBShared(t)
+	defer teardown2()
+
+	db1.MustExec(`CREATE TABLE items (id int PRIMARY KEY)`)
+
+	// Each caller should get its own database on the shared instance.
+	var count int
+	require.NoError(t, db2.Get(&count, `SELECT count(*) FROM information_schema.tables WHERE table_name = 'items'`))
+	assert.Equal(t, 0, count)
+
+	// Tearing down one database should leave the others usable.
+	teardown1()
+	require.Error(t, db1.Ping())
+	assert.NoError(t, db2.Ping())
+}
+
+func TestWaitForRow(t *testing.T) {
+	db, teardown := pgtest.SetupTestDBShared(t)
+	defer teardown()
+
+	db.MustExec(`CREATE TABLE items (id int PRIMARY KEY)`)
+
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		db.MustExec(`INSERT INTO items (id) VALUES (1)`)
+	}()
+
+	pgtest.WaitForRow(t, db, `SELECT id FROM items WHERE id = $1`, []interface{}{1}, 10*time.Second)
+}
@@ -19,16 +19,24 @@
 package agent
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"path"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gofrs/uuid"
 	"github.com/gogo/protobuf/proto"
 	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/util/clock"
 
+	"px.dev/pixie/src/shared/k8s"
 	"px.dev/pixie/src/shared/k8s/metadatapb"
 	types "px.dev/pixie/src/shared/types/gotypes"
 	"px.dev/pixie/src/utils"
@@ -43,26 +51,78 @@ import (
 // agent data.
 type Store interface {
 	CreateAgent(agentID uuid.UUID, a *agentpb.Agent) error
+	CreateAgents(agentIDs []uuid.UUID, agents []*agentpb.Agent, registeredIDs []uuid.UUID, registerTimeNS int64,
+		pin bool) error
 	GetAgent(agentID uuid.UUID) (*agentpb.Agent, error)
+	GetAgentWithSchema(agentID uuid.UUID) (*agentpb.Agent, []*storepb.TableInfo, error)
 	UpdateAgent(agentID uuid.UUID, a *agentpb.Agent) error
+	UpdateAgentWithStatus(agentID uuid.UUID, a *agentpb.Agent, status *agentpb.AgentStatus) error
+	GetAgentStatus(agentID uuid.UUID) (*agentpb.AgentStatus, error)
+	SetAgentLastRegisterTime(agentID uuid.UUID, timeNS int64) error
+	GetAgentLastRegisterTime(agentID uuid.UUID) (int64, error)
 	DeleteAgent(agentID uuid.UUID) error
+	DeleteAgents(agentIDs []uuid.UUID) error
 
 	GetAgents() ([]*agentpb.Agent, error)
+	GetAgentsFiltered(pred func(*agentpb.Agent) bool) ([]*agentpb.Agent, error)
+	GetAgentsWithCapability(collectsData bool) ([]*agentpb.Agent, error)
+	GetAgentCount() (int, error)
+	GetAgentCountByCapability(collectsData bool) (int, error)
+	GetAgentsModifiedSince(version uint64) ([]*agentpb.Agent, uint64, error)
+
+	SetAgentDescription(agentID uuid.UUID, description string) error
+	GetAgentDescription(agentID uuid.UUID) (string, error)
+
+	SetAgentConfig(agentID uuid.UUID, key string, value string) error
+	SetAgentsConfig(agentIDs []uuid.UUID, key string, value string) error
+	GetAgentConfig(agentID uuid.UUID) (map[string]string, error)
+
+	PinAgent(agentID uuid.UUID) error
+	IsAgentPinned(agentID uuid.UUID) (bool, error)
+	GetPinnedAgentIDs() ([]uuid.UUID, error)
 
 	GetASID() (uint32, error)
+	GetAgentsByASIDRange(lo uint32, hi uint32) ([]*agentpb.Agent, error)
+	GetAgentByASID(asid uint32) (*agentpb.Agent, error)
+	GetAgentsByHostnamePrefix(prefix string) ([]*agentpb.Agent, error)
+	UpdateAgentASIDIndex(agentID uuid.UUID, oldASID uint32, newASID uint32) error
 	GetAgentIDFromPodName(podName string) (string, error)
 
 	GetAgentsDataInfo() (map[uuid.UUID]*messagespb.AgentDataInfo, error)
+	IterateDataInfo(fn func(uuid.UUID, *messagespb.AgentDataInfo) bool) error
+	GetDataInfoForAgents(ids []uuid.UUID) (map[uuid.UUID]*messagespb.AgentDataInfo, error)
+	GetAgentIDsWithDataInfo() ([]uuid.UUID, error)
 	UpdateAgentDataInfo(agentID uuid.UUID, dataInfo *messagespb.AgentDataInfo) error
 
 	GetComputedSchema() (*storepb.ComputedSchema, error)
+	GetAgentTables(agentID uuid.UUID) ([]*storepb.TableInfo, error)
 	UpdateSchemas(agentID uuid.UUID, schemas []*storepb.TableInfo) error
 	PruneComputedSchema() error
 
 	GetProcesses(upids []*types.UInt128) ([]*metadatapb.ProcessInfo, error)
+	GetProcessesWithContext(ctx context.Context, upids []*types.UInt128) ([]*metadatapb.ProcessInfo, error)
+	GetProcessesActiveAt(ts int64, upids []*types.UInt128) ([]*metadatapb.ProcessInfo, error)
+	ListProcesses(cursor []byte, limit int) ([]*metadatapb.ProcessInfo, []byte, error)
+	CompactAgentProcesses(agentID uuid.UUID) error
 	UpdateProcesses(processes []*metadatapb.ProcessInfo) error
+	// UpdateAgentStates writes the processes, and the data info and schema of each of the agent states, in a
+	// single write.
+	UpdateAgentStates(processes []*metadatapb.ProcessInfo, states []*AgentState) error
+	SetProcessLabels(upid *types.UInt128, labels map[string]string) error
+	GetProcessLabels(upid *types.UInt128) (map[string]string, error)
+	SetProcessParent(upid *types.UInt128, parent *types.UInt128) error
+	GetProcessAncestors(upid *types.UInt128, maxDepth int) ([]*metadatapb.ProcessInfo, error)
 
 	GetAgentIDForHostnamePair(hnPair *HostnameIPPair) (string, error)
+	GetAgentIDsForHostnamePairs(hnPairs []*HostnameIPPair) ([]string, error)
+	GetAgentForHostnamePair(hnPair *HostnameIPPair) (*agentpb.Agent, error)
+
+	GetFullAgentRecord(agentID uuid.UUID) (*FullRecord, error)
+
+	SaveAgentUpdateCursor(state *CursorState) error
+	AppendAgentUpdateCursorUpdate(cursorID uuid.UUID, seq uint64, update *metadata_servicepb.AgentUpdate) error
+	GetAgentUpdateCursors() ([]*CursorState, error)
+	DeleteAgentUpdateCursor(cursorID uuid.UUID) error
 }
 
 // CIDRInfoProvider is an interface that provides CIDRInfo for a given agent.
@@ -71,50 +131,164 @@ type CIDRInfoProvider interface {
 	GetPodCIDRs() []string
 }
 
+// ErrAgentNotFound is returned when there is no live agent matching the request.
+var ErrAgentNotFound = errors.New("Could not find agent with the given name")
+
+// ErrCursorNotFound is returned when reading from an agent update cursor which does not exist, such as one which
+// has been deleted. The cursor should be re-created to resync the agent state.
+var ErrCursorNotFound = errors.New("Agent update cursor not found")
+
+// ErrASIDInUse is returned when reassigning an agent's ASID to one which is held by another live agent.
+var ErrASIDInUse = errors.New("ASID already belongs to another agent")
+
+// ErrHostnameConflict is returned when registering an agent whose hostname and IP belong to a different agent.
+var ErrHostnameConflict = errors.New("Hostname and IP already belong to another agent")
+
+// ErrInvalidAgent is returned when registering an agent which is missing its info, ID, host info or
+// capabilities, or whose ID is malformed.
+var ErrInvalidAgent = errors.New("Agent is invalid")
+
+// ErrInvalidAgentUpdate is returned when an agent update is missing its update info.
+var ErrInvalidAgentUpdate = errors.New("Agent update is missing update info")
+
+// ErrUpdateRateLimited is returned when an agent sends updates faster than its update rate limit.
+var ErrUpdateRateLimited = errors.New("Agent update rate limit exceeded")
+
+// The operations which are logged by the manager, besides the ones recorded in the audit log.
+const (
+	logOpExpire      = "expire"
+	logOpApplyUpdate = "apply_update"
+)
+
 // Update describes the update info for a given agent.
 type Update struct {
 	UpdateInfo *messagespb.AgentUpdateInfo
 	AgentID    uuid.UUID
+	// IncrementalSchema is merged into the agent's existing schema, after any schema in UpdateInfo is applied.
+	// This lets an agent which adds or removes a table send only that change, instead of its whole schema.
+	IncrementalSchema *SchemaDelta
+}
+
+// SchemaDelta describes a change to an agent's schema.
+type SchemaDelta struct {
+	// Tables are added to the agent's schema, replacing any of its tables with the same names.
+	Tables []*storepb.TableInfo
+	// TablesRemoved are the names of tables that the agent no longer has.
+	TablesRemoved []string
+}
+
+// ReconcileResult describes the changes made by a call to Reconcile.
+type ReconcileResult struct {
+	// Registered is the number of desired agents which were missing and have been registered.
+	Registered int
+	// Deleted is the number of agents which were not desired and have been deleted.
+	Deleted int
 }
 
 // Manager handles any agent updates and requests.
 type Manager interface {
-	// RegisterAgent registers a new agent.
+	// RegisterAgent registers a new agent. Once RegisterAgent returns, the agent is visible to all
+	// subsequent reads of the store.
 	RegisterAgent(info *agentpb.Agent) (uint32, error)
+	// ForceRegisterAgent registers a new agent, taking over its hostname and IP from any other agent which
+	// has them.
+	ForceRegisterAgent(info *agentpb.Agent) (uint32, error)
+	// RegisterAgents registers all of the given agents in a single write, and returns their ASIDs in the
+	// same order. If the write fails, none of the agents are registered.
+	RegisterAgents(infos []*agentpb.Agent) ([]uint32, error)
+	// ReassignASID assigns a new ASID to the agent, and returns the new ASID.
+	ReassignASID(agentID uuid.UUID) (uint32, error)
+	// RegisterSyntheticAgent registers an agent which is pinned, so that it is never expired and is always
+	// healthy regardless of its heartbeats. It can still be removed with DeleteAgent.
+	RegisterSyntheticAgent(info *agentpb.Agent) (uint32, error)
+	// IsAgentPinned returns whether the agent is a synthetic agent which should never be expired.
+	IsAgentPinned(agentID uuid.UUID) (bool, error)
 
 	// UpdateHeartbeat updates the agent heartbeat with the current time.
 	UpdateHeartbeat(agentID uuid.UUID) error
 
+	// UpdateHeartbeatWithStats updates the agent heartbeat with the current time, and stores the status
+	// reported by the agent.
+	UpdateHeartbeatWithStats(agentID uuid.UUID, stats *agentpb.AgentStatus) error
+
 	// Delete agent deletes the agent.
 	DeleteAgent(uuid.UUID) error
+	// DeleteAgents deletes all of the given agents in a single write.
+	DeleteAgents(agentIDs []uuid.UUID) error
+	// ExpireAgent deletes an agent which has stopped sending heartbeats.
+	ExpireAgent(agentID uuid.UUID) error
+
+	// CanSafelyRemove returns whether the agent can be removed without leaving any table unserved, along
+	// with the tables for which the agent is the only provider.
+	CanSafelyRemove(agentID uuid.UUID) (bool, []string, error)
+
+	// GetUnderReplicatedTables gets the tables which are served by fewer than k agents, along with the number
+	// of agents serving each of them.
+	GetUnderReplicatedTables(k int) (map[string]int, error)
+
+	// Reconcile makes the set of agents match the desired agents, registering the missing agents and
+	// deleting the agents which are not desired.
+	Reconcile(desired []*agentpb.Agent) (*ReconcileResult, error)
 
 	// GetActiveAgents gets all of the current active agents.
 	GetActiveAgents() ([]*agentpb.Agent, error)
+	// GetActiveAgentsWithCapability gets the active agents which do or do not collect data, sorted by ASID.
+	GetActiveAgentsWithCapability(collectsData bool) ([]*agentpb.Agent, error)
+	// GetAgentsWithoutDataInfo gets the data-collecting agents which have not reported their data info.
+	GetAgentsWithoutDataInfo() ([]uuid.UUID, error)
+	// GetNeverHeartbeatedAgents gets the agents which have not sent a heartbeat since they were registered.
+	GetNeverHeartbeatedAgents() ([]uuid.UUID, error)
+	// GetAgentsSharingHostIP gets all host IPs that are shared by more than one active agent.
+	GetAgentsSharingHostIP() (map[string][]uuid.UUID, error)
+	// GetAgentsByHostnamePrefix gets the agents whose hostnames start with the given prefix, such as the agents
+	// of a node pool.
+	GetAgentsByHostnamePrefix(prefix string) ([]*agentpb.Agent, error)
 
 	MessageAgents(agentIDs []uuid.UUID, msg []byte) error
 	MessageActiveAgents(msg []byte) error
 
 	ApplyAgentUpdate(update *Update) error
+	ApplyAgentUpdates(updates []*Update) error
 
 	// NewAgentUpdateCursor creates a unique ID for an agent update tracking cursor.
 	// It, when used with GetAgentUpdates, can be used by clients of the agent manager
 	// to get the initial agent state and track updates as deltas to that state.
-	NewAgentUpdateCursor() uuid.UUID
+	NewAgentUpdateCursor(opts ...AgentUpdateCursorOption) uuid.UUID
 
 	// DeleteAgentUpdateCursor deletes a cursor from the Manager so that it no longer
 	// tracks updates.
 	DeleteAgentUpdateCursor(cursorID uuid.UUID)
 
+	// GetZombieCursors returns the cursors which have not been read within the given duration.
+	GetZombieCursors(idleFor time.Duration) ([]uuid.UUID, error)
+	// ListCursors returns info about all of the agent update cursors, ordered by creation time.
+	ListCursors() []CursorInfo
+
 	// GetAgentUpdates returns all of the updates that have occurred for agents since
 	// the last invocation of GetAgentUpdates. If GetAgentUpdates has never been called for
 	// a given cursorID, the full initial state will be read first.
 	GetAgentUpdates(cursorID uuid.UUID) ([]*metadata_servicepb.AgentUpdate, *storepb.ComputedSchema, error)
+	// GetAgentUpdatesLimit is the same as GetAgentUpdates, but returns at most maxUpdates updates. The rest
+	// of the updates are returned by the following calls.
+	GetAgentUpdatesLimit(cursorID uuid.UUID, maxUpdates int) ([]*metadata_servicepb.AgentUpdate,
+		*storepb.ComputedSchema, error)
 
 	// UpdateConfig updates the config for the specified agent.
 	UpdateConfig(string, string, string, string) error
+	// UpdateConfigByID updates the config key and value for the agent with the given ID.
+	UpdateConfigByID(agentID uuid.UUID, key string, value string) error
+
+	// UpdateConfigAll updates the config key and value for all of the agents which collect data.
+	UpdateConfigAll(key string, value string) error
+	// SwapConfigAtomic updates the config key and value for all of the given agents, or none of them.
+	SwapConfigAtomic(agentIDs []uuid.UUID, key string, value string) error
 
 	// GetComputedSchema gets the computed schemas
 	GetComputedSchema() (*storepb.ComputedSchema, error)
+	// ListTables returns the sorted names of the tables in the computed schema.
+	ListTables() ([]string, error)
+	// GetTableSchema returns the schema of the table with the given name, or nil if there is no such table.
+	GetTableSchema(name string) (*storepb.TableInfo, error)
 	// GetAgentIDForHostnamePair gets the agent for the given hostnamePair, if it exists.
 	GetAgentIDForHostnamePair(hnPair *HostnameIPPair) (string, error)
 
@@ -122,21 +296,89 @@ type Manager interface {
 	GetServiceCIDR() string
 	// GetPodCIDRs returns the PodCIDRs for the cluster.
 	GetPodCIDRs() []string
+
+	// Quiesce blocks all new writes until the returned func is called. Writes made in the meantime fail with
+	// ErrQuiesced.
+	Quiesce() (func(), error)
 }
 
 // agentUpdateTracker stores the updates (in order) for agents for GetAgentUpdates.
 type agentUpdateTracker struct {
+	id                  uuid.UUID
 	updates             []*metadata_servicepb.AgentUpdate
 	schemaUpdated       bool
 	hasReadInitialState bool
+	// The time the tracker was created.
+	createTime time.Time
+	// The last time the updates were read, or the creation time if they were never read.
+	lastReadTime time.Time
+	// The sequence number to save the next update with.
+	nextSeq uint64
+	// Whether the tracker is saved so that it survives a restart. Only cursors created with a CursorID are
+	// saved, since the clients of other cursors have no way to find them again after a restart.
+	persistent bool
+}
+
+// AgentUpdateCursorOption configures an agent update cursor.
+type AgentUpdateCursorOption func(*agentUpdateTracker)
+
+// CursorID sets the ID of an agent update cursor. If a cursor with the ID already exists, such as one that
+// was restored after a restart, that cursor is reused. Only cursors with an ID set by this option are saved
+// to survive a restart.
+func CursorID(cursorID uuid.UUID) AgentUpdateCursorOption {
+	return func(a *agentUpdateTracker) {
+		a.id = cursorID
+		a.persistent = true
+	}
 }
 
 // newAgentUpdateTracker creates an agentUpdateTracker in the default state.
-func newAgentUpdateTracker() *agentUpdateTracker {
+func newAgentUpdateTracker(now time.Time) *agentUpdateTracker {
 	return &agentUpdateTracker{
 		updates:             []*metadata_servicepb.AgentUpdate{},
 		schemaUpdated:       false,
 		hasReadInitialState: false,
+		createTime:          now,
+		lastReadTime:        now,
+	}
+}
+
+// state returns the state of the tracker to persist.
+func (a *agentUpdateTracker) state() *CursorState {
+	return &CursorState{
+		ID:                  a.id,
+		HasReadInitialState: a.hasReadInitialState,
+		SchemaUpdated:       a.schemaUpdated,
+		CreateTimeNS:        a.createTime.UnixNano(),
+		Updates:             a.updates,
+	}
+}
+
+// CursorInfo describes an agent update cursor.
+type CursorInfo struct {
+	ID uuid.UUID
+	// CreateTime is the time the cursor was created. Cursors restored from before the creation time was
+	// recorded report the time they were restored.
+	CreateTime time.Time
+	// LastReadTime is the last time the cursor was read, or its creation time if it was never read.
+	LastReadTime        time.Time
+	HasReadInitialState bool
+	// PendingUpdates is the number of updates which have been buffered for the cursor since it was last read.
+	// A count which keeps growing means that the cursor's consumer is stuck or gone.
+	PendingUpdates int
+	// SchemaUpdated is whether the computed schema has changed since the cursor was last read.
+	SchemaUpdated bool
+}
+
+// info returns the CursorInfo of the tracker.
+func (a *agentUpdateTracker) info() CursorInfo {
+	return CursorInfo{
+		ID:                  a.id,
+		CreateTime:          a.createTime,
+		LastReadTime:        a.lastReadTime,
+		HasReadInitialState: a.hasReadInitialState,
+		PendingUpdates:      len(a.updates),
+		SchemaUpdated:       a.schemaUpdated,
 	}
 }
 
@@ -146,40 +388,301 @@ func (a *agentUpdateTracker) clearUpdates() {
 	a.schemaUpdated = false
 }
 
+// maxDeadLetterUpdateSize is the maximum number of bytes of a rejected update that are kept in its dead letter.
+const maxDeadLetterUpdateSize = 4096
+
+// DeadLetter describes an agent update which was rejected by ApplyAgentUpdate.
+type DeadLetter struct {
+	AgentID uuid.UUID
+	// Reason is the error that the update was rejected with.
+	Reason string
+	// Update is the serialized AgentUpdateInfo, truncated to at most maxDeadLetterUpdateSize bytes.
+	Update []byte
+}
+
+// DeadLetterHandler is called with each agent update that is rejected.
+type DeadLetterHandler func(*DeadLetter)
+
+// updateLimiter is a token bucket which limits the rate of updates from a single agent.
+type updateLimiter struct {
+	tokens     float64
+	lastRefill time.Time
+}
+
 // ManagerImpl is an implementation for Manager which talks to the metadata store.
 type ManagerImpl struct {
 	agtStore Store
 	cidr     CIDRInfoProvider
 	conn     *nats.Conn
+	clock    clock.Clock
+	// The prefix of the NATS subjects of messages sent to agents. Empty if the subjects are not prefixed.
+	subjectPrefix string
+	// The logger for the manager's operations.
+	logger *log.Entry
 
 	// The agent manager may have multiple clients requesting updates to the current agent state
 	// compared to the state they last saw. This map keeps all of the various trackers (per client)
 	agentUpdateTrackers map[uuid.UUID]*agentUpdateTracker
 	// Protects agentUpdateTrackers.
 	agentUpdateTrackersMutex sync.Mutex
+
+	// agentsVersion is incremented whenever an agent record is created, updated or deleted.
+	agentsVersion uint64
+	// The result of the last read of the agents, and the agentsVersion at the time of that read.
+	cachedAgents        []*agentpb.Agent
+	cachedPinnedAgents  map[uuid.UUID]bool
+	cachedAgentsVersion uint64
+	cachedAgentsValid   bool
+	// Protects the cached agents.
+	cachedAgentsMutex sync.Mutex
+
+	metrics *managerMetrics
+
+	// The number of updates per second, and the burst of updates, that each agent is allowed to apply.
+	// A rate of 0 means that updates are not limited.
+	updateRate  float64
+	updateBurst int
+	// The update limiters for each agent.
+	updateLimiters map[uuid.UUID]*updateLimiter
+	// Protects the update limiters.
+	updateLimitersMutex sync.Mutex
+
+	// The minimum interval between the heartbeat updates sent to the cursors for each agent. An interval of 0
+	// means that every heartbeat is sent.
+	heartbeatUpdateInterval time.Duration
+	// The time that a heartbeat update was last sent to the cursors for each agent.
+	lastHeartbeatUpdates map[uuid.UUID]time.Time
+	// Protects the last heartbeat updates.
+	heartbeatUpdatesMutex sync.Mutex
+
+	// deadLetterHandler, if set, is called with each rejected agent update.
+	deadLetterHandler DeadLetterHandler
+
+	// auditEncoder, if set, writes the audit log entries.
+	auditEncoder *json.Encoder
+	// Serializes the writes of the audit log entries.
+	auditMutex sync.Mutex
+
+	// quiesced is set while the writes are quiesced, and inflightWrites tracks the writes which are in progress.
+	quiesced       bool
+	inflightWrites sync.WaitGroup
+	// Protects quiesced, and the start of the writes tracked by inflightWrites.
+	quiesceMutex sync.Mutex
+}
+
+// ManagerOption configures an agent manager.
+type ManagerOption func(*ManagerImpl)
+
+// Clock sets the clock used by the agent manager. The real clock is used by default.
+func Clock(c clock.Clock) ManagerOption {
+	return func(m *ManagerImpl) {
+		m.clock = c
+	}
+}
+
+// MetricsRegisterer registers the agent manager's metrics with reg. The metrics are not registered by default.
+func MetricsRegisterer(reg prometheus.Registerer) ManagerOption {
+	return func(m *ManagerImpl) {
+		m.metrics.register(reg, m.agtStore)
+	}
+}
+
+// SubjectPrefix prefixes the NATS subjects of the messages sent to agents with prefix, so that they become
+// <prefix>/Agent/<id>. This keeps the messages of multiple Viziers sharing a NATS cluster apart. By default,
+// the subjects are unprefixed.
+func SubjectPrefix(prefix string) ManagerOption {
+	return func(m *ManagerImpl) {
+		m.subjectPrefix = prefix
+	}
+}
+
+// Logger logs the agent manager's operations to logger, so that they carry its fields. The standard logger
+// is used by default.
+func Logger(logger *log.Entry) ManagerOption {
+	return func(m *ManagerImpl) {
+		m.logger = logger
+	}
+}
+
+// AgentUpdateRateLimit limits each agent to applying updatesPerSecond updates per second, with bursts of up
+// to burst updates. Updates which exceed the limit are rejected with ErrUpdateRateLimited, without affecting
+// the updates of other agents. Updates are not limited by default.
+func AgentUpdateRateLimit(updatesPerSecond float64, burst int) ManagerOption {
+	return func(m *ManagerImpl) {
+		m.updateRate = updatesPerSecond
+		m.updateBurst = burst
+	}
+}
+
+// HeartbeatUpdateInterval limits the updates sent to the agent update cursors for the heartbeats of each agent
+// to at most one per interval, so that the heartbeats of many agents do not flood the cursors. The heartbeats are
+// still written to the store. By default, an update is sent for every heartbeat.
+func HeartbeatUpdateInterval(interval time.Duration) ManagerOption {
+	return func(m *ManagerImpl) {
+		m.heartbeatUpdateInterval = interval
+	}
+}
+
+// OnDeadLetter calls handler with each agent update that is rejected by ApplyAgentUpdate, so that the rejected
+// updates can be inspected. By default, rejected updates are dropped.
+func OnDeadLetter(handler DeadLetterHandler) ManagerOption {
+	return func(m *ManagerImpl) {
+		m.deadLetterHandler = handler
+	}
 }
 
 // NewManager creates a new agent manager.
 // TODO (vihang/michelle): Figure out a better solution than passing in the k8s controller.
 // We need the cidr to get CIDR info right now.
-func NewManager(agtStore Store, cidr CIDRInfoProvider, conn *nats.Conn) *ManagerImpl {
+func NewManager(agtStore Store, cidr CIDRInfoProvider, conn *nats.Conn, opts ...ManagerOption) *ManagerImpl {
 	Manager := &ManagerImpl{
-		agtStore:            agtStore,
-		cidr:                cidr,
-		conn:                conn,
-		agentUpdateTrackers: make(map[uuid.UUID]*agentUpdateTracker),
+		agtStore:             agtStore,
+		cidr:                 cidr,
+		conn:                 conn,
+		clock:                clock.RealClock{},
+		logger:               log.NewEntry(log.StandardLogger()),
+		agentUpdateTrackers:  make(map[uuid.UUID]*agentUpdateTracker),
+		metrics:              newManagerMetrics(),
+		updateLimiters:       make(map[uuid.UUID]*updateLimiter),
+		lastHeartbeatUpdates: make(map[uuid.UUID]time.Time),
+	}
+	for _, opt := range opts {
+		opt(Manager)
+	}
+
+	// Restore the cursors from before the last restart, so that their clients can continue reading from them.
+	cursors, err := agtStore.GetAgentUpdateCursors()
+	if err != nil {
+		Manager.logger.WithError(err).Error("Failed to load agent update cursors")
+	}
+	for _, cursor := range cursors {
+		tracker := newAgentUpdateTracker(Manager.clock.Now())
+		tracker.id = cursor.ID
+		tracker.persistent = true
+		tracker.hasReadInitialState = cursor.HasReadInitialState
+		tracker.schemaUpdated = cursor.SchemaUpdated
+		if cursor.CreateTimeNS != 0 {
+			tracker.createTime = time.Unix(0, cursor.CreateTimeNS)
+		}
+		if cursor.Updates != nil {
+			tracker.updates = cursor.Updates
+		}
+		// Save the tracker again so that the saved updates are numbered from 0, in case there are any gaps.
+		Manager.saveTracker(tracker)
+		Manager.agentUpdateTrackers[cursor.ID] = tracker
 	}
 
 	return Manager
 }
 
+// agentLogger returns the logger for an operation on the agent, with the fields that identify the agent. The ASID
+// and hostname are only included if agt is not nil.
+func (m *ManagerImpl) agentLogger(operation string, agentID uuid.UUID, agt *agentpb.Agent) *log.Entry {
+	fields := log.Fields{
+		"operation": operation,
+		"agentID":   agentID.String(),
+	}
+	if agt != nil {
+		fields["asid"] = agt.ASID
+		if agt.Info != nil && agt.Info.HostInfo != nil {
+			fields["hostname"] = agt.Info.HostInfo.Hostname
+		}
+	}
+	return m.logger.WithFields(fields)
+}
+
+// allowUpdate returns whether the agent is within its update rate limit, and if so, uses up one of its updates.
+func (m *ManagerImpl) allowUpdate(agentID uuid.UUID) bool {
+	m.updateLimitersMutex.Lock()
+	defer m.updateLimitersMutex.Unlock()
+
+	if m.updateRate <= 0 {
+		return true
+	}
+
+	now := m.clock.Now()
+	limiter, ok := m.updateLimiters[agentID]
+	if !ok {
+		limiter = &updateLimiter{
+			tokens:     float64(m.updateBurst),
+			lastRefill: now,
+		}
+		m.updateLimiters[agentID] = limiter
+	}
+
+	limiter.tokens += now.Sub(limiter.lastRefill).Seconds() * m.updateRate
+	if limiter.tokens > float64(m.updateBurst) {
+		limiter.tokens = float64(m.updateBurst)
+	}
+	limiter.lastRefill = now
+
+	if limiter.tokens < 1 {
+		return false
+	}
+	limiter.tokens--
+	return true
+}
+
+// allowHeartbeatUpdate returns whether a heartbeat update for the agent should be sent to the cursors, and if
+// so, records that it was sent.
+func (m *ManagerImpl) allowHeartbeatUpdate(agentID uuid.UUID) bool {
+	m.heartbeatUpdatesMutex.Lock()
+	defer m.heartbeatUpdatesMutex.Unlock()
+
+	if m.heartbeatUpdateInterval <= 0 {
+		return true
+	}
+
+	now := m.clock.Now()
+	if last, ok := m.lastHeartbeatUpdates[agentID]; ok && now.Sub(last) < m.heartbeatUpdateInterval {
+		return false
+	}
+	m.lastHeartbeatUpdates[agentID] = now
+	return true
+}
+
+// deadLetter passes the rejected update to the dead letter handler, if there is one.
+func (m *ManagerImpl) deadLetter(update *Update, reason error) {
+	if m.deadLetterHandler == nil {
+		return
+	}
+
+	var b []byte
+	if update.UpdateInfo != nil {
+		var err error
+		b, err = update.UpdateInfo.Marshal()
+		if err != nil {
+			m.logger.WithError(err).Warn("Failed to marshal rejected agent update")
+		}
+	}
+	if len(b) > maxDeadLetterUpdateSize {
+		b = b[:maxDeadLetterUpdateSize]
+	}
+
+	m.deadLetterHandler(&DeadLetter{
+		AgentID: update.AgentID,
+		Reason:  reason.Error(),
+		Update:  b,
+	})
+}
+
 // NewAgentUpdateCursor creates a new cursor that keeps track of agent state over time.
-func (m *ManagerImpl) NewAgentUpdateCursor() uuid.UUID {
+func (m *ManagerImpl) NewAgentUpdateCursor(opts ...AgentUpdateCursorOption) uuid.UUID {
 	m.agentUpdateTrackersMutex.Lock()
 	defer m.agentUpdateTrackersMutex.Unlock()
-	cursor := uuid.Must(uuid.NewV4())
-	m.agentUpdateTrackers[cursor] = newAgentUpdateTracker()
-	return cursor
+	tracker := newAgentUpdateTracker(m.clock.Now())
+	for _, opt := range opts {
+		opt(tracker)
+	}
+	if tracker.id == uuid.Nil {
+		tracker.id = uuid.Must(uuid.NewV4())
+	} else if _, ok := m.agentUpdateTrackers[tracker.id]; ok {
+		return tracker.id
+	}
+
+	m.saveTracker(tracker)
+	m.agentUpdateTrackers[tracker.id] = tracker
+	return tracker.id
 }
 
 // DeleteAgentUpdateCursor deletes a created cursor so that it no longer needs to keep
@@ -187,97 +690,244 @@ func (m *ManagerImpl) NewAgentUpdateCursor() uuid.UUID {
 func (m *ManagerImpl) DeleteAgentUpdateCursor(cursorID uuid.UUID) {
 	m.agentUpdateTrackersMutex.Lock()
 	defer m.agentUpdateTrackersMutex.Unlock()
+	tracker, ok := m.agentUpdateTrackers[cursorID]
 	delete(m.agentUpdateTrackers, cursorID)
+	if ok && !tracker.persistent {
+		return
+	}
+
+	err := m.agtStore.DeleteAgentUpdateCursor(cursorID)
+	if err != nil {
+		m.logger.WithError(err).Warnf("Failed to delete agent update cursor %s", cursorID.String())
+	}
 }
 
-// A helper function for all cases where we call m.agtStore.UpdateSchemas
-// This should be called instead of m.agtStore.UpdateSchemas in order to make sure that the agent
-// schema update is tracked in the our agent state change tracker (updatedAgents).
-func (m *ManagerImpl) updateAgentSchemaWrapper(agentID uuid.UUID, schema []*storepb.TableInfo) error {
-	// Note: Metadata store state must be updated before the agent tracker state is updated, otherwise the
-	// update may be missed by the agent tracker when reading the initial agent state.
-	// We cannot lock the entire call to `updateAgentSchemaWrapper`, which would allow for perfect consistency,
-	// since the update to the metadata store may hit the network.
-	err := m.agtStore.UpdateSchemas(agentID, schema)
+// saveTracker saves the state of a persistent tracker, so that it survives a restart.
+// This should only be called when agentUpdateTrackersMutex is held.
+func (m *ManagerImpl) saveTracker(tracker *agentUpdateTracker) {
+	if !tracker.persistent {
+		return
+	}
+	tracker.nextSeq = uint64(len(tracker.updates))
+	err := m.agtStore.SaveAgentUpdateCursor(tracker.state())
 	if err != nil {
-		log.WithError(err).Warnf("Failed to update agent schema for agent %s", agentID.String())
-		return err
+		m.logger.WithError(err).Warnf("Failed to save agent update cursor %s", tracker.id.String())
+	}
+}
+
+// trackUpdate adds the update to the tracker, and saves it if the tracker is persistent.
+// This should only be called when agentUpdateTrackersMutex is held.
+func (m *ManagerImpl) trackUpdate(tracker *agentUpdateTracker, update *metadata_servicepb.AgentUpdate) {
+	tracker.updates = append(tracker.updates, update)
+	if !tracker.persistent {
+		return
+	}
+	err := m.agtStore.AppendAgentUpdateCursorUpdate(tracker.id, tracker.nextSeq, update)
+	tracker.nextSeq++
+	if err != nil {
+		m.logger.WithError(err).Warnf("Failed to save update for agent update cursor %s", tracker.id.String())
 	}
+}
 
+// GetZombieCursors returns the cursors which have not been read within the given duration. These are
+// likely held by consumers which never deleted them, and pin the updates buffered for them in memory.
+func (m *ManagerImpl) GetZombieCursors(idleFor time.Duration) ([]uuid.UUID, error) {
 	m.agentUpdateTrackersMutex.Lock()
 	defer m.agentUpdateTrackersMutex.Unlock()
 
-	// Mark this change across all of the agent update trackers.
-	for _, tracker := range m.agentUpdateTrackers {
-		tracker.schemaUpdated = true
+	var cursors []uuid.UUID
+	for cursorID, tracker := range m.agentUpdateTrackers {
+		if m.clock.Since(tracker.lastReadTime) >= idleFor {
+			cursors = append(cursors, cursorID)
+		}
 	}
+	return cursors, nil
+}
 
-	return nil
+// ListCursors returns info about all of the agent update cursors, ordered by creation time. It can be used to
+// find cursors which are held by consumers that have gone away, so that they can be deleted with
+// DeleteAgentUpdateCursor.
+func (m *ManagerImpl) ListCursors() []CursorInfo {
+	m.agentUpdateTrackersMutex.Lock()
+	defer m.agentUpdateTrackersMutex.Unlock()
+
+	cursors := make([]CursorInfo, 0, len(m.agentUpdateTrackers))
+	for _, tracker := range m.agentUpdateTrackers {
+		cursors = append(cursors, tracker.info())
+	}
+	sort.Slice(cursors, func(i, j int) bool {
+		if !cursors[i].CreateTime.Equal(cursors[j].CreateTime) {
+			return cursors[i].CreateTime.Before(cursors[j].CreateTime)
+		}
+		return cursors[i].ID.String() < cursors[j].ID.String()
+	})
+	return cursors
 }
 
 // A helper function for all cases where we call m.agtStore.DeleteAgent.
 // This should be called instead of agtStore.DeleteAgent in order to make sure that the agent
 // deletion is tracked in the our agent state change tracker (updatedAgents).
 func (m *ManagerImpl) deleteAgentWrapper(agentID uuid.UUID) error {
+	return m.deleteAgentsWrapper([]uuid.UUID{agentID})
+}
+
+// A helper function for all cases where we call m.agtStore.DeleteAgents.
+// This should be called instead of agtStore.DeleteAgents in order to make sure that the agent
+// deletions are tracked in the our agent state change tracker (updatedAgents). The deletions are sent to
+// each tracker together, in the order of agentIDs.
+func (m *ManagerImpl) deleteAgentsWrapper(agentIDs []uuid.UUID) error {
 	// Note: Metadata store state must be updated before the agent tracker state is updated, otherwise the
 	// update may be missed by the agent tracker when reading the initial agent state.
-	// We cannot lock the entire call to `deleteAgentWrapper`, which would allow for perfect consistency,
+	// We cannot lock the entire call to `deleteAgentsWrapper`, which would allow for perfect consistency,
 	// since the update to the metadata store may hit the network.
-	err := m.agtStore.DeleteAgent(agentID)
+	// The agents are read before they are deleted, so that only the agents which existed are counted, audited
+	// and logged.
+	agents := make([]*agentpb.Agent, len(agentIDs))
+	for i, agentID := range agentIDs {
+		agt, err := m.agtStore.GetAgent(agentID)
+		if err != nil {
+			m.agentLogger(AuditOpDelete, agentID, nil).WithError(err).Warn("Failed to get agent")
+			return err
+		}
+		agents[i] = agt
+	}
+
+	// Deleting the agents also drops any tables that only they provide from the computed schema, in which
+	// case the trackers need to send the new schema so that the dropped tables are no longer queried.
+	dropsTables, err := m.dropsTables(agentIDs)
+	if err != nil && err != ErrNoComputedSchemas {
+		m.logger.WithError(err).Warnf("Failed to check whether deleting %d agents drops any tables", len(agentIDs))
+		dropsTables = true
+	}
+
+	err = m.agtStore.DeleteAgents(agentIDs)
 
 	if err != nil {
-		log.WithError(err).Warnf("Failed to delete agent %s", agentID.String())
+		m.logger.WithError(err).Warnf("Failed to delete %d agents", len(agentIDs))
 		return err
 	}
 
+	atomic.AddUint64(&m.agentsVersion, 1)
+	// The store ignores the agents which do not exist, so only the agents which were found are recorded as
+	// deleted.
+	for i, agentID := range agentIDs {
+		if agents[i] == nil {
+			continue
+		}
+		m.metrics.agentsDeleted.Inc()
+		m.audit(agentID, AuditOpDelete, "")
+		m.agentLogger(AuditOpDelete, agentID, agents[i]).Info("Deleted agent")
+	}
+
+	m.updateLimitersMutex.Lock()
+	for _, agentID := range agentIDs {
+		delete(m.updateLimiters, agentID)
+	}
+	m.updateLimitersMutex.Unlock()
+
+	m.heartbeatUpdatesMutex.Lock()
+	for _, agentID := range agentIDs {
+		delete(m.lastHeartbeatUpdates, agentID)
+	}
+	m.heartbeatUpdatesMutex.Unlock()
+
 	m.agentUpdateTrackersMutex.Lock()
 	defer m.agentUpdateTrackersMutex.Unlock()
 
-	// Create a single update object so we don't make one for each tracker.
-	update := &metadata_servicepb.AgentUpdate{
-		AgentID: utils.ProtoFromUUID(agentID),
-		Update: &metadata_servicepb.AgentUpdate_Deleted{
-			Deleted: true,
-		},
+	// Create a single update object per agent so we don't make one for each tracker.
+	updates := make([]*metadata_servicepb.AgentUpdate, len(agentIDs))
+	for i, agentID := range agentIDs {
+		updates[i] = &metadata_servicepb.AgentUpdate{
+			AgentID: utils.ProtoFromUUID(agentID),
+			Update: &metadata_servicepb.AgentUpdate_Deleted{
+				Deleted: true,
+			},
+		}
 	}
 
-	// Mark this change across all of the agent update trackers.
+	// Mark these changes across all of the agent update trackers.
 	for _, tracker := range m.agentUpdateTrackers {
-		tracker.updates = append(tracker.updates, update)
+		if dropsTables && !tracker.schemaUpdated {
+			tracker.schemaUpdated = true
+			m.saveTracker(tracker)
+		}
+		for _, update := range updates {
+			m.trackUpdate(tracker, update)
+		}
 	}
 
 	return nil
 }
 
-// A helper function for all cases where we call m.agtStore.CreateAgent.
-// This should be called instead of agtStore.CreateAgent in order to make sure that the agent
-// creation is tracked in the our agent state change tracker (updatedAgents).
-func (m *ManagerImpl) createAgentWrapper(agentID uuid.UUID, agentInfo *agentpb.Agent) error {
+// dropsTables returns whether deleting all of the given agents would leave any table in the computed schema
+// without a contributing agent.
+func (m *ManagerImpl) dropsTables(agentIDs []uuid.UUID) (bool, error) {
+	computedSchema, err := m.agtStore.GetComputedSchema()
+	if err != nil {
+		return false, err
+	}
+
+	deleted := make(map[uuid.UUID]bool)
+	for _, agentID := range agentIDs {
+		deleted[agentID] = true
+	}
+	for _, agents := range computedSchema.TableNameToAgentIDs {
+		served := false
+		for _, agentID := range agents.AgentID {
+			if !deleted[utils.UUIDFromProtoOrNil(agentID)] {
+				served = true
+				break
+			}
+		}
+		if !served {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// A helper function for all cases where we call m.agtStore.CreateAgents.
+// This should be called instead of agtStore.CreateAgents in order to make sure that the agent
+// creations are tracked in the our agent state change tracker (updatedAgents). The register time of the
+// agents in registeredIDs is set in the same write, and they are pinned if pin is true.
+func (m *ManagerImpl) createAgentsWrapper(agentIDs []uuid.UUID, agentInfos []*agentpb.Agent,
+	registeredIDs []uuid.UUID, registerTimeNS int64, pin bool) error {
 	// Note: Metadata store state must be updated before the agent tracker state is updated, otherwise the
 	// update may be missed by the agent tracker when reading the initial agent state.
-	// We cannot lock the entire call to `createAgentWrapper`, which would allow for perfect consistency,
-	// since the update to the metadata store may hit the network.
-	err := m.agtStore.CreateAgent(agentID, agentInfo)
+	err := m.agtStore.CreateAgents(agentIDs, agentInfos, registeredIDs, registerTimeNS, pin)
 
 	if err != nil {
-		log.WithError(err).Warnf("Failed to create agent %s", agentID.String())
+		m.logger.WithError(err).Warnf("Failed to create %d agents", len(agentIDs))
 		return err
 	}
+	if pin {
+		// The pinned agents' heartbeats change, so the cached agents are no longer valid.
+		atomic.AddUint64(&m.agentsVersion, 1)
+	}
+	if len(agentIDs) == 0 {
+		return nil
+	}
+
+	atomic.AddUint64(&m.agentsVersion, 1)
+	m.metrics.agentsRegistered.Add(float64(len(agentIDs)))
+	for i, agentID := range agentIDs {
+		m.audit(agentID, AuditOpRegister, "")
+		m.agentLogger(AuditOpRegister, agentID, agentInfos[i]).Info("Registered agent")
+	}
 
 	m.agentUpdateTrackersMutex.Lock()
 	defer m.agentUpdateTrackersMutex.Unlock()
 
-	// Create a single update object so we don't make one for each tracker.
-	update := &metadata_servicepb.AgentUpdate{
-		AgentID: utils.ProtoFromUUID(agentID),
-		Update: &metadata_servicepb.AgentUpdate_Agent{
-			Agent: agentInfo,
-		},
-	}
-
-	// Mark this change across all of the agent update trackers.
-	for _, tracker := range m.agentUpdateTrackers {
-		tracker.updates = append(tracker.updates, update)
+	for i, agentInfo := range agentInfos {
+		update := &metadata_servicepb.AgentUpdate{
+			AgentID: utils.ProtoFromUUID(agentIDs[i]),
+			Update: &metadata_servicepb.AgentUpdate_Agent{
+				Agent: agentInfo,
+			},
+		}
+		for _, tracker := range m.agentUpdateTrackers {
+			m.trackUpdate(tracker, update)
+		}
 	}
 
 	return nil
@@ -285,19 +935,31 @@ func (m *ManagerImpl) createAgentWrapper(agentID uuid.UUID, agentInfo *agentpb.A
 
 // A helper function for all cases where we call m.agtStore.CreateAgent.
 // This should be called instead of agtStore.CreateAgent in order to make sure that the agent
-// update is tracked in the our agent state change tracker (updatedAgents).
-func (m *ManagerImpl) updateAgentWrapper(agentID uuid.UUID, agentInfo *agentpb.Agent) error {
+// update is tracked in the our agent state change tracker (updatedAgents). If track is false, the update is
+// written to the store without being sent to the trackers.
+func (m *ManagerImpl) updateAgentWrapper(agentID uuid.UUID, agentInfo *agentpb.Agent, status *agentpb.AgentStatus,
+	track bool) error {
 	// Note: Metadata store state must be updated before the agent tracker state is updated, otherwise the
 	// update may be missed by the agent tracker when reading the initial agent state.
 	// We cannot lock the entire call to `updateAgentWrapper`, which would allow for perfect consistency,
 	// since the update to the metadata store may hit the network.
-	err := m.agtStore.UpdateAgent(agentID, agentInfo)
+	var err error
+	if status != nil {
+		err = m.agtStore.UpdateAgentWithStatus(agentID, agentInfo, status)
+	} else {
+		err = m.agtStore.UpdateAgent(agentID, agentInfo)
+	}
 
 	if err != nil {
-		log.WithError(err).Warnf("Failed to update agent %s", agentID.String())
+		m.logger.WithError(err).Warnf("Failed to update agent %s", agentID.String())
 		return err
 	}
 
+	atomic.AddUint64(&m.agentsVersion, 1)
+	if !track {
+		return nil
+	}
+
 	m.agentUpdateTrackersMutex.Lock()
 	defer m.agentUpdateTrackersMutex.Unlock()
 
@@ -311,136 +973,391 @@ func (m *ManagerImpl) updateAgentWrapper(agentID uuid.UUID, agentInfo *agentpb.A
 
 	// Mark this change across all of the agent update trackers.
 	for _, tracker := range m.agentUpdateTrackers {
-		tracker.updates = append(tracker.updates, update)
+		m.trackUpdate(tracker, update)
 	}
 
 	return nil
 }
 
-// A helper function for all cases where we call m.agtStore.UpdateAgentDataInfo.
-// This should be called instead of agtStore.UpdateAgentDataInfo in order to make sure that the agent
-// update is tracked in the our agent state change tracker (updatedAgents).
-func (m *ManagerImpl) updateAgentDataInfoWrapper(agentID uuid.UUID, agentDataInfo *messagespb.AgentDataInfo) error {
+// A helper function for all cases where we call m.agtStore.UpdateAgentStates.
+// This should be called instead of agtStore.UpdateAgentStates in order to make sure that the data info and
+// schema updates are tracked in the our agent state change tracker (updatedAgents).
+func (m *ManagerImpl) updateAgentStatesWrapper(processes []*metadatapb.ProcessInfo, states []*AgentState) error {
 	// Note: Metadata store state must be updated before the agent tracker state is updated, otherwise the
 	// update may be missed by the agent tracker when reading the initial agent state.
-	// We cannot lock the entire call to `updateAgentDataInfoWrapper`, which would allow for perfect consistency,
+	// We cannot lock the entire call to `updateAgentStatesWrapper`, which would allow for perfect consistency,
 	// since the update to the metadata store may hit the network.
-	err := m.agtStore.UpdateAgentDataInfo(agentID, agentDataInfo)
-
+	err := m.agtStore.UpdateAgentStates(processes, states)
 	if err != nil {
-		log.WithError(err).Warnf("Failed to update agent data info for agent %s", agentID.String())
+		m.logger.WithError(err).Warnf("Failed to update the state of %d agents", len(states))
 		return err
 	}
 
+	schemaUpdated := false
+	for _, state := range states {
+		if state.UpdateSchema {
+			schemaUpdated = true
+			m.audit(state.AgentID, AuditOpUpdateSchema, "")
+		}
+	}
+
 	m.agentUpdateTrackersMutex.Lock()
 	defer m.agentUpdateTrackersMutex.Unlock()
 
-	// Create a single update object so we don't make one for each tracker.
-	update := &metadata_servicepb.AgentUpdate{
-		AgentID: utils.ProtoFromUUID(agentID),
-		Update: &metadata_servicepb.AgentUpdate_DataInfo{
-			DataInfo: agentDataInfo,
-		},
+	for _, state := range states {
+		if state.DataInfo == nil {
+			continue
+		}
+		// Create a single update object so we don't make one for each tracker.
+		update := &metadata_servicepb.AgentUpdate{
+			AgentID: utils.ProtoFromUUID(state.AgentID),
+			Update: &metadata_servicepb.AgentUpdate_DataInfo{
+				DataInfo: state.DataInfo,
+			},
+		}
+
+		// Mark this change across all of the agent update trackers.
+		for _, tracker := range m.agentUpdateTrackers {
+			m.trackUpdate(tracker, update)
+		}
 	}
 
-	// Mark this change across all of the agent update trackers.
-	for _, tracker := range m.agentUpdateTrackers {
-		tracker.updates = append(tracker.updates, update)
+	// Mark the schema change across all of the agent update trackers.
+	if schemaUpdated {
+		for _, tracker := range m.agentUpdateTrackers {
+			if !tracker.schemaUpdated {
+				tracker.schemaUpdated = true
+				m.saveTracker(tracker)
+			}
+		}
 	}
 
 	return nil
 }
 
-// ApplyAgentUpdate updates the metadata store with the information from the agent update.
+// ApplyAgentUpdate updates the metadata store with the information from the agent update. If the agent
+// has exceeded its update rate limit, the update is dropped and ErrUpdateRateLimited is returned.
+// The update is written atomically, so if it fails to apply, the store is left as it was. Updates which fail
+// to apply are passed to the dead letter handler.
 func (m *ManagerImpl) ApplyAgentUpdate(update *Update) error {
-	resp, err := m.agtStore.GetAgent(update.AgentID)
+	return m.ApplyAgentUpdates([]*Update{update})
+}
+
+// ApplyAgentUpdates applies a batch of agent updates. The processes created and terminated by the updates,
+// and the data info and schema of each update in the order that the updates arrived, are written to the store
+// in a single atomic write. If the write fails, none of the updates are applied. Updates which fail to apply are
+// passed to the dead letter handler, and the first error is returned once the rest of the batch has been
+// applied.
+func (m *ManagerImpl) ApplyAgentUpdates(updates []*Update) error {
+	done, err := m.beginWrite()
 	if err != nil {
-		log.WithError(err).Warn("Failed to get agent")
 		return err
-	} else if resp == nil {
-		log.Info("Ignoring update for agent that has already been deleted")
-		return nil
 	}
-
-	err = m.handleCreatedProcesses(update.UpdateInfo.ProcessCreated)
-	if err != nil {
-		log.WithError(err).Error("Error when creating new processes")
+	defer done()
+
+	// The agents are only read once per batch. A nil agent means the agent has been deleted.
+	agents := make(map[uuid.UUID]*agentpb.Agent)
+
+	var firstErr error
+	reject := func(update *Update, err error) {
+		logger := m.agentLogger(logOpApplyUpdate, update.AgentID, agents[update.AgentID]).WithError(err)
+		// Rate limited updates are expected from noisy agents, so they are not worth a warning each.
+		if err == ErrUpdateRateLimited {
+			logger.Debug("Rejected agent update")
+		} else {
+			logger.Warn("Rejected agent update")
+		}
+		m.deadLetter(update, err)
+		if firstErr == nil {
+			firstErr = err
+		}
 	}
 
-	err = m.handleTerminatedProcesses(update.UpdateInfo.ProcessTerminated)
-	if err != nil {
-		log.WithError(err).Error("Error when updating terminated processes")
+	var accepted []*Update
+	for _, update := range updates {
+		m.metrics.updatesApplied.Inc()
+
+		if update.UpdateInfo == nil {
+			reject(update, ErrInvalidAgentUpdate)
+			continue
+		}
+		if !m.allowUpdate(update.AgentID) {
+			reject(update, ErrUpdateRateLimited)
+			continue
+		}
+
+		agt, ok := agents[update.AgentID]
+		if !ok {
+			var err error
+			agt, err = m.agtStore.GetAgent(update.AgentID)
+			if err != nil {
+				reject(update, err)
+				continue
+			}
+			agents[update.AgentID] = agt
+		}
+		if agt == nil {
+			m.agentLogger(logOpApplyUpdate, update.AgentID, nil).
+				Info("Ignoring update for agent that has already been deleted")
+			continue
+		}
+
+		accepted = append(accepted, update)
 	}
-	if update.UpdateInfo.Data != nil {
-		err = m.updateAgentDataInfoWrapper(update.AgentID, update.UpdateInfo.Data)
+
+	// The schema changes of earlier updates in the batch are not in the store yet, so the tables of the agents
+	// whose schemas have changed are kept here.
+	tables := make(map[uuid.UUID][]*storepb.TableInfo)
+	var written []*Update
+	var states []*AgentState
+	var created []*metadatapb.ProcessCreated
+	var terminated []*metadatapb.ProcessTerminated
+	for _, update := range accepted {
+		state, err := m.agentState(update, tables)
 		if err != nil {
-			return err
+			reject(update, err)
+			continue
 		}
+		written = append(written, update)
+		states = append(states, state)
+		created = append(created, update.UpdateInfo.ProcessCreated...)
+		terminated = append(terminated, update.UpdateInfo.ProcessTerminated...)
 	}
-	if !update.UpdateInfo.DoesUpdateSchema {
-		return nil
+	if len(written) == 0 {
+		return firstErr
 	}
-	return m.updateAgentSchemaWrapper(update.AgentID, update.UpdateInfo.Schema)
-}
 
-func (m *ManagerImpl) handleCreatedProcesses(processes []*metadatapb.ProcessCreated) error {
-	if len(processes) == 0 {
-		return nil
+	processes, err := m.createdProcesses(created)
+	if err == nil {
+		var terminatedProcesses []*metadatapb.ProcessInfo
+		terminatedProcesses, err = m.terminatedProcesses(terminated, processes)
+		processes = append(processes, terminatedProcesses...)
 	}
-
-	processInfos := make([]*metadatapb.ProcessInfo, len(processes))
-	for i, p := range processes {
-		pPb := &metadatapb.ProcessInfo{
-			UPID:             p.UPID,
-			StartTimestampNS: p.StartTimestampNS,
-			ProcessArgs:      p.Cmdline,
-			CID:              p.CID,
+	if err == nil {
+		err = m.updateAgentStatesWrapper(processes, states)
+	}
+	if err != nil {
+		for _, update := range written {
+			reject(update, err)
 		}
-		processInfos[i] = pPb
 	}
-
-	return m.agtStore.UpdateProcesses(processInfos)
+	return firstErr
 }
 
-func (m *ManagerImpl) handleTerminatedProcesses(processes []*metadatapb.ProcessTerminated) error {
-	if len(processes) == 0 {
-		return nil
+// agentState returns the data info and schema which the update writes for its agent. The tables map holds the
+// tables of the agents whose schemas were changed by earlier updates in the batch, and is updated with the
+// agent's new tables.
+func (m *ManagerImpl) agentState(update *Update, tables map[uuid.UUID][]*storepb.TableInfo) (*AgentState, error) {
+	state := &AgentState{
+		AgentID:  update.AgentID,
+		DataInfo: update.UpdateInfo.Data,
 	}
-
-	upids := make([]*types.UInt128, len(processes))
-	for i, p := range processes {
-		upids[i] = types.UInt128FromProto(p.UPID)
+	if update.UpdateInfo.DoesUpdateSchema {
+		state.Schema = update.UpdateInfo.Schema
+		state.UpdateSchema = true
+		tables[update.AgentID] = state.Schema
 	}
 
-	pInfos, err := m.agtStore.GetProcesses(upids)
-	if err != nil {
-		log.WithError(err).Error("Could not get processes when trying to update terminated processes")
-		return err
+	delta := update.IncrementalSchema
+	if delta == nil || (len(delta.Tables) == 0 && len(delta.TablesRemoved) == 0) {
+		return state, nil
 	}
 
-	var updatedProcesses []*metadatapb.ProcessInfo
-	for i, p := range pInfos {
+	existing, ok := tables[update.AgentID]
+	if !ok {
+		var err error
+		existing, err = m.agtStore.GetAgentTables(update.AgentID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	state.Schema = mergeTables(existing, delta.Tables, delta.TablesRemoved)
+	state.UpdateSchema = true
+	tables[update.AgentID] = state.Schema
+	return state, nil
+}
+
+// mergeTables adds the given tables to the existing tables, replacing any tables with the same names, and
+// then removes the tables with the given names. The other existing tables are left intact.
+func mergeTables(existing []*storepb.TableInfo, added []*storepb.TableInfo, removedNames []string) []*storepb.TableInfo {
+	skip := make(map[string]bool)
+	for _, table := range added {
+		skip[table.Name] = true
+	}
+	var tables []*storepb.TableInfo
+	for _, table := range existing {
+		if !skip[table.Name] {
+			tables = append(tables, table)
+		}
+	}
+	tables = append(tables, added...)
+
+	removed := make(map[string]bool)
+	for _, name := range removedNames {
+		removed[name] = true
+	}
+	merged := tables[:0]
+	for _, table := range tables {
+		if !removed[table.Name] {
+			merged = append(merged, table)
+		}
+	}
+	return merged
+}
+
+// createdProcesses returns the process infos to write for the created processes. If there are multiple creates for the same UPID, the
+// process with the latest start time wins, so that the final state does not depend on the arrival order.
+// Agents may re-send the create for a process they already reported, such as after a reconnect. A create for
+// a process which has already terminated is ignored, so that its stop time is kept, and a create for a live
+// process keeps the process's original start time.
+func (m *ManagerImpl) createdProcesses(processes []*metadatapb.ProcessCreated) ([]*metadatapb.ProcessInfo, error) {
+	if len(processes) == 0 {
+		return nil, nil
+	}
+
+	upids := make([]*types.UInt128, len(processes))
+	for i, p := range processes {
+		upids[i] = types.UInt128FromProto(p.UPID)
+	}
+
+	existing, err := m.agtStore.GetProcesses(upids)
+	if err != nil {
+		return nil, err
+	}
+
+	var processInfos []*metadatapb.ProcessInfo
+	// The start time of the create which each process info came from. The process info may keep the stored
+	// start time instead, so the creates in the batch are compared by these.
+	var createStarts []int64
+	processIdx := make(map[string]int)
+	for i, p := range processes {
+		if existing[i] != nil && (existing[i].StopTimestampNS != 0 || existing[i].StartTimestampNS > p.StartTimestampNS) {
+			continue
+		}
+		pPb := &metadatapb.ProcessInfo{
+			UPID:             p.UPID,
+			StartTimestampNS: p.StartTimestampNS,
+			ProcessArgs:      p.Cmdline,
+			CID:              p.CID,
+		}
+		if existing[i] != nil {
+			pPb.StartTimestampNS = existing[i].StartTimestampNS
+		}
+
+		upid := k8s.StringFromUPID(upids[i])
+		idx, ok := processIdx[upid]
+		if !ok {
+			processIdx[upid] = len(processInfos)
+			processInfos = append(processInfos, pPb)
+			createStarts = append(createStarts, p.StartTimestampNS)
+			continue
+		}
+		if createStarts[idx] <= p.StartTimestampNS {
+			processInfos[idx] = pPb
+			createStarts[idx] = p.StartTimestampNS
+		}
+	}
+
+	return processInfos, nil
+}
+
+// terminatedProcesses returns the process infos to write for the terminated processes. The created processes
+// are the ones which are about to be written along with the terminated processes. They are stopped in place,
+// since the processes which they terminate are not in the store yet.
+func (m *ManagerImpl) terminatedProcesses(processes []*metadatapb.ProcessTerminated,
+	created []*metadatapb.ProcessInfo) ([]*metadatapb.ProcessInfo, error) {
+	if len(processes) == 0 {
+		return nil, nil
+	}
+
+	createdByUPID := make(map[string]*metadatapb.ProcessInfo)
+	for _, p := range created {
+		createdByUPID[k8s.StringFromUPID(types.UInt128FromProto(p.UPID))] = p
+	}
+
+	upids := make([]*types.UInt128, len(processes))
+	for i, p := range processes {
+		upids[i] = types.UInt128FromProto(p.UPID)
+	}
+
+	pInfos, err := m.agtStore.GetProcesses(upids)
+	if err != nil {
+		m.logger.WithError(err).Error("Could not get processes when trying to update terminated processes")
+		return nil, err
+	}
+
+	var updatedProcesses []*metadatapb.ProcessInfo
+	for i, p := range pInfos {
+		if c, ok := createdByUPID[k8s.StringFromUPID(upids[i])]; ok {
+			c.StopTimestampNS = processes[i].StopTimestampNS
+			continue
+		}
 		if p != (*metadatapb.ProcessInfo)(nil) {
 			p.StopTimestampNS = processes[i].StopTimestampNS
 			updatedProcesses = append(updatedProcesses, p)
 		}
 	}
 
-	return m.agtStore.UpdateProcesses(updatedProcesses)
+	return updatedProcesses, nil
 }
 
-// RegisterAgent creates a new agent.
+// RegisterAgent creates a new agent. The agent is written to the store before returning, so it is
+// guaranteed to be visible to any read that happens after RegisterAgent returns. ErrHostnameConflict is
+// returned if the agent's hostname and IP already belong to a different agent, and ErrInvalidAgent is returned
+// if the agent fails ValidateAgent.
 func (m *ManagerImpl) RegisterAgent(agent *agentpb.Agent) (uint32, error) {
+	return m.registerAgent(agent, false)
+}
+
+// ForceRegisterAgent is the same as RegisterAgent, but takes over the agent's hostname and IP from any other
+// agent which has them.
+func (m *ManagerImpl) ForceRegisterAgent(agent *agentpb.Agent) (uint32, error) {
+	return m.registerAgent(agent, true)
+}
+
+func (m *ManagerImpl) registerAgent(agent *agentpb.Agent, force bool) (uint32, error) {
+	aUUID, err := ValidateAgent(agent)
+	if err != nil {
+		return 0, err
+	}
+
+	done, err := m.beginWrite()
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+
+	return m.registerValidatedAgent(aUUID, agent, force, false)
+}
+
+// registerValidatedAgent registers an agent which passed ValidateAgent, and pins it in the same write if pin is
+// true. It must be called within a write started by beginWrite.
+func (m *ManagerImpl) registerValidatedAgent(aUUID uuid.UUID, agent *agentpb.Agent, force bool,
+	pin bool) (uint32, error) {
 	// Check if agent already exists.
-	aUUID := utils.UUIDFromProtoOrNil(agent.Info.AgentID)
+
+	// The registration time is recorded on every registration, so that a restart of an existing agent can be
+	// told apart from its creation.
+	registerTimeNS := m.clock.Now().UnixNano()
 
 	resp, err := m.agtStore.GetAgent(aUUID)
 	if err != nil {
-		log.WithError(err).Fatal("Failed to get agent")
+		m.logger.WithError(err).Fatal("Failed to get agent")
 	} else if resp != nil {
+		err = m.createAgentsWrapper(nil, nil, []uuid.UUID{aUUID}, registerTimeNS, pin)
+		if err != nil {
+			return 0, err
+		}
 		return resp.ASID, nil
 	}
 
+	if !force {
+		err = m.checkHostnameConflict(aUUID, agent)
+		if err != nil {
+			return 0, err
+		}
+	}
+
 	agent = proto.Clone(agent).(*agentpb.Agent)
 
 	if agent.ASID == 0 {
@@ -451,31 +1368,389 @@ func (m *ManagerImpl) RegisterAgent(agent *agentpb.Agent) (uint32, error) {
 			return 0, err
 		}
 		agent.ASID = asid
-		agent.CreateTimeNS = time.Now().UnixNano()
-		agent.LastHeartbeatNS = time.Now().UnixNano()
+		// The heartbeat is initialized to the creation time, so that it only differs once the agent heartbeats.
+		agent.CreateTimeNS = registerTimeNS
+		agent.LastHeartbeatNS = agent.CreateTimeNS
 	}
 
 	// Add this agent to the updated agents list.
-	err = m.createAgentWrapper(aUUID, agent)
+	err = m.createAgentsWrapper([]uuid.UUID{aUUID}, []*agentpb.Agent{agent}, []uuid.UUID{aUUID}, registerTimeNS, pin)
 	if err != nil {
 		return 0, err
 	}
-
 	return agent.ASID, nil
 }
 
+// ValidateAgent returns the ID of the agent, or an error wrapping ErrInvalidAgent if the agent is missing any of
+// the fields needed to register it.
+func ValidateAgent(agent *agentpb.Agent) (uuid.UUID, error) {
+	if agent == nil || agent.Info == nil {
+		return uuid.Nil, fmt.Errorf("%w: missing agent info", ErrInvalidAgent)
+	}
+	aUUID, err := utils.UUIDFromProto(agent.Info.AgentID)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("%w: bad agent ID: %s", ErrInvalidAgent, err)
+	}
+	if agent.Info.HostInfo == nil {
+		return uuid.Nil, fmt.Errorf("%w: agent %s is missing host info", ErrInvalidAgent, aUUID)
+	}
+	if agent.Info.Capabilities == nil {
+		return uuid.Nil, fmt.Errorf("%w: agent %s is missing capabilities", ErrInvalidAgent, aUUID)
+	}
+	return aUUID, nil
+}
+
+// checkHostnameConflict returns ErrHostnameConflict if the agent's hostname and IP belong to a different agent
+// which still exists.
+func (m *ManagerImpl) checkHostnameConflict(agentID uuid.UUID, agent *agentpb.Agent) error {
+	ownerID, err := m.agtStore.GetAgentIDForHostnamePair(getHostnamePair(agent))
+	if err != nil {
+		return err
+	}
+	if ownerID == "" || ownerID == agentID.String() {
+		return nil
+	}
+
+	owner, err := m.agtStore.GetAgent(uuid.FromStringOrNil(ownerID))
+	if err != nil {
+		return err
+	}
+	if owner == nil {
+		return nil
+	}
+	return ErrHostnameConflict
+}
+
+// RegisterAgents creates all of the given agents in a single write, so that a failure does not leave some
+// of the agents or their indexes behind. Agents which already exist are left as is, and their existing ASID
+// is returned. If any of the agents is invalid, or if any new agent's hostname and IP belong to a different
+// agent, either in the store or earlier in the batch, none of them are registered.
+func (m *ManagerImpl) RegisterAgents(agents []*agentpb.Agent) ([]uint32, error) {
+	agentIDs := make([]uuid.UUID, len(agents))
+	for i, agent := range agents {
+		aUUID, err := ValidateAgent(agent)
+		if err != nil {
+			return nil, err
+		}
+		agentIDs[i] = aUUID
+	}
+
+	done, err := m.beginWrite()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	asids := make([]uint32, len(agents))
+	registerTimeNS := m.clock.Now().UnixNano()
+
+	var newAgentIDs []uuid.UUID
+	var newAgents []*agentpb.Agent
+	// Tracks the index in newAgents of the agents in this batch, in case an agent is repeated.
+	newAgentIdx := make(map[uuid.UUID]int)
+	newHostnamePairs := make(map[HostnameIPPair]bool)
+	for i, agent := range agents {
+		aUUID := agentIDs[i]
+		if _, ok := newAgentIdx[aUUID]; ok {
+			continue
+		}
+
+		resp, err := m.agtStore.GetAgent(aUUID)
+		if err != nil {
+			return nil, err
+		} else if resp != nil {
+			asids[i] = resp.ASID
+			continue
+		}
+
+		err = m.checkHostnameConflict(aUUID, agent)
+		if err != nil {
+			return nil, err
+		}
+		hnPair := *getHostnamePair(agent)
+		if newHostnamePairs[hnPair] {
+			return nil, ErrHostnameConflict
+		}
+		newHostnamePairs[hnPair] = true
+
+		newAgentIdx[aUUID] = len(newAgents)
+		newAgentIDs = append(newAgentIDs, aUUID)
+		newAgents = append(newAgents, proto.Clone(agent).(*agentpb.Agent))
+	}
+
+	// ASIDs are only assigned once all of the agents are known to be registrable, so that a rejected batch
+	// does not use any of them up.
+	for _, agent := range newAgents {
+		if agent.ASID != 0 {
+			continue
+		}
+		asid, err := m.agtStore.GetASID()
+		if err != nil {
+			return nil, err
+		}
+		agent.ASID = asid
+		// The heartbeat is initialized to the creation time, so that it only differs once the agent heartbeats.
+		agent.CreateTimeNS = registerTimeNS
+		agent.LastHeartbeatNS = agent.CreateTimeNS
+	}
+	for i, aUUID := range agentIDs {
+		if idx, ok := newAgentIdx[aUUID]; ok {
+			asids[i] = newAgents[idx].ASID
+		}
+	}
+
+	err = m.createAgentsWrapper(newAgentIDs, newAgents, agentIDs, registerTimeNS, false)
+	if err != nil {
+		return nil, err
+	}
+	return asids, nil
+}
+
+// ReassignASID assigns the next ASID from the counter to the agent, such as to resolve an ASID collision
+// introduced by restoring a backup. The agent record and the ASID index are updated, and the cursors receive
+// the agent with its new ASID as an agent update. ErrASIDInUse is returned if the new ASID is held by another
+// live agent, which means that the counter is behind the assigned ASIDs. The agent's processes keep the UPIDs
+// that they were created with.
+func (m *ManagerImpl) ReassignASID(agentID uuid.UUID) (uint32, error) {
+	done, err := m.beginWrite()
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+
+	agt, err := m.agtStore.GetAgent(agentID)
+	if err != nil {
+		return 0, err
+	}
+	if agt == nil {
+		return 0, ErrAgentNotFound
+	}
+
+	asid, err := m.agtStore.GetASID()
+	if err != nil {
+		return 0, err
+	}
+	owner, err := m.agtStore.GetAgentByASID(asid)
+	if err != nil {
+		return 0, err
+	}
+	if owner != nil {
+		return 0, fmt.Errorf("%w: ASID %d", ErrASIDInUse, asid)
+	}
+
+	oldASID := agt.ASID
+	agt = proto.Clone(agt).(*agentpb.Agent)
+	agt.ASID = asid
+
+	// The index is updated first, since the index is only trusted when it matches the agent record.
+	err = m.agtStore.UpdateAgentASIDIndex(agentID, oldASID, asid)
+	if err != nil {
+		return 0, err
+	}
+	err = m.updateAgentWrapper(agentID, agt, nil, true)
+	if err != nil {
+		return 0, err
+	}
+	m.audit(agentID, AuditOpReassignASID, fmt.Sprintf("%d->%d", oldASID, asid))
+	return asid, nil
+}
+
+// RegisterSyntheticAgent registers the agent and pins it, so that it is never expired. Since the agent does not
+// send heartbeats, its last heartbeat is always reported as the current time, so that it is always healthy.
+func (m *ManagerImpl) RegisterSyntheticAgent(agent *agentpb.Agent) (uint32, error) {
+	aUUID, err := ValidateAgent(agent)
+	if err != nil {
+		return 0, err
+	}
+
+	done, err := m.beginWrite()
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+
+	return m.registerValidatedAgent(aUUID, agent, false, true)
+}
+
+// IsAgentPinned returns whether the agent is a synthetic agent which should never be expired.
+func (m *ManagerImpl) IsAgentPinned(agentID uuid.UUID) (bool, error) {
+	return m.agtStore.IsAgentPinned(agentID)
+}
+
 // DeleteAgent deletes the agent with the given ID.
 func (m *ManagerImpl) DeleteAgent(agentID uuid.UUID) error {
-	err := m.deleteAgentWrapper(agentID)
+	done, err := m.beginWrite()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	err = m.deleteAgentWrapper(agentID)
 	if err != nil {
-		log.WithError(err).Fatal("Failed to delete agent from etcd")
+		m.logger.WithError(err).Fatal("Failed to delete agent from etcd")
 	}
 
 	return err
 }
 
+// ExpireAgent deletes an agent which has stopped sending heartbeats. It is the same as DeleteAgent, except that
+// the expiry is logged, so that it can be told apart from an agent which was deleted on purpose.
+func (m *ManagerImpl) ExpireAgent(agentID uuid.UUID) error {
+	agt, err := m.agtStore.GetAgent(agentID)
+	if err != nil {
+		return err
+	}
+	m.agentLogger(logOpExpire, agentID, agt).Info("Expiring agent")
+	return m.DeleteAgent(agentID)
+}
+
+// DeleteAgents deletes the agents with the given IDs in a single write to the store. The deletions are sent to
+// the agent update cursors together, in the same order as agentIDs. An ID which is repeated is only deleted once.
+func (m *ManagerImpl) DeleteAgents(agentIDs []uuid.UUID) error {
+	done, err := m.beginWrite()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	seen := make(map[uuid.UUID]bool)
+	var ids []uuid.UUID
+	for _, agentID := range agentIDs {
+		if seen[agentID] {
+			continue
+		}
+		seen[agentID] = true
+		ids = append(ids, agentID)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	return m.deleteAgentsWrapper(ids)
+}
+
+// CanSafelyRemove returns whether removing the agent would leave every table with at least one
+// contributing agent. If not, the tables which the agent is the only provider for are returned, sorted by name.
+func (m *ManagerImpl) CanSafelyRemove(agentID uuid.UUID) (bool, []string, error) {
+	computedSchema, err := m.agtStore.GetComputedSchema()
+	if err == ErrNoComputedSchemas {
+		return true, nil, nil
+	}
+	if err != nil {
+		return false, nil, err
+	}
+
+	agentIDPb := utils.ProtoFromUUID(agentID)
+	var unserved []string
+	for tableName, agentIDs := range computedSchema.TableNameToAgentIDs {
+		if len(agentIDs.AgentID) == 1 && agentIDs.AgentID[0].Equal(agentIDPb) {
+			unserved = append(unserved, tableName)
+		}
+	}
+	sort.Strings(unserved)
+	return len(unserved) == 0, unserved, nil
+}
+
+// GetUnderReplicatedTables gets the tables which have fewer than k contributing agents in the computed schema,
+// mapped to their number of contributing agents.
+func (m *ManagerImpl) GetUnderReplicatedTables(k int) (map[string]int, error) {
+	tables := make(map[string]int)
+	computedSchema, err := m.agtStore.GetComputedSchema()
+	if err == ErrNoComputedSchemas {
+		return tables, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for tableName, agentIDs := range computedSchema.TableNameToAgentIDs {
+		if len(agentIDs.AgentID) < k {
+			tables[tableName] = len(agentIDs.AgentID)
+		}
+	}
+	return tables, nil
+}
+
+// Reconcile makes the set of agents match the desired agents. Any desired agent which does not exist is
+// registered, and any existing agent which is not desired is deleted. Agents that exist and are desired
+// are left unchanged. All of the desired agents are validated before anything is written, so an invalid agent
+// fails the whole reconcile with ErrInvalidAgent.
+func (m *ManagerImpl) Reconcile(desired []*agentpb.Agent) (*ReconcileResult, error) {
+	desiredIDs := make([]uuid.UUID, len(desired))
+	for i, agt := range desired {
+		aUUID, err := ValidateAgent(agt)
+		if err != nil {
+			return &ReconcileResult{}, err
+		}
+		desiredIDs[i] = aUUID
+	}
+
+	done, err := m.beginWrite()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	agents, err := m.agtStore.GetAgents()
+	if err != nil {
+		return nil, err
+	}
+
+	existing := make(map[uuid.UUID]bool)
+	for _, agt := range agents {
+		existing[utils.UUIDFromProtoOrNil(agt.Info.AgentID)] = true
+	}
+
+	result := &ReconcileResult{}
+	isDesired := make(map[uuid.UUID]bool)
+	for i, agt := range desired {
+		agentID := desiredIDs[i]
+		isDesired[agentID] = true
+		if existing[agentID] {
+			continue
+		}
+		// The agent is registered within this write, since a second beginWrite would fail if the writes were
+		// quiesced in the meantime.
+		_, err = m.registerValidatedAgent(agentID, agt, false, false)
+		if err != nil {
+			return result, err
+		}
+		result.Registered++
+	}
+
+	for agentID := range existing {
+		if isDesired[agentID] {
+			continue
+		}
+		err = m.deleteAgentWrapper(agentID)
+		if err != nil {
+			return result, err
+		}
+		result.Deleted++
+	}
+
+	return result, nil
+}
+
 // UpdateHeartbeat updates the agent heartbeat with the current time.
 func (m *ManagerImpl) UpdateHeartbeat(agentID uuid.UUID) error {
+	return m.updateHeartbeat(agentID, nil)
+}
+
+// UpdateHeartbeatWithStats updates the agent heartbeat with the current time, and stores the status reported
+// by the agent along with it. The status is cleared if the agent is re-registered.
+func (m *ManagerImpl) UpdateHeartbeatWithStats(agentID uuid.UUID, stats *agentpb.AgentStatus) error {
+	if stats == nil {
+		return errors.New("Agent stats must be specified")
+	}
+	return m.updateHeartbeat(agentID, stats)
+}
+
+func (m *ManagerImpl) updateHeartbeat(agentID uuid.UUID, stats *agentpb.AgentStatus) error {
+	done, err := m.beginWrite()
+	if err != nil {
+		return err
+	}
+	defer done()
+
 	// Get current AgentData.
 	agent, err := m.agtStore.GetAgent(agentID)
 	if err != nil {
@@ -486,26 +1761,161 @@ func (m *ManagerImpl) UpdateHeartbeat(agentID uuid.UUID) error {
 	}
 
 	// Update LastHeartbeatNS in AgentData.
-	agent.LastHeartbeatNS = time.Now().UnixNano()
+	agent.LastHeartbeatNS = m.clock.Now().UnixNano()
 
-	err = m.updateAgentWrapper(agentID, agent)
+	err = m.updateAgentWrapper(agentID, agent, stats, m.allowHeartbeatUpdate(agentID))
 	if err != nil {
 		return err
 	}
+	m.metrics.heartbeatsProcessed.Inc()
 
 	return nil
 }
 
-// GetActiveAgents gets all of the current active agents.
+// GetActiveAgents gets all of the current active agents. The agents are only read from the store if an agent
+// has changed since the last call. The returned agents are copies of the cached agents, so callers may modify
+// them.
 func (m *ManagerImpl) GetActiveAgents() ([]*agentpb.Agent, error) {
 	var agents []*agentpb.Agent
 
-	agentPbs, err := m.agtStore.GetAgents()
+	m.cachedAgentsMutex.Lock()
+	defer m.cachedAgentsMutex.Unlock()
+
+	// The version must be read before the store, so that a change which happens during the read
+	// invalidates the cache.
+	version := atomic.LoadUint64(&m.agentsVersion)
+	if !m.cachedAgentsValid || m.cachedAgentsVersion != version {
+		agentPbs, err := m.agtStore.GetAgents()
+		if err != nil {
+			return agents, err
+		}
+		pinnedAgentIDs, err := m.agtStore.GetPinnedAgentIDs()
+		if err != nil {
+			return agents, err
+		}
+
+		m.cachedAgents = agentPbs
+		m.cachedPinnedAgents = make(map[uuid.UUID]bool)
+		for _, agentID := range pinnedAgentIDs {
+			m.cachedPinnedAgents[agentID] = true
+		}
+		m.cachedAgentsVersion = version
+		m.cachedAgentsValid = true
+	}
+
+	// Pinned agents are always healthy, so their last heartbeat is reported as the current time.
+	now := m.clock.Now().UnixNano()
+	agents = make([]*agentpb.Agent, len(m.cachedAgents))
+	for i, agt := range m.cachedAgents {
+		agents[i] = proto.Clone(agt).(*agentpb.Agent)
+		if m.cachedPinnedAgents[utils.UUIDFromProtoOrNil(agt.Info.AgentID)] {
+			agents[i].LastHeartbeatNS = now
+		}
+	}
+	return agents, nil
+}
+
+// GetActiveAgentsWithCapability gets the active agents which do or do not collect data, sorted by ASID. As with
+// GetActiveAgents, the agents are read from the cache, and pinned agents are reported with a current heartbeat.
+func (m *ManagerImpl) GetActiveAgentsWithCapability(collectsData bool) ([]*agentpb.Agent, error) {
+	agents, err := m.GetActiveAgents()
+	if err != nil {
+		return nil, err
+	}
+
+	var matching []*agentpb.Agent
+	for _, agt := range agents {
+		if agt.Info.Capabilities != nil && agt.Info.Capabilities.CollectsData == collectsData {
+			matching = append(matching, agt)
+		}
+	}
+	sort.Slice(matching, func(i, j int) bool {
+		return matching[i].ASID < matching[j].ASID
+	})
+	return matching, nil
+}
+
+// GetAgentsWithoutDataInfo gets the data-collecting agents which have not reported their data info. These
+// agents cannot be targeted using their metadata bloom filter. Agents which do not collect data are
+// never expected to report data info, so they are not included.
+func (m *ManagerImpl) GetAgentsWithoutDataInfo() ([]uuid.UUID, error) {
+	agents, err := m.agtStore.GetAgentsWithCapability(true)
+	if err != nil {
+		return nil, err
+	}
+	withDataInfo, err := m.agtStore.GetAgentIDsWithDataInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	hasDataInfo := make(map[uuid.UUID]bool)
+	for _, agentID := range withDataInfo {
+		hasDataInfo[agentID] = true
+	}
+
+	var agentIDs []uuid.UUID
+	for _, agt := range agents {
+		agentID := utils.UUIDFromProtoOrNil(agt.Info.AgentID)
+		if !hasDataInfo[agentID] {
+			agentIDs = append(agentIDs, agentID)
+		}
+	}
+	return agentIDs, nil
+}
+
+// GetNeverHeartbeatedAgents gets the active agents which have not sent a heartbeat since they were registered.
+// These agents may be stuck. Pinned agents never heartbeat, so they are not included.
+func (m *ManagerImpl) GetNeverHeartbeatedAgents() ([]uuid.UUID, error) {
+	agents, err := m.GetActiveAgents()
+	if err != nil {
+		return nil, err
+	}
+
+	var agentIDs []uuid.UUID
+	for _, agt := range agents {
+		if agt.LastHeartbeatNS <= agt.CreateTimeNS {
+			agentIDs = append(agentIDs, utils.UUIDFromProtoOrNil(agt.Info.AgentID))
+		}
+	}
+	return agentIDs, nil
+}
+
+// GetAgentsSharingHostIP gets all host IPs that are shared by more than one active agent, along with
+// the IDs of those agents. This usually indicates a misconfiguration, such as agents running with hostNetwork.
+func (m *ManagerImpl) GetAgentsSharingHostIP() (map[string][]uuid.UUID, error) {
+	// The hostname/IP index only tracks a single PEM per IP, so group the agents themselves by IP instead.
+	agents, err := m.agtStore.GetAgents()
 	if err != nil {
-		return agents, err
+		return nil, err
+	}
+
+	agentsByIP := make(map[string][]uuid.UUID)
+	for _, agt := range agents {
+		ip := agt.Info.HostInfo.HostIP
+		agentsByIP[ip] = append(agentsByIP[ip], utils.UUIDFromProtoOrNil(agt.Info.AgentID))
+	}
+
+	shared := make(map[string][]uuid.UUID)
+	for ip, agentIDs := range agentsByIP {
+		if len(agentIDs) > 1 {
+			shared[ip] = agentIDs
+		}
 	}
+	return shared, nil
+}
 
-	return agentPbs, nil
+// GetAgentsByHostnamePrefix gets the agents whose hostnames start with the given prefix, such as the agents of
+// a node pool. Agents without a hostname only match an empty prefix.
+func (m *ManagerImpl) GetAgentsByHostnamePrefix(prefix string) ([]*agentpb.Agent, error) {
+	return m.agtStore.GetAgentsByHostnamePrefix(prefix)
+}
+
+// agentTopic returns the NATS subject of messages sent to the given agent.
+func (m *ManagerImpl) agentTopic(agentID uuid.UUID) string {
+	if m.subjectPrefix == "" {
+		return messagebus.AgentUUIDTopic(agentID)
+	}
+	return path.Join(m.subjectPrefix, messagebus.AgentUUIDTopic(agentID))
 }
 
 // MessageAgents sends the message to the given agentIDs.
@@ -513,7 +1923,7 @@ func (m *ManagerImpl) MessageAgents(agentIDs []uuid.UUID, msg []byte) error {
 	// Send request to all agents.
 	var errs []error
 	for _, agentID := range agentIDs {
-		topic := messagebus.AgentUUIDTopic(agentID)
+		topic := m.agentTopic(agentID)
 
 		err := m.conn.Publish(topic, msg)
 		if err != nil {
@@ -544,15 +1954,92 @@ func (m *ManagerImpl) MessageActiveAgents(msg []byte) error {
 	return m.MessageAgents(agentIDs, msg)
 }
 
-// UpdateConfig updates the config key and value for the specified agent.
+// UpdateConfig updates the config key and value for the specified agent. ErrAgentNotFound is returned
+// if the pod does not belong to a live agent.
 func (m *ManagerImpl) UpdateConfig(ns string, podName string, key string, value string) error {
 	// Find the agent ID for the agent with the given name.
 	agentID, err := m.agtStore.GetAgentIDFromPodName(podName)
-	if err != nil || agentID == "" {
-		return errors.New("Could not find agent with the given name")
+	if err != nil {
+		return err
+	}
+	if agentID == "" {
+		return ErrAgentNotFound
+	}
+	// The pod name index may outlive the agent, so the agent is checked to still be registered rather than
+	// publishing to a subject nobody is listening on.
+	return m.UpdateConfigByID(uuid.FromStringOrNil(agentID), key, value)
+}
+
+// UpdateConfigByID updates the config key and value for the agent with the given ID. ErrAgentNotFound is
+// returned if the agent is not registered.
+func (m *ManagerImpl) UpdateConfigByID(agentID uuid.UUID, key string, value string) error {
+	agt, err := m.agtStore.GetAgent(agentID)
+	if err != nil {
+		return err
+	}
+	if agt == nil {
+		return ErrAgentNotFound
 	}
 
+	// Record the config before sending it, so that it can be reconciled if the send fails.
+	err = m.agtStore.SetAgentConfig(agentID, key, value)
+	if err != nil {
+		return err
+	}
+	m.audit(agentID, AuditOpUpdateConfig, key)
+
 	// Send the config update to the agent over NATS.
+	msg, err := configUpdateMessage(key, value)
+	if err != nil {
+		return err
+	}
+	topic := m.agentTopic(agentID)
+	err = m.conn.Publish(topic, msg)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// UpdateConfigAll updates the config key and value for all of the active agents which collect data. Kelvins
+// are skipped, since the config keys only apply to PEMs.
+func (m *ManagerImpl) UpdateConfigAll(key string, value string) error {
+	agents, err := m.GetActiveAgents()
+	if err != nil {
+		return err
+	}
+
+	var agentIDs []uuid.UUID
+	for _, agt := range agents {
+		if agt.Info.Capabilities != nil && !agt.Info.Capabilities.CollectsData {
+			continue
+		}
+		agentIDs = append(agentIDs, utils.UUIDFromProtoOrNil(agt.Info.AgentID))
+	}
+	return m.SwapConfigAtomic(agentIDs, key, value)
+}
+
+// SwapConfigAtomic updates the config key and value for all of the given agents. The config is recorded for
+// all of the agents in a single write before it is sent, so if the write fails, the config is not sent to
+// any of the agents.
+func (m *ManagerImpl) SwapConfigAtomic(agentIDs []uuid.UUID, key string, value string) error {
+	err := m.agtStore.SetAgentsConfig(agentIDs, key, value)
+	if err != nil {
+		return err
+	}
+	for _, agentID := range agentIDs {
+		m.audit(agentID, AuditOpUpdateConfig, key)
+	}
+
+	msg, err := configUpdateMessage(key, value)
+	if err != nil {
+		return err
+	}
+	return m.MessageAgents(agentIDs, msg)
+}
+
+// configUpdateMessage creates the message which requests an agent to update the config key to the value.
+func configUpdateMessage(key string, value string) ([]byte, error) {
 	updateReq := messagespb.VizierMessage{
 		Msg: &messagespb.VizierMessage_ConfigUpdateMessage{
 			ConfigUpdateMessage: &messagespb.ConfigUpdateMessage{
@@ -565,28 +2052,39 @@ func (m *ManagerImpl) UpdateConfig(ns string, podName string, key string, value
 			},
 		},
 	}
-	msg, err := updateReq.Marshal()
-	if err != nil {
-		return err
-	}
-	topic := messagebus.AgentTopic(agentID)
-	err = m.conn.Publish(topic, msg)
-	if err != nil {
-		return err
-	}
-	return nil
+	return updateReq.Marshal()
 }
 
 // GetAgentUpdates returns the latest agent status since the last call to GetAgentUpdates().
+// ErrCursorNotFound is returned if the cursor does not exist, such as after it has been deleted.
 // if the input cursor has never read the initial state before, the full initial agent state is read out.
 // Afterwards, the changes to the agent state are read out as a delta to the previous state.
 func (m *ManagerImpl) GetAgentUpdates(cursorID uuid.UUID) ([]*metadata_servicepb.AgentUpdate,
+	*storepb.ComputedSchema, error) {
+	return m.GetAgentUpdatesLimit(cursorID, 0)
+}
+
+// takeUpdates splits the updates into the first maxUpdates updates and the rest. A maxUpdates of 0 means
+// there is no limit.
+func takeUpdates(updates []*metadata_servicepb.AgentUpdate, maxUpdates int) ([]*metadata_servicepb.AgentUpdate,
+	[]*metadata_servicepb.AgentUpdate) {
+	if maxUpdates <= 0 || len(updates) <= maxUpdates {
+		return updates, []*metadata_servicepb.AgentUpdate{}
+	}
+	return updates[:maxUpdates], updates[maxUpdates:]
+}
+
+// GetAgentUpdatesLimit is the same as GetAgentUpdates, but returns at most maxUpdates updates. The remaining
+// updates stay buffered in the cursor, in order, and are returned by the next calls. The schema is only
+// returned by the call which reads the schema change. A maxUpdates of 0 means there is no limit.
+func (m *ManagerImpl) GetAgentUpdatesLimit(cursorID uuid.UUID, maxUpdates int) ([]*metadata_servicepb.AgentUpdate,
 	*storepb.ComputedSchema, error) {
 	schemaUpdated := false
 	var updatedAgentsUpdates []*metadata_servicepb.AgentUpdate
 
 	var err error
 	var hasReadInitialState bool
+	var tracker *agentUpdateTracker
 	func() {
 		// Note: Due to the fact that we do not lock the entirety of this GetAgentUpdates function (and the various
 		// wrapper functions updating the metadata store with new agent state), there may be inconsistency in the
@@ -598,26 +2096,34 @@ func (m *ManagerImpl) GetAgentUpdates(cursorID uuid.UUID) ([]*metadata_servicepb
 		m.agentUpdateTrackersMutex.Lock()
 		defer m.agentUpdateTrackersMutex.Unlock()
 
-		tracker, present := m.agentUpdateTrackers[cursorID]
+		var present bool
+		tracker, present = m.agentUpdateTrackers[cursorID]
 		if !present {
-			err = fmt.Errorf("Agent update cursor %s is not present in Manager", cursorID.String())
+			err = fmt.Errorf("%w: %s is not present in Manager", ErrCursorNotFound, cursorID.String())
 			return
 		}
 		if tracker == nil {
-			err = fmt.Errorf("Agent update cursor %s is nil in Manager", cursorID.String())
+			err = fmt.Errorf("%w: %s is nil in Manager", ErrCursorNotFound, cursorID.String())
 			return
 		}
 
 		schemaUpdated = tracker.schemaUpdated
-		updatedAgentsUpdates = tracker.updates
-
-		// Reset the state now that we have popped off the latest updates.
-		tracker.clearUpdates()
 		hasReadInitialState = tracker.hasReadInitialState
 
+		if hasReadInitialState {
+			// Pop off as many of the latest updates as we are allowed to return.
+			updatedAgentsUpdates, tracker.updates = takeUpdates(tracker.updates, maxUpdates)
+			tracker.schemaUpdated = false
+		} else {
+			// Reset the state, since the initial state includes all of the pending updates.
+			tracker.clearUpdates()
+		}
+		tracker.lastReadTime = m.clock.Now()
+
 		if !tracker.hasReadInitialState {
 			tracker.hasReadInitialState = true
 		}
+		m.saveTracker(tracker)
 	}()
 
 	if err != nil {
@@ -663,6 +2169,21 @@ func (m *ManagerImpl) GetAgentUpdates(cursorID uuid.UUID) ([]*metadata_servicepb
 		}
 	}
 
+	if !hasReadInitialState {
+		var remaining []*metadata_servicepb.AgentUpdate
+		agentUpdates, remaining = takeUpdates(agentUpdates, maxUpdates)
+		if len(remaining) > 0 {
+			// Buffer the rest of the initial state ahead of any updates that came in since it was read.
+			m.agentUpdateTrackersMutex.Lock()
+			tracker.updates = append(remaining, tracker.updates...)
+			// Don't save the tracker if the cursor was deleted in the meantime.
+			if _, ok := m.agentUpdateTrackers[cursorID]; ok {
+				m.saveTracker(tracker)
+			}
+			m.agentUpdateTrackersMutex.Unlock()
+		}
+	}
+
 	return agentUpdates, computedSchema, nil
 }
 
@@ -671,6 +2192,42 @@ func (m *ManagerImpl) GetComputedSchema() (*storepb.ComputedSchema, error) {
 	return m.agtStore.GetComputedSchema()
 }
 
+// ListTables returns the sorted names of the tables in the computed schema. Unlike GetAgentUpdates, it does not
+// read from or advance any cursor.
+func (m *ManagerImpl) ListTables() ([]string, error) {
+	computedSchema, err := m.agtStore.GetComputedSchema()
+	if err == ErrNoComputedSchemas {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(computedSchema.Tables))
+	for i, table := range computedSchema.Tables {
+		names[i] = table.Name
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// GetTableSchema returns the schema of the table with the given name from the computed schema, or nil if there
+// is no such table.
+func (m *ManagerImpl) GetTableSchema(name string) (*storepb.TableInfo, error) {
+	computedSchema, err := m.agtStore.GetComputedSchema()
+	if err == ErrNoComputedSchemas {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, table := range computedSchema.Tables {
+		if table.Name == name {
+			return table, nil
+		}
+	}
+	return nil, nil
+}
+
 // GetAgentIDForHostnamePair gets the agent for the given hostnamePair, if it exists.
 func (m *ManagerImpl) GetAgentIDForHostnamePair(hnPair *HostnameIPPair) (string, error) {
 	return m.agtStore.GetAgentIDForHostnamePair(hnPair)
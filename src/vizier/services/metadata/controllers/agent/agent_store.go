@@ -19,15 +19,19 @@
 package agent
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/gofrs/uuid"
+	"github.com/gogo/protobuf/jsonpb"
 	"github.com/gogo/protobuf/proto"
 	log "github.com/sirupsen/logrus"
 
@@ -37,16 +41,49 @@ import (
 	types "px.dev/pixie/src/shared/types/gotypes"
 	"px.dev/pixie/src/utils"
 	"px.dev/pixie/src/vizier/messages/messagespb"
+	metadata_servicepb "px.dev/pixie/src/vizier/services/metadata/metadatapb"
 	"px.dev/pixie/src/vizier/services/metadata/storepb"
 	"px.dev/pixie/src/vizier/services/shared/agentpb"
 	"px.dev/pixie/src/vizier/utils/datastore"
 )
 
 const (
-	agentKeyPrefix      = "/agent/"
-	agentDataInfoPrefix = "/agentDataInfo/"
-	asidKey             = "/asid"
-	computedSchemaKey   = "/computedSchema"
+	agentKeyPrefix          = "/agent/"
+	agentConfigPrefix       = "/agentConfig/"
+	agentModifiedPrefix     = "/agentModified/"
+	agentStatusPrefix       = "/agentStatus/"
+	agentRegisterTimePrefix = "/agentRegisterTime/"
+	agentVersionPrefix      = "/agentVersion/"
+	agentDataInfoPrefix     = "/agentDataInfo/"
+	agentDescriptionPrefix  = "/agentDescription/"
+	agentUpdateCursorPrefix = "/agentUpdateCursor/"
+	asidToAgentIDPrefix     = "/asidToAgentID/"
+	hostnameToAgentIDPrefix = "/hostnameToAgentID/"
+	hostnameIPPrefix        = "/hostnameIP/"
+	podToAgentIDPrefix      = "/podToAgentID/"
+	kelvinAgentPrefix       = "/kelvin/"
+	pinnedAgentPrefix       = "/pinnedAgent/"
+	processKeyPrefix        = "/processes/"
+	processLabelsPrefix     = "/processLabels/"
+	processParentPrefix     = "/processParent/"
+	agentVersionCounterKey  = "/agentVersionCounter"
+	asidKey                 = "/asid"
+	computedSchemaKey       = "/computedSchema"
+	upidKeyMigrationKey     = "/migrations/upidKeys"
+)
+
+// jsonRecordHeader is prepended to records stored in the JSON format. A serialized protobuf can never start
+// with a zero byte, so values without this header are always read as protobuf.
+const jsonRecordHeader = "\x00json"
+
+// RecordCodec is the serialization format used for stored agent records.
+type RecordCodec int
+
+const (
+	// ProtoRecordCodec stores agent records as serialized protobufs. This is the default.
+	ProtoRecordCodec RecordCodec = iota
+	// JSONRecordCodec stores agent records as JSON, which is larger but easier to debug.
+	JSONRecordCodec
 )
 
 // ErrNoComputedSchemas is an error indicating the lack of computedSchemas.
@@ -58,81 +95,439 @@ type HostnameIPPair struct {
 	IP       string
 }
 
+// FullRecord contains all of the data stored for a single agent.
+type FullRecord struct {
+	Agent       *agentpb.Agent
+	Description string
+	// Config is the config that was sent to the agent, as returned by GetAgentConfig.
+	Config   map[string]string
+	DataInfo *messagespb.AgentDataInfo
+	// LastRegisterTimeNS is the last time that the agent registered, which is later than its create time if
+	// the agent has restarted. It is 0 if the registration time was never recorded.
+	LastRegisterTimeNS int64
+	// Tables are the tables in the computed schema which the agent contributes to.
+	Tables []*storepb.TableInfo
+	// Processes are the processes running under the agent's ASID.
+	Processes []*metadatapb.ProcessInfo
+	// ProcessLabels are the custom labels of the agent's processes, keyed by UPID string.
+	ProcessLabels map[string]map[string]string
+}
+
+// AgentState is the data info and schema of an agent, as written by UpdateAgentStates.
+type AgentState struct {
+	AgentID uuid.UUID
+	// DataInfo replaces the agent's data info, unless it is nil.
+	DataInfo *messagespb.AgentDataInfo
+	// Schema replaces the agent's tables if UpdateSchema is set.
+	Schema       []*storepb.TableInfo
+	UpdateSchema bool
+}
+
+// CursorState is the persisted state of an agent update cursor.
+type CursorState struct {
+	ID                  uuid.UUID `json:"-"`
+	HasReadInitialState bool      `json:"hasReadInitialState"`
+	SchemaUpdated       bool      `json:"schemaUpdated"`
+	// CreateTimeNS is the time the cursor was created. It is 0 for cursors saved before it was recorded.
+	CreateTimeNS int64 `json:"createTimeNS,omitempty"`
+	// Updates are the updates which have not been read from the cursor yet, in order.
+	Updates []*metadata_servicepb.AgentUpdate `json:"-"`
+}
+
 // Datastore implements the Store interface on a given Datastore.
 type Datastore struct {
 	ds             datastore.MultiGetterSetterDeleterCloser
 	expiryDuration time.Duration
+	codec          RecordCodec
 
 	asidMu sync.Mutex
+	// versionMu is held while allocating agent versions and writing the modified agents, so that
+	// the versions become visible in order.
+	versionMu sync.Mutex
 }
 
 // NewDatastore wraps the datastore in a Store
 func NewDatastore(ds datastore.MultiGetterSetterDeleterCloser, expiryDuration time.Duration) *Datastore {
-	return &Datastore{ds: ds, expiryDuration: expiryDuration}
+	return NewDatastoreWithCodec(ds, expiryDuration, ProtoRecordCodec)
+}
+
+// NewDatastoreWithCodec wraps the datastore in a Store which writes agent records using the given codec.
+// Records are always readable regardless of the codec they were written with.
+func NewDatastoreWithCodec(ds datastore.MultiGetterSetterDeleterCloser, expiryDuration time.Duration, codec RecordCodec) *Datastore {
+	a := &Datastore{ds: ds, expiryDuration: expiryDuration, codec: codec}
+	err := a.migrateUPIDKeys()
+	if err != nil {
+		log.WithError(err).Error("Failed to migrate the process keys")
+	}
+	err = a.backfillAgentIndexes()
+	if err != nil {
+		log.WithError(err).Error("Failed to backfill the agent indexes")
+	}
+	return a
+}
+
+// backfillAgentIndexes writes the ASID and hostname index keys of the agents which were stored before those
+// indexes existed. The agents which are already indexed are left alone.
+func (a *Datastore) backfillAgentIndexes() error {
+	agents, err := a.GetAgents()
+	if err != nil {
+		return err
+	}
+	indexKeys := make(map[string]bool)
+	for _, prefix := range []string{asidToAgentIDPrefix, hostnameToAgentIDPrefix} {
+		keys, _, err := a.ds.GetWithPrefix(prefix)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			indexKeys[key] = true
+		}
+	}
+
+	var keys []string
+	var values []string
+	for _, agt := range agents {
+		agentID := utils.UUIDFromProtoOrNil(agt.Info.AgentID)
+		agentKeys := []string{getASIDToAgentIDKey(agt.ASID)}
+		if agt.Info.HostInfo != nil {
+			agentKeys = append(agentKeys, getHostnameToAgentIDKey(agt.Info.HostInfo.Hostname, agentID))
+		}
+		for _, key := range agentKeys {
+			if !indexKeys[key] {
+				keys = append(keys, key)
+				values = append(values, agentID.String())
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	return a.ds.SetAll(keys, values)
+}
+
+// migrateUPIDKeys rewrites the process and process label keys which were written with the UPID format of
+// k8s.StringFromUPID, to the format of EncodeUPIDKey. Terminated processes and their labels keep expiring. The
+// migration only runs once, which is recorded in the datastore.
+func (a *Datastore) migrateUPIDKeys() error {
+	done, err := a.ds.Get(upidKeyMigrationKey)
+	if err != nil {
+		return err
+	}
+	if done != nil {
+		return nil
+	}
+
+	// The processes are migrated first, so that the labels of terminated processes can be given a TTL.
+	stopped := make(map[string]bool)
+	for _, prefix := range []string{processKeyPrefix, processLabelsPrefix} {
+		keys, vals, err := a.ds.GetWithPrefix(prefix)
+		if err != nil {
+			return err
+		}
+
+		var oldKeys []string
+		var newKeys []string
+		var newVals []string
+		var ttls []time.Duration
+		for i, key := range keys {
+			oldUPIDKey := strings.TrimPrefix(key, prefix)
+			upid, err := DecodeUPIDKey(oldUPIDKey)
+			if err != nil {
+				log.WithError(err).Errorf("Could not migrate key '%s'", key)
+				continue
+			}
+			upidKey := EncodeUPIDKey(upid)
+			if prefix == processKeyPrefix {
+				processPb := &metadatapb.ProcessInfo{}
+				if err := proto.Unmarshal(vals[i], processPb); err == nil && processPb.StopTimestampNS > 0 {
+					stopped[upidKey] = true
+				}
+			}
+			if upidKey == oldUPIDKey {
+				continue
+			}
+
+			var ttl time.Duration
+			if stopped[upidKey] {
+				ttl = a.expiryDuration
+			}
+			oldKeys = append(oldKeys, key)
+			newKeys = append(newKeys, prefix+upidKey)
+			newVals = append(newVals, string(vals[i]))
+			ttls = append(ttls, ttl)
+		}
+
+		err = a.setAllWithTTL(newKeys, newVals, ttls)
+		if err != nil {
+			return err
+		}
+		if len(oldKeys) > 0 {
+			err = a.ds.DeleteAll(oldKeys)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return a.ds.Set(upidKeyMigrationKey, "1")
 }
 
 func getAgentKey(agentID uuid.UUID) string {
 	return path.Join(agentKeyPrefix, agentID.String())
 }
 
+// getAgentConfigPrefix returns the prefix of the config keys of the agent. The config key is appended as-is.
+func getAgentConfigPrefix(agentID uuid.UUID) string {
+	return path.Join(agentConfigPrefix, agentID.String()) + "/"
+}
+
 func getAgentDataInfoKey(agentID uuid.UUID) string {
 	return path.Join(agentDataInfoPrefix, agentID.String())
 }
 
+func getAgentUpdateCursorStateKey(cursorID uuid.UUID) string {
+	return path.Join(agentUpdateCursorPrefix, cursorID.String(), "state")
+}
+
+// getAgentUpdateCursorUpdatesPrefix returns the prefix for the pending updates of the cursor. The updates are
+// keyed by their zero-padded sequence number, so that they are read back in order.
+func getAgentUpdateCursorUpdatesPrefix(cursorID uuid.UUID) string {
+	return path.Join(agentUpdateCursorPrefix, cursorID.String(), "updates") + "/"
+}
+
+func getAgentUpdateCursorUpdateKey(cursorID uuid.UUID, seq uint64) string {
+	return getAgentUpdateCursorUpdatesPrefix(cursorID) + fmt.Sprintf("%020d", seq)
+}
+
+func getAgentStatusKey(agentID uuid.UUID) string {
+	return path.Join(agentStatusPrefix, agentID.String())
+}
+
+func getAgentRegisterTimeKey(agentID uuid.UUID) string {
+	return path.Join(agentRegisterTimePrefix, agentID.String())
+}
+
+func getAgentVersionKey(agentID uuid.UUID) string {
+	return path.Join(agentVersionPrefix, agentID.String())
+}
+
+// getAgentModifiedKey returns the key indexing the agent modified at the given version. The version is
+// zero-padded so that the keys sort in version order.
+func getAgentModifiedKey(version uint64) string {
+	return agentModifiedPrefix + fmt.Sprintf("%020d", version)
+}
+
+func getAgentDescriptionKey(agentID uuid.UUID) string {
+	return path.Join(agentDescriptionPrefix, agentID.String())
+}
+
+// getASIDToAgentIDKey returns the ASID index key for the given ASID. The ASID is zero-padded so that
+// the keys sort in ASID order.
+func getASIDToAgentIDKey(asid uint32) string {
+	return path.Join(asidToAgentIDPrefix, fmt.Sprintf("%010d", asid))
+}
+
+// getHostnameToAgentIDKey returns the hostname index key for the agent. The hostname comes first, so that the
+// agents whose hostnames share a prefix are a single range of keys.
+func getHostnameToAgentIDKey(hostname string, agentID uuid.UUID) string {
+	return hostnameToAgentIDPrefix + hostname + "/" + agentID.String()
+}
+
 func getHostnamePairAgentKey(pair *HostnameIPPair) string {
-	return path.Join("/hostnameIP", fmt.Sprintf("%s-%s", pair.Hostname, pair.IP), "agent")
+	return path.Join(hostnameIPPrefix, fmt.Sprintf("%s-%s", pair.Hostname, pair.IP), "agent")
 }
 
 func getKelvinAgentKey(agentID uuid.UUID) string {
-	return path.Join("/kelvin", agentID.String())
+	return path.Join(kelvinAgentPrefix, agentID.String())
+}
+
+func getPinnedAgentKey(agentID uuid.UUID) string {
+	return path.Join(pinnedAgentPrefix, agentID.String())
 }
 
 func getPodNameToAgentIDKey(podName string) string {
-	return path.Join("/podToAgentID", podName)
+	return path.Join(podToAgentIDPrefix, podName)
+}
+
+func getProcessKey(upid *types.UInt128) string {
+	return processKeyPrefix + EncodeUPIDKey(upid)
+}
+
+func getProcessLabelsKey(upid *types.UInt128) string {
+	return processLabelsPrefix + EncodeUPIDKey(upid)
+}
+
+func getProcessParentKey(upid *types.UInt128) string {
+	return path.Join(processParentPrefix, EncodeUPIDKey(upid))
 }
 
-func getProcessKey(upid string) string {
-	return path.Join("/processes", upid)
+// getASIDProcessPrefix returns the key prefix for all processes with the given ASID.
+func getASIDProcessPrefix(asid uint32) string {
+	return path.Join(processKeyPrefix, encodeASIDKeyPrefix(asid))
 }
 
-// CreateAgent creates a new agent.
+func getASIDProcessLabelsPrefix(asid uint32) string {
+	return processLabelsPrefix + encodeASIDKeyPrefix(asid)
+}
+
+func encodeASIDKeyPrefix(asid uint32) string {
+	return fmt.Sprintf("%010d:", asid)
+}
+
+// EncodeUPIDKey encodes the UPID for use in a datastore key. Each component is zero-padded so that the
+// keys sort by ASID, then PID, then start time, which allows all processes for an ASID to be read with
+// a single range scan.
+func EncodeUPIDKey(upid *types.UInt128) string {
+	return fmt.Sprintf("%s%010d:%020d", encodeASIDKeyPrefix(k8s.ASIDFromUPID(upid)), k8s.PIDFromUPID(upid),
+		k8s.StartTSFromUPID(upid))
+}
+
+// DecodeUPIDKey decodes a UPID which was encoded using EncodeUPIDKey.
+func DecodeUPIDKey(key string) (*types.UInt128, error) {
+	sp := strings.Split(key, ":")
+	if len(sp) != 3 {
+		return nil, fmt.Errorf("malformed UPID key: '%s'", key)
+	}
+	asid, err := strconv.ParseUint(sp[0], 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	pid, err := strconv.ParseUint(sp[1], 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	startTS, err := strconv.ParseUint(sp[2], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &types.UInt128{
+		High: asid<<32 | pid,
+		Low:  startTS,
+	}, nil
+}
+
+// marshalAgent serializes the agent record using the configured codec.
+func (a *Datastore) marshalAgent(agt *agentpb.Agent) ([]byte, error) {
+	if a.codec == JSONRecordCodec {
+		m := jsonpb.Marshaler{}
+		s, err := m.MarshalToString(agt)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(jsonRecordHeader + s), nil
+	}
+	return agt.Marshal()
+}
+
+// unmarshalAgent deserializes an agent record, detecting the codec it was written with.
+func unmarshalAgent(b []byte, agt *agentpb.Agent) error {
+	if strings.HasPrefix(string(b), jsonRecordHeader) {
+		return jsonpb.UnmarshalString(strings.TrimPrefix(string(b), jsonRecordHeader), agt)
+	}
+	return proto.Unmarshal(b, agt)
+}
+
+// CreateAgent creates a new agent. All of the writes are synced before returning, so the agent can be read
+// immediately afterwards.
 func (a *Datastore) CreateAgent(agentID uuid.UUID, agt *agentpb.Agent) error {
-	i, err := agt.Marshal()
+	return a.CreateAgents([]uuid.UUID{agentID}, []*agentpb.Agent{agt}, nil, 0, false)
+}
+
+// CreateAgents creates all of the given agents in a single write, so that either all of the agents and their
+// indexes are created, or none of them are. The last register time of the agents in registeredIDs, which may
+// include agents that already exist, is set to registerTimeNS in the same write. If pin is true, the agents in
+// registeredIDs are also pinned in the same write.
+func (a *Datastore) CreateAgents(agentIDs []uuid.UUID, agts []*agentpb.Agent, registeredIDs []uuid.UUID,
+	registerTimeNS int64, pin bool) error {
+	if len(agentIDs) != len(agts) {
+		return errors.New("number of agent IDs and agents must match")
+	}
+
+	var keys []string
+	var values []string
+	for i, agt := range agts {
+		k, v, err := a.getAgentKeyValues(agentIDs[i], agt)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, k...)
+		values = append(values, v...)
+	}
+	for _, agentID := range registeredIDs {
+		keys = append(keys, getAgentRegisterTimeKey(agentID))
+		values = append(values, strconv.FormatInt(registerTimeNS, 10))
+		if pin {
+			keys = append(keys, getPinnedAgentKey(agentID))
+			values = append(values, agentID.String())
+		}
+	}
+
+	// Clear any stats left behind by a previous registration of the agents.
+	statusKeys := make([]string, len(agentIDs))
+	for i, agentID := range agentIDs {
+		statusKeys[i] = getAgentStatusKey(agentID)
+	}
+	err := a.ds.DeleteAll(statusKeys)
 	if err != nil {
-		return errors.New("Unable to marshal agent protobuf: " + err.Error())
+		return err
+	}
+
+	err = a.setAgentsWithVersions(agentIDs, keys, values)
+	if err != nil {
+		return err
+	}
+
+	for _, agt := range agts {
+		log.WithField("hostname", getHostnamePair(agt).Hostname).WithField("HostIP", agt.Info.HostInfo.HostIP).
+			Info("Registering agent")
 	}
+	return nil
+}
+
+// getHostnamePair returns the hostname/IP pair that the agent is indexed by.
+func getHostnamePair(agt *agentpb.Agent) *HostnameIPPair {
 	hostname := ""
 	if !agt.Info.Capabilities.CollectsData {
 		hostname = agt.Info.HostInfo.Hostname
 	}
-	hnPair := &HostnameIPPair{
+	return &HostnameIPPair{
 		Hostname: hostname,
 		IP:       agt.Info.HostInfo.HostIP,
 	}
+}
 
-	err = a.ds.Set(getHostnamePairAgentKey(hnPair), agentID.String())
+// getAgentKeyValues returns all of the keys and values that need to be written to create the agent.
+func (a *Datastore) getAgentKeyValues(agentID uuid.UUID, agt *agentpb.Agent) ([]string, []string, error) {
+	i, err := a.marshalAgent(agt)
 	if err != nil {
-		return err
+		return nil, nil, errors.New("Unable to marshal agent protobuf: " + err.Error())
 	}
-	err = a.ds.Set(getAgentKey(agentID), string(i))
-	if err != nil {
-		return err
+
+	keys := []string{
+		getHostnamePairAgentKey(getHostnamePair(agt)),
+		getAgentKey(agentID),
+		getASIDToAgentIDKey(agt.ASID),
+		getHostnameToAgentIDKey(agt.Info.HostInfo.Hostname, agentID),
 	}
-	err = a.ds.Set(getPodNameToAgentIDKey(agt.Info.HostInfo.PodName), agentID.String())
-	if err != nil {
-		return err
+	values := []string{
+		agentID.String(),
+		string(i),
+		agentID.String(),
+		agentID.String(),
+	}
+
+	// Only PEMs carry a pod name, other agents are not indexed by it.
+	if agt.Info.HostInfo.PodName != "" {
+		keys = append(keys, getPodNameToAgentIDKey(agt.Info.HostInfo.PodName))
+		values = append(values, agentID.String())
 	}
 
 	collectsData := agt.Info.Capabilities == nil || agt.Info.Capabilities.CollectsData
 	if !collectsData {
-		err = a.ds.Set(getKelvinAgentKey(agentID), agentID.String())
-		if err != nil {
-			return err
-		}
+		keys = append(keys, getKelvinAgentKey(agentID))
+		values = append(values, agentID.String())
 	}
 
-	log.WithField("hostname", hnPair.Hostname).WithField("HostIP", hnPair.IP).Info("Registering agent")
-	return nil
+	return keys, values, nil
 }
 
 // GetAgent gets the agent info for the agent with the given id.
@@ -145,301 +540,1009 @@ func (a *Datastore) GetAgent(agentID uuid.UUID) (*agentpb.Agent, error) {
 		return nil, nil
 	}
 	aPb := &agentpb.Agent{}
-	err = proto.Unmarshal(resp, aPb)
+	err = unmarshalAgent(resp, aPb)
 	if err != nil {
 		return nil, err
 	}
 	return aPb, nil
 }
 
+// GetAgentWithSchema gets the agent with the given ID along with the tables it serves, sorted by name. The
+// agent and the computed schema are read from a single consistent view of the datastore, so a concurrent
+// schema update cannot leave them out of sync. Returns nil if the agent does not exist.
+func (a *Datastore) GetAgentWithSchema(agentID uuid.UUID) (*agentpb.Agent, []*storepb.TableInfo, error) {
+	vals, err := a.ds.GetAll([]string{getAgentKey(agentID), computedSchemaKey})
+	if err != nil {
+		return nil, nil, err
+	}
+	if vals[0] == nil {
+		return nil, nil, nil
+	}
+
+	aPb := &agentpb.Agent{}
+	err = unmarshalAgent(vals[0], aPb)
+	if err != nil {
+		return nil, nil, err
+	}
+	if vals[1] == nil {
+		return aPb, nil, nil
+	}
+
+	computedSchemaPb := &storepb.ComputedSchema{}
+	err = proto.Unmarshal(vals[1], computedSchemaPb)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return aPb, agentTables(computedSchemaPb, agentID), nil
+}
+
+// GetAgentTables gets the tables served by the agent with the given ID, sorted by name.
+func (a *Datastore) GetAgentTables(agentID uuid.UUID) ([]*storepb.TableInfo, error) {
+	computedSchemaPb, err := a.GetComputedSchema()
+	if err == ErrNoComputedSchemas {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return agentTables(computedSchemaPb, agentID), nil
+}
+
+// agentTables returns the tables in the computed schema which are served by the given agent, sorted by name.
+func agentTables(computedSchemaPb *storepb.ComputedSchema, agentID uuid.UUID) []*storepb.TableInfo {
+	agentIDPb := utils.ProtoFromUUID(agentID)
+	var tables []*storepb.TableInfo
+	for _, table := range computedSchemaPb.Tables {
+		for _, id := range computedSchemaPb.TableNameToAgentIDs[table.Name].GetAgentID() {
+			if id.Equal(agentIDPb) {
+				tables = append(tables, table)
+				break
+			}
+		}
+	}
+	sort.Slice(tables, func(i, j int) bool {
+		return tables[i].Name < tables[j].Name
+	})
+	return tables
+}
+
 // UpdateAgent updates the agent info for the agent with the given ID.
 func (a *Datastore) UpdateAgent(agentID uuid.UUID, agt *agentpb.Agent) error {
-	i, err := agt.Marshal()
+	i, err := a.marshalAgent(agt)
 	if err != nil {
 		return errors.New("Unable to marshal agent protobuf: " + err.Error())
 	}
 
-	return a.ds.Set(getAgentKey(agentID), string(i))
+	return a.setAgentsWithVersions([]uuid.UUID{agentID}, []string{getAgentKey(agentID)}, []string{string(i)})
 }
 
-// DeleteAgent deletes the agent with the given ID.
-func (a *Datastore) DeleteAgent(agentID uuid.UUID) error {
-	resp, err := a.ds.Get(getAgentKey(agentID))
+// UpdateAgentWithStatus updates the agent info and the latest status reported by the agent in a single write.
+func (a *Datastore) UpdateAgentWithStatus(agentID uuid.UUID, agt *agentpb.Agent, status *agentpb.AgentStatus) error {
+	i, err := a.marshalAgent(agt)
 	if err != nil {
-		return err
+		return errors.New("Unable to marshal agent protobuf: " + err.Error())
+	}
+	st, err := status.Marshal()
+	if err != nil {
+		return errors.New("Unable to marshal agent status protobuf: " + err.Error())
 	}
 
-	// Agent does not exist, no need to delete.
+	return a.setAgentsWithVersions([]uuid.UUID{agentID}, []string{getAgentKey(agentID), getAgentStatusKey(agentID)},
+		[]string{string(i), string(st)})
+}
+
+// SetAgentLastRegisterTime sets the last time that the agent with the given ID registered.
+func (a *Datastore) SetAgentLastRegisterTime(agentID uuid.UUID, timeNS int64) error {
+	return a.ds.Set(getAgentRegisterTimeKey(agentID), strconv.FormatInt(timeNS, 10))
+}
+
+// GetAgentLastRegisterTime gets the last time that the agent with the given ID registered. Returns 0 if the
+// registration time was never recorded.
+func (a *Datastore) GetAgentLastRegisterTime(agentID uuid.UUID) (int64, error) {
+	resp, err := a.ds.Get(getAgentRegisterTimeKey(agentID))
+	if err != nil {
+		return 0, err
+	}
 	if resp == nil {
-		log.Info("Tried to delete an agent that was already deleted")
-		return nil
+		return 0, nil
 	}
+	return strconv.ParseInt(string(resp), 10, 64)
+}
 
-	aPb := &agentpb.Agent{}
-	err = proto.Unmarshal(resp, aPb)
+// GetAgentStatus gets the latest status reported by the agent with the given ID. Nil is returned if the agent
+// has not reported any status since it was registered.
+func (a *Datastore) GetAgentStatus(agentID uuid.UUID) (*agentpb.AgentStatus, error) {
+	resp, err := a.ds.Get(getAgentStatusKey(agentID))
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	hostname := ""
-	if !aPb.Info.Capabilities.CollectsData {
-		hostname = aPb.Info.HostInfo.Hostname
+	if resp == nil {
+		return nil, nil
 	}
 
-	hnPair := &HostnameIPPair{
-		Hostname: hostname,
-		IP:       aPb.Info.HostInfo.HostIP,
+	status := &agentpb.AgentStatus{}
+	err = proto.Unmarshal(resp, status)
+	if err != nil {
+		return nil, err
 	}
-	delKeys := []string{getAgentKey(agentID), getHostnamePairAgentKey(hnPair), getPodNameToAgentIDKey(aPb.Info.HostInfo.PodName)}
+	return status, nil
+}
 
-	// Info.Capabiltiies should never be nil with our new PEMs/Kelvin. If it is nil,
-	// this means that the protobuf we retrieved from etcd belongs to an older agent.
-	collectsData := aPb.Info.Capabilities == nil || aPb.Info.Capabilities.CollectsData
-	if !collectsData {
-		delKeys = append(delKeys, getKelvinAgentKey(agentID))
+// getAgentVersionCounter gets the version of the most recent agent modification.
+func (a *Datastore) getAgentVersionCounter() (uint64, error) {
+	resp, err := a.ds.Get(agentVersionCounterKey)
+	if err != nil {
+		return 0, err
+	}
+	if resp == nil {
+		return 0, nil
 	}
+	return strconv.ParseUint(string(resp), 10, 64)
+}
 
-	err = a.ds.DeleteAll(delKeys)
+// setAgentsWithVersions writes the given keys and values along with a new version for each of the agents.
+// The index entries for the agents' previous versions are deleted once the write succeeds. Stale entries
+// left behind by a failed delete are ignored by GetAgentsModifiedSince.
+func (a *Datastore) setAgentsWithVersions(agentIDs []uuid.UUID, keys []string, values []string) error {
+	a.versionMu.Lock()
+	defer a.versionMu.Unlock()
+
+	version, err := a.getAgentVersionCounter()
 	if err != nil {
 		return err
 	}
 
-	// Deletes from the computedSchema
-	err = a.UpdateSchemas(agentID, []*storepb.TableInfo{})
+	var staleKeys []string
+	for _, agentID := range agentIDs {
+		resp, err := a.ds.Get(getAgentVersionKey(agentID))
+		if err != nil {
+			return err
+		}
+		if resp != nil {
+			staleKeys = append(staleKeys, agentModifiedPrefix+string(resp))
+		}
+
+		version++
+		keys = append(keys, getAgentVersionKey(agentID), getAgentModifiedKey(version))
+		values = append(values, fmt.Sprintf("%020d", version), agentID.String())
+	}
+	keys = append(keys, agentVersionCounterKey)
+	values = append(values, fmt.Sprint(version))
+
+	err = a.ds.SetAll(keys, values)
 	if err != nil {
 		return err
 	}
-
-	return a.ds.DeleteWithPrefix(getAgentDataInfoKey(agentID))
+	if len(staleKeys) == 0 {
+		return nil
+	}
+	return a.ds.DeleteAll(staleKeys)
 }
 
-// GetAgents gets all of the current active agents.
-func (a *Datastore) GetAgents() ([]*agentpb.Agent, error) {
+// GetAgentsModifiedSince gets the agents which have been created or updated after the given version,
+// along with the version of the most recent modification. Passing the returned version to the next call
+// returns only the agents modified in between. Deleted agents are not returned.
+func (a *Datastore) GetAgentsModifiedSince(version uint64) ([]*agentpb.Agent, uint64, error) {
+	a.versionMu.Lock()
+	defer a.versionMu.Unlock()
+
+	latest, err := a.getAgentVersionCounter()
+	if err != nil {
+		return nil, 0, err
+	}
 	var agents []*agentpb.Agent
+	if version >= latest {
+		return agents, latest, nil
+	}
 
-	keys, vals, err := a.ds.GetWithPrefix(agentKeyPrefix)
+	keys, vals, err := a.ds.GetWithRange(getAgentModifiedKey(version+1), getAgentModifiedKey(latest+1))
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	for i, key := range keys {
-		// Filter out keys that aren't of the form /agent/<uuid>.
-		splitKey := strings.Split(string(key), "/")
-		if len(splitKey) != 3 {
+	for i, val := range vals {
+		agentID, err := uuid.FromString(string(val))
+		if err != nil {
+			return nil, 0, err
+		}
+		// Skip index entries which were superseded by a later modification of the agent.
+		current, err := a.ds.Get(getAgentVersionKey(agentID))
+		if err != nil {
+			return nil, 0, err
+		}
+		if current == nil || agentModifiedPrefix+string(current) != keys[i] {
 			continue
 		}
-
-		pb := &agentpb.Agent{}
-		err = proto.Unmarshal(vals[i], pb)
+		agt, err := a.GetAgent(agentID)
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
-		if pb.Info != nil && !utils.IsNilUUIDProto(pb.Info.AgentID) {
-			agents = append(agents, pb)
+		if agt != nil {
+			agents = append(agents, agt)
 		}
 	}
-
-	return agents, nil
+	return agents, latest, nil
 }
 
-// GetASID gets the next assignable ASID.
-func (a *Datastore) GetASID() (uint32, error) {
-	a.asidMu.Lock()
-	defer a.asidMu.Unlock()
-	asid := "1" // Starting ASID.
+// DeleteAgent deletes the agent with the given ID, along with all of its indexes and state.
+func (a *Datastore) DeleteAgent(agentID uuid.UUID) error {
+	return a.DeleteAgents([]uuid.UUID{agentID})
+}
 
-	resp, err := a.ds.Get(asidKey)
+// DeleteAgents deletes the agents with the given IDs, along with all of their indexes and state, and removes
+// them from the computed schema. If the underlying datastore supports batches, everything is deleted in a single
+// write. Otherwise, the agent records and their indexes are deleted in one write, and the computed schema and the
+// agents' configs are updated in separate writes. Agents which do not exist are ignored.
+func (a *Datastore) DeleteAgents(agentIDs []uuid.UUID) error {
+	agentKeys := make([]string, len(agentIDs))
+	for i, agentID := range agentIDs {
+		agentKeys[i] = getAgentKey(agentID)
+	}
+	resps, err := a.ds.GetAll(agentKeys)
 	if err != nil {
-		return 0, err
+		return err
 	}
-	if resp != nil {
-		asid = string(resp)
+
+	var delKeys []string
+	var deletedIDs []uuid.UUID
+	for i, resp := range resps {
+		// Agent does not exist, no need to delete.
+		if resp == nil {
+			log.Info("Tried to delete an agent that was already deleted")
+			continue
+		}
+
+		agentID := agentIDs[i]
+		aPb := &agentpb.Agent{}
+		err = unmarshalAgent(resp, aPb)
+		if err != nil {
+			return err
+		}
+
+		delKeys = append(delKeys, getAgentKey(agentID), getHostnamePairAgentKey(getHostnamePair(aPb)), getAgentDescriptionKey(agentID), getASIDToAgentIDKey(aPb.ASID), getPinnedAgentKey(agentID), getAgentStatusKey(agentID), getAgentDataInfoKey(agentID), getAgentRegisterTimeKey(agentID))
+		delKeys = append(delKeys, getHostnameToAgentIDKey(aPb.Info.HostInfo.Hostname, agentID))
+		if aPb.Info.HostInfo.PodName != "" {
+			delKeys = append(delKeys, getPodNameToAgentIDKey(aPb.Info.HostInfo.PodName))
+		}
+
+		// Info.Capabiltiies should never be nil with our new PEMs/Kelvin. If it is nil,
+		// this means that the protobuf we retrieved from etcd belongs to an older agent.
+		collectsData := aPb.Info.Capabilities == nil || aPb.Info.Capabilities.CollectsData
+		if !collectsData {
+			delKeys = append(delKeys, getKelvinAgentKey(agentID))
+		}
+		deletedIDs = append(deletedIDs, agentID)
+	}
+	if len(deletedIDs) == 0 {
+		return nil
 	}
 
-	// Convert ASID from etcd into uint32.
-	asidInt, err := strconv.ParseUint(asid, 10, 32)
+	versionKeys := make([]string, len(deletedIDs))
+	for i, agentID := range deletedIDs {
+		versionKeys[i] = getAgentVersionKey(agentID)
+	}
+
+	a.versionMu.Lock()
+	defer a.versionMu.Unlock()
+	versions, err := a.ds.GetAll(versionKeys)
 	if err != nil {
-		return 0, err
+		return err
+	}
+	for i, version := range versions {
+		if version != nil {
+			delKeys = append(delKeys, versionKeys[i], agentModifiedPrefix+string(version))
+		}
 	}
 
-	// Increment ASID in datastore.
-	updatedAsid := asidInt + 1
-	err = a.ds.Set(asidKey, fmt.Sprint(updatedAsid))
+	computedSchema, hasComputedSchema, err := a.computedSchemaWithoutAgents(deletedIDs)
 	if err != nil {
-		return 0, err
+		return err
 	}
 
-	return uint32(asidInt), nil
+	if batcher, ok := a.ds.(datastore.Batcher); ok {
+		b := batcher.NewBatch()
+		for _, key := range delKeys {
+			b.Delete(key)
+		}
+		if hasComputedSchema {
+			b.Set(computedSchemaKey, computedSchema)
+		}
+		// Clear the config, so that it is not replayed if the agent registers again.
+		for _, agentID := range deletedIDs {
+			b.DeleteWithPrefix(getAgentConfigPrefix(agentID))
+		}
+		return b.Commit()
+	}
+
+	err = a.ds.DeleteAll(delKeys)
+	if err != nil {
+		return err
+	}
+	if hasComputedSchema {
+		err = a.ds.Set(computedSchemaKey, computedSchema)
+		if err != nil {
+			return err
+		}
+	}
+	for _, agentID := range deletedIDs {
+		err = a.ds.DeleteWithPrefix(getAgentConfigPrefix(agentID))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// GetAgentIDFromPodName gets the agent ID for the agent with the given name.
-func (a *Datastore) GetAgentIDFromPodName(podName string) (string, error) {
-	id, err := a.ds.Get(getPodNameToAgentIDKey(podName))
+// computedSchemaWithoutAgents returns the marshalled computed schema with the given agents removed from it, and
+// any tables which are no longer served by any agent deleted. The returned bool is false if there is no
+// computed schema.
+func (a *Datastore) computedSchemaWithoutAgents(agentIDs []uuid.UUID) (string, bool, error) {
+	computedSchemaPb, err := a.GetComputedSchema()
+	if err == ErrNoComputedSchemas {
+		return "", false, nil
+	}
 	if err != nil {
-		return "", err
+		return "", false, err
 	}
 
-	if id == nil {
-		return "", nil
+	for _, agentID := range agentIDs {
+		agentIDPb := utils.ProtoFromUUID(agentID)
+		var tableNames []string
+		for tableName, agents := range computedSchemaPb.TableNameToAgentIDs {
+			for _, agt := range agents.AgentID {
+				if agt.Equal(agentIDPb) {
+					tableNames = append(tableNames, tableName)
+					break
+				}
+			}
+		}
+		for _, tableName := range tableNames {
+			err = deleteAgentFromComputed(computedSchemaPb, tableName, agentIDPb)
+			if err != nil {
+				log.WithError(err).Errorf("Could not delete table to agent mapping %s -> %v", tableName, agentID)
+				return "", false, err
+			}
+		}
 	}
 
-	return string(id), nil
+	computedSchema, err := computedSchemaPb.Marshal()
+	if err != nil {
+		log.WithError(err).Error("Could not marshal computed schema update message.")
+		return "", false, err
+	}
+	return string(computedSchema), true, nil
 }
 
-// GetAgentsDataInfo returns all of the information about data tables that each agent has.
-func (a *Datastore) GetAgentsDataInfo() (map[uuid.UUID]*messagespb.AgentDataInfo, error) {
-	dataInfos := make(map[uuid.UUID]*messagespb.AgentDataInfo)
+// SetAgentConfig records the value of the config key that was sent to the agent with the given ID.
+func (a *Datastore) SetAgentConfig(agentID uuid.UUID, key string, value string) error {
+	return a.ds.Set(getAgentConfigPrefix(agentID)+key, value)
+}
+
+// SetAgentsConfig records the value of the config key that was sent to each of the agents with the given IDs.
+// The config is recorded for all of the agents in a single write, so either all of them are updated, or none are.
+func (a *Datastore) SetAgentsConfig(agentIDs []uuid.UUID, key string, value string) error {
+	keys := make([]string, len(agentIDs))
+	values := make([]string, len(agentIDs))
+	for i, agentID := range agentIDs {
+		keys[i] = getAgentConfigPrefix(agentID) + key
+		values[i] = value
+	}
+	return a.ds.SetAll(keys, values)
+}
 
-	keys, vals, err := a.ds.GetWithPrefix(agentDataInfoPrefix)
+// GetAgentConfig gets the config keys and values that were sent to the agent with the given ID.
+func (a *Datastore) GetAgentConfig(agentID uuid.UUID) (map[string]string, error) {
+	prefix := getAgentConfigPrefix(agentID)
+	keys, vals, err := a.ds.GetWithPrefix(prefix)
 	if err != nil {
 		return nil, err
 	}
 
+	config := make(map[string]string)
 	for i, key := range keys {
-		// Filter out keys that aren't of the form /agentDataInfo/<uuid>.
-		splitKey := strings.Split(string(key), "/")
-		if len(splitKey) != 3 {
-			continue
-		}
-		agentID, err := uuid.FromString(splitKey[2])
-		if err != nil {
-			return nil, err
-		}
+		config[strings.TrimPrefix(key, prefix)] = string(vals[i])
+	}
+	return config, nil
+}
 
-		pb := &messagespb.AgentDataInfo{}
-		err = proto.Unmarshal(vals[i], pb)
-		if err != nil {
-			return nil, err
-		}
-		dataInfos[agentID] = pb
+// SetAgentDescription sets the operator-provided description for the agent with the given ID. ErrAgentNotFound is
+// returned if the agent does not exist.
+func (a *Datastore) SetAgentDescription(agentID uuid.UUID, description string) error {
+	agt, err := a.ds.Get(getAgentKey(agentID))
+	if err != nil {
+		return err
 	}
-	return dataInfos, nil
+	if agt == nil {
+		return ErrAgentNotFound
+	}
+	return a.ds.Set(getAgentDescriptionKey(agentID), description)
 }
 
-// UpdateAgentDataInfo updates the information about data tables that a particular agent has.
-func (a *Datastore) UpdateAgentDataInfo(agentID uuid.UUID, dataInfo *messagespb.AgentDataInfo) error {
-	i, err := dataInfo.Marshal()
+// GetAgentDescription gets the operator-provided description for the agent with the given ID.
+func (a *Datastore) GetAgentDescription(agentID uuid.UUID) (string, error) {
+	resp, err := a.ds.Get(getAgentDescriptionKey(agentID))
 	if err != nil {
-		return errors.New("Unable to marshal agent data info protobuf: " + err.Error())
+		return "", err
 	}
+	return string(resp), nil
+}
 
-	return a.ds.Set(getAgentDataInfoKey(agentID), string(i))
+// PinAgent pins the agent, so that it is never expired. The pin is removed when the agent is deleted.
+func (a *Datastore) PinAgent(agentID uuid.UUID) error {
+	return a.ds.Set(getPinnedAgentKey(agentID), agentID.String())
 }
 
-// GetComputedSchema returns the raw CombinedComputedSchema.
-func (a *Datastore) GetComputedSchema() (*storepb.ComputedSchema, error) {
-	cSchemas, err := a.ds.Get(computedSchemaKey)
+// IsAgentPinned returns whether the agent has been pinned.
+func (a *Datastore) IsAgentPinned(agentID uuid.UUID) (bool, error) {
+	resp, err := a.ds.Get(getPinnedAgentKey(agentID))
+	if err != nil {
+		return false, err
+	}
+	return resp != nil, nil
+}
+
+// GetPinnedAgentIDs gets the IDs of all of the pinned agents.
+func (a *Datastore) GetPinnedAgentIDs() ([]uuid.UUID, error) {
+	_, vals, err := a.ds.GetWithPrefix(pinnedAgentPrefix)
 	if err != nil {
 		return nil, err
 	}
-	if cSchemas == nil {
-		return nil, ErrNoComputedSchemas
+
+	agentIDs := make([]uuid.UUID, len(vals))
+	for i, val := range vals {
+		agentIDs[i], err = uuid.FromString(string(val))
+		if err != nil {
+			return nil, err
+		}
 	}
+	return agentIDs, nil
+}
 
-	computedSchemaPb := &storepb.ComputedSchema{}
-	err = proto.Unmarshal(cSchemas, computedSchemaPb)
+// GetAgents gets all of the current active agents.
+func (a *Datastore) GetAgents() ([]*agentpb.Agent, error) {
+	return a.GetAgentsFiltered(nil)
+}
+
+// GetAgentsFiltered gets all of the agents for which pred returns true. The predicate is applied while the
+// agents are read, so the agents which don't match are never collected. A nil predicate matches every agent.
+func (a *Datastore) GetAgentsFiltered(pred func(*agentpb.Agent) bool) ([]*agentpb.Agent, error) {
+	var agents []*agentpb.Agent
+
+	keys, vals, err := a.ds.GetWithPrefix(agentKeyPrefix)
 	if err != nil {
 		return nil, err
 	}
 
-	return computedSchemaPb, nil
-}
+	for i, key := range keys {
+		// Filter out keys that aren't of the form /agent/<uuid>.
+		splitKey := strings.Split(string(key), "/")
+		if len(splitKey) != 3 {
+			continue
+		}
 
-func deleteTableFromComputed(computedSchemaPb *storepb.ComputedSchema, tableName string) error {
-	idx := -1
-	for i, schemaPb := range computedSchemaPb.Tables {
-		if schemaPb.Name == tableName {
-			idx = i
-			break
+		pb := &agentpb.Agent{}
+		err = unmarshalAgent(vals[i], pb)
+		if err != nil {
+			return nil, err
+		}
+		if pb.Info == nil || utils.IsNilUUIDProto(pb.Info.AgentID) {
+			continue
+		}
+		if pred == nil || pred(pb) {
+			agents = append(agents, pb)
 		}
-	}
-	if idx < 0 {
-		return fmt.Errorf("schema name not found, cannot delete")
 	}
 
-	// Set the ith element equal to last element.
-	computedSchemaPb.Tables[idx] = computedSchemaPb.Tables[len(computedSchemaPb.Tables)-1]
-	// Truncate last element away.
-	computedSchemaPb.Tables = computedSchemaPb.Tables[:len(computedSchemaPb.Tables)-1]
-	delete(computedSchemaPb.TableNameToAgentIDs, tableName)
-	return nil
+	return agents, nil
 }
 
-func deleteAgentFromComputed(computedSchemaPb *storepb.ComputedSchema, tableName string, agentIDPb *uuidpb.UUID) error {
-	agents := computedSchemaPb.TableNameToAgentIDs[tableName]
-	// If the number of agents is 1, delete the schema period.
-	if len(agents.AgentID) == 1 {
-		// A check to make sure the only element is the agent to delete. ideally would be a DCHECK.
-		if !agents.AgentID[0].Equal(agentIDPb) {
-			return fmt.Errorf("Agent %v marked for deletion not found in list of agents for %s", agentIDPb, tableName)
+// GetAgentCount gets the number of agents, without unmarshalling the agent records. If the datastore supports
+// iterating over a prefix, the agent keys are counted without loading all of the records at once.
+func (a *Datastore) GetAgentCount() (int, error) {
+	count := 0
+	countKey := func(key string) {
+		// Filter out keys that aren't of the form /agent/<uuid>.
+		if len(strings.Split(key, "/")) == 3 {
+			count++
 		}
-		return deleteTableFromComputed(computedSchemaPb, tableName)
 	}
 
-	// If there are more than 1 agents then we delete the agents from the list.
-	idx := -1
-	for i, a := range agents.AgentID {
-		if a.Equal(agentIDPb) {
-			idx = i
-			break
+	if it, ok := a.ds.(datastore.PrefixIterator); ok {
+		err := it.IteratePrefix(agentKeyPrefix, func(key, _ []byte) error {
+			countKey(string(key))
+			return nil
+		})
+		if err != nil {
+			return 0, err
 		}
+		return count, nil
 	}
 
-	if idx < 0 {
-		return fmt.Errorf("Agent %v marked for deletion not found in list of agents for %s", agentIDPb, tableName)
+	keys, _, err := a.ds.GetWithPrefix(agentKeyPrefix)
+	if err != nil {
+		return 0, err
 	}
-
-	// Set the ith element equal to last element.
-	agents.AgentID[idx] = agents.AgentID[len(agents.AgentID)-1]
-	// Truncate last element away.
-	agents.AgentID = agents.AgentID[:len(agents.AgentID)-1]
-	computedSchemaPb.TableNameToAgentIDs[tableName] = agents
-	return nil
+	for _, key := range keys {
+		countKey(key)
+	}
+	return count, nil
 }
 
-// UpdateSchemas updates the given schemas in the metadata store.
-func (a *Datastore) UpdateSchemas(agentID uuid.UUID, schemas []*storepb.TableInfo) error {
-	computedSchemaPb, err := a.GetComputedSchema()
-	// If there are no computed schemas, that means we have yet to set one.
-	if err == ErrNoComputedSchemas {
-		// Reset error as this is not actually an error.
-		err = nil
+// GetAgentCountByCapability gets the number of agents which do or do not collect data. The agents which do
+// not collect data are counted through their index, so the agent records are never read.
+func (a *Datastore) GetAgentCountByCapability(collectsData bool) (int, error) {
+	keys, _, err := a.ds.GetWithPrefix(kelvinAgentPrefix)
+	if err != nil {
+		return 0, err
+	}
+	if !collectsData {
+		return len(keys), nil
 	}
 
-	// Other errors are still errors.
+	count, err := a.GetAgentCount()
 	if err != nil {
-		log.WithError(err).Error("Could not get old schema.")
-		return err
+		return 0, err
 	}
+	return count - len(keys), nil
+}
 
-	// Make sure the computedSchema is non-nil and fields are non-nil.
-	if computedSchemaPb == nil {
-		computedSchemaPb = &storepb.ComputedSchema{}
-	}
-	if computedSchemaPb.TableNameToAgentIDs == nil {
-		computedSchemaPb.TableNameToAgentIDs = make(map[string]*storepb.ComputedSchema_AgentIDs)
+// GetAgentsWithCapability gets the agents which do or do not collect data, sorted by ASID. Agents which do
+// not collect data (Kelvins) are read through their index, rather than by reading every agent.
+func (a *Datastore) GetAgentsWithCapability(collectsData bool) ([]*agentpb.Agent, error) {
+	var agents []*agentpb.Agent
+
+	if collectsData {
+		var err error
+		agents, err = a.GetAgentsFiltered(func(agt *agentpb.Agent) bool {
+			return agt.Info.Capabilities == nil || agt.Info.Capabilities.CollectsData
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		_, vals, err := a.ds.GetWithPrefix(kelvinAgentPrefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, val := range vals {
+			agentID, err := uuid.FromString(string(val))
+			if err != nil {
+				return nil, err
+			}
+			agt, err := a.GetAgent(agentID)
+			if err != nil {
+				return nil, err
+			}
+			if agt != nil {
+				agents = append(agents, agt)
+			}
+		}
 	}
 
-	// Tracker for tables that were potentially deleted in the agent. We first track all the tables
-	// agent previously had, then compare to the tables it currently has. Any entry that's false here
-	// will have the entry deleted.
-	previousAgentTableTracker := make(map[string]bool)
+	sort.Slice(agents, func(i, j int) bool {
+		return agents[i].ASID < agents[j].ASID
+	})
+	return agents, nil
+}
 
-	agentIDPb := utils.ProtoFromUUID(agentID)
+// GetAgentsByASIDRange gets the agents with an ASID in the range [lo, hi).
+func (a *Datastore) GetAgentsByASIDRange(lo uint32, hi uint32) ([]*agentpb.Agent, error) {
+	var agents []*agentpb.Agent
+	if lo >= hi {
+		return agents, nil
+	}
 
-	// Build up a table map so that we can update tables by name.
-	tableMap := make(map[string]*storepb.TableInfo)
-	for _, existingTable := range computedSchemaPb.Tables {
-		tableMap[existingTable.Name] = existingTable
+	_, vals, err := a.ds.GetWithRange(getASIDToAgentIDKey(lo), getASIDToAgentIDKey(hi))
+	if err != nil {
+		return nil, err
 	}
 
-	// Add the list of tables that the agent currently belongs to.
-	for name, agents := range computedSchemaPb.TableNameToAgentIDs {
-		for _, agt := range agents.AgentID {
-			if agt.Equal(agentIDPb) {
-				previousAgentTableTracker[name] = false
-				break
-			}
+	for _, val := range vals {
+		agentID, err := uuid.FromString(string(val))
+		if err != nil {
+			return nil, err
+		}
+		agt, err := a.GetAgent(agentID)
+		if err != nil {
+			return nil, err
+		}
+		// The index may briefly point to an agent that is being deleted.
+		if agt != nil {
+			agents = append(agents, agt)
+		}
+	}
+	return agents, nil
+}
+
+// GetAgentsByHostnamePrefix gets the agents whose hostnames start with the given prefix, grouped by hostname.
+// Only the matching range of the hostname index is read. Agents without a hostname only match an empty prefix.
+func (a *Datastore) GetAgentsByHostnamePrefix(prefix string) ([]*agentpb.Agent, error) {
+	_, vals, err := a.ds.GetWithPrefix(hostnameToAgentIDPrefix + prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, len(vals))
+	for i, val := range vals {
+		agentID, err := uuid.FromString(string(val))
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = getAgentKey(agentID)
+	}
+	resps, err := a.ds.GetAll(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	var agents []*agentpb.Agent
+	for _, resp := range resps {
+		// The index may briefly point to an agent that is being deleted.
+		if resp == nil {
+			continue
+		}
+		agt := &agentpb.Agent{}
+		err = unmarshalAgent(resp, agt)
+		if err != nil {
+			return nil, err
+		}
+		agents = append(agents, agt)
+	}
+	return agents, nil
+}
+
+// GetAgentByASID gets the agent with the given ASID. ASIDs are never reused, so nil is returned for the ASID
+// of an agent which has been deleted.
+func (a *Datastore) GetAgentByASID(asid uint32) (*agentpb.Agent, error) {
+	id, err := a.ds.Get(getASIDToAgentIDKey(asid))
+	if err != nil {
+		return nil, err
+	}
+	if id == nil {
+		return nil, nil
+	}
+
+	agentID, err := uuid.FromString(string(id))
+	if err != nil {
+		return nil, err
+	}
+	agt, err := a.GetAgent(agentID)
+	if err != nil {
+		return nil, err
+	}
+	// The index may briefly point to an agent that is being deleted.
+	if agt == nil || agt.ASID != asid {
+		return nil, nil
+	}
+	return agt, nil
+}
+
+// UpdateAgentASIDIndex points the ASID index entry for newASID at the agent, and removes the entry for oldASID
+// if it still points at the agent.
+func (a *Datastore) UpdateAgentASIDIndex(agentID uuid.UUID, oldASID uint32, newASID uint32) error {
+	err := a.ds.Set(getASIDToAgentIDKey(newASID), agentID.String())
+	if err != nil {
+		return err
+	}
+
+	id, err := a.ds.Get(getASIDToAgentIDKey(oldASID))
+	if err != nil {
+		return err
+	}
+	if string(id) != agentID.String() {
+		return nil
+	}
+	return a.ds.Delete(getASIDToAgentIDKey(oldASID))
+}
+
+// GetASID gets the next assignable ASID.
+func (a *Datastore) GetASID() (uint32, error) {
+	a.asidMu.Lock()
+	defer a.asidMu.Unlock()
+	asid := "1" // Starting ASID.
+
+	resp, err := a.ds.Get(asidKey)
+	if err != nil {
+		return 0, err
+	}
+	if resp != nil {
+		asid = string(resp)
+	}
+
+	// Convert ASID from etcd into uint32.
+	asidInt, err := strconv.ParseUint(asid, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+
+	// Increment ASID in datastore.
+	updatedAsid := asidInt + 1
+	err = a.ds.Set(asidKey, fmt.Sprint(updatedAsid))
+	if err != nil {
+		return 0, err
+	}
+
+	return uint32(asidInt), nil
+}
+
+// GetAgentIDFromPodName gets the agent ID for the agent with the given name.
+func (a *Datastore) GetAgentIDFromPodName(podName string) (string, error) {
+	if podName == "" {
+		return "", nil
+	}
+	id, err := a.ds.Get(getPodNameToAgentIDKey(podName))
+	if err != nil {
+		return "", err
+	}
+
+	if id == nil {
+		return "", nil
+	}
+
+	return string(id), nil
+}
+
+// GetAgentsDataInfo returns all of the information about data tables that each agent has.
+func (a *Datastore) GetAgentsDataInfo() (map[uuid.UUID]*messagespb.AgentDataInfo, error) {
+	dataInfos := make(map[uuid.UUID]*messagespb.AgentDataInfo)
+	err := a.IterateDataInfo(func(agentID uuid.UUID, dataInfo *messagespb.AgentDataInfo) bool {
+		dataInfos[agentID] = dataInfo
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dataInfos, nil
+}
+
+// errStopIteration is returned from the datastore iteration callback to stop IterateDataInfo early.
+var errStopIteration = errors.New("stop iteration")
+
+// IterateDataInfo calls fn with the data info of each agent, until fn returns false. If the underlying datastore
+// can iterate over a prefix, the data infos are streamed, so that they don't all need to be held in memory.
+func (a *Datastore) IterateDataInfo(fn func(uuid.UUID, *messagespb.AgentDataInfo) bool) error {
+	visit := func(key string, value []byte) error {
+		// Filter out keys that aren't of the form /agentDataInfo/<uuid>.
+		splitKey := strings.Split(key, "/")
+		if len(splitKey) != 3 {
+			return nil
+		}
+		agentID, err := uuid.FromString(splitKey[2])
+		if err != nil {
+			return err
+		}
+
+		pb := &messagespb.AgentDataInfo{}
+		err = proto.Unmarshal(value, pb)
+		if err != nil {
+			return err
+		}
+		if !fn(agentID, pb) {
+			return errStopIteration
+		}
+		return nil
+	}
+
+	var err error
+	if it, ok := a.ds.(datastore.PrefixIterator); ok {
+		err = it.IteratePrefix(agentDataInfoPrefix, func(key, value []byte) error {
+			return visit(string(key), value)
+		})
+	} else {
+		var keys []string
+		var vals [][]byte
+		keys, vals, err = a.ds.GetWithPrefix(agentDataInfoPrefix)
+		for i := 0; err == nil && i < len(keys); i++ {
+			err = visit(keys[i], vals[i])
+		}
+	}
+	if err == errStopIteration {
+		return nil
+	}
+	return err
+}
+
+// GetDataInfoForAgents gets the data info for the given agents. Agents without data info are absent from
+// the returned map.
+func (a *Datastore) GetDataInfoForAgents(ids []uuid.UUID) (map[uuid.UUID]*messagespb.AgentDataInfo, error) {
+	keys := make([]string, len(ids))
+	for i, agentID := range ids {
+		keys[i] = getAgentDataInfoKey(agentID)
+	}
+
+	vals, err := a.ds.GetAll(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	dataInfos := make(map[uuid.UUID]*messagespb.AgentDataInfo)
+	for i, val := range vals {
+		if val == nil {
+			continue
+		}
+		pb := &messagespb.AgentDataInfo{}
+		err = proto.Unmarshal(val, pb)
+		if err != nil {
+			return nil, err
+		}
+		dataInfos[ids[i]] = pb
+	}
+	return dataInfos, nil
+}
+
+// GetAgentIDsWithDataInfo gets the IDs of all agents which have data info, without reading the data info itself.
+func (a *Datastore) GetAgentIDsWithDataInfo() ([]uuid.UUID, error) {
+	keys, _, err := a.ds.GetWithPrefix(agentDataInfoPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var agentIDs []uuid.UUID
+	for _, key := range keys {
+		// Filter out keys that aren't of the form /agentDataInfo/<uuid>.
+		splitKey := strings.Split(key, "/")
+		if len(splitKey) != 3 {
+			continue
+		}
+		agentID, err := uuid.FromString(splitKey[2])
+		if err != nil {
+			return nil, err
+		}
+		agentIDs = append(agentIDs, agentID)
+	}
+	return agentIDs, nil
+}
+
+// UpdateAgentDataInfo updates the information about data tables that a particular agent has.
+func (a *Datastore) UpdateAgentDataInfo(agentID uuid.UUID, dataInfo *messagespb.AgentDataInfo) error {
+	i, err := dataInfo.Marshal()
+	if err != nil {
+		return errors.New("Unable to marshal agent data info protobuf: " + err.Error())
+	}
+
+	return a.ds.Set(getAgentDataInfoKey(agentID), string(i))
+}
+
+// GetComputedSchema returns the raw CombinedComputedSchema.
+func (a *Datastore) GetComputedSchema() (*storepb.ComputedSchema, error) {
+	cSchemas, err := a.ds.Get(computedSchemaKey)
+	if err != nil {
+		return nil, err
+	}
+	if cSchemas == nil {
+		return nil, ErrNoComputedSchemas
+	}
+
+	computedSchemaPb := &storepb.ComputedSchema{}
+	err = proto.Unmarshal(cSchemas, computedSchemaPb)
+	if err != nil {
+		return nil, err
+	}
+
+	return computedSchemaPb, nil
+}
+
+func deleteTableFromComputed(computedSchemaPb *storepb.ComputedSchema, tableName string) error {
+	idx := -1
+	for i, schemaPb := range computedSchemaPb.Tables {
+		if schemaPb.Name == tableName {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		return fmt.Errorf("schema name not found, cannot delete")
+	}
+
+	// Set the ith element equal to last element.
+	computedSchemaPb.Tables[idx] = computedSchemaPb.Tables[len(computedSchemaPb.Tables)-1]
+	// Truncate last element away.
+	computedSchemaPb.Tables = computedSchemaPb.Tables[:len(computedSchemaPb.Tables)-1]
+	delete(computedSchemaPb.TableNameToAgentIDs, tableName)
+	return nil
+}
+
+func deleteAgentFromComputed(computedSchemaPb *storepb.ComputedSchema, tableName string, agentIDPb *uuidpb.UUID) error {
+	agents := computedSchemaPb.TableNameToAgentIDs[tableName]
+	// If the number of agents is 1, delete the schema period.
+	if len(agents.AgentID) == 1 {
+		// A check to make sure the only element is the agent to delete. ideally would be a DCHECK.
+		if !agents.AgentID[0].Equal(agentIDPb) {
+			return fmt.Errorf("Agent %v marked for deletion not found in list of agents for %s", agentIDPb, tableName)
+		}
+		return deleteTableFromComputed(computedSchemaPb, tableName)
+	}
+
+	// If there are more than 1 agents then we delete the agents from the list.
+	idx := -1
+	for i, a := range agents.AgentID {
+		if a.Equal(agentIDPb) {
+			idx = i
+			break
+		}
+	}
+
+	if idx < 0 {
+		return fmt.Errorf("Agent %v marked for deletion not found in list of agents for %s", agentIDPb, tableName)
+	}
+
+	// Set the ith element equal to last element.
+	agents.AgentID[idx] = agents.AgentID[len(agents.AgentID)-1]
+	// Truncate last element away.
+	agents.AgentID = agents.AgentID[:len(agents.AgentID)-1]
+	computedSchemaPb.TableNameToAgentIDs[tableName] = agents
+	return nil
+}
+
+// UpdateSchemas updates the given schemas in the metadata store.
+func (a *Datastore) UpdateSchemas(agentID uuid.UUID, schemas []*storepb.TableInfo) error {
+	computedSchemaPb, err := a.getComputedSchemaForUpdate()
+	if err != nil {
+		return err
+	}
+	err = updateComputedSchema(computedSchemaPb, agentID, schemas)
+	if err != nil {
+		return err
+	}
+
+	computedSchema, err := computedSchemaPb.Marshal()
+	if err != nil {
+		log.WithError(err).Error("Could not marshal computed schema update message.")
+		return err
+	}
+
+	return a.ds.Set(computedSchemaKey, string(computedSchema))
+}
+
+// getComputedSchemaForUpdate returns the computed schema, or an empty one if none has been set yet.
+func (a *Datastore) getComputedSchemaForUpdate() (*storepb.ComputedSchema, error) {
+	computedSchemaPb, err := a.GetComputedSchema()
+	// If there are no computed schemas, that means we have yet to set one.
+	if err == ErrNoComputedSchemas {
+		// Reset error as this is not actually an error.
+		err = nil
+	}
+
+	// Other errors are still errors.
+	if err != nil {
+		log.WithError(err).Error("Could not get old schema.")
+		return nil, err
+	}
+
+	// Make sure the computedSchema is non-nil and fields are non-nil.
+	if computedSchemaPb == nil {
+		computedSchemaPb = &storepb.ComputedSchema{}
+	}
+	if computedSchemaPb.TableNameToAgentIDs == nil {
+		computedSchemaPb.TableNameToAgentIDs = make(map[string]*storepb.ComputedSchema_AgentIDs)
+	}
+	return computedSchemaPb, nil
+}
+
+// updateComputedSchema replaces the tables of the agent in the computed schema with the given schemas.
+func updateComputedSchema(computedSchemaPb *storepb.ComputedSchema, agentID uuid.UUID,
+	schemas []*storepb.TableInfo) error {
+	// Tracker for tables that were potentially deleted in the agent. We first track all the tables
+	// agent previously had, then compare to the tables it currently has. Any entry that's false here
+	// will have the entry deleted.
+	previousAgentTableTracker := make(map[string]bool)
+
+	agentIDPb := utils.ProtoFromUUID(agentID)
+
+	// Build up a table map so that we can update tables by name.
+	tableMap := make(map[string]*storepb.TableInfo)
+	for _, existingTable := range computedSchemaPb.Tables {
+		tableMap[existingTable.Name] = existingTable
+	}
+
+	// Add the list of tables that the agent currently belongs to.
+	for name, agents := range computedSchemaPb.TableNameToAgentIDs {
+		for _, agt := range agents.AgentID {
+			if agt.Equal(agentIDPb) {
+				previousAgentTableTracker[name] = false
+				break
+			}
 		}
 	}
 
@@ -477,159 +1580,759 @@ func (a *Datastore) UpdateSchemas(agentID uuid.UUID, schemas []*storepb.TableInf
 	for _, tableInfo := range tableMap {
 		resultTableInfos = append(resultTableInfos, tableInfo)
 	}
-	computedSchemaPb.Tables = resultTableInfos
+	computedSchemaPb.Tables = resultTableInfos
+
+	// Now find any tables that might have been deleted from an Agent.
+	// This will also delete tables entirely when there are no more agents after the last agent is deleted.
+	for tableName, agentHasTable := range previousAgentTableTracker {
+		if agentHasTable {
+			continue
+		}
+		err := deleteAgentFromComputed(computedSchemaPb, tableName, agentIDPb)
+		if err != nil {
+			log.WithError(err).Errorf("Could not delete table to agent mapping %s -> %v", tableName, agentID)
+			return err
+		}
+	}
+	return nil
+}
+
+// PruneComputedSchema cleans any dead agents from the computed schema. This is a temporary fix, to address a larger
+// consistency and race-condition problem that will be addressed by the upcoming extensive refactor of the metadata service.
+func (a *Datastore) PruneComputedSchema() error {
+	// Fetch all existing agents.
+	agents, err := a.GetAgents()
+	if err != nil {
+		return err
+	}
+	// Make a map from the agent IDs.
+	existingAgents := make(map[uuid.UUID]bool)
+	for _, agt := range agents {
+		existingAgents[utils.UUIDFromProtoOrNil(agt.Info.AgentID)] = true
+	}
+
+	// Fetch current computed schema.
+	computedSchemaPb, err := a.GetComputedSchema()
+	// If there are no computed schemas, that means we don't have to do anything.
+	if err == ErrNoComputedSchemas || computedSchemaPb == nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if computedSchemaPb.TableNameToAgentIDs == nil {
+		computedSchemaPb.TableNameToAgentIDs = make(map[string]*storepb.ComputedSchema_AgentIDs)
+	}
+
+	var tableInfos []*storepb.TableInfo
+	tableToAgents := make(map[string]*storepb.ComputedSchema_AgentIDs)
+
+	existingTables := make(map[string]bool)
+
+	// Filter out any dead agents from the table -> agent mapping.
+	for tableName, agentIDs := range computedSchemaPb.TableNameToAgentIDs {
+		prunedIDs := []*uuidpb.UUID{}
+		for i, agentID := range agentIDs.AgentID {
+			if existingAgents[utils.UUIDFromProtoOrNil(agentID)] {
+				prunedIDs = append(prunedIDs, agentIDs.AgentID[i])
+			}
+		}
+		if len(prunedIDs) > 0 {
+			tableToAgents[tableName] = &storepb.ComputedSchema_AgentIDs{
+				AgentID: prunedIDs,
+			}
+			existingTables[tableName] = true
+		}
+	}
+
+	// Filter out any tables that should now be deleted.
+	for i, table := range computedSchemaPb.Tables {
+		if existingTables[table.Name] {
+			tableInfos = append(tableInfos, computedSchemaPb.Tables[i])
+		}
+	}
+
+	// Write pruned schema to the datastore.
+	newComputedSchemaPb := &storepb.ComputedSchema{
+		Tables:              tableInfos,
+		TableNameToAgentIDs: tableToAgents,
+	}
+	computedSchema, err := newComputedSchemaPb.Marshal()
+	if err != nil {
+		log.WithError(err).Error("Could not marshal computed schema update message.")
+		return err
+	}
+
+	return a.ds.Set(computedSchemaKey, string(computedSchema))
+}
+
+// GetProcesses gets the process infos for the given process upids.
+func (a *Datastore) GetProcesses(upids []*types.UInt128) ([]*metadatapb.ProcessInfo, error) {
+	return a.GetProcessesWithContext(context.Background(), upids)
+}
+
+// GetProcessesWithContext gets the process infos for the given process upids. If the context is done before
+// all of the processes are read, the processes read so far are returned along with the context's error.
+// The processes which were not reached are nil. A upid which is repeated in upids is only read once, but
+// each of its entries gets its own copy of the process info.
+func (a *Datastore) GetProcessesWithContext(ctx context.Context, upids []*types.UInt128) ([]*metadatapb.ProcessInfo, error) {
+	processes := make([]*metadatapb.ProcessInfo, len(upids))
+	// Index of the first occurrence of each upid.
+	readIdx := make(map[types.UInt128]int)
+
+	for i, upid := range upids {
+		if err := ctx.Err(); err != nil {
+			return processes, err
+		}
+		if idx, ok := readIdx[*upid]; ok {
+			if processes[idx] != nil {
+				processes[i] = proto.Clone(processes[idx]).(*metadatapb.ProcessInfo)
+			}
+			continue
+		}
+		readIdx[*upid] = i
+
+		process, err := a.ds.Get(getProcessKey(upid))
+		if err != nil {
+			return nil, err
+		}
+		if process == nil {
+			processes[i] = nil
+		} else {
+			processPb := metadatapb.ProcessInfo{}
+			if err := proto.Unmarshal(process, &processPb); err != nil {
+				log.WithError(err).Error("Could not unmarshal process pb.")
+				processes[i] = nil
+				continue
+			}
+			processes[i] = &processPb
+		}
+	}
+	return processes, nil
+}
+
+// GetProcessesActiveAt gets the process infos for the given process upids, as GetProcesses does, but only for
+// the processes which were running at the given time. The entry for any process which had not started or had
+// already stopped at that time is nil.
+func (a *Datastore) GetProcessesActiveAt(ts int64, upids []*types.UInt128) ([]*metadatapb.ProcessInfo, error) {
+	processes, err := a.GetProcesses(upids)
+	if err != nil {
+		return nil, err
+	}
+	for i, p := range processes {
+		if p == nil {
+			continue
+		}
+		if p.StartTimestampNS > ts || (p.StopTimestampNS != 0 && p.StopTimestampNS <= ts) {
+			processes[i] = nil
+		}
+	}
+	return processes, nil
+}
+
+// ListProcesses lists up to limit processes in UPID order, starting after the given cursor. A nil cursor starts
+// from the first process, and a limit of 0 lists all of the remaining processes. The returned cursor is passed
+// to the next call to continue the listing, and is empty once there are no more processes. Since the cursor is
+// the last UPID that was returned rather than an offset, processes which are created or deleted between calls
+// do not cause other processes to be skipped or repeated.
+func (a *Datastore) ListProcesses(cursor []byte, limit int) ([]*metadatapb.ProcessInfo, []byte, error) {
+	from := processKeyPrefix
+	if len(cursor) > 0 {
+		if _, err := DecodeUPIDKey(string(cursor)); err != nil {
+			return nil, nil, fmt.Errorf("invalid process cursor: %w", err)
+		}
+		// Start from the smallest key after the cursor.
+		from = processKeyPrefix + string(cursor) + "\x00"
+	}
+	// '0' is the character after '/', so this is the first key after all of the process keys.
+	to := strings.TrimSuffix(processKeyPrefix, "/") + "0"
+
+	var keys []string
+	var vals [][]byte
+	var err error
+	if it, ok := a.ds.(datastore.RangeIterator); ok && limit > 0 {
+		// Only read one key more than the limit, which is enough to tell whether there are more processes.
+		err = it.IterateRange(from, to, func(key, value []byte) error {
+			keys = append(keys, string(key))
+			vals = append(vals, append([]byte(nil), value...))
+			if len(keys) > limit {
+				return errStopIteration
+			}
+			return nil
+		})
+		if err == errStopIteration {
+			err = nil
+		}
+	} else {
+		keys, vals, err = a.ds.GetWithRange(from, to)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var nextCursor []byte
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+		vals = vals[:limit]
+		nextCursor = []byte(strings.TrimPrefix(keys[limit-1], processKeyPrefix))
+	}
+
+	processes := make([]*metadatapb.ProcessInfo, 0, len(vals))
+	for _, val := range vals {
+		processPb := &metadatapb.ProcessInfo{}
+		if err := proto.Unmarshal(val, processPb); err != nil {
+			log.WithError(err).Error("Could not unmarshal process pb.")
+			continue
+		}
+		processes = append(processes, processPb)
+	}
+	return processes, nextCursor, nil
+}
+
+// UpdateProcesses updates the given processes in the metadata store.
+func (a *Datastore) UpdateProcesses(processes []*metadatapb.ProcessInfo) error {
+	keys, values, ttls, err := a.getProcessKeyValues(processes)
+	if err != nil {
+		return err
+	}
+	return a.setAllWithTTL(keys, values, ttls)
+}
+
+// getProcessKeyValues returns the keys, values and TTLs to write for the given processes. The terminated
+// processes are written with a TTL, along with their custom labels and parent links, so that they are purged
+// together.
+func (a *Datastore) getProcessKeyValues(processes []*metadatapb.ProcessInfo) ([]string, []string, []time.Duration, error) {
+	var keys []string
+	var values []string
+	var ttls []time.Duration
+	for _, processPb := range processes {
+		process, err := processPb.Marshal()
+		if err != nil {
+			log.WithError(err).Error("Could not marshall processInfo.")
+			continue
+		}
+		upid := types.UInt128FromProto(processPb.UPID)
+		keys = append(keys, getProcessKey(upid))
+		values = append(values, string(process))
+		if processPb.StopTimestampNS == 0 {
+			ttls = append(ttls, 0)
+			continue
+		}
+		ttls = append(ttls, a.expiryDuration)
+
+		// Expire the custom labels and parent link along with the terminated process.
+		for _, key := range []string{getProcessLabelsKey(upid), getProcessParentKey(upid)} {
+			value, err := a.ds.Get(key)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			if value == nil {
+				continue
+			}
+			keys = append(keys, key)
+			values = append(values, string(value))
+			ttls = append(ttls, a.expiryDuration)
+		}
+	}
+	return keys, values, ttls, nil
+}
+
+// UpdateAgentStates writes the processes, and the data info and schema of each of the agent states, in a single
+// write. The states are applied in order, so a later state for an agent replaces an earlier one. If the underlying
+// datastore can set keys with TTLs atomically, then either everything is written, or nothing is.
+func (a *Datastore) UpdateAgentStates(processes []*metadatapb.ProcessInfo, states []*AgentState) error {
+	keys, values, ttls, err := a.getProcessKeyValues(processes)
+	if err != nil {
+		return err
+	}
+
+	var computedSchemaPb *storepb.ComputedSchema
+	for _, state := range states {
+		if state.DataInfo != nil {
+			i, err := state.DataInfo.Marshal()
+			if err != nil {
+				return errors.New("Unable to marshal agent data info protobuf: " + err.Error())
+			}
+			keys = append(keys, getAgentDataInfoKey(state.AgentID))
+			values = append(values, string(i))
+			ttls = append(ttls, 0)
+		}
+		if !state.UpdateSchema {
+			continue
+		}
+		if computedSchemaPb == nil {
+			computedSchemaPb, err = a.getComputedSchemaForUpdate()
+			if err != nil {
+				return err
+			}
+		}
+		err = updateComputedSchema(computedSchemaPb, state.AgentID, state.Schema)
+		if err != nil {
+			return err
+		}
+	}
+	if computedSchemaPb != nil {
+		computedSchema, err := computedSchemaPb.Marshal()
+		if err != nil {
+			log.WithError(err).Error("Could not marshal computed schema update message.")
+			return err
+		}
+		keys = append(keys, computedSchemaKey)
+		values = append(values, string(computedSchema))
+		ttls = append(ttls, 0)
+	}
+
+	return a.setAllWithTTL(keys, values, ttls)
+}
+
+// setAllWithTTL sets the keys, each with its own TTL, where a TTL of 0 means that the key does not expire. The
+// keys are set in a single batch if the underlying datastore supports it. Otherwise, the keys without a TTL are
+// set together, and the keys with a TTL are set one by one.
+func (a *Datastore) setAllWithTTL(keys []string, values []string, ttls []time.Duration) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	if batcher, ok := a.ds.(datastore.Batcher); ok {
+		b := batcher.NewBatch()
+		for i, key := range keys {
+			b.SetWithTTL(key, values[i], ttls[i])
+		}
+		return b.Commit()
+	}
 
-	// Now find any tables that might have been deleted from an Agent.
-	// This will also delete tables entirely when there are no more agents after the last agent is deleted.
-	for tableName, agentHasTable := range previousAgentTableTracker {
-		if agentHasTable {
+	var plainKeys []string
+	var plainValues []string
+	for i, key := range keys {
+		if ttls[i] == 0 {
+			plainKeys = append(plainKeys, key)
+			plainValues = append(plainValues, values[i])
 			continue
 		}
-		err := deleteAgentFromComputed(computedSchemaPb, tableName, agentIDPb)
+		err := a.ds.SetWithTTL(key, values[i], ttls[i])
 		if err != nil {
-			log.WithError(err).Errorf("Could not delete table to agent mapping %s -> %v", tableName, agentID)
 			return err
 		}
 	}
+	if len(plainKeys) == 0 {
+		return nil
+	}
+	return a.ds.SetAll(plainKeys, plainValues)
+}
 
-	computedSchema, err := computedSchemaPb.Marshal()
+// GetAgentIDForHostnamePair gets the agent for the given hostnamePair, if it exists.
+func (a *Datastore) GetAgentIDForHostnamePair(hnPair *HostnameIPPair) (string, error) {
+	id, err := a.ds.Get(getHostnamePairAgentKey(hnPair))
 	if err != nil {
-		log.WithError(err).Error("Could not marshal computed schema update message.")
-		return err
+		return "", err
+	}
+	if id == nil {
+		return "", nil
 	}
 
-	return a.ds.Set(computedSchemaKey, string(computedSchema))
+	return string(id), err
 }
 
-// PruneComputedSchema cleans any dead agents from the computed schema. This is a temporary fix, to address a larger
-// consistency and race-condition problem that will be addressed by the upcoming extensive refactor of the metadata service.
-func (a *Datastore) PruneComputedSchema() error {
-	// Fetch all existing agents.
-	agents, err := a.GetAgents()
+// GetAgentIDsForHostnamePairs gets the agent IDs for the given hostnamePairs, in the same order as the pairs.
+// The ID is empty for any pair that does not map to an agent. All of the pairs are read in a single pass.
+func (a *Datastore) GetAgentIDsForHostnamePairs(hnPairs []*HostnameIPPair) ([]string, error) {
+	keys := make([]string, len(hnPairs))
+	for i, hnPair := range hnPairs {
+		keys[i] = getHostnamePairAgentKey(hnPair)
+	}
+
+	vals, err := a.ds.GetAll(keys)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	// Make a map from the agent IDs.
-	existingAgents := make(map[uuid.UUID]bool)
-	for _, agt := range agents {
-		existingAgents[utils.UUIDFromProtoOrNil(agt.Info.AgentID)] = true
+
+	ids := make([]string, len(vals))
+	for i, val := range vals {
+		ids[i] = string(val)
 	}
+	return ids, nil
+}
 
-	// Fetch current computed schema.
-	computedSchemaPb, err := a.GetComputedSchema()
-	// If there are no computed schemas, that means we don't have to do anything.
-	if err == ErrNoComputedSchemas || computedSchemaPb == nil {
-		return nil
+// GetAgentForHostnamePair gets the agent for the given hostnamePair. Returns nil if the pair does not map to
+// an agent.
+func (a *Datastore) GetAgentForHostnamePair(hnPair *HostnameIPPair) (*agentpb.Agent, error) {
+	id, err := a.GetAgentIDForHostnamePair(hnPair)
+	if err != nil {
+		return nil, err
+	}
+	if id == "" {
+		return nil, nil
 	}
+
+	agentID, err := uuid.FromString(id)
+	if err != nil {
+		return nil, err
+	}
+	return a.GetAgent(agentID)
+}
+
+// SetProcessLabels sets the custom labels for the process with the given upid, replacing any existing labels.
+// If the process has terminated, the labels expire along with it.
+func (a *Datastore) SetProcessLabels(upid *types.UInt128, labels map[string]string) error {
+	l, err := json.Marshal(labels)
 	if err != nil {
 		return err
 	}
+	return a.setWithProcessTTL(upid, getProcessLabelsKey(upid), string(l))
+}
 
-	if computedSchemaPb.TableNameToAgentIDs == nil {
-		computedSchemaPb.TableNameToAgentIDs = make(map[string]*storepb.ComputedSchema_AgentIDs)
+// setWithProcessTTL sets a key which belongs to the process with the given upid. If the process has terminated,
+// the key is set with the TTL that the process has left, so that it expires along with the process.
+func (a *Datastore) setWithProcessTTL(upid *types.UInt128, key string, value string) error {
+	process, err := a.ds.Get(getProcessKey(upid))
+	if err != nil {
+		return err
+	}
+	if process == nil {
+		return a.ds.Set(key, value)
+	}
+	processPb := &metadatapb.ProcessInfo{}
+	err = proto.Unmarshal(process, processPb)
+	if err != nil {
+		return err
+	}
+	if processPb.StopTimestampNS == 0 {
+		return a.ds.Set(key, value)
 	}
 
-	var tableInfos []*storepb.TableInfo
-	tableToAgents := make(map[string]*storepb.ComputedSchema_AgentIDs)
+	ttl := a.expiryDuration
+	if g, ok := a.ds.(datastore.TTLGetter); ok {
+		remaining, hasTTL, err := g.GetTTL(getProcessKey(upid))
+		if err != nil {
+			return err
+		}
+		if hasTTL {
+			ttl = remaining
+		}
+	}
+	// The process is about to be deleted, so the key should be deleted with it.
+	if ttl <= 0 {
+		ttl = time.Nanosecond
+	}
+	return a.ds.SetWithTTL(key, value, ttl)
+}
 
-	existingTables := make(map[string]bool)
+// GetProcessLabels gets the custom labels for the process with the given upid. Returns nil if the process
+// has no labels.
+func (a *Datastore) GetProcessLabels(upid *types.UInt128) (map[string]string, error) {
+	resp, err := a.ds.Get(getProcessLabelsKey(upid))
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil {
+		return nil, nil
+	}
+	labels := make(map[string]string)
+	err = json.Unmarshal(resp, &labels)
+	if err != nil {
+		return nil, err
+	}
+	return labels, nil
+}
 
-	// Filter out any dead agents from the table -> agent mapping.
-	for tableName, agentIDs := range computedSchemaPb.TableNameToAgentIDs {
-		prunedIDs := []*uuidpb.UUID{}
-		for i, agentID := range agentIDs.AgentID {
-			if existingAgents[utils.UUIDFromProtoOrNil(agentID)] {
-				prunedIDs = append(prunedIDs, agentIDs.AgentID[i])
-			}
+// SetProcessParent sets the parent of the process with the given upid. The parent must belong to the same
+// agent as the process. Agents don't report the parents of their processes yet, since ProcessCreated has no
+// parent UPID, so nothing calls this when applying agent updates. Until they do, processes have no recorded
+// ancestors unless their parents are set through this method.
+func (a *Datastore) SetProcessParent(upid *types.UInt128, parent *types.UInt128) error {
+	if k8s.ASIDFromUPID(upid) != k8s.ASIDFromUPID(parent) {
+		return errors.New("Parent process belongs to a different agent")
+	}
+	return a.setWithProcessTTL(upid, getProcessParentKey(upid), EncodeUPIDKey(parent))
+}
+
+// GetProcessAncestors gets the ancestors of the process with the given upid, starting with its parent and
+// walking up to maxDepth parent links. The walk stops at the root process, or at a parent which is not in the
+// store.
+func (a *Datastore) GetProcessAncestors(upid *types.UInt128, maxDepth int) ([]*metadatapb.ProcessInfo, error) {
+	var ancestors []*metadatapb.ProcessInfo
+	// Guard against a cycle in the parent links.
+	visited := map[types.UInt128]bool{*upid: true}
+
+	cur := upid
+	for len(ancestors) < maxDepth {
+		resp, err := a.ds.Get(getProcessParentKey(cur))
+		if err != nil {
+			return nil, err
 		}
-		if len(prunedIDs) > 0 {
-			tableToAgents[tableName] = &storepb.ComputedSchema_AgentIDs{
-				AgentID: prunedIDs,
-			}
-			existingTables[tableName] = true
+		if resp == nil {
+			break
 		}
-	}
+		parent, err := DecodeUPIDKey(string(resp))
+		if err != nil {
+			return nil, err
+		}
+		if visited[*parent] {
+			break
+		}
+		visited[*parent] = true
 
-	// Filter out any tables that should now be deleted.
-	for i, table := range computedSchemaPb.Tables {
-		if existingTables[table.Name] {
-			tableInfos = append(tableInfos, computedSchemaPb.Tables[i])
+		processes, err := a.GetProcesses([]*types.UInt128{parent})
+		if err != nil {
+			return nil, err
+		}
+		if processes[0] == nil {
+			break
 		}
+		ancestors = append(ancestors, processes[0])
+		cur = parent
 	}
+	return ancestors, nil
+}
 
-	// Write pruned schema to the datastore.
-	newComputedSchemaPb := &storepb.ComputedSchema{
-		Tables:              tableInfos,
-		TableNameToAgentIDs: tableToAgents,
+// CompactAgentProcesses compacts the process keys of the agent with the given ID, to reclaim the space used by
+// its terminated processes. It does nothing if the underlying datastore does not support compaction.
+func (a *Datastore) CompactAgentProcesses(agentID uuid.UUID) error {
+	c, ok := a.ds.(datastore.Compacter)
+	if !ok {
+		return nil
 	}
-	computedSchema, err := newComputedSchemaPb.Marshal()
+
+	agt, err := a.GetAgent(agentID)
 	if err != nil {
-		log.WithError(err).Error("Could not marshal computed schema update message.")
 		return err
 	}
+	if agt == nil {
+		return errors.New("Agent does not exist")
+	}
 
-	return a.ds.Set(computedSchemaKey, string(computedSchema))
+	// The ASID prefixes end in ':', so the prefixes ending in the next character bound the agent's keys.
+	for _, prefix := range []string{getASIDProcessPrefix(agt.ASID), getASIDProcessLabelsPrefix(agt.ASID)} {
+		err = c.Compact(prefix, strings.TrimSuffix(prefix, ":")+";")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// GetProcesses gets the process infos for the given process upids.
-func (a *Datastore) GetProcesses(upids []*types.UInt128) ([]*metadatapb.ProcessInfo, error) {
-	processes := make([]*metadatapb.ProcessInfo, len(upids))
+// newReader returns a reader of a single consistent view of the datastore, if the datastore supports snapshots.
+// Otherwise, the datastore itself is returned, and each read sees the latest writes. The returned func must be
+// called once the reader is no longer used.
+func (a *Datastore) newReader() (datastore.MultiGetter, func()) {
+	s, ok := a.ds.(datastore.Snapshotter)
+	if !ok {
+		return a.ds, func() {}
+	}
+	snapshot := s.NewSnapshot()
+	return snapshot, func() {
+		err := snapshot.Close()
+		if err != nil {
+			log.WithError(err).Error("Failed to close datastore snapshot")
+		}
+	}
+}
 
-	for i, upid := range upids {
-		process, err := a.ds.Get(getProcessKey(k8s.StringFromUPID(upid)))
+// GetFullAgentRecord gets all of the data stored for the agent with the given ID. Returns nil if the agent
+// does not exist. The record is read from a single snapshot of the datastore if the datastore supports it, so
+// that it is consistent.
+func (a *Datastore) GetFullAgentRecord(agentID uuid.UUID) (*FullRecord, error) {
+	reader, closeReader := a.newReader()
+	defer closeReader()
+
+	vals, err := reader.GetAll([]string{
+		getAgentKey(agentID),
+		getAgentDescriptionKey(agentID),
+		getAgentRegisterTimeKey(agentID),
+		getAgentDataInfoKey(agentID),
+		computedSchemaKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+	agentVal, descriptionVal, registerTimeVal := vals[0], vals[1], vals[2]
+	dataInfoVal, computedSchemaVal := vals[3], vals[4]
+	if agentVal == nil {
+		return nil, nil
+	}
+
+	agt := &agentpb.Agent{}
+	err = unmarshalAgent(agentVal, agt)
+	if err != nil {
+		return nil, err
+	}
+	record := &FullRecord{
+		Agent:         agt,
+		Description:   string(descriptionVal),
+		Config:        make(map[string]string),
+		ProcessLabels: make(map[string]map[string]string),
+	}
+
+	if registerTimeVal != nil {
+		record.LastRegisterTimeNS, err = strconv.ParseInt(string(registerTimeVal), 10, 64)
 		if err != nil {
 			return nil, err
 		}
-		if process == nil {
-			processes[i] = nil
-		} else {
-			processPb := metadatapb.ProcessInfo{}
-			if err := proto.Unmarshal(process, &processPb); err != nil {
-				log.WithError(err).Error("Could not unmarshal process pb.")
-				processes[i] = nil
+	}
+
+	if dataInfoVal != nil {
+		record.DataInfo = &messagespb.AgentDataInfo{}
+		err = proto.Unmarshal(dataInfoVal, record.DataInfo)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if computedSchemaVal != nil {
+		computedSchemaPb := &storepb.ComputedSchema{}
+		err = proto.Unmarshal(computedSchemaVal, computedSchemaPb)
+		if err != nil {
+			return nil, err
+		}
+		for _, table := range computedSchemaPb.Tables {
+			agents, ok := computedSchemaPb.TableNameToAgentIDs[table.Name]
+			if !ok {
 				continue
 			}
-			processes[i] = &processPb
+			for _, id := range agents.AgentID {
+				if id.Equal(agt.Info.AgentID) {
+					record.Tables = append(record.Tables, table)
+					break
+				}
+			}
 		}
 	}
-	return processes, nil
+
+	configPrefix := getAgentConfigPrefix(agentID)
+	keys, vals, err := reader.GetWithPrefix(configPrefix)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		record.Config[strings.TrimPrefix(key, configPrefix)] = string(vals[i])
+	}
+
+	_, vals, err = reader.GetWithPrefix(getASIDProcessPrefix(agt.ASID))
+	if err != nil {
+		return nil, err
+	}
+	for _, val := range vals {
+		processPb := &metadatapb.ProcessInfo{}
+		err = proto.Unmarshal(val, processPb)
+		if err != nil {
+			return nil, err
+		}
+		record.Processes = append(record.Processes, processPb)
+	}
+
+	keys, vals, err = reader.GetWithPrefix(getASIDProcessLabelsPrefix(agt.ASID))
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		upid, err := DecodeUPIDKey(path.Base(key))
+		if err != nil {
+			return nil, err
+		}
+		labels := make(map[string]string)
+		err = json.Unmarshal(vals[i], &labels)
+		if err != nil {
+			return nil, err
+		}
+		record.ProcessLabels[k8s.StringFromUPID(upid)] = labels
+	}
+
+	return record, nil
 }
 
-// UpdateProcesses updates the given processes in the metadata store.
-func (a *Datastore) UpdateProcesses(processes []*metadatapb.ProcessInfo) error {
-	for _, processPb := range processes {
-		process, err := processPb.Marshal()
+// SaveAgentUpdateCursor saves the state of the agent update cursor, replacing any pending updates that were
+// previously saved for it. The updates are saved with the sequence numbers 0 to len(state.Updates)-1.
+func (a *Datastore) SaveAgentUpdateCursor(state *CursorState) error {
+	st, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	keys := []string{getAgentUpdateCursorStateKey(state.ID)}
+	values := []string{string(st)}
+	for i, update := range state.Updates {
+		u, err := update.Marshal()
 		if err != nil {
-			log.WithError(err).Error("Could not marshall processInfo.")
-			continue
+			return err
 		}
-		upid := types.UInt128FromProto(processPb.UPID)
-		processKey := getProcessKey(k8s.StringFromUPID(upid))
+		keys = append(keys, getAgentUpdateCursorUpdateKey(state.ID, uint64(i)))
+		values = append(values, string(u))
+	}
 
-		if processPb.StopTimestampNS > 0 {
-			err = a.ds.SetWithTTL(processKey, string(process), a.expiryDuration)
-			if err != nil {
-				return err
-			}
-		} else {
-			err = a.ds.Set(processKey, string(process))
-			if err != nil {
-				return err
-			}
+	// Replace the saved updates in a single batch, so that a failed write doesn't lose them.
+	if batcher, ok := a.ds.(datastore.Batcher); ok {
+		b := batcher.NewBatch()
+		b.DeleteWithPrefix(getAgentUpdateCursorUpdatesPrefix(state.ID))
+		for i, key := range keys {
+			b.Set(key, values[i])
 		}
+		return b.Commit()
 	}
-	return nil
+
+	err = a.ds.DeleteWithPrefix(getAgentUpdateCursorUpdatesPrefix(state.ID))
+	if err != nil {
+		return err
+	}
+	return a.ds.SetAll(keys, values)
 }
 
-// GetAgentIDForHostnamePair gets the agent for the given hostnamePair, if it exists.
-func (a *Datastore) GetAgentIDForHostnamePair(hnPair *HostnameIPPair) (string, error) {
-	id, err := a.ds.Get(getHostnamePairAgentKey(hnPair))
+// AppendAgentUpdateCursorUpdate saves a pending update for the agent update cursor, with the given sequence number.
+func (a *Datastore) AppendAgentUpdateCursorUpdate(cursorID uuid.UUID, seq uint64, update *metadata_servicepb.AgentUpdate) error {
+	u, err := update.Marshal()
 	if err != nil {
-		return "", err
+		return err
 	}
-	if id == nil {
-		return "", nil
+	return a.ds.Set(getAgentUpdateCursorUpdateKey(cursorID, seq), string(u))
+}
+
+// GetAgentUpdateCursors gets the state of all of the saved agent update cursors.
+func (a *Datastore) GetAgentUpdateCursors() ([]*CursorState, error) {
+	keys, vals, err := a.ds.GetWithPrefix(agentUpdateCursorPrefix)
+	if err != nil {
+		return nil, err
 	}
 
-	return string(id), err
+	var cursors []*CursorState
+	cursorsByID := make(map[uuid.UUID]*CursorState)
+	for i, key := range keys {
+		// Keys are of the form /agentUpdateCursor/<uuid>/state or /agentUpdateCursor/<uuid>/updates/<seq>.
+		// The state key sorts before the updates of the same cursor.
+		splitKey := strings.Split(key, "/")
+		if len(splitKey) < 4 {
+			continue
+		}
+		cursorID, err := uuid.FromString(splitKey[2])
+		if err != nil {
+			return nil, err
+		}
+
+		if splitKey[3] == "state" {
+			state := &CursorState{}
+			err = json.Unmarshal(vals[i], state)
+			if err != nil {
+				return nil, err
+			}
+			state.ID = cursorID
+			cursorsByID[cursorID] = state
+			cursors = append(cursors, state)
+			continue
+		}
+
+		state, ok := cursorsByID[cursorID]
+		if !ok {
+			continue
+		}
+		update := &metadata_servicepb.AgentUpdate{}
+		err = proto.Unmarshal(vals[i], update)
+		if err != nil {
+			return nil, err
+		}
+		state.Updates = append(state.Updates, update)
+	}
+	return cursors, nil
+}
+
+// DeleteAgentUpdateCursor deletes the saved state of the agent update cursor.
+func (a *Datastore) DeleteAgentUpdateCursor(cursorID uuid.UUID) error {
+	return a.ds.DeleteWithPrefix(path.Join(agentUpdateCursorPrefix, cursorID.String()) + "/")
 }
@@ -0,0 +1,1124 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package agent_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/gofrs/uuid"
+	"github.com/gogo/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"px.dev/pixie/src/api/proto/uuidpb"
+	"px.dev/pixie/src/carnot/planner/distributedpb"
+	k8s_metadatapb "px.dev/pixie/src/shared/k8s/metadatapb"
+	"px.dev/pixie/src/shared/metadatapb"
+	types "px.dev/pixie/src/shared/types/gotypes"
+	"px.dev/pixie/src/utils"
+	"px.dev/pixie/src/vizier/messages/messagespb"
+	"px.dev/pixie/src/vizier/services/metadata/controllers/agent"
+	"px.dev/pixie/src/vizier/services/metadata/controllers/testutils"
+	"px.dev/pixie/src/vizier/services/metadata/storepb"
+	"px.dev/pixie/src/vizier/services/shared/agentpb"
+	"px.dev/pixie/src/vizier/utils/datastore/pebbledb"
+	"px.dev/pixie/src/vizier/utils/datastore/pebbledb/pebbledbtest"
+)
+
+func setupDatastore(t *testing.T, expiryDuration time.Duration) (*agent.Datastore, func()) {
+	memFS := vfs.NewMem()
+	c, err := pebble.Open("test", &pebble.Options{
+		FS: memFS,
+	})
+	if err != nil {
+		t.Fatal("failed to initialize a pebbledb")
+	}
+
+	db := pebbledb.New(c, 100*time.Millisecond)
+	ads := agent.NewDatastore(db, expiryDuration)
+
+	return ads, func() {
+		db.Close()
+	}
+}
+
+func TestDatastore_DeleteAgentsIOFailure(t *testing.T) {
+	agentID := uuid.FromStringOrNil(testutils.ExistingAgentUUID)
+
+	// The write fails at each point in turn. The agent should either be deleted along with its config and
+	// schema, or not at all.
+	for syncs := 0; syncs < 3; syncs++ {
+		fs := pebbledbtest.NewCrashFS()
+		c, err := fs.Open("test")
+		require.NoError(t, err)
+		ads := agent.NewDatastore(pebbledb.New(c, 3*time.Second), 1*time.Minute)
+		createAgentInADS(t, testutils.ExistingAgentUUID, ads, testutils.ExistingAgentInfo)
+		require.NoError(t, ads.UpdateSchemas(agentID, []*storepb.TableInfo{{Name: "table1"}}))
+		require.NoError(t, ads.SetAgentConfig(agentID, "gprof", "true"))
+
+		// Pebble treats a failed write as fatal, so the delete panics if its write fails.
+		fs.FailWritesAfter(syncs)
+		failed := false
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					assert.Equal(t, pebbledbtest.ErrFatal, r)
+					failed = true
+				}
+			}()
+			require.NoError(t, ads.DeleteAgents([]uuid.UUID{agentID}))
+		}()
+		if syncs == 0 {
+			assert.True(t, failed)
+		}
+
+		// Restart from what was written to disk.
+		fs.Crash()
+		c, err = fs.Open("test")
+		require.NoError(t, err)
+		db := pebbledb.New(c, 3*time.Second)
+		ads = agent.NewDatastore(db, 1*time.Minute)
+
+		agt, err := ads.GetAgent(agentID)
+		require.NoError(t, err)
+		config, err := ads.GetAgentConfig(agentID)
+		require.NoError(t, err)
+		schema, err := ads.GetComputedSchema()
+		require.NoError(t, err)
+
+		if failed {
+			assert.NotNil(t, agt)
+			assert.Equal(t, map[string]string{"gprof": "true"}, config)
+			assert.Contains(t, schema.TableNameToAgentIDs, "table1")
+		} else {
+			assert.Nil(t, agt)
+			assert.Empty(t, config)
+			assert.NotContains(t, schema.TableNameToAgentIDs, "table1")
+		}
+		require.NoError(t, db.Close())
+	}
+}
+
+func TestDatastore_ProcessLabels(t *testing.T) {
+	ads, cleanup := setupDatastore(t, 1*time.Second)
+	defer cleanup()
+
+	pi := new(k8s_metadatapb.ProcessInfo)
+	if err := proto.UnmarshalText(testutils.ProcessInfo1PB, pi); err != nil {
+		t.Fatal("Cannot Unmarshal protobuf.")
+	}
+	err := ads.UpdateProcesses([]*k8s_metadatapb.ProcessInfo{pi})
+	require.NoError(t, err)
+
+	upid := types.UInt128FromProto(pi.UPID)
+	labels, err := ads.GetProcessLabels(upid)
+	require.NoError(t, err)
+	assert.Nil(t, labels)
+
+	err = ads.SetProcessLabels(upid, map[string]string{"service": "checkout"})
+	require.NoError(t, err)
+
+	labels, err = ads.GetProcessLabels(upid)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"service": "checkout"}, labels)
+
+	// Terminate the process. The labels should be purged along with it.
+	pi.StopTimestampNS = 10
+	err = ads.UpdateProcesses([]*k8s_metadatapb.ProcessInfo{pi})
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		labels, err := ads.GetProcessLabels(upid)
+		return err == nil && labels == nil
+	}, 5*time.Second, 100*time.Millisecond)
+
+	pInfos, err := ads.GetProcesses([]*types.UInt128{upid})
+	require.NoError(t, err)
+	assert.Nil(t, pInfos[0])
+}
+
+func TestDatastore_ProcessLabelsAfterTermination(t *testing.T) {
+	ads, cleanup := setupDatastore(t, 1*time.Second)
+	defer cleanup()
+
+	pi := new(k8s_metadatapb.ProcessInfo)
+	if err := proto.UnmarshalText(testutils.ProcessInfo1PB, pi); err != nil {
+		t.Fatal("Cannot Unmarshal protobuf.")
+	}
+	pi.StopTimestampNS = 10
+	err := ads.UpdateProcesses([]*k8s_metadatapb.ProcessInfo{pi})
+	require.NoError(t, err)
+
+	// Labels set after the process has terminated should expire along with it.
+	upid := types.UInt128FromProto(pi.UPID)
+	err = ads.SetProcessLabels(upid, map[string]string{"service": "checkout"})
+	require.NoError(t, err)
+
+	labels, err := ads.GetProcessLabels(upid)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"service": "checkout"}, labels)
+
+	assert.Eventually(t, func() bool {
+		labels, err := ads.GetProcessLabels(upid)
+		return err == nil && labels == nil
+	}, 5*time.Second, 100*time.Millisecond)
+}
+
+func TestDatastore_GetProcessAncestors(t *testing.T) {
+	ads, cleanup := setupDatastore(t, 1*time.Second)
+	defer cleanup()
+
+	upid := func(asid uint64, pid uint64) *types.UInt128 {
+		return &types.UInt128{High: asid<<32 | pid, Low: 1}
+	}
+	// Process tree: 1 <- 2 <- 3 <- 4. Process 5's parent, 6, is not in the store.
+	var processes []*k8s_metadatapb.ProcessInfo
+	for pid := uint64(1); pid <= 5; pid++ {
+		processes = append(processes, &k8s_metadatapb.ProcessInfo{
+			UPID: types.ProtoFromUInt128(upid(123, pid)),
+			Name: fmt.Sprintf("proc%d", pid),
+		})
+	}
+	err := ads.UpdateProcesses(processes)
+	require.NoError(t, err)
+	for _, link := range [][2]uint64{{2, 1}, {3, 2}, {4, 3}, {5, 6}} {
+		err = ads.SetProcessParent(upid(123, link[0]), upid(123, link[1]))
+		require.NoError(t, err)
+	}
+
+	names := func(pInfos []*k8s_metadatapb.ProcessInfo) []string {
+		var n []string
+		for _, p := range pInfos {
+			n = append(n, p.Name)
+		}
+		return n
+	}
+
+	ancestors, err := ads.GetProcessAncestors(upid(123, 4), 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"proc3", "proc2", "proc1"}, names(ancestors))
+
+	ancestors, err = ads.GetProcessAncestors(upid(123, 4), 2)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"proc3", "proc2"}, names(ancestors))
+
+	ancestors, err = ads.GetProcessAncestors(upid(123, 1), 10)
+	require.NoError(t, err)
+	assert.Len(t, ancestors, 0)
+
+	ancestors, err = ads.GetProcessAncestors(upid(123, 5), 10)
+	require.NoError(t, err)
+	assert.Len(t, ancestors, 0)
+
+	// The parent must belong to the same agent.
+	err = ads.SetProcessParent(upid(123, 1), upid(456, 1))
+	assert.Error(t, err)
+}
+
+func TestDatastore_GetProcessesActiveAt(t *testing.T) {
+	ads, cleanup := setupDatastore(t, 1*time.Minute)
+	defer cleanup()
+
+	upid := func(pid uint64) *types.UInt128 {
+		return &types.UInt128{High: 123<<32 | pid, Low: 1}
+	}
+	err := ads.UpdateProcesses([]*k8s_metadatapb.ProcessInfo{
+		{UPID: types.ProtoFromUInt128(upid(1)), StartTimestampNS: 10},
+		{UPID: types.ProtoFromUInt128(upid(2)), StartTimestampNS: 10, StopTimestampNS: 20},
+		{UPID: types.ProtoFromUInt128(upid(3)), StartTimestampNS: 30},
+	})
+	require.NoError(t, err)
+
+	active := func(ts int64) []bool {
+		pInfos, err := ads.GetProcessesActiveAt(ts, []*types.UInt128{upid(1), upid(2), upid(3), upid(4)})
+		require.NoError(t, err)
+		isActive := make([]bool, len(pInfos))
+		for i, pInfo := range pInfos {
+			isActive[i] = pInfo != nil
+		}
+		return isActive
+	}
+
+	assert.Equal(t, []bool{false, false, false, false}, active(5))
+	assert.Equal(t, []bool{true, true, false, false}, active(10))
+	assert.Equal(t, []bool{true, true, false, false}, active(19))
+	assert.Equal(t, []bool{true, false, false, false}, active(20))
+	assert.Equal(t, []bool{true, false, true, false}, active(30))
+}
+
+func TestDatastore_MigrateUPIDKeys(t *testing.T) {
+	c, err := pebble.Open("test", &pebble.Options{
+		FS: vfs.NewMem(),
+	})
+	require.NoError(t, err)
+	db := pebbledb.New(c, 100*time.Millisecond)
+	defer db.Close()
+
+	running := &types.UInt128{High: 123<<32 | 1, Low: 100}
+	stopped := &types.UInt128{High: 123<<32 | 2, Low: 200}
+	runningPb := &k8s_metadatapb.ProcessInfo{UPID: types.ProtoFromUInt128(running), Name: "running"}
+	stoppedPb := &k8s_metadatapb.ProcessInfo{UPID: types.ProtoFromUInt128(stopped), Name: "stopped", StopTimestampNS: 5}
+	runningVal, err := runningPb.Marshal()
+	require.NoError(t, err)
+	stoppedVal, err := stoppedPb.Marshal()
+	require.NoError(t, err)
+
+	// Write the keys in the format used before the UPIDs in keys were zero-padded.
+	require.NoError(t, db.SetAll([]string{
+		"/processes/123:1:100",
+		"/processes/123:2:200",
+		"/processLabels/123:1:100",
+		"/processLabels/123:2:200",
+	}, []string{
+		string(runningVal),
+		string(stoppedVal),
+		`{"app":"running"}`,
+		`{"app":"stopped"}`,
+	}))
+
+	ads := agent.NewDatastore(db, 1*time.Second)
+	pInfos, err := ads.GetProcesses([]*types.UInt128{running, stopped})
+	require.NoError(t, err)
+	assert.Equal(t, []*k8s_metadatapb.ProcessInfo{runningPb, stoppedPb}, pInfos)
+	labels, err := ads.GetProcessLabels(running)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"app": "running"}, labels)
+
+	oldKeys, _, err := db.GetWithPrefix("/processes/123:")
+	require.NoError(t, err)
+	assert.Empty(t, oldKeys)
+	oldKeys, _, err = db.GetWithPrefix("/processLabels/123:")
+	require.NoError(t, err)
+	assert.Empty(t, oldKeys)
+
+	// The terminated process and its labels should still expire.
+	assert.Eventually(t, func() bool {
+		labels, err := ads.GetProcessLabels(stopped)
+		return err == nil && labels == nil
+	}, 5*time.Second, 100*time.Millisecond)
+	pInfos, err = ads.GetProcesses([]*types.UInt128{running, stopped})
+	require.NoError(t, err)
+	assert.Equal(t, []*k8s_metadatapb.ProcessInfo{runningPb, nil}, pInfos)
+	labels, err = ads.GetProcessLabels(running)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"app": "running"}, labels)
+
+	// The migration only runs once, so keys in the old format are left alone afterwards.
+	require.NoError(t, db.Set("/processes/456:1:1", string(runningVal)))
+	agent.NewDatastore(db, 1*time.Second)
+	v, err := db.Get("/processes/456:1:1")
+	require.NoError(t, err)
+	assert.NotNil(t, v)
+}
+
+func TestDatastore_JSONRecordCodec(t *testing.T) {
+	c, err := pebble.Open("test", &pebble.Options{
+		FS: vfs.NewMem(),
+	})
+	require.NoError(t, err)
+	db := pebbledb.New(c, 3*time.Second)
+	defer db.Close()
+
+	jsonADS := agent.NewDatastoreWithCodec(db, 1*time.Minute, agent.JSONRecordCodec)
+	protoADS := agent.NewDatastore(db, 1*time.Minute)
+
+	agentInfo := new(agentpb.Agent)
+	if err := proto.UnmarshalText(testutils.ExistingAgentInfo, agentInfo); err != nil {
+		t.Fatal("Cannot Unmarshal protobuf.")
+	}
+	u := uuid.FromStringOrNil(testutils.ExistingAgentUUID)
+	err = jsonADS.CreateAgent(u, agentInfo)
+	require.NoError(t, err)
+
+	raw, err := db.Get("/agent/" + testutils.ExistingAgentUUID)
+	require.NoError(t, err)
+	assert.Contains(t, string(raw), `"hostname":"testhost"`)
+
+	agt, err := protoADS.GetAgent(u)
+	require.NoError(t, err)
+	assert.Equal(t, agentInfo, agt)
+
+	agents, err := protoADS.GetAgents()
+	require.NoError(t, err)
+	assert.Equal(t, []*agentpb.Agent{agentInfo}, agents)
+}
+
+func TestDatastore_GetFullAgentRecord(t *testing.T) {
+	ads, agtMgr, _, cleanup := setupManager(t)
+	defer cleanup()
+
+	u := uuid.FromStringOrNil(testutils.ExistingAgentUUID)
+
+	cp1 := new(k8s_metadatapb.ProcessCreated)
+	if err := proto.UnmarshalText(testutils.ProcessCreated1PB, cp1); err != nil {
+		t.Fatal("Cannot Unmarshal protobuf.")
+	}
+	dataInfo := &messagespb.AgentDataInfo{
+		MetadataInfo: &distributedpb.MetadataInfo{
+			MetadataFields: []metadatapb.MetadataType{
+				metadatapb.CONTAINER_ID,
+			},
+		},
+	}
+	err := agtMgr.ApplyAgentUpdate(&agent.Update{
+		UpdateInfo: &messagespb.AgentUpdateInfo{
+			ProcessCreated: []*k8s_metadatapb.ProcessCreated{cp1},
+			Data:           dataInfo,
+		},
+		AgentID: u,
+	})
+	require.NoError(t, err)
+	err = ads.SetProcessLabels(types.UInt128FromProto(cp1.UPID), map[string]string{"service": "checkout"})
+	require.NoError(t, err)
+	require.NoError(t, ads.SetAgentConfig(u, "gprof", "true"))
+
+	record, err := ads.GetFullAgentRecord(u)
+	require.NoError(t, err)
+	require.NotNil(t, record)
+
+	agentInfo := new(agentpb.Agent)
+	if err := proto.UnmarshalText(testutils.ExistingAgentInfo, agentInfo); err != nil {
+		t.Fatal("Cannot Unmarshal protobuf.")
+	}
+	assert.Equal(t, agentInfo, record.Agent)
+	assert.Equal(t, dataInfo, record.DataInfo)
+	assert.Equal(t, map[string]string{"gprof": "true"}, record.Config)
+	require.Len(t, record.Tables, 1)
+	assert.Equal(t, "a_table", record.Tables[0].Name)
+	require.Len(t, record.Processes, 1)
+	assert.Equal(t, "./bin/bash", record.Processes[0].ProcessArgs)
+	assert.Equal(t, map[string]map[string]string{
+		"123:567:89101": {"service": "checkout"},
+	}, record.ProcessLabels)
+
+	record, err = ads.GetFullAgentRecord(uuid.FromStringOrNil(testutils.NewAgentUUID))
+	require.NoError(t, err)
+	assert.Nil(t, record)
+}
+
+func TestDatastore_IterateDataInfo(t *testing.T) {
+	ads, agtMgr, _, cleanup := setupManager(t)
+	defer cleanup()
+
+	dataInfo := &messagespb.AgentDataInfo{
+		MetadataInfo: &distributedpb.MetadataInfo{
+			MetadataFields: []metadatapb.MetadataType{
+				metadatapb.CONTAINER_ID,
+			},
+		},
+	}
+	agentIDs := []uuid.UUID{
+		uuid.FromStringOrNil(testutils.ExistingAgentUUID),
+		uuid.FromStringOrNil(testutils.UnhealthyAgentUUID),
+	}
+	for _, agentID := range agentIDs {
+		err := agtMgr.ApplyAgentUpdate(&agent.Update{
+			UpdateInfo: &messagespb.AgentUpdateInfo{
+				Data: dataInfo,
+			},
+			AgentID: agentID,
+		})
+		require.NoError(t, err)
+	}
+
+	dataInfos := make(map[uuid.UUID]*messagespb.AgentDataInfo)
+	err := ads.IterateDataInfo(func(agentID uuid.UUID, info *messagespb.AgentDataInfo) bool {
+		dataInfos[agentID] = info
+		return true
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[uuid.UUID]*messagespb.AgentDataInfo{
+		agentIDs[0]: dataInfo,
+		agentIDs[1]: dataInfo,
+	}, dataInfos)
+
+	// Returning false should stop the iteration after the first entry.
+	calls := 0
+	var first uuid.UUID
+	err = ads.IterateDataInfo(func(agentID uuid.UUID, info *messagespb.AgentDataInfo) bool {
+		calls++
+		first = agentID
+		return false
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, calls)
+	assert.Contains(t, agentIDs, first)
+}
+
+func TestDatastore_GetAgentsByASIDRange(t *testing.T) {
+	ads, agtMgr, _, cleanup := setupManager(t)
+	defer cleanup()
+
+	agents, err := ads.GetAgentsByASIDRange(400, 800)
+	require.NoError(t, err)
+	require.Len(t, agents, 2)
+	assert.Equal(t, uint32(456), agents[0].ASID)
+	assert.Equal(t, uint32(789), agents[1].ASID)
+
+	agents, err = ads.GetAgentsByASIDRange(100, 789)
+	require.NoError(t, err)
+	require.Len(t, agents, 2)
+	assert.Equal(t, uint32(123), agents[0].ASID)
+	assert.Equal(t, uint32(456), agents[1].ASID)
+
+	err = agtMgr.DeleteAgent(uuid.FromStringOrNil(testutils.UnhealthyAgentUUID))
+	require.NoError(t, err)
+	agents, err = ads.GetAgentsByASIDRange(400, 500)
+	require.NoError(t, err)
+	assert.Len(t, agents, 0)
+}
+
+func TestDatastore_BackfillAgentIndexes(t *testing.T) {
+	c, err := pebble.Open("test", &pebble.Options{
+		FS: vfs.NewMem(),
+	})
+	require.NoError(t, err)
+	db := pebbledb.New(c, 3*time.Second)
+	defer db.Close()
+
+	agentInfo := new(agentpb.Agent)
+	require.NoError(t, proto.UnmarshalText(testutils.ExistingAgentInfo, agentInfo))
+	require.NoError(t, agent.NewDatastore(db, 1*time.Minute).CreateAgent(
+		uuid.FromStringOrNil(testutils.ExistingAgentUUID), agentInfo))
+
+	// Drop the indexes, as for an agent which was stored before they existed.
+	require.NoError(t, db.DeleteWithPrefix("/asidToAgentID/"))
+	require.NoError(t, db.DeleteWithPrefix("/hostnameToAgentID/"))
+
+	ads := agent.NewDatastore(db, 1*time.Minute)
+	agents, err := ads.GetAgentsByASIDRange(100, 200)
+	require.NoError(t, err)
+	require.Len(t, agents, 1)
+	assert.Equal(t, uint32(123), agents[0].ASID)
+
+	agents, err = ads.GetAgentsByHostnamePrefix("test")
+	require.NoError(t, err)
+	require.Len(t, agents, 1)
+	assert.Equal(t, "testhost", agents[0].Info.HostInfo.Hostname)
+}
+
+func TestDatastore_GetAgentsByHostnamePrefix(t *testing.T) {
+	ads, agtMgr, _, cleanup := setupManager(t)
+	defer cleanup()
+
+	hostnames := func(agents []*agentpb.Agent) []string {
+		var names []string
+		for _, agt := range agents {
+			names = append(names, agt.Info.HostInfo.Hostname)
+		}
+		return names
+	}
+
+	// Register an agent without a hostname, which is only indexed by its IP.
+	ipOnlyID := uuid.FromStringOrNil(testutils.NewAgentUUID)
+	_, err := agtMgr.RegisterAgent(&agentpb.Agent{
+		Info: &agentpb.AgentInfo{
+			HostInfo: &agentpb.HostInfo{
+				HostIP: "127.0.0.4",
+			},
+			AgentID: utils.ProtoFromUUID(ipOnlyID),
+			Capabilities: &agentpb.AgentCapabilities{
+				CollectsData: true,
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	agents, err := ads.GetAgentsByHostnamePrefix("a")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"abcd", "anotherhost"}, hostnames(agents))
+
+	agents, err = ads.GetAgentsByHostnamePrefix("testhost")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"testhost"}, hostnames(agents))
+
+	agents, err = ads.GetAgentsByHostnamePrefix("gpu-")
+	require.NoError(t, err)
+	assert.Empty(t, agents)
+
+	// Only an empty prefix matches the agent without a hostname.
+	agents, err = ads.GetAgentsByHostnamePrefix("")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"", "abcd", "anotherhost", "testhost"}, hostnames(agents))
+
+	// Deleted agents are removed from the index.
+	err = agtMgr.DeleteAgent(uuid.FromStringOrNil(testutils.UnhealthyAgentUUID))
+	require.NoError(t, err)
+	agents, err = agtMgr.GetAgentsByHostnamePrefix("a")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"abcd"}, hostnames(agents))
+}
+
+func TestDatastore_GetAgentByASID(t *testing.T) {
+	ads, agtMgr, _, cleanup := setupManager(t)
+	defer cleanup()
+
+	agt, err := ads.GetAgentByASID(456)
+	require.NoError(t, err)
+	require.NotNil(t, agt)
+	assert.Equal(t, testutils.UnhealthyAgentUUID, utils.UUIDFromProtoOrNil(agt.Info.AgentID).String())
+
+	agt, err = ads.GetAgentByASID(1000)
+	require.NoError(t, err)
+	assert.Nil(t, agt)
+
+	// The ASID of a deleted agent is never reused, and no longer maps to the agent.
+	err = agtMgr.DeleteAgent(uuid.FromStringOrNil(testutils.UnhealthyAgentUUID))
+	require.NoError(t, err)
+	agt, err = ads.GetAgentByASID(456)
+	require.NoError(t, err)
+	assert.Nil(t, agt)
+}
+
+func TestDatastore_GetASIDAfterRestart(t *testing.T) {
+	memFS := vfs.NewMem()
+	open := func() *pebbledb.DataStore {
+		c, err := pebble.Open("test", &pebble.Options{
+			FS: memFS,
+		})
+		require.NoError(t, err)
+		return pebbledb.New(c, 3*time.Second)
+	}
+	newAgent := func(hostIP string) *agentpb.Agent {
+		return &agentpb.Agent{
+			Info: &agentpb.AgentInfo{
+				HostInfo:     &agentpb.HostInfo{Hostname: "localhost", HostIP: hostIP},
+				AgentID:      utils.ProtoFromUUID(uuid.Must(uuid.NewV4())),
+				Capabilities: &agentpb.AgentCapabilities{CollectsData: true},
+			},
+		}
+	}
+
+	db := open()
+	asid1, err := agent.NewManager(agent.NewDatastore(db, 1*time.Minute), nil, nil).RegisterAgent(newAgent("127.0.0.1"))
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	// The next ASID is persisted in the datastore, so it is not reset by a restart.
+	db = open()
+	defer db.Close()
+	asid2, err := agent.NewManager(agent.NewDatastore(db, 1*time.Minute), nil, nil).RegisterAgent(newAgent("127.0.0.2"))
+	require.NoError(t, err)
+	assert.Greater(t, asid2, asid1)
+}
+
+func TestDatastore_SnapshotRestore(t *testing.T) {
+	store, _, _, cleanup := setupManager(t)
+	defer cleanup()
+	ads := store.(*agent.Datastore)
+
+	var snapshot bytes.Buffer
+	require.NoError(t, ads.Snapshot(&snapshot))
+
+	restored, cleanupRestored := setupDatastore(t, 1*time.Minute)
+	defer cleanupRestored()
+	require.NoError(t, restored.Restore(bytes.NewReader(snapshot.Bytes()), false))
+
+	expectedAgents, err := ads.GetAgents()
+	require.NoError(t, err)
+	agents, err := restored.GetAgents()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, expectedAgents, agents)
+
+	expectedSchema, err := ads.GetComputedSchema()
+	require.NoError(t, err)
+	schema, err := restored.GetComputedSchema()
+	require.NoError(t, err)
+	assert.Equal(t, expectedSchema, schema)
+
+	expectedASID, err := ads.GetASID()
+	require.NoError(t, err)
+	asid, err := restored.GetASID()
+	require.NoError(t, err)
+	assert.Equal(t, expectedASID, asid)
+
+	// A datastore with agent state is only restored into if it is overwritten.
+	err = restored.Restore(bytes.NewReader(snapshot.Bytes()), false)
+	assert.ErrorIs(t, err, agent.ErrDatastoreNotEmpty)
+	require.NoError(t, restored.DeleteAgent(uuid.FromStringOrNil(testutils.ExistingAgentUUID)))
+	require.NoError(t, restored.Restore(bytes.NewReader(snapshot.Bytes()), true))
+	agents, err = restored.GetAgents()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, expectedAgents, agents)
+
+	err = restored.Restore(strings.NewReader(`{"version":100}`), true)
+	assert.Error(t, err)
+}
+
+func TestDatastore_GetAgentsModifiedSince(t *testing.T) {
+	ads, _, _, cleanup := setupManager(t)
+	defer cleanup()
+
+	agents, version, err := ads.GetAgentsModifiedSince(0)
+	require.NoError(t, err)
+	assert.Len(t, agents, 3)
+
+	agentID := uuid.FromStringOrNil(testutils.UnhealthyAgentUUID)
+	agt, err := ads.GetAgent(agentID)
+	require.NoError(t, err)
+	agt.LastHeartbeatNS = 10
+	err = ads.UpdateAgent(agentID, agt)
+	require.NoError(t, err)
+
+	agents, newVersion, err := ads.GetAgentsModifiedSince(version)
+	require.NoError(t, err)
+	require.Len(t, agents, 1)
+	assert.Equal(t, utils.ProtoFromUUID(agentID), agents[0].Info.AgentID)
+	assert.Equal(t, int64(10), agents[0].LastHeartbeatNS)
+	assert.Greater(t, newVersion, version)
+
+	// The superseded version of the agent should not be returned again.
+	agents, version, err = ads.GetAgentsModifiedSince(0)
+	require.NoError(t, err)
+	assert.Len(t, agents, 3)
+	assert.Equal(t, newVersion, version)
+
+	agents, version, err = ads.GetAgentsModifiedSince(newVersion)
+	require.NoError(t, err)
+	assert.Len(t, agents, 0)
+	assert.Equal(t, newVersion, version)
+
+	err = ads.DeleteAgent(agentID)
+	require.NoError(t, err)
+	agents, _, err = ads.GetAgentsModifiedSince(0)
+	require.NoError(t, err)
+	assert.Len(t, agents, 2)
+}
+
+func TestDatastore_GetAgentsFiltered(t *testing.T) {
+	ads, _, _, cleanup := setupManager(t)
+	defer cleanup()
+
+	agents, err := ads.GetAgentsFiltered(func(agt *agentpb.Agent) bool {
+		return agt.Info.HostInfo.HostIP != "127.0.0.1"
+	})
+	require.NoError(t, err)
+	require.Len(t, agents, 2)
+	sort.Slice(agents, func(i, j int) bool { return agents[i].ASID < agents[j].ASID })
+	assert.Equal(t, uint32(456), agents[0].ASID)
+	assert.Equal(t, uint32(789), agents[1].ASID)
+
+	agents, err = ads.GetAgentsFiltered(func(agt *agentpb.Agent) bool { return false })
+	require.NoError(t, err)
+	assert.Len(t, agents, 0)
+
+	agents, err = ads.GetAgentsFiltered(nil)
+	require.NoError(t, err)
+	assert.Len(t, agents, 3)
+}
+
+func TestDatastore_GetProcessesWithContext(t *testing.T) {
+	ads, cleanup := setupDatastore(t, 1*time.Minute)
+	defer cleanup()
+
+	pi := new(k8s_metadatapb.ProcessInfo)
+	if err := proto.UnmarshalText(testutils.ProcessInfo1PB, pi); err != nil {
+		t.Fatal("Cannot Unmarshal protobuf.")
+	}
+	err := ads.UpdateProcesses([]*k8s_metadatapb.ProcessInfo{pi})
+	require.NoError(t, err)
+
+	upids := make([]*types.UInt128, 100)
+	for i := range upids {
+		upids[i] = types.UInt128FromProto(pi.UPID)
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now())
+	defer cancel()
+	pInfos, err := ads.GetProcessesWithContext(ctx, upids)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Len(t, pInfos, 100)
+	assert.Nil(t, pInfos[99])
+
+	pInfos, err = ads.GetProcessesWithContext(context.Background(), upids)
+	require.NoError(t, err)
+	assert.Equal(t, pi, pInfos[99])
+}
+
+func TestDatastore_ListProcesses(t *testing.T) {
+	ads, cleanup := setupDatastore(t, 1*time.Minute)
+	defer cleanup()
+
+	newProcess := func(asid uint64, pid uint64) *k8s_metadatapb.ProcessInfo {
+		return &k8s_metadatapb.ProcessInfo{
+			UPID: types.ProtoFromUInt128(&types.UInt128{High: asid<<32 | pid, Low: 1}),
+		}
+	}
+	listPIDs := func(processes []*k8s_metadatapb.ProcessInfo) []uint64 {
+		pids := make([]uint64, len(processes))
+		for i, p := range processes {
+			pids[i] = p.UPID.High & 0xFFFFFFFF
+		}
+		return pids
+	}
+
+	err := ads.UpdateProcesses([]*k8s_metadatapb.ProcessInfo{
+		newProcess(2, 20), newProcess(1, 10), newProcess(1, 11), newProcess(3, 30),
+	})
+	require.NoError(t, err)
+
+	processes, cursor, err := ads.ListProcesses(nil, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{10, 11}, listPIDs(processes))
+	require.NotEmpty(t, cursor)
+
+	// Processes created mid-scan don't cause any processes to be skipped or repeated.
+	err = ads.UpdateProcesses([]*k8s_metadatapb.ProcessInfo{newProcess(1, 5), newProcess(2, 21)})
+	require.NoError(t, err)
+
+	processes, cursor, err = ads.ListProcesses(cursor, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{20, 21}, listPIDs(processes))
+	require.NotEmpty(t, cursor)
+
+	processes, cursor, err = ads.ListProcesses(cursor, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{30}, listPIDs(processes))
+	assert.Empty(t, cursor)
+
+	processes, cursor, err = ads.ListProcesses(nil, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{5, 10, 11, 20, 21, 30}, listPIDs(processes))
+	assert.Empty(t, cursor)
+
+	_, _, err = ads.ListProcesses([]byte("invalid"), 2)
+	assert.Error(t, err)
+}
+
+func TestDatastore_CompactAgentProcesses(t *testing.T) {
+	ads, cleanup := setupDatastore(t, 100*time.Millisecond)
+	defer cleanup()
+
+	agentID := uuid.FromStringOrNil(testutils.ExistingAgentUUID)
+	agt := new(agentpb.Agent)
+	if err := proto.UnmarshalText(testutils.ExistingAgentInfo, agt); err != nil {
+		t.Fatal("Cannot Unmarshal protobuf.")
+	}
+	require.NoError(t, ads.CreateAgent(agentID, agt))
+
+	newProcess := func(asid uint64, pid uint64) *k8s_metadatapb.ProcessInfo {
+		return &k8s_metadatapb.ProcessInfo{
+			UPID: types.ProtoFromUInt128(&types.UInt128{High: asid<<32 | pid, Low: 1}),
+		}
+	}
+	var processes []*k8s_metadatapb.ProcessInfo
+	var upids []*types.UInt128
+	for pid := uint64(1); pid <= 500; pid++ {
+		p := newProcess(uint64(agt.ASID), pid)
+		processes = append(processes, p)
+		upids = append(upids, types.UInt128FromProto(p.UPID))
+	}
+	live := newProcess(uint64(agt.ASID), 1000)
+	other := newProcess(uint64(agt.ASID)+1, 1)
+	require.NoError(t, ads.UpdateProcesses(append(processes, live, other)))
+
+	// Terminate all but one of the agent's processes, and wait for them to be purged.
+	for _, p := range processes {
+		p.StopTimestampNS = 10
+	}
+	require.NoError(t, ads.UpdateProcesses(processes))
+	assert.Eventually(t, func() bool {
+		pInfos, err := ads.GetProcesses(upids)
+		if err != nil {
+			return false
+		}
+		for _, pInfo := range pInfos {
+			if pInfo != nil {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 100*time.Millisecond)
+
+	require.NoError(t, ads.CompactAgentProcesses(agentID))
+
+	pInfos, err := ads.GetProcesses(append(upids,
+		types.UInt128FromProto(live.UPID), types.UInt128FromProto(other.UPID)))
+	require.NoError(t, err)
+	for _, pInfo := range pInfos[:len(upids)] {
+		assert.Nil(t, pInfo)
+	}
+	assert.Equal(t, live, pInfos[len(upids)])
+	assert.Equal(t, other, pInfos[len(upids)+1])
+
+	err = ads.CompactAgentProcesses(uuid.FromStringOrNil(testutils.NewAgentUUID))
+	assert.Error(t, err)
+}
+
+func TestDatastore_GetAgentWithSchema(t *testing.T) {
+	ads, _, _, cleanup := setupManager(t)
+	defer cleanup()
+
+	agentID := uuid.FromStringOrNil(testutils.ExistingAgentUUID)
+	schemaAt := func(version int64) []*storepb.TableInfo {
+		schemas := make([]*storepb.TableInfo, 2)
+		for i, pb := range []string{testutils.SchemaInfoPB, testutils.SchemaInfo2PB} {
+			schemas[i] = new(storepb.TableInfo)
+			if err := proto.UnmarshalText(pb, schemas[i]); err != nil {
+				t.Fatal("Cannot Unmarshal protobuf.")
+			}
+			schemas[i].StartTimestampNS = version
+		}
+		return schemas
+	}
+
+	err := ads.UpdateSchemas(agentID, schemaAt(0))
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	// Wait for the writer before the datastore is closed.
+	defer wg.Wait()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := int64(1); i <= 100; i++ {
+			assert.NoError(t, ads.UpdateSchemas(agentID, schemaAt(i)))
+		}
+	}()
+
+	// Both tables are always written together, so a consistent read always sees them at the same version.
+	for i := 0; i < 100; i++ {
+		agt, tables, err := ads.GetAgentWithSchema(agentID)
+		require.NoError(t, err)
+		require.NotNil(t, agt)
+		assert.Equal(t, testutils.ExistingAgentUUID, utils.UUIDFromProtoOrNil(agt.Info.AgentID).String())
+		require.Len(t, tables, 2)
+		assert.Equal(t, "a_table", tables[0].Name)
+		assert.Equal(t, "b_table", tables[1].Name)
+		assert.Equal(t, tables[0].StartTimestampNS, tables[1].StartTimestampNS)
+	}
+
+	agt, tables, err := ads.GetAgentWithSchema(uuid.Must(uuid.NewV4()))
+	require.NoError(t, err)
+	assert.Nil(t, agt)
+	assert.Nil(t, tables)
+}
+
+func TestDatastore_GetAgentTables(t *testing.T) {
+	ads, _, _, cleanup := setupManager(t)
+	defer cleanup()
+
+	expected := new(storepb.TableInfo)
+	if err := proto.UnmarshalText(testutils.SchemaInfoPB, expected); err != nil {
+		t.Fatal("Cannot Unmarshal protobuf.")
+	}
+
+	tables, err := ads.GetAgentTables(uuid.FromStringOrNil(testutils.ExistingAgentUUID))
+	require.NoError(t, err)
+	require.Len(t, tables, 1)
+	assert.Equal(t, "a_table", tables[0].Name)
+	assert.Equal(t, expected.Columns, tables[0].Columns)
+
+	tables, err = ads.GetAgentTables(uuid.Must(uuid.NewV4()))
+	require.NoError(t, err)
+	assert.Len(t, tables, 0)
+}
+
+func TestDatastore_GetDataInfoForAgents(t *testing.T) {
+	ads, agtMgr, _, cleanup := setupManager(t)
+	defer cleanup()
+
+	existing := uuid.FromStringOrNil(testutils.ExistingAgentUUID)
+	unhealthy := uuid.FromStringOrNil(testutils.UnhealthyAgentUUID)
+	kelvin := uuid.FromStringOrNil(testutils.UnhealthyKelvinAgentUUID)
+
+	dataInfo := &messagespb.AgentDataInfo{
+		MetadataInfo: &distributedpb.MetadataInfo{
+			MetadataFields: []metadatapb.MetadataType{
+				metadatapb.CONTAINER_ID,
+			},
+		},
+	}
+	for _, agentID := range []uuid.UUID{existing, unhealthy} {
+		err := agtMgr.ApplyAgentUpdate(&agent.Update{
+			UpdateInfo: &messagespb.AgentUpdateInfo{
+				Data: dataInfo,
+			},
+			AgentID: agentID,
+		})
+		require.NoError(t, err)
+	}
+
+	// Agents without data info, and agents which don't exist, should be absent from the map.
+	dataInfos, err := ads.GetDataInfoForAgents([]uuid.UUID{existing, kelvin, uuid.FromStringOrNil(testutils.NewAgentUUID)})
+	require.NoError(t, err)
+	assert.Equal(t, map[uuid.UUID]*messagespb.AgentDataInfo{
+		existing: dataInfo,
+	}, dataInfos)
+
+	dataInfos, err = ads.GetDataInfoForAgents(nil)
+	require.NoError(t, err)
+	assert.Empty(t, dataInfos)
+}
+
+func TestDatastore_UpdateAgentStates(t *testing.T) {
+	ads, cleanup := setupDatastore(t, 1*time.Minute)
+	defer cleanup()
+
+	agentA := uuid.FromStringOrNil(testutils.ExistingAgentUUID)
+	agentB := uuid.FromStringOrNil(testutils.UnhealthyAgentUUID)
+	dataInfo := &messagespb.AgentDataInfo{
+		MetadataInfo: &distributedpb.MetadataInfo{
+			MetadataFields: []metadatapb.MetadataType{metadatapb.CONTAINER_ID},
+		},
+	}
+	running := &k8s_metadatapb.ProcessInfo{
+		UPID:             types.ProtoFromUInt128(&types.UInt128{High: 123<<32 | 1, Low: 1}),
+		StartTimestampNS: 1,
+	}
+	stopped := &k8s_metadatapb.ProcessInfo{
+		UPID:             types.ProtoFromUInt128(&types.UInt128{High: 123<<32 | 2, Low: 1}),
+		StartTimestampNS: 1,
+		StopTimestampNS:  2,
+	}
+
+	err := ads.UpdateAgentStates([]*k8s_metadatapb.ProcessInfo{running, stopped}, []*agent.AgentState{
+		{AgentID: agentA, Schema: []*storepb.TableInfo{{Name: "table1"}}, UpdateSchema: true},
+		{AgentID: agentB, DataInfo: dataInfo},
+		// The later state for the agent should replace its tables.
+		{AgentID: agentA, Schema: []*storepb.TableInfo{{Name: "table2"}}, UpdateSchema: true},
+	})
+	require.NoError(t, err)
+
+	processes, err := ads.GetProcesses([]*types.UInt128{
+		types.UInt128FromProto(running.UPID),
+		types.UInt128FromProto(stopped.UPID),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []*k8s_metadatapb.ProcessInfo{running, stopped}, processes)
+
+	dataInfos, err := ads.GetAgentsDataInfo()
+	require.NoError(t, err)
+	assert.Equal(t, map[uuid.UUID]*messagespb.AgentDataInfo{agentB: dataInfo}, dataInfos)
+
+	schema, err := ads.GetComputedSchema()
+	require.NoError(t, err)
+	require.Len(t, schema.TableNameToAgentIDs, 1)
+	assert.Equal(t, []*uuidpb.UUID{utils.ProtoFromUUID(agentA)}, schema.TableNameToAgentIDs["table2"].AgentID)
+}
+
+func TestEncodeUPIDKey(t *testing.T) {
+	upids := []*types.UInt128{
+		{High: 12<<32 | 5, Low: 100},
+		{High: 123<<32 | 2, Low: 1},
+		{High: 123<<32 | 10, Low: 1},
+		{High: 123<<32 | 10, Low: 20},
+		{High: 1000<<32 | 1, Low: 0},
+	}
+
+	keys := make([]string, len(upids))
+	for i, upid := range upids {
+		keys[i] = agent.EncodeUPIDKey(upid)
+	}
+	assert.True(t, sort.StringsAreSorted(keys))
+
+	for i, key := range keys {
+		upid, err := agent.DecodeUPIDKey(key)
+		require.NoError(t, err)
+		assert.Equal(t, upids[i], upid)
+	}
+
+	_, err := agent.DecodeUPIDKey("123:567")
+	assert.Error(t, err)
+}
+
+func TestDatastore_GetAgentForHostnamePair(t *testing.T) {
+	ads, _, _, cleanup := setupManager(t)
+	defer cleanup()
+
+	agt, err := ads.GetAgentForHostnamePair(&agent.HostnameIPPair{Hostname: "", IP: "127.0.0.1"})
+	require.NoError(t, err)
+	require.NotNil(t, agt)
+	assert.Equal(t, testutils.ExistingAgentUUID, utils.UUIDFromProtoOrNil(agt.Info.AgentID).String())
+
+	agt, err = ads.GetAgentForHostnamePair(&agent.HostnameIPPair{Hostname: "", IP: "127.0.0.100"})
+	require.NoError(t, err)
+	assert.Nil(t, agt)
+}
+
+func TestDatastore_GetAgentIDsForHostnamePairs(t *testing.T) {
+	ads, _, _, cleanup := setupManager(t)
+	defer cleanup()
+
+	ids, err := ads.GetAgentIDsForHostnamePairs([]*agent.HostnameIPPair{
+		{Hostname: "", IP: "127.0.0.2"},
+		{Hostname: "", IP: "127.0.0.100"},
+		{Hostname: "", IP: "127.0.0.1"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{testutils.UnhealthyAgentUUID, "", testutils.ExistingAgentUUID}, ids)
+}
+
+func TestDatastore_GetProcessesDuplicateUPIDs(t *testing.T) {
+	ads, cleanup := setupDatastore(t, 1*time.Minute)
+	defer cleanup()
+
+	pi := new(k8s_metadatapb.ProcessInfo)
+	if err := proto.UnmarshalText(testutils.ProcessInfo1PB, pi); err != nil {
+		t.Fatal("Cannot Unmarshal protobuf.")
+	}
+	err := ads.UpdateProcesses([]*k8s_metadatapb.ProcessInfo{pi})
+	require.NoError(t, err)
+
+	upid := types.UInt128FromProto(pi.UPID)
+	missing := &types.UInt128{High: 1, Low: 2}
+	pInfos, err := ads.GetProcesses([]*types.UInt128{upid, missing, upid, missing})
+	require.NoError(t, err)
+	require.Len(t, pInfos, 4)
+	assert.Equal(t, pi, pInfos[0])
+	assert.Equal(t, pi, pInfos[2])
+	assert.Nil(t, pInfos[1])
+	assert.Nil(t, pInfos[3])
+}
+
+func TestDatastore_GetAgentCount(t *testing.T) {
+	ads, _, _, cleanup := setupManager(t)
+	defer cleanup()
+
+	count, err := ads.GetAgentCount()
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+
+	count, err = ads.GetAgentCountByCapability(true)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	count, err = ads.GetAgentCountByCapability(false)
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	err = ads.DeleteAgent(uuid.FromStringOrNil(testutils.UnhealthyKelvinAgentUUID))
+	require.NoError(t, err)
+
+	count, err = ads.GetAgentCount()
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	count, err = ads.GetAgentCountByCapability(false)
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
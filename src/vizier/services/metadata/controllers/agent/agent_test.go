@@ -19,7 +19,10 @@
 package agent_test
 
 import (
+	"bytes"
+	"encoding/json"
 	"os"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -29,9 +32,15 @@ import (
 	"github.com/gofrs/uuid"
 	"github.com/gogo/protobuf/proto"
 	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/util/clock"
 
+	"px.dev/pixie/src/api/proto/uuidpb"
 	"px.dev/pixie/src/carnot/planner/distributedpb"
 	"px.dev/pixie/src/shared/bloomfilterpb"
 	k8s_metadatapb "px.dev/pixie/src/shared/k8s/metadatapb"
@@ -45,6 +54,7 @@ import (
 	"px.dev/pixie/src/vizier/services/metadata/storepb"
 	"px.dev/pixie/src/vizier/services/shared/agentpb"
 	"px.dev/pixie/src/vizier/utils/datastore/pebbledb"
+	"px.dev/pixie/src/vizier/utils/datastore/pebbledb/pebbledbtest"
 )
 
 func setupManager(t *testing.T) (agent.Store, agent.Manager, *nats.Conn, func()) {
@@ -78,6 +88,20 @@ func setupManager(t *testing.T) (agent.Store, agent.Manager, *nats.Conn, func())
 	return ads, agtMgr, nc, cleanupFn
 }
 
+// setupEmptyManager creates an agent manager with an empty datastore, which has no agents or computed schema.
+func setupEmptyManager(t *testing.T) (agent.Manager, func()) {
+	c, err := pebble.Open("test", &pebble.Options{
+		FS: vfs.NewMem(),
+	})
+	require.NoError(t, err)
+	db := pebbledb.New(c, 3*time.Second)
+	ads := agent.NewDatastore(db, 1*time.Minute)
+
+	return agent.NewManager(ads, nil, nil), func() {
+		db.Close()
+	}
+}
+
 func createAgentInADS(t *testing.T, agentID string, ads agent.Store, agentPb string) {
 	info := new(agentpb.Agent)
 	if err := proto.UnmarshalText(agentPb, info); err != nil {
@@ -149,6 +173,148 @@ func TestRegisterAgent(t *testing.T) {
 	assert.Equal(t, testutils.NewAgentUUID, hostnameID)
 }
 
+func TestRegisterAgents(t *testing.T) {
+	ads, agtMgr, _, cleanup := setupManager(t)
+	defer cleanup()
+
+	existingAgent := new(agentpb.Agent)
+	if err := proto.UnmarshalText(testutils.ExistingAgentInfo, existingAgent); err != nil {
+		t.Fatalf("Cannot Unmarshal protobuf for existing agent")
+	}
+
+	u1, err := uuid.FromString(testutils.NewAgentUUID)
+	require.NoError(t, err)
+	u2 := uuid.Must(uuid.NewV4())
+	newAgent := func(u uuid.UUID, hostIP string) *agentpb.Agent {
+		return &agentpb.Agent{
+			Info: &agentpb.AgentInfo{
+				HostInfo: &agentpb.HostInfo{
+					Hostname: "localhost",
+					HostIP:   hostIP,
+				},
+				AgentID: utils.ProtoFromUUID(u),
+				Capabilities: &agentpb.AgentCapabilities{
+					CollectsData: true,
+				},
+			},
+		}
+	}
+
+	asids, err := agtMgr.RegisterAgents([]*agentpb.Agent{
+		newAgent(u1, "127.0.0.4"),
+		existingAgent,
+		newAgent(u2, "127.0.0.5"),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []uint32{1, 123, 2}, asids)
+
+	agt, err := ads.GetAgent(u1)
+	require.NoError(t, err)
+	require.NotNil(t, agt)
+	assert.Equal(t, uint32(1), agt.ASID)
+
+	agt, err = ads.GetAgent(u2)
+	require.NoError(t, err)
+	require.NotNil(t, agt)
+	assert.Equal(t, uint32(2), agt.ASID)
+
+	hostnameID, err := ads.GetAgentIDForHostnamePair(&agent.HostnameIPPair{Hostname: "", IP: "127.0.0.5"})
+	require.NoError(t, err)
+	assert.Equal(t, u2.String(), hostnameID)
+
+	// The register time is recorded for the new and the existing agents alike.
+	registerTimeNS, err := ads.GetAgentLastRegisterTime(u1)
+	require.NoError(t, err)
+	assert.NotEqual(t, int64(0), registerTimeNS)
+	for _, u := range []uuid.UUID{u2, uuid.FromStringOrNil(testutils.ExistingAgentUUID)} {
+		timeNS, err := ads.GetAgentLastRegisterTime(u)
+		require.NoError(t, err)
+		assert.Equal(t, registerTimeNS, timeNS)
+	}
+
+	agents, err := agtMgr.GetActiveAgents()
+	require.NoError(t, err)
+	assert.Len(t, agents, 5)
+}
+
+func TestRegisterAgentsHostnameConflict(t *testing.T) {
+	ads, agtMgr, _, cleanup := setupManager(t)
+	defer cleanup()
+
+	u1 := uuid.FromStringOrNil(testutils.NewAgentUUID)
+	u2 := uuid.Must(uuid.NewV4())
+	newAgent := func(u uuid.UUID, hostIP string) *agentpb.Agent {
+		return &agentpb.Agent{
+			Info: &agentpb.AgentInfo{
+				HostInfo: &agentpb.HostInfo{
+					Hostname: "localhost",
+					HostIP:   hostIP,
+				},
+				AgentID: utils.ProtoFromUUID(u),
+				Capabilities: &agentpb.AgentCapabilities{
+					CollectsData: true,
+				},
+			},
+		}
+	}
+
+	// The existing agent has the same host IP as the second agent.
+	_, err := agtMgr.RegisterAgents([]*agentpb.Agent{
+		newAgent(u1, "127.0.0.4"),
+		newAgent(u2, "127.0.0.1"),
+	})
+	assert.ErrorIs(t, err, agent.ErrHostnameConflict)
+
+	// The agents in the batch have the same host IP.
+	_, err = agtMgr.RegisterAgents([]*agentpb.Agent{
+		newAgent(u1, "127.0.0.4"),
+		newAgent(u2, "127.0.0.4"),
+	})
+	assert.ErrorIs(t, err, agent.ErrHostnameConflict)
+
+	for _, u := range []uuid.UUID{u1, u2} {
+		agt, err := ads.GetAgent(u)
+		require.NoError(t, err)
+		assert.Nil(t, agt)
+	}
+	id, err := ads.GetAgentIDForHostnamePair(&agent.HostnameIPPair{Hostname: "", IP: "127.0.0.1"})
+	require.NoError(t, err)
+	assert.Equal(t, testutils.ExistingAgentUUID, id)
+
+	// The rejected batches did not use up any ASIDs.
+	asids, err := agtMgr.RegisterAgents([]*agentpb.Agent{newAgent(u1, "127.0.0.4")})
+	require.NoError(t, err)
+	assert.Equal(t, []uint32{1}, asids)
+}
+
+func TestRegisterAgentReadYourWrites(t *testing.T) {
+	ads, agtMgr, _, cleanup := setupManager(t)
+	defer cleanup()
+
+	u, err := uuid.FromString(testutils.NewAgentUUID)
+	require.NoError(t, err)
+	agentInfo := &agentpb.Agent{
+		Info: &agentpb.AgentInfo{
+			HostInfo: &agentpb.HostInfo{
+				Hostname: "localhost",
+				HostIP:   "127.0.0.4",
+			},
+			AgentID: utils.ProtoFromUUID(u),
+			Capabilities: &agentpb.AgentCapabilities{
+				CollectsData: true,
+			},
+		},
+	}
+
+	asid, err := agtMgr.RegisterAgent(agentInfo)
+	require.NoError(t, err)
+
+	agt, err := ads.GetAgent(u)
+	require.NoError(t, err)
+	require.NotNil(t, agt)
+	assert.Equal(t, asid, agt.ASID)
+}
+
 func TestRegisterKelvinAgent(t *testing.T) {
 	ads, agtMgr, _, cleanup := setupManager(t)
 	defer cleanup()
@@ -212,6 +378,46 @@ func TestRegisterExistingAgent(t *testing.T) {
 	assert.Equal(t, agentInfo, agt)
 }
 
+func TestRegisterAgentLastRegisterTime(t *testing.T) {
+	ads, _, nc, cleanup := setupManager(t)
+	defer cleanup()
+
+	fakeClock := clock.NewFakeClock(time.Now())
+	agtMgr := agent.NewManager(ads, nil, nc, agent.Clock(fakeClock))
+
+	u := uuid.FromStringOrNil(testutils.NewAgentUUID)
+	agentInfo := &agentpb.Agent{
+		Info: &agentpb.AgentInfo{
+			HostInfo: &agentpb.HostInfo{
+				Hostname: "localhost",
+				HostIP:   "127.0.0.4",
+			},
+			AgentID: utils.ProtoFromUUID(u),
+			Capabilities: &agentpb.AgentCapabilities{
+				CollectsData: true,
+			},
+		},
+	}
+	createTime := fakeClock.Now().UnixNano()
+	_, err := agtMgr.RegisterAgent(agentInfo)
+	require.NoError(t, err)
+
+	record, err := ads.GetFullAgentRecord(u)
+	require.NoError(t, err)
+	assert.Equal(t, createTime, record.Agent.CreateTimeNS)
+	assert.Equal(t, createTime, record.LastRegisterTimeNS)
+
+	// Re-registering the agent keeps its create time, but records the new registration time.
+	fakeClock.Step(time.Minute)
+	_, err = agtMgr.RegisterAgent(agentInfo)
+	require.NoError(t, err)
+
+	record, err = ads.GetFullAgentRecord(u)
+	require.NoError(t, err)
+	assert.Equal(t, createTime, record.Agent.CreateTimeNS)
+	assert.Equal(t, fakeClock.Now().UnixNano(), record.LastRegisterTimeNS)
+}
+
 func TestReregisterPurgedAgent(t *testing.T) {
 	ads, agtMgr, _, cleanup := setupManager(t)
 	defer cleanup()
@@ -233,517 +439,2527 @@ func TestReregisterPurgedAgent(t *testing.T) {
 	assert.Equal(t, agentInfo, agt)
 }
 
-func TestUpdateHeartbeat(t *testing.T) {
+func TestAgent_Quiesce(t *testing.T) {
 	ads, agtMgr, _, cleanup := setupManager(t)
 	defer cleanup()
 
-	u, err := uuid.FromString(testutils.ExistingAgentUUID)
-	if err != nil {
-		t.Fatal("Could not generate UUID.")
+	u := uuid.FromStringOrNil(testutils.NewAgentUUID)
+	agentInfo := &agentpb.Agent{
+		Info: &agentpb.AgentInfo{
+			HostInfo: &agentpb.HostInfo{
+				Hostname: "localhost",
+				HostIP:   "127.0.0.4",
+			},
+			AgentID: utils.ProtoFromUUID(u),
+			Capabilities: &agentpb.AgentCapabilities{
+				CollectsData: true,
+			},
+		},
 	}
 
-	now := time.Now().UnixNano()
-	err = agtMgr.UpdateHeartbeat(u)
+	release, err := agtMgr.Quiesce()
 	require.NoError(t, err)
 
-	// Check that correct agent info is in ads.
+	// Writes are rejected while quiesced.
+	_, err = agtMgr.RegisterAgent(agentInfo)
+	assert.ErrorIs(t, err, agent.ErrQuiesced)
+	err = agtMgr.UpdateHeartbeat(uuid.FromStringOrNil(testutils.ExistingAgentUUID))
+	assert.ErrorIs(t, err, agent.ErrQuiesced)
+	_, err = agtMgr.Quiesce()
+	assert.ErrorIs(t, err, agent.ErrQuiesced)
+
+	// Reads continue.
+	agents, err := agtMgr.GetActiveAgents()
+	require.NoError(t, err)
+	assert.Len(t, agents, 3)
+
 	agt, err := ads.GetAgent(u)
 	require.NoError(t, err)
-	assert.NotNil(t, agt)
+	assert.Nil(t, agt)
 
-	assert.Greater(t, agt.LastHeartbeatNS, now)
+	release()
+	// Releasing more than once has no effect.
+	release()
+
+	_, err = agtMgr.RegisterAgent(agentInfo)
+	require.NoError(t, err)
+	agt, err = ads.GetAgent(u)
+	require.NoError(t, err)
+	assert.NotNil(t, agt)
 }
 
-func TestUpdateHeartbeatForNonExistingAgent(t *testing.T) {
-	_, agtMgr, _, cleanup := setupManager(t)
+func TestRegisterAgentPodNameIndex(t *testing.T) {
+	ads, agtMgr, _, cleanup := setupManager(t)
 	defer cleanup()
 
-	u, err := uuid.FromString(testutils.NewAgentUUID)
-	if err != nil {
-		t.Fatal("Could not generate UUID.")
+	agentInfo := new(agentpb.Agent)
+	if err := proto.UnmarshalText(testutils.ExistingAgentInfo, agentInfo); err != nil {
+		t.Fatalf("Cannot Unmarshal protobuf for existing agent")
 	}
+	uid, err := utils.UUIDFromProto(agentInfo.Info.AgentID)
+	require.NoError(t, err)
 
-	err = agtMgr.UpdateHeartbeat(u)
-	assert.NotNil(t, err)
+	err = agtMgr.DeleteAgent(uid)
+	require.NoError(t, err)
+	id, err := ads.GetAgentIDFromPodName("pem-existing")
+	require.NoError(t, err)
+	assert.Equal(t, "", id)
+
+	_, err = agtMgr.RegisterAgent(agentInfo)
+	require.NoError(t, err)
+	id, err = ads.GetAgentIDFromPodName("pem-existing")
+	require.NoError(t, err)
+	assert.Equal(t, testutils.ExistingAgentUUID, id)
+	// UpdateConfig resolves the agent through the pod name index.
+	err = agtMgr.UpdateConfig("pl", "pem-existing", "gprof", "true")
+	require.NoError(t, err)
+
+	// Agents without a pod name should not be indexed.
+	id, err = ads.GetAgentIDFromPodName("")
+	require.NoError(t, err)
+	assert.Equal(t, "", id)
 }
 
-func TestUpdateAgentDelete(t *testing.T) {
+func TestUpdateHeartbeat(t *testing.T) {
 	ads, agtMgr, _, cleanup := setupManager(t)
 	defer cleanup()
 
-	u, err := uuid.FromString(testutils.UnhealthyAgentUUID)
-	if err != nil {
-		t.Fatal("Could not generate UUID.")
-	}
-	u2, err := uuid.FromString(testutils.UnhealthyKelvinAgentUUID)
+	u, err := uuid.FromString(testutils.ExistingAgentUUID)
 	if err != nil {
 		t.Fatal("Could not generate UUID.")
 	}
 
-	err = agtMgr.DeleteAgent(u)
-	require.NoError(t, err)
-	err = agtMgr.DeleteAgent(u2)
-	require.NoError(t, err)
-
-	agents, err := ads.GetAgents()
+	now := time.Now().UnixNano()
+	err = agtMgr.UpdateHeartbeat(u)
 	require.NoError(t, err)
-	assert.Len(t, agents, 1)
 
+	// Check that correct agent info is in ads.
 	agt, err := ads.GetAgent(u)
 	require.NoError(t, err)
-	assert.Nil(t, agt)
+	assert.NotNil(t, agt)
 
-	hostnameID, err := ads.GetAgentIDForHostnamePair(&agent.HostnameIPPair{"", "127.0.0.2"})
-	require.NoError(t, err)
-	assert.Equal(t, "", hostnameID)
+	assert.Greater(t, agt.LastHeartbeatNS, now)
 }
 
-func TestGetActiveAgents(t *testing.T) {
-	_, agtMgr, _, cleanup := setupManager(t)
+func TestUpdateHeartbeatWithStats(t *testing.T) {
+	ads, agtMgr, _, cleanup := setupManager(t)
 	defer cleanup()
 
-	agents, err := agtMgr.GetActiveAgents()
+	u, err := uuid.FromString(testutils.ExistingAgentUUID)
 	require.NoError(t, err)
 
-	assert.Len(t, agents, 3)
+	status, err := ads.GetAgentStatus(u)
+	require.NoError(t, err)
+	assert.Nil(t, status)
 
-	agentInfo := new(agentpb.Agent)
-	if err := proto.UnmarshalText(testutils.ExistingAgentInfo, agentInfo); err != nil {
-		t.Fatalf("Cannot Unmarshal protobuf for existing agent")
+	now := time.Now().UnixNano()
+	stats := &agentpb.AgentStatus{
+		NSSinceLastHeartbeat: 10,
+		State:                agentpb.AGENT_STATE_HEALTHY,
 	}
-	assert.Contains(t, agents, agentInfo)
+	err = agtMgr.UpdateHeartbeatWithStats(u, stats)
+	require.NoError(t, err)
 
-	agentInfo = new(agentpb.Agent)
-	if err = proto.UnmarshalText(testutils.UnhealthyAgentInfo, agentInfo); err != nil {
-		t.Fatalf("Cannot Unmarshal protobuf for unhealthy agent")
-	}
-	assert.Contains(t, agents, agentInfo)
+	agt, err := ads.GetAgent(u)
+	require.NoError(t, err)
+	assert.Greater(t, agt.LastHeartbeatNS, now)
+	status, err = ads.GetAgentStatus(u)
+	require.NoError(t, err)
+	assert.Equal(t, stats, status)
 
-	agentInfo = new(agentpb.Agent)
-	if err = proto.UnmarshalText(testutils.UnhealthyKelvinAgentInfo, agentInfo); err != nil {
-		t.Fatalf("Cannot Unmarshal protobuf for unhealthy kelvin agent")
-	}
-	assert.Contains(t, agents, agentInfo)
+	// The stats should not carry over to a new registration of the agent.
+	err = agtMgr.DeleteAgent(u)
+	require.NoError(t, err)
+	status, err = ads.GetAgentStatus(u)
+	require.NoError(t, err)
+	assert.Nil(t, status)
+
+	createAgentInADS(t, testutils.ExistingAgentUUID, ads, testutils.ExistingAgentInfo)
+	err = agtMgr.UpdateHeartbeatWithStats(u, stats)
+	require.NoError(t, err)
+	createAgentInADS(t, testutils.ExistingAgentUUID, ads, testutils.ExistingAgentInfo)
+	status, err = ads.GetAgentStatus(u)
+	require.NoError(t, err)
+	assert.Nil(t, status)
 }
 
-func TestApplyUpdates(t *testing.T) {
-	ads, agtMgr, _, cleanup := setupManager(t)
+func TestGetNeverHeartbeatedAgents(t *testing.T) {
+	ads, _, nc, cleanup := setupManager(t)
 	defer cleanup()
 
-	u, err := uuid.FromString(testutils.ExistingAgentUUID)
-	if err != nil {
-		t.Fatal("Could not parse UUID from string.")
-	}
+	fakeClock := clock.NewFakeClock(time.Now())
+	agtMgr := agent.NewManager(ads, nil, nc, agent.Clock(fakeClock))
 
-	schemas := make([]*storepb.TableInfo, 1)
+	u := uuid.FromStringOrNil(testutils.NewAgentUUID)
+	_, err := agtMgr.RegisterAgent(&agentpb.Agent{
+		Info: &agentpb.AgentInfo{
+			HostInfo: &agentpb.HostInfo{
+				Hostname: "localhost",
+				HostIP:   "127.0.0.4",
+			},
+			AgentID: utils.ProtoFromUUID(u),
+			Capabilities: &agentpb.AgentCapabilities{
+				CollectsData: true,
+			},
+		},
+	})
+	require.NoError(t, err)
 
-	schema1 := new(storepb.TableInfo)
-	if err := proto.UnmarshalText(testutils.SchemaInfoPB, schema1); err != nil {
-		t.Fatal("Cannot Unmarshal protobuf.")
+	// The unhealthy fixture agents have never heartbeated either.
+	unhealthyIDs := []uuid.UUID{
+		uuid.FromStringOrNil(testutils.UnhealthyAgentUUID),
+		uuid.FromStringOrNil(testutils.UnhealthyKelvinAgentUUID),
 	}
-	schemas[0] = schema1
+	agentIDs, err := agtMgr.GetNeverHeartbeatedAgents()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, append([]uuid.UUID{u}, unhealthyIDs...), agentIDs)
 
-	createdProcesses := make([]*k8s_metadatapb.ProcessCreated, 2)
+	fakeClock.Step(time.Second)
+	err = agtMgr.UpdateHeartbeat(u)
+	require.NoError(t, err)
 
-	cp1 := new(k8s_metadatapb.ProcessCreated)
-	if err := proto.UnmarshalText(testutils.ProcessCreated1PB, cp1); err != nil {
-		t.Fatal("Cannot Unmarshal protobuf.")
-	}
-	createdProcesses[0] = cp1
-	cp2 := new(k8s_metadatapb.ProcessCreated)
-	if err := proto.UnmarshalText(testutils.ProcessCreated2PB, cp2); err != nil {
-		t.Fatal("Cannot Unmarshal protobuf.")
-	}
-	createdProcesses[1] = cp2
+	agentIDs, err = agtMgr.GetNeverHeartbeatedAgents()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, unhealthyIDs, agentIDs)
+}
 
-	cProcessInfo := make([]*k8s_metadatapb.ProcessInfo, 2)
+func TestAgent_AuditLog(t *testing.T) {
+	ads, _, nc, cleanup := setupManager(t)
+	defer cleanup()
 
-	cpi1 := new(k8s_metadatapb.ProcessInfo)
-	if err := proto.UnmarshalText(testutils.ProcessInfo1PB, cpi1); err != nil {
-		t.Fatal("Cannot Unmarshal protobuf.")
-	}
-	cProcessInfo[0] = cpi1
-	cpi2 := new(k8s_metadatapb.ProcessInfo)
-	if err := proto.UnmarshalText(testutils.ProcessInfo2PB, cpi2); err != nil {
-		t.Fatal("Cannot Unmarshal protobuf.")
-	}
-	cProcessInfo[1] = cpi2
+	now := time.Unix(0, 10)
+	var buf bytes.Buffer
+	agtMgr := agent.NewManager(ads, nil, nc, agent.Clock(clock.NewFakeClock(now)), agent.AuditLog(&buf))
 
-	expectedDataInfo := &messagespb.AgentDataInfo{
-		MetadataInfo: &distributedpb.MetadataInfo{
-			MetadataFields: []metadatapb.MetadataType{
-				metadatapb.CONTAINER_ID,
-				metadatapb.POD_NAME,
+	u := uuid.FromStringOrNil(testutils.NewAgentUUID)
+	_, err := agtMgr.RegisterAgent(&agentpb.Agent{
+		Info: &agentpb.AgentInfo{
+			HostInfo: &agentpb.HostInfo{
+				Hostname: "localhost",
+				HostIP:   "127.0.0.4",
 			},
-			Filter: &distributedpb.MetadataInfo_XXHash64BloomFilter{
-				XXHash64BloomFilter: &bloomfilterpb.XXHash64BloomFilter{
-					Data:      []byte("1234"),
-					NumHashes: 4,
-				},
+			AgentID: utils.ProtoFromUUID(u),
+			Capabilities: &agentpb.AgentCapabilities{
+				CollectsData: true,
 			},
 		},
-	}
+	})
+	require.NoError(t, err)
+	err = agtMgr.DeleteAgent(u)
+	require.NoError(t, err)
 
-	update := &messagespb.AgentUpdateInfo{
-		Schema:         schemas,
-		ProcessCreated: createdProcesses,
-		Data:           expectedDataInfo,
+	var entries []*agent.AuditEntry
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		entry := &agent.AuditEntry{}
+		require.NoError(t, dec.Decode(entry))
+		entries = append(entries, entry)
 	}
+	require.Len(t, entries, 2)
+	assert.Equal(t, agent.AuditOpRegister, entries[0].Operation)
+	assert.Equal(t, agent.AuditOpDelete, entries[1].Operation)
+	for _, entry := range entries {
+		assert.Equal(t, u, entry.AgentID)
+		assert.True(t, now.Equal(entry.Time))
+	}
+}
 
-	agentUpdate := agent.Update{
-		UpdateInfo: update,
-		AgentID:    u,
+func TestAgent_StructuredLogging(t *testing.T) {
+	ads, _, nc, cleanup := setupManager(t)
+	defer cleanup()
+
+	logger, hook := logtest.NewNullLogger()
+	logger.SetLevel(log.DebugLevel)
+	agtMgr := agent.NewManager(ads, nil, nc, agent.Clock(clock.NewFakeClock(time.Now())),
+		agent.Logger(logger.WithField("component", "agent_manager")))
+
+	lastEntry := func(operation string) *log.Entry {
+		entries := hook.AllEntries()
+		for i := len(entries) - 1; i >= 0; i-- {
+			if entries[i].Data["operation"] == operation {
+				return entries[i]
+			}
+		}
+		return nil
 	}
 
-	err = agtMgr.ApplyAgentUpdate(&agentUpdate)
+	u := uuid.FromStringOrNil(testutils.NewAgentUUID)
+	asid, err := agtMgr.RegisterAgent(&agentpb.Agent{
+		Info: &agentpb.AgentInfo{
+			HostInfo: &agentpb.HostInfo{
+				Hostname: "localhost",
+				HostIP:   "127.0.0.4",
+			},
+			AgentID: utils.ProtoFromUUID(u),
+			Capabilities: &agentpb.AgentCapabilities{
+				CollectsData: true,
+			},
+		},
+	})
 	require.NoError(t, err)
+	entry := lastEntry(agent.AuditOpRegister)
+	require.NotNil(t, entry)
+	assert.Equal(t, log.Fields{
+		"component": "agent_manager",
+		"operation": agent.AuditOpRegister,
+		"agentID":   u.String(),
+		"asid":      asid,
+		"hostname":  "localhost",
+	}, entry.Data)
+
+	// A failed update is logged with the agent it came from.
+	existingID := uuid.FromStringOrNil(testutils.ExistingAgentUUID)
+	err = agtMgr.ApplyAgentUpdate(&agent.Update{AgentID: existingID})
+	assert.ErrorIs(t, err, agent.ErrInvalidAgentUpdate)
+	entry = lastEntry("apply_update")
+	require.NotNil(t, entry)
+	assert.Equal(t, log.WarnLevel, entry.Level)
+	assert.Equal(t, existingID.String(), entry.Data["agentID"])
+	assert.Equal(t, agent.ErrInvalidAgentUpdate, entry.Data[log.ErrorKey])
+
+	require.NoError(t, agtMgr.DeleteAgent(u))
+	entry = lastEntry(agent.AuditOpDelete)
+	require.NotNil(t, entry)
+	assert.Equal(t, u.String(), entry.Data["agentID"])
+	assert.Equal(t, asid, entry.Data["asid"])
+
+	require.NoError(t, agtMgr.ExpireAgent(existingID))
+	entry = lastEntry("expire")
+	require.NotNil(t, entry)
+	assert.Equal(t, existingID.String(), entry.Data["agentID"])
+	assert.Equal(t, uint32(123), entry.Data["asid"])
+}
 
-	upid1 := &types.UInt128{
-		Low:  uint64(89101),
-		High: uint64(528280977975),
-	}
+func TestAgentDescription(t *testing.T) {
+	ads, agtMgr, _, cleanup := setupManager(t)
+	defer cleanup()
 
-	upid2 := &types.UInt128{
-		Low:  uint64(468),
-		High: uint64(528280977975),
-	}
+	u, err := uuid.FromString(testutils.ExistingAgentUUID)
+	require.NoError(t, err)
 
-	pInfos, err := ads.GetProcesses([]*types.UInt128{upid1, upid2})
+	err = ads.SetAgentDescription(u, "debug build, do not reap")
 	require.NoError(t, err)
-	assert.Len(t, pInfos, 2)
 
-	assert.Equal(t, cProcessInfo[0], pInfos[0])
-	assert.Equal(t, cProcessInfo[1], pInfos[1])
+	err = agtMgr.UpdateHeartbeat(u)
+	require.NoError(t, err)
 
-	dataInfos, err := ads.GetAgentsDataInfo()
+	desc, err := ads.GetAgentDescription(u)
 	require.NoError(t, err)
-	assert.NotNil(t, dataInfos)
-	dataInfo, present := dataInfos[u]
-	assert.True(t, present)
-	assert.Equal(t, dataInfo, expectedDataInfo)
+	assert.Equal(t, "debug build, do not reap", desc)
+
+	err = agtMgr.DeleteAgent(u)
+	require.NoError(t, err)
+
+	desc, err = ads.GetAgentDescription(u)
+	require.NoError(t, err)
+	assert.Equal(t, "", desc)
+
+	// A description can't be set for an agent which does not exist.
+	err = ads.SetAgentDescription(u, "deleted")
+	assert.Equal(t, agent.ErrAgentNotFound, err)
+	desc, err = ads.GetAgentDescription(u)
+	require.NoError(t, err)
+	assert.Equal(t, "", desc)
 }
 
-func TestApplyUpdatesDeleted(t *testing.T) {
-	ads, agtMgr, _, cleanup := setupManager(t)
+func TestUpdateHeartbeatForNonExistingAgent(t *testing.T) {
+	_, agtMgr, _, cleanup := setupManager(t)
 	defer cleanup()
 
 	u, err := uuid.FromString(testutils.NewAgentUUID)
 	if err != nil {
-		t.Fatal("Could not parse UUID from string.")
+		t.Fatal("Could not generate UUID.")
 	}
 
-	schemas := make([]*storepb.TableInfo, 1)
-
-	schema1 := new(storepb.TableInfo)
-	if err := proto.UnmarshalText(testutils.SchemaInfoPB, schema1); err != nil {
-		t.Fatal("Cannot Unmarshal protobuf.")
-	}
-	schemas[0] = schema1
+	err = agtMgr.UpdateHeartbeat(u)
+	assert.NotNil(t, err)
+}
 
-	createdProcesses := make([]*k8s_metadatapb.ProcessCreated, 2)
+func TestUpdateAgentDelete(t *testing.T) {
+	ads, agtMgr, _, cleanup := setupManager(t)
+	defer cleanup()
 
-	cp1 := new(k8s_metadatapb.ProcessCreated)
-	if err := proto.UnmarshalText(testutils.ProcessCreated1PB, cp1); err != nil {
-		t.Fatal("Cannot Unmarshal protobuf.")
+	u, err := uuid.FromString(testutils.UnhealthyAgentUUID)
+	if err != nil {
+		t.Fatal("Could not generate UUID.")
 	}
-	createdProcesses[0] = cp1
-	cp2 := new(k8s_metadatapb.ProcessCreated)
-	if err := proto.UnmarshalText(testutils.ProcessCreated2PB, cp2); err != nil {
-		t.Fatal("Cannot Unmarshal protobuf.")
+	u2, err := uuid.FromString(testutils.UnhealthyKelvinAgentUUID)
+	if err != nil {
+		t.Fatal("Could not generate UUID.")
 	}
-	createdProcesses[1] = cp2
 
-	cProcessInfo := make([]*k8s_metadatapb.ProcessInfo, 2)
+	err = agtMgr.DeleteAgent(u)
+	require.NoError(t, err)
+	err = agtMgr.DeleteAgent(u2)
+	require.NoError(t, err)
 
-	cpi1 := new(k8s_metadatapb.ProcessInfo)
-	if err := proto.UnmarshalText(testutils.ProcessInfo1PB, cpi1); err != nil {
-		t.Fatal("Cannot Unmarshal protobuf.")
-	}
-	cProcessInfo[0] = cpi1
-	cpi2 := new(k8s_metadatapb.ProcessInfo)
-	if err := proto.UnmarshalText(testutils.ProcessInfo2PB, cpi2); err != nil {
-		t.Fatal("Cannot Unmarshal protobuf.")
-	}
-	cProcessInfo[1] = cpi2
+	agents, err := ads.GetAgents()
+	require.NoError(t, err)
+	assert.Len(t, agents, 1)
 
-	expectedDataInfo := &messagespb.AgentDataInfo{
-		MetadataInfo: &distributedpb.MetadataInfo{
-			MetadataFields: []metadatapb.MetadataType{
-				metadatapb.CONTAINER_ID,
-				metadatapb.POD_NAME,
-			},
-			Filter: &distributedpb.MetadataInfo_XXHash64BloomFilter{
-				XXHash64BloomFilter: &bloomfilterpb.XXHash64BloomFilter{
-					Data:      []byte("1234"),
-					NumHashes: 4,
-				},
-			},
-		},
-	}
+	agt, err := ads.GetAgent(u)
+	require.NoError(t, err)
+	assert.Nil(t, agt)
 
-	update := &messagespb.AgentUpdateInfo{
-		Schema:         schemas,
-		ProcessCreated: createdProcesses,
-		Data:           expectedDataInfo,
-	}
+	hostnameID, err := ads.GetAgentIDForHostnamePair(&agent.HostnameIPPair{"", "127.0.0.2"})
+	require.NoError(t, err)
+	assert.Equal(t, "", hostnameID)
+}
 
-	agentUpdate := agent.Update{
-		UpdateInfo: update,
-		AgentID:    u,
-	}
+func TestUpdateAgentDeleteMultiple(t *testing.T) {
+	ads, agtMgr, _, cleanup := setupManager(t)
+	defer cleanup()
 
-	err = agtMgr.ApplyAgentUpdate(&agentUpdate)
-	require.NoError(t, err)
+	u := uuid.FromStringOrNil(testutils.UnhealthyAgentUUID)
+	u2 := uuid.FromStringOrNil(testutils.UnhealthyKelvinAgentUUID)
 
-	upid1 := &types.UInt128{
-		Low:  uint64(89101),
-		High: uint64(528280977975),
-	}
+	cursor := agtMgr.NewAgentUpdateCursor()
+	// Read out the initial state.
+	_, _, err := agtMgr.GetAgentUpdates(cursor)
+	require.NoError(t, err)
 
-	upid2 := &types.UInt128{
-		Low:  uint64(468),
-		High: uint64(528280977975),
-	}
+	err = agtMgr.DeleteAgents([]uuid.UUID{u2, u, u2})
+	require.NoError(t, err)
 
-	pInfos, err := ads.GetProcesses([]*types.UInt128{upid1, upid2})
+	agents, err := ads.GetAgents()
 	require.NoError(t, err)
-	assert.Len(t, pInfos, 2)
+	require.Len(t, agents, 1)
+	assert.Equal(t, testutils.ExistingAgentUUID, utils.UUIDFromProtoOrNil(agents[0].Info.AgentID).String())
 
-	assert.Nil(t, pInfos[0])
-	assert.Nil(t, pInfos[1])
+	hostnameID, err := ads.GetAgentIDForHostnamePair(&agent.HostnameIPPair{"", "127.0.0.2"})
+	require.NoError(t, err)
+	assert.Equal(t, "", hostnameID)
+	agt, err := ads.GetAgentByASID(456)
+	require.NoError(t, err)
+	assert.Nil(t, agt)
 
-	dataInfos, err := ads.GetAgentsDataInfo()
+	// The deletions are read in the order that the agents were deleted in.
+	updates, _, err := agtMgr.GetAgentUpdates(cursor)
 	require.NoError(t, err)
-	assert.NotNil(t, dataInfos)
-	_, present := dataInfos[u]
-	assert.False(t, present)
+	require.Len(t, updates, 2)
+	assert.Equal(t, utils.ProtoFromUUID(u2), updates[0].AgentID)
+	assert.True(t, updates[0].GetDeleted())
+	assert.Equal(t, utils.ProtoFromUUID(u), updates[1].AgentID)
+	assert.True(t, updates[1].GetDeleted())
 }
 
-func TestAgentTerminatedProcesses(t *testing.T) {
-	ads, agtMgr, _, cleanup := setupManager(t)
+func TestGetActiveAgents(t *testing.T) {
+	_, agtMgr, _, cleanup := setupManager(t)
 	defer cleanup()
 
-	u, err := uuid.FromString(testutils.ExistingAgentUUID)
-	if err != nil {
-		t.Fatal("Could not parse UUID from string.")
-	}
+	agents, err := agtMgr.GetActiveAgents()
+	require.NoError(t, err)
 
-	schemas := make([]*storepb.TableInfo, 1)
+	assert.Len(t, agents, 3)
 
-	schema1 := new(storepb.TableInfo)
-	if err := proto.UnmarshalText(testutils.SchemaInfoPB, schema1); err != nil {
-		t.Fatal("Cannot Unmarshal protobuf.")
+	agentInfo := new(agentpb.Agent)
+	if err := proto.UnmarshalText(testutils.ExistingAgentInfo, agentInfo); err != nil {
+		t.Fatalf("Cannot Unmarshal protobuf for existing agent")
 	}
-	schemas[0] = schema1
-
-	terminatedProcesses := make([]*k8s_metadatapb.ProcessTerminated, 2)
+	assert.Contains(t, agents, agentInfo)
 
-	tp1 := new(k8s_metadatapb.ProcessTerminated)
-	if err := proto.UnmarshalText(testutils.ProcessTerminated1PB, tp1); err != nil {
-		t.Fatal("Cannot Unmarshal protobuf.")
+	agentInfo = new(agentpb.Agent)
+	if err = proto.UnmarshalText(testutils.UnhealthyAgentInfo, agentInfo); err != nil {
+		t.Fatalf("Cannot Unmarshal protobuf for unhealthy agent")
 	}
-	terminatedProcesses[0] = tp1
-	tp2 := new(k8s_metadatapb.ProcessTerminated)
-	if err := proto.UnmarshalText(testutils.ProcessTerminated2PB, tp2); err != nil {
-		t.Fatal("Cannot Unmarshal protobuf.")
+	assert.Contains(t, agents, agentInfo)
+
+	agentInfo = new(agentpb.Agent)
+	if err = proto.UnmarshalText(testutils.UnhealthyKelvinAgentInfo, agentInfo); err != nil {
+		t.Fatalf("Cannot Unmarshal protobuf for unhealthy kelvin agent")
 	}
-	terminatedProcesses[1] = tp2
+	assert.Contains(t, agents, agentInfo)
+}
 
-	createdProcesses := make([]*k8s_metadatapb.ProcessCreated, 2)
+// countingStore counts the number of times that the agents are read from the underlying store.
+type countingStore struct {
+	agent.Store
+	getAgentsCalls int
+}
 
-	cp1 := new(k8s_metadatapb.ProcessCreated)
-	if err := proto.UnmarshalText(testutils.ProcessCreated1PB, cp1); err != nil {
-		t.Fatal("Cannot Unmarshal protobuf.")
-	}
-	createdProcesses[0] = cp1
-	cp2 := new(k8s_metadatapb.ProcessCreated)
-	if err := proto.UnmarshalText(testutils.ProcessCreated2PB, cp2); err != nil {
-		t.Fatal("Cannot Unmarshal protobuf.")
-	}
-	createdProcesses[1] = cp2
+func (c *countingStore) GetAgents() ([]*agentpb.Agent, error) {
+	c.getAgentsCalls++
+	return c.Store.GetAgents()
+}
 
-	updatedInfo := make([]*k8s_metadatapb.ProcessInfo, 2)
-	upi1 := new(k8s_metadatapb.ProcessInfo)
-	if err := proto.UnmarshalText(testutils.ProcessInfo1PB, upi1); err != nil {
-		t.Fatal("Cannot Unmarshal protobuf.")
-	}
-	upi1.StopTimestampNS = 6
-	updatedInfo[0] = upi1
-	upi2 := new(k8s_metadatapb.ProcessInfo)
+func TestGetActiveAgentsCached(t *testing.T) {
+	ads, _, nc, cleanup := setupManager(t)
+	defer cleanup()
+
+	store := &countingStore{Store: ads}
+	agtMgr := agent.NewManager(store, nil, nc)
+
+	agents, err := agtMgr.GetActiveAgents()
+	require.NoError(t, err)
+	assert.Len(t, agents, 3)
+	assert.Equal(t, 1, store.getAgentsCalls)
+
+	// Nothing has changed, so the agents should not be read again.
+	agents2, err := agtMgr.GetActiveAgents()
+	require.NoError(t, err)
+	assert.Equal(t, agents, agents2)
+	assert.Equal(t, 1, store.getAgentsCalls)
+
+	// The returned slice should be a copy of the cache.
+	agents2[0] = nil
+	agents, err = agtMgr.GetActiveAgents()
+	require.NoError(t, err)
+	assert.NotNil(t, agents[0])
+
+	// The returned agents should be copies of the cached agents.
+	agents[0].Info.HostInfo.Hostname = "modified"
+	agents2, err = agtMgr.GetActiveAgents()
+	require.NoError(t, err)
+	assert.NotEqual(t, "modified", agents2[0].Info.HostInfo.Hostname)
+	assert.Equal(t, 1, store.getAgentsCalls)
+
+	err = agtMgr.DeleteAgent(uuid.FromStringOrNil(testutils.UnhealthyAgentUUID))
+	require.NoError(t, err)
+
+	agents, err = agtMgr.GetActiveAgents()
+	require.NoError(t, err)
+	assert.Len(t, agents, 2)
+	assert.Equal(t, 2, store.getAgentsCalls)
+
+	err = agtMgr.UpdateHeartbeat(uuid.FromStringOrNil(testutils.ExistingAgentUUID))
+	require.NoError(t, err)
+
+	_, err = agtMgr.GetActiveAgents()
+	require.NoError(t, err)
+	assert.Equal(t, 3, store.getAgentsCalls)
+}
+
+func TestGetActiveAgentsWithCapability(t *testing.T) {
+	_, agtMgr, _, cleanup := setupManager(t)
+	defer cleanup()
+
+	kelvins, err := agtMgr.GetActiveAgentsWithCapability(false)
+	require.NoError(t, err)
+	require.Len(t, kelvins, 1)
+	assert.Equal(t, testutils.UnhealthyKelvinAgentUUID, utils.UUIDFromProtoOrNil(kelvins[0].Info.AgentID).String())
+
+	pems, err := agtMgr.GetActiveAgentsWithCapability(true)
+	require.NoError(t, err)
+	require.Len(t, pems, 2)
+	assert.Equal(t, uint32(123), pems[0].ASID)
+	assert.Equal(t, uint32(456), pems[1].ASID)
+}
+
+func TestGetActiveAgentsWithCapabilityPinned(t *testing.T) {
+	ads, _, nc, cleanup := setupManager(t)
+	defer cleanup()
+
+	fakeClock := clock.NewFakeClock(time.Now())
+	agtMgr := agent.NewManager(ads, nil, nc, agent.Clock(fakeClock))
+
+	u := uuid.FromStringOrNil(testutils.NewAgentUUID)
+	_, err := agtMgr.RegisterSyntheticAgent(&agentpb.Agent{
+		Info: &agentpb.AgentInfo{
+			HostInfo: &agentpb.HostInfo{
+				Hostname: "localhost",
+				HostIP:   "127.0.0.10",
+			},
+			AgentID:      utils.ProtoFromUUID(u),
+			Capabilities: &agentpb.AgentCapabilities{},
+		},
+	})
+	require.NoError(t, err)
+
+	// The synthetic agent is reported with a current heartbeat, as it is by GetActiveAgents.
+	fakeClock.Step(24 * time.Hour)
+	kelvins, err := agtMgr.GetActiveAgentsWithCapability(false)
+	require.NoError(t, err)
+	require.Len(t, kelvins, 2)
+	assert.Equal(t, uint32(789), kelvins[1].ASID)
+	assert.Equal(t, u, utils.UUIDFromProtoOrNil(kelvins[0].Info.AgentID))
+	assert.Equal(t, fakeClock.Now().UnixNano(), kelvins[0].LastHeartbeatNS)
+}
+
+func TestGetAgentsWithoutDataInfo(t *testing.T) {
+	_, agtMgr, _, cleanup := setupManager(t)
+	defer cleanup()
+
+	existingID := uuid.FromStringOrNil(testutils.ExistingAgentUUID)
+	unhealthyID := uuid.FromStringOrNil(testutils.UnhealthyAgentUUID)
+
+	err := agtMgr.ApplyAgentUpdate(&agent.Update{
+		AgentID: existingID,
+		UpdateInfo: &messagespb.AgentUpdateInfo{
+			Data: &messagespb.AgentDataInfo{
+				MetadataInfo: &distributedpb.MetadataInfo{
+					MetadataFields: []metadatapb.MetadataType{metadatapb.POD_NAME},
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	u, err := uuid.FromString(testutils.NewAgentUUID)
+	require.NoError(t, err)
+	_, err = agtMgr.RegisterAgent(&agentpb.Agent{
+		Info: &agentpb.AgentInfo{
+			HostInfo: &agentpb.HostInfo{
+				Hostname: "localhost",
+				HostIP:   "127.0.0.4",
+			},
+			AgentID: utils.ProtoFromUUID(u),
+			Capabilities: &agentpb.AgentCapabilities{
+				CollectsData: true,
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	agentIDs, err := agtMgr.GetAgentsWithoutDataInfo()
+	require.NoError(t, err)
+	// The Kelvin does not collect data, so it is not expected to have data info.
+	assert.ElementsMatch(t, []uuid.UUID{unhealthyID, u}, agentIDs)
+}
+
+func TestGetAgentsSharingHostIP(t *testing.T) {
+	_, agtMgr, _, cleanup := setupManager(t)
+	defer cleanup()
+
+	shared, err := agtMgr.GetAgentsSharingHostIP()
+	require.NoError(t, err)
+	assert.Len(t, shared, 0)
+
+	u, err := uuid.FromString(testutils.NewAgentUUID)
+	require.NoError(t, err)
+	agentInfo := &agentpb.Agent{
+		Info: &agentpb.AgentInfo{
+			HostInfo: &agentpb.HostInfo{
+				Hostname: "otherhost",
+				HostIP:   "127.0.0.1",
+			},
+			AgentID: utils.ProtoFromUUID(u),
+			Capabilities: &agentpb.AgentCapabilities{
+				CollectsData: true,
+			},
+		},
+	}
+	// The agents share the host IP, so the new agent must take it over.
+	_, err = agtMgr.ForceRegisterAgent(agentInfo)
+	require.NoError(t, err)
+
+	shared, err = agtMgr.GetAgentsSharingHostIP()
+	require.NoError(t, err)
+	assert.Len(t, shared, 1)
+	assert.ElementsMatch(t, []uuid.UUID{uuid.FromStringOrNil(testutils.ExistingAgentUUID), u}, shared["127.0.0.1"])
+}
+
+func TestRegisterAgentHostnameConflict(t *testing.T) {
+	ads, agtMgr, _, cleanup := setupManager(t)
+	defer cleanup()
+
+	u := uuid.FromStringOrNil(testutils.NewAgentUUID)
+	// The existing agent has the same host IP.
+	agentInfo := &agentpb.Agent{
+		Info: &agentpb.AgentInfo{
+			HostInfo: &agentpb.HostInfo{
+				Hostname: "testhost",
+				HostIP:   "127.0.0.1",
+			},
+			AgentID: utils.ProtoFromUUID(u),
+			Capabilities: &agentpb.AgentCapabilities{
+				CollectsData: true,
+			},
+		},
+	}
+	hnPair := &agent.HostnameIPPair{Hostname: "", IP: "127.0.0.1"}
+
+	_, err := agtMgr.RegisterAgent(agentInfo)
+	assert.ErrorIs(t, err, agent.ErrHostnameConflict)
+	agt, err := ads.GetAgent(u)
+	require.NoError(t, err)
+	assert.Nil(t, agt)
+	id, err := ads.GetAgentIDForHostnamePair(hnPair)
+	require.NoError(t, err)
+	assert.Equal(t, testutils.ExistingAgentUUID, id)
+
+	_, err = agtMgr.ForceRegisterAgent(agentInfo)
+	require.NoError(t, err)
+	id, err = ads.GetAgentIDForHostnamePair(hnPair)
+	require.NoError(t, err)
+	assert.Equal(t, testutils.NewAgentUUID, id)
+
+	// Deleting the agent frees its hostname and IP for another agent.
+	require.NoError(t, agtMgr.DeleteAgent(u))
+	agentInfo.Info.AgentID = utils.ProtoFromUUID(uuid.Must(uuid.NewV4()))
+	_, err = agtMgr.RegisterAgent(agentInfo)
+	require.NoError(t, err)
+}
+
+func TestRegisterAgentInvalid(t *testing.T) {
+	ads, agtMgr, _, cleanup := setupManager(t)
+	defer cleanup()
+
+	u := uuid.FromStringOrNil(testutils.NewAgentUUID)
+	hostInfo := &agentpb.HostInfo{
+		Hostname: "testhost",
+		HostIP:   "127.0.0.10",
+	}
+	tests := []struct {
+		name  string
+		agent *agentpb.Agent
+	}{
+		{"nil agent", nil},
+		{"missing info", &agentpb.Agent{}},
+		{"missing agent ID", &agentpb.Agent{
+			Info: &agentpb.AgentInfo{HostInfo: hostInfo},
+		}},
+		{"empty agent ID", &agentpb.Agent{
+			Info: &agentpb.AgentInfo{HostInfo: hostInfo, AgentID: &uuidpb.UUID{}},
+		}},
+		{"missing host info", &agentpb.Agent{
+			Info: &agentpb.AgentInfo{AgentID: utils.ProtoFromUUID(u)},
+		}},
+		{"missing capabilities", &agentpb.Agent{
+			Info: &agentpb.AgentInfo{HostInfo: hostInfo, AgentID: utils.ProtoFromUUID(u)},
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := agtMgr.RegisterAgent(test.agent)
+			assert.ErrorIs(t, err, agent.ErrInvalidAgent)
+
+			// Nothing should be written for the agent, including its hostname index.
+			count, err := ads.GetAgentCount()
+			require.NoError(t, err)
+			assert.Equal(t, 3, count)
+			id, err := ads.GetAgentIDForHostnamePair(&agent.HostnameIPPair{Hostname: "", IP: "127.0.0.10"})
+			require.NoError(t, err)
+			assert.Equal(t, "", id)
+		})
+	}
+
+	// A batch with an invalid agent should register none of the agents.
+	validAgent := &agentpb.Agent{
+		Info: &agentpb.AgentInfo{
+			HostInfo: hostInfo,
+			AgentID:  utils.ProtoFromUUID(u),
+			Capabilities: &agentpb.AgentCapabilities{
+				CollectsData: true,
+			},
+		},
+	}
+	_, err := agtMgr.RegisterAgents([]*agentpb.Agent{validAgent, tests[5].agent})
+	assert.ErrorIs(t, err, agent.ErrInvalidAgent)
+	agt, err := ads.GetAgent(u)
+	require.NoError(t, err)
+	assert.Nil(t, agt)
+}
+
+func TestReassignASID(t *testing.T) {
+	ads, agtMgr, _, cleanup := setupManager(t)
+	defer cleanup()
+
+	u := uuid.FromStringOrNil(testutils.ExistingAgentUUID)
+	cursor := agtMgr.NewAgentUpdateCursor()
+	_, _, err := agtMgr.GetAgentUpdates(cursor)
+	require.NoError(t, err)
+
+	asid, err := agtMgr.ReassignASID(u)
+	require.NoError(t, err)
+	assert.NotEqual(t, uint32(123), asid)
+
+	agt, err := ads.GetAgent(u)
+	require.NoError(t, err)
+	assert.Equal(t, asid, agt.ASID)
+	agt, err = ads.GetAgentByASID(asid)
+	require.NoError(t, err)
+	require.NotNil(t, agt)
+	assert.Equal(t, utils.ProtoFromUUID(u), agt.Info.AgentID)
+	agt, err = ads.GetAgentByASID(123)
+	require.NoError(t, err)
+	assert.Nil(t, agt)
+
+	updates, _, err := agtMgr.GetAgentUpdates(cursor)
+	require.NoError(t, err)
+	require.Len(t, updates, 1)
+	assert.Equal(t, asid, updates[0].GetAgent().ASID)
+
+	// Move the counter back onto the ASID of another live agent, as a botched restore would.
+	for next := uint32(0); next != 455; {
+		next, err = ads.GetASID()
+		require.NoError(t, err)
+	}
+	_, err = agtMgr.ReassignASID(u)
+	assert.ErrorIs(t, err, agent.ErrASIDInUse)
+	agt, err = ads.GetAgent(u)
+	require.NoError(t, err)
+	assert.Equal(t, asid, agt.ASID)
+
+	_, err = agtMgr.ReassignASID(uuid.FromStringOrNil(testutils.NewAgentUUID))
+	assert.Equal(t, agent.ErrAgentNotFound, err)
+}
+
+func TestReconcile(t *testing.T) {
+	ads, agtMgr, _, cleanup := setupManager(t)
+	defer cleanup()
+
+	existingAgent := new(agentpb.Agent)
+	if err := proto.UnmarshalText(testutils.ExistingAgentInfo, existingAgent); err != nil {
+		t.Fatalf("Cannot Unmarshal protobuf for existing agent")
+	}
+	kelvinAgent := new(agentpb.Agent)
+	if err := proto.UnmarshalText(testutils.UnhealthyKelvinAgentInfo, kelvinAgent); err != nil {
+		t.Fatalf("Cannot Unmarshal protobuf for unhealthy kelvin agent")
+	}
+
+	u, err := uuid.FromString(testutils.NewAgentUUID)
+	require.NoError(t, err)
+	newAgent := &agentpb.Agent{
+		Info: &agentpb.AgentInfo{
+			HostInfo: &agentpb.HostInfo{
+				Hostname: "localhost",
+				HostIP:   "127.0.0.4",
+			},
+			AgentID: utils.ProtoFromUUID(u),
+			Capabilities: &agentpb.AgentCapabilities{
+				CollectsData: true,
+			},
+		},
+	}
+
+	result, err := agtMgr.Reconcile([]*agentpb.Agent{existingAgent, kelvinAgent, newAgent})
+	require.NoError(t, err)
+	assert.Equal(t, &agent.ReconcileResult{Registered: 1, Deleted: 1}, result)
+
+	agt, err := ads.GetAgent(uuid.FromStringOrNil(testutils.UnhealthyAgentUUID))
+	require.NoError(t, err)
+	assert.Nil(t, agt)
+
+	agt, err = ads.GetAgent(u)
+	require.NoError(t, err)
+	require.NotNil(t, agt)
+	assert.Equal(t, "127.0.0.4", agt.Info.HostInfo.HostIP)
+
+	agents, err := agtMgr.GetActiveAgents()
+	require.NoError(t, err)
+	assert.Len(t, agents, 3)
+}
+
+func TestReconcileInvalidAgent(t *testing.T) {
+	ads, agtMgr, _, cleanup := setupManager(t)
+	defer cleanup()
+
+	u, err := uuid.FromString(testutils.NewAgentUUID)
+	require.NoError(t, err)
+	newAgent := &agentpb.Agent{
+		Info: &agentpb.AgentInfo{
+			HostInfo: &agentpb.HostInfo{
+				Hostname: "localhost",
+				HostIP:   "127.0.0.4",
+			},
+			AgentID: utils.ProtoFromUUID(u),
+			Capabilities: &agentpb.AgentCapabilities{
+				CollectsData: true,
+			},
+		},
+	}
+
+	// The agent without info comes after a valid new agent, which should not be registered either.
+	result, err := agtMgr.Reconcile([]*agentpb.Agent{newAgent, {}})
+	assert.ErrorIs(t, err, agent.ErrInvalidAgent)
+	assert.Equal(t, &agent.ReconcileResult{}, result)
+
+	agt, err := ads.GetAgent(u)
+	require.NoError(t, err)
+	assert.Nil(t, agt)
+	agents, err := ads.GetAgents()
+	require.NoError(t, err)
+	assert.Len(t, agents, 3)
+}
+
+// quiescingStore calls onGetAgents before the agents are first read from the underlying store.
+type quiescingStore struct {
+	agent.Store
+	onGetAgents func()
+}
+
+func (q *quiescingStore) GetAgents() ([]*agentpb.Agent, error) {
+	if f := q.onGetAgents; f != nil {
+		q.onGetAgents = nil
+		f()
+	}
+	return q.Store.GetAgents()
+}
+
+func TestReconcileWhileQuiescing(t *testing.T) {
+	ads, _, nc, cleanup := setupManager(t)
+	defer cleanup()
+
+	store := &quiescingStore{Store: ads}
+	agtMgr := agent.NewManager(store, nil, nc)
+
+	desired, err := ads.GetAgents()
+	require.NoError(t, err)
+	u, err := uuid.FromString(testutils.NewAgentUUID)
+	require.NoError(t, err)
+	desired = append(desired, &agentpb.Agent{
+		Info: &agentpb.AgentInfo{
+			HostInfo: &agentpb.HostInfo{
+				Hostname: "localhost",
+				HostIP:   "127.0.0.4",
+			},
+			AgentID: utils.ProtoFromUUID(u),
+			Capabilities: &agentpb.AgentCapabilities{
+				CollectsData: true,
+			},
+		},
+	})
+
+	// Quiesce the writes once the reconcile has started. Quiesce waits for the reconcile to complete.
+	released := make(chan func())
+	store.onGetAgents = func() {
+		go func() {
+			release, err := agtMgr.Quiesce()
+			assert.NoError(t, err)
+			released <- release
+		}()
+		assert.Eventually(t, func() bool {
+			return agtMgr.UpdateHeartbeat(uuid.FromStringOrNil(testutils.ExistingAgentUUID)) == agent.ErrQuiesced
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+
+	result, err := agtMgr.Reconcile(desired)
+	require.NoError(t, err)
+	assert.Equal(t, &agent.ReconcileResult{Registered: 1}, result)
+	release := <-released
+	defer release()
+
+	agt, err := ads.GetAgent(u)
+	require.NoError(t, err)
+	assert.NotNil(t, agt)
+}
+
+func TestApplyUpdates(t *testing.T) {
+	ads, agtMgr, _, cleanup := setupManager(t)
+	defer cleanup()
+
+	u, err := uuid.FromString(testutils.ExistingAgentUUID)
+	if err != nil {
+		t.Fatal("Could not parse UUID from string.")
+	}
+
+	schemas := make([]*storepb.TableInfo, 1)
+
+	schema1 := new(storepb.TableInfo)
+	if err := proto.UnmarshalText(testutils.SchemaInfoPB, schema1); err != nil {
+		t.Fatal("Cannot Unmarshal protobuf.")
+	}
+	schemas[0] = schema1
+
+	createdProcesses := make([]*k8s_metadatapb.ProcessCreated, 2)
+
+	cp1 := new(k8s_metadatapb.ProcessCreated)
+	if err := proto.UnmarshalText(testutils.ProcessCreated1PB, cp1); err != nil {
+		t.Fatal("Cannot Unmarshal protobuf.")
+	}
+	createdProcesses[0] = cp1
+	cp2 := new(k8s_metadatapb.ProcessCreated)
+	if err := proto.UnmarshalText(testutils.ProcessCreated2PB, cp2); err != nil {
+		t.Fatal("Cannot Unmarshal protobuf.")
+	}
+	createdProcesses[1] = cp2
+
+	cProcessInfo := make([]*k8s_metadatapb.ProcessInfo, 2)
+
+	cpi1 := new(k8s_metadatapb.ProcessInfo)
+	if err := proto.UnmarshalText(testutils.ProcessInfo1PB, cpi1); err != nil {
+		t.Fatal("Cannot Unmarshal protobuf.")
+	}
+	cProcessInfo[0] = cpi1
+	cpi2 := new(k8s_metadatapb.ProcessInfo)
+	if err := proto.UnmarshalText(testutils.ProcessInfo2PB, cpi2); err != nil {
+		t.Fatal("Cannot Unmarshal protobuf.")
+	}
+	cProcessInfo[1] = cpi2
+
+	expectedDataInfo := &messagespb.AgentDataInfo{
+		MetadataInfo: &distributedpb.MetadataInfo{
+			MetadataFields: []metadatapb.MetadataType{
+				metadatapb.CONTAINER_ID,
+				metadatapb.POD_NAME,
+			},
+			Filter: &distributedpb.MetadataInfo_XXHash64BloomFilter{
+				XXHash64BloomFilter: &bloomfilterpb.XXHash64BloomFilter{
+					Data:      []byte("1234"),
+					NumHashes: 4,
+				},
+			},
+		},
+	}
+
+	update := &messagespb.AgentUpdateInfo{
+		Schema:         schemas,
+		ProcessCreated: createdProcesses,
+		Data:           expectedDataInfo,
+	}
+
+	agentUpdate := agent.Update{
+		UpdateInfo: update,
+		AgentID:    u,
+	}
+
+	err = agtMgr.ApplyAgentUpdate(&agentUpdate)
+	require.NoError(t, err)
+
+	upid1 := &types.UInt128{
+		Low:  uint64(89101),
+		High: uint64(528280977975),
+	}
+
+	upid2 := &types.UInt128{
+		Low:  uint64(468),
+		High: uint64(528280977975),
+	}
+
+	pInfos, err := ads.GetProcesses([]*types.UInt128{upid1, upid2})
+	require.NoError(t, err)
+	assert.Len(t, pInfos, 2)
+
+	assert.Equal(t, cProcessInfo[0], pInfos[0])
+	assert.Equal(t, cProcessInfo[1], pInfos[1])
+
+	dataInfos, err := ads.GetAgentsDataInfo()
+	require.NoError(t, err)
+	assert.NotNil(t, dataInfos)
+	dataInfo, present := dataInfos[u]
+	assert.True(t, present)
+	assert.Equal(t, dataInfo, expectedDataInfo)
+}
+
+func TestApplyUpdatesBatch(t *testing.T) {
+	ads, agtMgr, _, cleanup := setupManager(t)
+	defer cleanup()
+
+	agentA := uuid.FromStringOrNil(testutils.ExistingAgentUUID)
+	agentB := uuid.FromStringOrNil(testutils.UnhealthyAgentUUID)
+	upid := func(asid uint64, pid uint64) *types.UInt128 {
+		return &types.UInt128{High: asid<<32 | pid, Low: 1}
+	}
+	created := func(upid *types.UInt128) *k8s_metadatapb.ProcessCreated {
+		return &k8s_metadatapb.ProcessCreated{UPID: types.ProtoFromUInt128(upid), StartTimestampNS: 1}
+	}
+	schema2 := new(storepb.TableInfo)
+	if err := proto.UnmarshalText(testutils.SchemaInfo2PB, schema2); err != nil {
+		t.Fatal("Cannot Unmarshal protobuf.")
+	}
+
+	err := agtMgr.ApplyAgentUpdates([]*agent.Update{
+		{
+			AgentID: agentA,
+			UpdateInfo: &messagespb.AgentUpdateInfo{
+				ProcessCreated: []*k8s_metadatapb.ProcessCreated{created(upid(123, 1)), created(upid(123, 2))},
+			},
+		},
+		{
+			AgentID: agentB,
+			UpdateInfo: &messagespb.AgentUpdateInfo{
+				ProcessCreated: []*k8s_metadatapb.ProcessCreated{created(upid(456, 1))},
+			},
+		},
+		// An invalid update is rejected without affecting the rest of the batch.
+		{AgentID: agentB},
+		{
+			AgentID: agentA,
+			UpdateInfo: &messagespb.AgentUpdateInfo{
+				ProcessTerminated: []*k8s_metadatapb.ProcessTerminated{
+					{UPID: types.ProtoFromUInt128(upid(123, 1)), StopTimestampNS: 10},
+				},
+				Schema:           []*storepb.TableInfo{schema2},
+				DoesUpdateSchema: true,
+			},
+		},
+		// The later schema update for the agent is applied last.
+		{
+			AgentID: agentA,
+			UpdateInfo: &messagespb.AgentUpdateInfo{
+				DoesUpdateSchema: true,
+			},
+			IncrementalSchema: &agent.SchemaDelta{
+				TablesRemoved: []string{"a_table"},
+			},
+		},
+	})
+	assert.ErrorIs(t, err, agent.ErrInvalidAgentUpdate)
+
+	pInfos, err := ads.GetProcesses([]*types.UInt128{upid(123, 1), upid(123, 2), upid(456, 1)})
+	require.NoError(t, err)
+	require.NotNil(t, pInfos[0])
+	assert.Equal(t, int64(10), pInfos[0].StopTimestampNS)
+	require.NotNil(t, pInfos[1])
+	assert.Equal(t, int64(0), pInfos[1].StopTimestampNS)
+	assert.NotNil(t, pInfos[2])
+
+	_, tables, err := ads.GetAgentWithSchema(agentA)
+	require.NoError(t, err)
+	assert.Len(t, tables, 0)
+	_, tables, err = ads.GetAgentWithSchema(agentB)
+	require.NoError(t, err)
+	require.Len(t, tables, 1)
+	assert.Equal(t, "a_table", tables[0].Name)
+}
+
+func TestApplyUpdatesRateLimited(t *testing.T) {
+	ads, _, nc, cleanup := setupManager(t)
+	defer cleanup()
+
+	fakeClock := clock.NewFakeClock(time.Now())
+	agtMgr := agent.NewManager(ads, nil, nc, agent.Clock(fakeClock), agent.AgentUpdateRateLimit(1, 2))
+
+	floodingAgent := uuid.FromStringOrNil(testutils.ExistingAgentUUID)
+	otherAgent := uuid.FromStringOrNil(testutils.UnhealthyAgentUUID)
+	applyUpdate := func(agentID uuid.UUID) error {
+		return agtMgr.ApplyAgentUpdate(&agent.Update{
+			AgentID:    agentID,
+			UpdateInfo: &messagespb.AgentUpdateInfo{},
+		})
+	}
+
+	// The flooding agent uses up its burst, and its excess updates are limited.
+	require.NoError(t, applyUpdate(floodingAgent))
+	require.NoError(t, applyUpdate(floodingAgent))
+	for i := 0; i < 5; i++ {
+		assert.ErrorIs(t, applyUpdate(floodingAgent), agent.ErrUpdateRateLimited)
+	}
+
+	// The other agent is not affected.
+	require.NoError(t, applyUpdate(otherAgent))
+	require.NoError(t, applyUpdate(otherAgent))
+
+	// The flooding agent can send another update once the limit has refilled.
+	fakeClock.Step(time.Second)
+	require.NoError(t, applyUpdate(floodingAgent))
+	assert.ErrorIs(t, applyUpdate(floodingAgent), agent.ErrUpdateRateLimited)
+}
+
+func TestAgent_HeartbeatUpdateInterval(t *testing.T) {
+	ads, _, nc, cleanup := setupManager(t)
+	defer cleanup()
+
+	fakeClock := clock.NewFakeClock(time.Now())
+	agtMgr := agent.NewManager(ads, nil, nc, agent.Clock(fakeClock), agent.HeartbeatUpdateInterval(10*time.Second))
+
+	agentID := uuid.FromStringOrNil(testutils.ExistingAgentUUID)
+	cursor := agtMgr.NewAgentUpdateCursor()
+	// Read out the initial state.
+	_, _, err := agtMgr.GetAgentUpdates(cursor)
+	require.NoError(t, err)
+
+	heartbeatUpdates := func() int {
+		updates, _, err := agtMgr.GetAgentUpdates(cursor)
+		require.NoError(t, err)
+		count := 0
+		for _, update := range updates {
+			if update.GetAgent() != nil {
+				count++
+			}
+		}
+		return count
+	}
+
+	// A flurry of heartbeats within the interval only sends one update.
+	for i := 0; i < 5; i++ {
+		require.NoError(t, agtMgr.UpdateHeartbeat(agentID))
+		fakeClock.Step(time.Second)
+	}
+	assert.Equal(t, 1, heartbeatUpdates())
+
+	// Every heartbeat is still written to the store.
+	agt, err := ads.GetAgent(agentID)
+	require.NoError(t, err)
+	assert.Equal(t, fakeClock.Now().Add(-time.Second).UnixNano(), agt.LastHeartbeatNS)
+
+	// Another update is sent once the interval has passed.
+	fakeClock.Step(10 * time.Second)
+	require.NoError(t, agtMgr.UpdateHeartbeat(agentID))
+	require.NoError(t, agtMgr.UpdateHeartbeat(agentID))
+	assert.Equal(t, 1, heartbeatUpdates())
+}
+
+func TestApplyUpdatesDeadLetter(t *testing.T) {
+	ads, _, nc, cleanup := setupManager(t)
+	defer cleanup()
+
+	var deadLetters []*agent.DeadLetter
+	onDeadLetter := agent.OnDeadLetter(func(dl *agent.DeadLetter) {
+		deadLetters = append(deadLetters, dl)
+	})
+	agtMgr := agent.NewManager(ads, nil, nc, agent.Clock(clock.NewFakeClock(time.Now())), onDeadLetter)
+
+	agentID := uuid.FromStringOrNil(testutils.ExistingAgentUUID)
+	err := agtMgr.ApplyAgentUpdate(&agent.Update{AgentID: agentID})
+	assert.ErrorIs(t, err, agent.ErrInvalidAgentUpdate)
+	require.Len(t, deadLetters, 1)
+	assert.Equal(t, agentID, deadLetters[0].AgentID)
+	assert.Equal(t, agent.ErrInvalidAgentUpdate.Error(), deadLetters[0].Reason)
+	assert.Nil(t, deadLetters[0].Update)
+
+	// Rejected updates are kept, truncated to a bounded size.
+	limitedMgr := agent.NewManager(ads, nil, nc, agent.Clock(clock.NewFakeClock(time.Now())), onDeadLetter,
+		agent.AgentUpdateRateLimit(1, 0))
+	err = limitedMgr.ApplyAgentUpdate(&agent.Update{
+		AgentID: agentID,
+		UpdateInfo: &messagespb.AgentUpdateInfo{
+			Schema:           []*storepb.TableInfo{{Name: strings.Repeat("a", 10000)}},
+			DoesUpdateSchema: true,
+		},
+	})
+	assert.ErrorIs(t, err, agent.ErrUpdateRateLimited)
+	require.Len(t, deadLetters, 2)
+	assert.Equal(t, agent.ErrUpdateRateLimited.Error(), deadLetters[1].Reason)
+	assert.Len(t, deadLetters[1].Update, 4096)
+
+	// Updates which apply successfully are not dead-lettered.
+	err = agtMgr.ApplyAgentUpdate(&agent.Update{AgentID: agentID, UpdateInfo: &messagespb.AgentUpdateInfo{}})
+	require.NoError(t, err)
+	assert.Len(t, deadLetters, 2)
+}
+
+func TestApplyUpdatesWriteFailure(t *testing.T) {
+	nc, natsCleanup := testingutils.MustStartTestNATS(t)
+	defer natsCleanup()
+	c, err := pebble.Open("test", &pebble.Options{
+		FS: vfs.NewMem(),
+	})
+	require.NoError(t, err)
+	// Limit the value size, so that a large schema fails the write.
+	db := pebbledb.NewWithMaxValueSize(c, 3*time.Second, 1024)
+	defer db.Close()
+	ads := agent.NewDatastore(db, 1*time.Minute)
+	createAgentInADS(t, testutils.ExistingAgentUUID, ads, testutils.ExistingAgentInfo)
+	agtMgr := agent.NewManager(ads, nil, nc)
+
+	agentID := uuid.FromStringOrNil(testutils.ExistingAgentUUID)
+	upid1 := &types.UInt128{High: 123<<32 | 1, Low: 1}
+	upid2 := &types.UInt128{High: 123<<32 | 2, Low: 1}
+	dataInfo := func(field metadatapb.MetadataType) *messagespb.AgentDataInfo {
+		return &messagespb.AgentDataInfo{
+			MetadataInfo: &distributedpb.MetadataInfo{
+				MetadataFields: []metadatapb.MetadataType{field},
+			},
+		}
+	}
+
+	err = agtMgr.ApplyAgentUpdate(&agent.Update{
+		AgentID: agentID,
+		UpdateInfo: &messagespb.AgentUpdateInfo{
+			ProcessCreated: []*k8s_metadatapb.ProcessCreated{
+				{UPID: types.ProtoFromUInt128(upid1), StartTimestampNS: 1},
+			},
+			Data:             dataInfo(metadatapb.POD_NAME),
+			Schema:           []*storepb.TableInfo{{Name: "table1"}},
+			DoesUpdateSchema: true,
+		},
+	})
+	require.NoError(t, err)
+
+	// The large schema fails the write, which should leave all of the update's other changes unapplied.
+	err = agtMgr.ApplyAgentUpdate(&agent.Update{
+		AgentID: agentID,
+		UpdateInfo: &messagespb.AgentUpdateInfo{
+			ProcessCreated: []*k8s_metadatapb.ProcessCreated{
+				{UPID: types.ProtoFromUInt128(upid2), StartTimestampNS: 2},
+			},
+			ProcessTerminated: []*k8s_metadatapb.ProcessTerminated{
+				{UPID: types.ProtoFromUInt128(upid1), StopTimestampNS: 3},
+			},
+			Data:             dataInfo(metadatapb.CONTAINER_ID),
+			Schema:           []*storepb.TableInfo{{Name: strings.Repeat("a", 2000)}},
+			DoesUpdateSchema: true,
+		},
+	})
+	assert.ErrorIs(t, err, pebbledb.ErrValueTooLarge)
+
+	processes, err := ads.GetProcesses([]*types.UInt128{upid1, upid2})
+	require.NoError(t, err)
+	require.NotNil(t, processes[0])
+	assert.Equal(t, int64(0), processes[0].StopTimestampNS)
+	assert.Nil(t, processes[1])
+
+	dataInfos, err := ads.GetAgentsDataInfo()
+	require.NoError(t, err)
+	assert.Equal(t, dataInfo(metadatapb.POD_NAME), dataInfos[agentID])
+
+	tables, err := ads.GetAgentTables(agentID)
+	require.NoError(t, err)
+	require.Len(t, tables, 1)
+	assert.Equal(t, "table1", tables[0].Name)
+}
+
+func TestApplyUpdatesIOFailure(t *testing.T) {
+	nc, natsCleanup := testingutils.MustStartTestNATS(t)
+	defer natsCleanup()
+
+	agentID := uuid.FromStringOrNil(testutils.ExistingAgentUUID)
+	upid1 := &types.UInt128{High: 123<<32 | 1, Low: 1}
+	upid2 := &types.UInt128{High: 123<<32 | 2, Low: 1}
+	dataInfo := func(field metadatapb.MetadataType) *messagespb.AgentDataInfo {
+		return &messagespb.AgentDataInfo{
+			MetadataInfo: &distributedpb.MetadataInfo{
+				MetadataFields: []metadatapb.MetadataType{field},
+			},
+		}
+	}
+
+	// The write fails at each point in turn. The update should either be applied in full, or not at all.
+	for syncs := 0; syncs < 3; syncs++ {
+		fs := pebbledbtest.NewCrashFS()
+		c, err := fs.Open("test")
+		require.NoError(t, err)
+		ads := agent.NewDatastore(pebbledb.New(c, 3*time.Second), 1*time.Minute)
+		createAgentInADS(t, testutils.ExistingAgentUUID, ads, testutils.ExistingAgentInfo)
+		agtMgr := agent.NewManager(ads, nil, nc)
+
+		err = agtMgr.ApplyAgentUpdate(&agent.Update{
+			AgentID: agentID,
+			UpdateInfo: &messagespb.AgentUpdateInfo{
+				ProcessCreated: []*k8s_metadatapb.ProcessCreated{
+					{UPID: types.ProtoFromUInt128(upid1), StartTimestampNS: 1},
+				},
+				Data:             dataInfo(metadatapb.POD_NAME),
+				Schema:           []*storepb.TableInfo{{Name: "table1"}},
+				DoesUpdateSchema: true,
+			},
+		})
+		require.NoError(t, err)
+
+		// Pebble treats a failed write as fatal, so the update panics if its write fails.
+		fs.FailWritesAfter(syncs)
+		failed := false
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					assert.Equal(t, pebbledbtest.ErrFatal, r)
+					failed = true
+				}
+			}()
+			err = agtMgr.ApplyAgentUpdate(&agent.Update{
+				AgentID: agentID,
+				UpdateInfo: &messagespb.AgentUpdateInfo{
+					ProcessCreated: []*k8s_metadatapb.ProcessCreated{
+						{UPID: types.ProtoFromUInt128(upid2), StartTimestampNS: 2},
+					},
+					ProcessTerminated: []*k8s_metadatapb.ProcessTerminated{
+						{UPID: types.ProtoFromUInt128(upid1), StopTimestampNS: 3},
+					},
+					Data:             dataInfo(metadatapb.CONTAINER_ID),
+					Schema:           []*storepb.TableInfo{{Name: "table2"}},
+					DoesUpdateSchema: true,
+				},
+			})
+			require.NoError(t, err)
+		}()
+		if syncs == 0 {
+			assert.True(t, failed)
+		}
+
+		// Restart from what was written to disk.
+		fs.Crash()
+		c, err = fs.Open("test")
+		require.NoError(t, err)
+		db := pebbledb.New(c, 3*time.Second)
+		ads = agent.NewDatastore(db, 1*time.Minute)
+
+		processes, err := ads.GetProcesses([]*types.UInt128{upid1, upid2})
+		require.NoError(t, err)
+		dataInfos, err := ads.GetAgentsDataInfo()
+		require.NoError(t, err)
+		tables, err := ads.GetAgentTables(agentID)
+		require.NoError(t, err)
+		require.Len(t, tables, 1)
+		require.NotNil(t, processes[0])
+
+		if failed {
+			assert.Equal(t, int64(0), processes[0].StopTimestampNS)
+			assert.Nil(t, processes[1])
+			assert.Equal(t, dataInfo(metadatapb.POD_NAME), dataInfos[agentID])
+			assert.Equal(t, "table1", tables[0].Name)
+		} else {
+			assert.Equal(t, int64(3), processes[0].StopTimestampNS)
+			assert.NotNil(t, processes[1])
+			assert.Equal(t, dataInfo(metadatapb.CONTAINER_ID), dataInfos[agentID])
+			assert.Equal(t, "table2", tables[0].Name)
+		}
+		require.NoError(t, db.Close())
+	}
+}
+
+func TestApplyUpdatesDeleted(t *testing.T) {
+	ads, agtMgr, _, cleanup := setupManager(t)
+	defer cleanup()
+
+	u, err := uuid.FromString(testutils.NewAgentUUID)
+	if err != nil {
+		t.Fatal("Could not parse UUID from string.")
+	}
+
+	schemas := make([]*storepb.TableInfo, 1)
+
+	schema1 := new(storepb.TableInfo)
+	if err := proto.UnmarshalText(testutils.SchemaInfoPB, schema1); err != nil {
+		t.Fatal("Cannot Unmarshal protobuf.")
+	}
+	schemas[0] = schema1
+
+	createdProcesses := make([]*k8s_metadatapb.ProcessCreated, 2)
+
+	cp1 := new(k8s_metadatapb.ProcessCreated)
+	if err := proto.UnmarshalText(testutils.ProcessCreated1PB, cp1); err != nil {
+		t.Fatal("Cannot Unmarshal protobuf.")
+	}
+	createdProcesses[0] = cp1
+	cp2 := new(k8s_metadatapb.ProcessCreated)
+	if err := proto.UnmarshalText(testutils.ProcessCreated2PB, cp2); err != nil {
+		t.Fatal("Cannot Unmarshal protobuf.")
+	}
+	createdProcesses[1] = cp2
+
+	cProcessInfo := make([]*k8s_metadatapb.ProcessInfo, 2)
+
+	cpi1 := new(k8s_metadatapb.ProcessInfo)
+	if err := proto.UnmarshalText(testutils.ProcessInfo1PB, cpi1); err != nil {
+		t.Fatal("Cannot Unmarshal protobuf.")
+	}
+	cProcessInfo[0] = cpi1
+	cpi2 := new(k8s_metadatapb.ProcessInfo)
+	if err := proto.UnmarshalText(testutils.ProcessInfo2PB, cpi2); err != nil {
+		t.Fatal("Cannot Unmarshal protobuf.")
+	}
+	cProcessInfo[1] = cpi2
+
+	expectedDataInfo := &messagespb.AgentDataInfo{
+		MetadataInfo: &distributedpb.MetadataInfo{
+			MetadataFields: []metadatapb.MetadataType{
+				metadatapb.CONTAINER_ID,
+				metadatapb.POD_NAME,
+			},
+			Filter: &distributedpb.MetadataInfo_XXHash64BloomFilter{
+				XXHash64BloomFilter: &bloomfilterpb.XXHash64BloomFilter{
+					Data:      []byte("1234"),
+					NumHashes: 4,
+				},
+			},
+		},
+	}
+
+	update := &messagespb.AgentUpdateInfo{
+		Schema:         schemas,
+		ProcessCreated: createdProcesses,
+		Data:           expectedDataInfo,
+	}
+
+	agentUpdate := agent.Update{
+		UpdateInfo: update,
+		AgentID:    u,
+	}
+
+	err = agtMgr.ApplyAgentUpdate(&agentUpdate)
+	require.NoError(t, err)
+
+	upid1 := &types.UInt128{
+		Low:  uint64(89101),
+		High: uint64(528280977975),
+	}
+
+	upid2 := &types.UInt128{
+		Low:  uint64(468),
+		High: uint64(528280977975),
+	}
+
+	pInfos, err := ads.GetProcesses([]*types.UInt128{upid1, upid2})
+	require.NoError(t, err)
+	assert.Len(t, pInfos, 2)
+
+	assert.Nil(t, pInfos[0])
+	assert.Nil(t, pInfos[1])
+
+	dataInfos, err := ads.GetAgentsDataInfo()
+	require.NoError(t, err)
+	assert.NotNil(t, dataInfos)
+	_, present := dataInfos[u]
+	assert.False(t, present)
+}
+
+func TestAgentTerminatedProcesses(t *testing.T) {
+	ads, agtMgr, _, cleanup := setupManager(t)
+	defer cleanup()
+
+	u, err := uuid.FromString(testutils.ExistingAgentUUID)
+	if err != nil {
+		t.Fatal("Could not parse UUID from string.")
+	}
+
+	schemas := make([]*storepb.TableInfo, 1)
+
+	schema1 := new(storepb.TableInfo)
+	if err := proto.UnmarshalText(testutils.SchemaInfoPB, schema1); err != nil {
+		t.Fatal("Cannot Unmarshal protobuf.")
+	}
+	schemas[0] = schema1
+
+	terminatedProcesses := make([]*k8s_metadatapb.ProcessTerminated, 2)
+
+	tp1 := new(k8s_metadatapb.ProcessTerminated)
+	if err := proto.UnmarshalText(testutils.ProcessTerminated1PB, tp1); err != nil {
+		t.Fatal("Cannot Unmarshal protobuf.")
+	}
+	terminatedProcesses[0] = tp1
+	tp2 := new(k8s_metadatapb.ProcessTerminated)
+	if err := proto.UnmarshalText(testutils.ProcessTerminated2PB, tp2); err != nil {
+		t.Fatal("Cannot Unmarshal protobuf.")
+	}
+	terminatedProcesses[1] = tp2
+
+	createdProcesses := make([]*k8s_metadatapb.ProcessCreated, 2)
+
+	cp1 := new(k8s_metadatapb.ProcessCreated)
+	if err := proto.UnmarshalText(testutils.ProcessCreated1PB, cp1); err != nil {
+		t.Fatal("Cannot Unmarshal protobuf.")
+	}
+	createdProcesses[0] = cp1
+	cp2 := new(k8s_metadatapb.ProcessCreated)
+	if err := proto.UnmarshalText(testutils.ProcessCreated2PB, cp2); err != nil {
+		t.Fatal("Cannot Unmarshal protobuf.")
+	}
+	createdProcesses[1] = cp2
+
+	updatedInfo := make([]*k8s_metadatapb.ProcessInfo, 2)
+	upi1 := new(k8s_metadatapb.ProcessInfo)
+	if err := proto.UnmarshalText(testutils.ProcessInfo1PB, upi1); err != nil {
+		t.Fatal("Cannot Unmarshal protobuf.")
+	}
+	upi1.StopTimestampNS = 6
+	updatedInfo[0] = upi1
+	upi2 := new(k8s_metadatapb.ProcessInfo)
 	if err := proto.UnmarshalText(testutils.ProcessInfo2PB, upi2); err != nil {
 		t.Fatal("Cannot Unmarshal protobuf.")
 	}
-	upi2.StopTimestampNS = 10
-	updatedInfo[1] = upi2
+	upi2.StopTimestampNS = 10
+	updatedInfo[1] = upi2
+
+	update := &messagespb.AgentUpdateInfo{
+		Schema:         schemas,
+		ProcessCreated: createdProcesses,
+	}
+
+	agentUpdate := agent.Update{
+		UpdateInfo: update,
+		AgentID:    u,
+	}
+
+	err = agtMgr.ApplyAgentUpdate(&agentUpdate)
+	require.NoError(t, err)
+
+	update = &messagespb.AgentUpdateInfo{
+		Schema:            schemas,
+		ProcessTerminated: terminatedProcesses,
+	}
+
+	agentUpdate = agent.Update{
+		UpdateInfo: update,
+		AgentID:    u,
+	}
+
+	err = agtMgr.ApplyAgentUpdate(&agentUpdate)
+	require.NoError(t, err)
+
+	upid1 := &types.UInt128{
+		Low:  uint64(89101),
+		High: uint64(528280977975),
+	}
+
+	upid2 := &types.UInt128{
+		Low:  uint64(468),
+		High: uint64(528280977975),
+	}
+
+	pInfos, err := ads.GetProcesses([]*types.UInt128{upid1, upid2})
+	require.NoError(t, err)
+	assert.Len(t, pInfos, 2)
+
+	assert.Equal(t, updatedInfo[0], pInfos[0])
+	assert.Equal(t, updatedInfo[1], pInfos[1])
+}
+
+func TestApplyUpdatesLatestProcessCreateWins(t *testing.T) {
+	ads, agtMgr, _, cleanup := setupManager(t)
+	defer cleanup()
+
+	u, err := uuid.FromString(testutils.ExistingAgentUUID)
+	require.NoError(t, err)
+
+	newer := new(k8s_metadatapb.ProcessCreated)
+	if err := proto.UnmarshalText(testutils.ProcessCreated1PB, newer); err != nil {
+		t.Fatal("Cannot Unmarshal protobuf.")
+	}
+	newer.StartTimestampNS = 10
+	older := proto.Clone(newer).(*k8s_metadatapb.ProcessCreated)
+	older.StartTimestampNS = 4
+	older.Cmdline = "./bin/old"
+
+	for _, pc := range []*k8s_metadatapb.ProcessCreated{newer, older} {
+		err = agtMgr.ApplyAgentUpdate(&agent.Update{
+			UpdateInfo: &messagespb.AgentUpdateInfo{
+				ProcessCreated: []*k8s_metadatapb.ProcessCreated{pc},
+			},
+			AgentID: u,
+		})
+		require.NoError(t, err)
+	}
+
+	pInfos, err := ads.GetProcesses([]*types.UInt128{types.UInt128FromProto(newer.UPID)})
+	require.NoError(t, err)
+	require.NotNil(t, pInfos[0])
+	assert.Equal(t, int64(10), pInfos[0].StartTimestampNS)
+	assert.Equal(t, "./bin/bash", pInfos[0].ProcessArgs)
+}
+
+func TestAgent_ListTables(t *testing.T) {
+	_, agtMgr, _, cleanup := setupManager(t)
+	defer cleanup()
+
+	schema2 := new(storepb.TableInfo)
+	if err := proto.UnmarshalText(testutils.SchemaInfo2PB, schema2); err != nil {
+		t.Fatal("Cannot Unmarshal protobuf.")
+	}
+	err := agtMgr.ApplyAgentUpdate(&agent.Update{
+		UpdateInfo: &messagespb.AgentUpdateInfo{
+			Schema:           []*storepb.TableInfo{schema2},
+			DoesUpdateSchema: true,
+		},
+		AgentID: uuid.FromStringOrNil(testutils.ExistingAgentUUID),
+	})
+	require.NoError(t, err)
+
+	tables, err := agtMgr.ListTables()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a_table", "b_table"}, tables)
+
+	table, err := agtMgr.GetTableSchema("b_table")
+	require.NoError(t, err)
+	assert.Equal(t, schema2, table)
+
+	table, err = agtMgr.GetTableSchema("missing_table")
+	require.NoError(t, err)
+	assert.Nil(t, table)
+}
+
+func TestApplyUpdatesDuplicateProcessCreate(t *testing.T) {
+	ads, agtMgr, _, cleanup := setupManager(t)
+	defer cleanup()
+
+	u, err := uuid.FromString(testutils.ExistingAgentUUID)
+	require.NoError(t, err)
+
+	terminated := new(k8s_metadatapb.ProcessCreated)
+	if err := proto.UnmarshalText(testutils.ProcessCreated1PB, terminated); err != nil {
+		t.Fatal("Cannot Unmarshal protobuf.")
+	}
+	terminated.StartTimestampNS = 4
+	live := proto.Clone(terminated).(*k8s_metadatapb.ProcessCreated)
+	live.UPID = types.ProtoFromUInt128(&types.UInt128{High: 123<<32 | 1, Low: 1})
+	upids := []*types.UInt128{types.UInt128FromProto(terminated.UPID), types.UInt128FromProto(live.UPID)}
+
+	apply := func(info *messagespb.AgentUpdateInfo) {
+		err := agtMgr.ApplyAgentUpdate(&agent.Update{
+			UpdateInfo: info,
+			AgentID:    u,
+		})
+		require.NoError(t, err)
+	}
+	apply(&messagespb.AgentUpdateInfo{
+		ProcessCreated: []*k8s_metadatapb.ProcessCreated{terminated, live},
+	})
+	apply(&messagespb.AgentUpdateInfo{
+		ProcessTerminated: []*k8s_metadatapb.ProcessTerminated{
+			{UPID: terminated.UPID, StopTimestampNS: 8},
+		},
+	})
+
+	// The duplicate creates are re-sent with a later start time, as after a reconnect.
+	dupTerminated := proto.Clone(terminated).(*k8s_metadatapb.ProcessCreated)
+	dupTerminated.StartTimestampNS = 10
+	dupLive := proto.Clone(live).(*k8s_metadatapb.ProcessCreated)
+	dupLive.StartTimestampNS = 10
+	dupLive.CID = "new_container"
+	apply(&messagespb.AgentUpdateInfo{
+		ProcessCreated: []*k8s_metadatapb.ProcessCreated{dupTerminated, dupLive},
+	})
+
+	pInfos, err := ads.GetProcesses(upids)
+	require.NoError(t, err)
+	require.NotNil(t, pInfos[0])
+	assert.Equal(t, int64(4), pInfos[0].StartTimestampNS)
+	assert.Equal(t, int64(8), pInfos[0].StopTimestampNS)
+	require.NotNil(t, pInfos[1])
+	assert.Equal(t, int64(4), pInfos[1].StartTimestampNS)
+	assert.Equal(t, int64(0), pInfos[1].StopTimestampNS)
+	assert.Equal(t, "new_container", pInfos[1].CID)
+}
+
+func TestApplyUpdatesDuplicateProcessCreateInBatch(t *testing.T) {
+	ads, agtMgr, _, cleanup := setupManager(t)
+	defer cleanup()
+
+	u, err := uuid.FromString(testutils.ExistingAgentUUID)
+	require.NoError(t, err)
+
+	for pid, reversed := range []bool{false, true} {
+		created := new(k8s_metadatapb.ProcessCreated)
+		if err := proto.UnmarshalText(testutils.ProcessCreated1PB, created); err != nil {
+			t.Fatal("Cannot Unmarshal protobuf.")
+		}
+		created.UPID = types.ProtoFromUInt128(&types.UInt128{High: 123<<32 | uint64(pid+10), Low: 1})
+		created.StartTimestampNS = 100
+		err = agtMgr.ApplyAgentUpdate(&agent.Update{
+			UpdateInfo: &messagespb.AgentUpdateInfo{
+				ProcessCreated: []*k8s_metadatapb.ProcessCreated{created},
+			},
+			AgentID: u,
+		})
+		require.NoError(t, err)
+
+		// Both creates re-send the live process. The one with the latest start time should win, whatever
+		// order they arrive in.
+		later := proto.Clone(created).(*k8s_metadatapb.ProcessCreated)
+		later.StartTimestampNS = 200
+		later.CID = "later_container"
+		earlier := proto.Clone(created).(*k8s_metadatapb.ProcessCreated)
+		earlier.StartTimestampNS = 150
+		earlier.CID = "earlier_container"
+		creates := []*k8s_metadatapb.ProcessCreated{later, earlier}
+		if reversed {
+			creates = []*k8s_metadatapb.ProcessCreated{earlier, later}
+		}
+		err = agtMgr.ApplyAgentUpdate(&agent.Update{
+			UpdateInfo: &messagespb.AgentUpdateInfo{
+				ProcessCreated: creates,
+			},
+			AgentID: u,
+		})
+		require.NoError(t, err)
+
+		pInfos, err := ads.GetProcesses([]*types.UInt128{types.UInt128FromProto(created.UPID)})
+		require.NoError(t, err)
+		require.NotNil(t, pInfos[0])
+		assert.Equal(t, int64(100), pInfos[0].StartTimestampNS)
+		assert.Equal(t, "later_container", pInfos[0].CID)
+	}
+}
+
+func TestApplyUpdatesTablesRemoved(t *testing.T) {
+	_, agtMgr, _, cleanup := setupManager(t)
+	defer cleanup()
+
+	u, err := uuid.FromString(testutils.ExistingAgentUUID)
+	require.NoError(t, err)
+
+	schema1 := new(storepb.TableInfo)
+	if err := proto.UnmarshalText(testutils.SchemaInfoPB, schema1); err != nil {
+		t.Fatal("Cannot Unmarshal protobuf.")
+	}
+	schema2 := new(storepb.TableInfo)
+	if err := proto.UnmarshalText(testutils.SchemaInfo2PB, schema2); err != nil {
+		t.Fatal("Cannot Unmarshal protobuf.")
+	}
+
+	err = agtMgr.ApplyAgentUpdate(&agent.Update{
+		UpdateInfo: &messagespb.AgentUpdateInfo{
+			Schema:           []*storepb.TableInfo{schema1, schema2},
+			DoesUpdateSchema: true,
+		},
+		AgentID: u,
+	})
+	require.NoError(t, err)
+
+	schema, err := agtMgr.GetComputedSchema()
+	require.NoError(t, err)
+	assert.Len(t, schema.Tables, 2)
+	assert.Len(t, schema.TableNameToAgentIDs["a_table"].AgentID, 3)
+	assert.Len(t, schema.TableNameToAgentIDs["b_table"].AgentID, 1)
+
+	err = agtMgr.ApplyAgentUpdate(&agent.Update{
+		UpdateInfo: &messagespb.AgentUpdateInfo{},
+		AgentID:    u,
+		IncrementalSchema: &agent.SchemaDelta{
+			TablesRemoved: []string{"a_table"},
+		},
+	})
+	require.NoError(t, err)
+
+	schema, err = agtMgr.GetComputedSchema()
+	require.NoError(t, err)
+	assert.Len(t, schema.Tables, 2)
+	// The agent should only contribute b_table now.
+	assert.Len(t, schema.TableNameToAgentIDs["a_table"].AgentID, 2)
+	assert.NotContains(t, schema.TableNameToAgentIDs["a_table"].AgentID, utils.ProtoFromUUID(u))
+	assert.Equal(t, []*uuidpb.UUID{utils.ProtoFromUUID(u)}, schema.TableNameToAgentIDs["b_table"].AgentID)
+}
+
+func TestApplyUpdatesIncrementalSchema(t *testing.T) {
+	ads, agtMgr, _, cleanup := setupManager(t)
+	defer cleanup()
+
+	u, err := uuid.FromString(testutils.ExistingAgentUUID)
+	require.NoError(t, err)
+
+	schema2 := new(storepb.TableInfo)
+	if err := proto.UnmarshalText(testutils.SchemaInfo2PB, schema2); err != nil {
+		t.Fatal("Cannot Unmarshal protobuf.")
+	}
+	tableNames := func() []string {
+		tables, err := ads.GetAgentTables(u)
+		require.NoError(t, err)
+		var names []string
+		for _, table := range tables {
+			names = append(names, table.Name)
+		}
+		return names
+	}
+
+	// The new table is added to the agent's existing a_table.
+	err = agtMgr.ApplyAgentUpdate(&agent.Update{
+		UpdateInfo: &messagespb.AgentUpdateInfo{},
+		AgentID:    u,
+		IncrementalSchema: &agent.SchemaDelta{
+			Tables: []*storepb.TableInfo{schema2},
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a_table", "b_table"}, tableNames())
+
+	// Tables can be added and removed in the same update.
+	err = agtMgr.ApplyAgentUpdate(&agent.Update{
+		UpdateInfo: &messagespb.AgentUpdateInfo{},
+		AgentID:    u,
+		IncrementalSchema: &agent.SchemaDelta{
+			Tables:        []*storepb.TableInfo{{Name: "c_table"}},
+			TablesRemoved: []string{"a_table"},
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b_table", "c_table"}, tableNames())
+
+	// A full schema update still replaces all of the agent's tables.
+	err = agtMgr.ApplyAgentUpdate(&agent.Update{
+		UpdateInfo: &messagespb.AgentUpdateInfo{
+			Schema:           []*storepb.TableInfo{schema2},
+			DoesUpdateSchema: true,
+		},
+		AgentID: u,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b_table"}, tableNames())
+}
+
+func TestCanSafelyRemove(t *testing.T) {
+	_, agtMgr, _, cleanup := setupManager(t)
+	defer cleanup()
+
+	u, err := uuid.FromString(testutils.ExistingAgentUUID)
+	require.NoError(t, err)
+
+	// Every agent provides a_table, so any of them can be removed.
+	safe, tables, err := agtMgr.CanSafelyRemove(u)
+	require.NoError(t, err)
+	assert.True(t, safe)
+	assert.Len(t, tables, 0)
+
+	schema1 := new(storepb.TableInfo)
+	if err := proto.UnmarshalText(testutils.SchemaInfoPB, schema1); err != nil {
+		t.Fatal("Cannot Unmarshal protobuf.")
+	}
+	schema2 := new(storepb.TableInfo)
+	if err := proto.UnmarshalText(testutils.SchemaInfo2PB, schema2); err != nil {
+		t.Fatal("Cannot Unmarshal protobuf.")
+	}
+	err = agtMgr.ApplyAgentUpdate(&agent.Update{
+		UpdateInfo: &messagespb.AgentUpdateInfo{
+			Schema:           []*storepb.TableInfo{schema1, schema2},
+			DoesUpdateSchema: true,
+		},
+		AgentID: u,
+	})
+	require.NoError(t, err)
 
-	update := &messagespb.AgentUpdateInfo{
-		Schema:         schemas,
-		ProcessCreated: createdProcesses,
+	// The agent is now the sole provider of b_table.
+	safe, tables, err = agtMgr.CanSafelyRemove(u)
+	require.NoError(t, err)
+	assert.False(t, safe)
+	assert.Equal(t, []string{"b_table"}, tables)
+
+	safe, _, err = agtMgr.CanSafelyRemove(uuid.FromStringOrNil(testutils.UnhealthyAgentUUID))
+	require.NoError(t, err)
+	assert.True(t, safe)
+}
+
+func TestCanSafelyRemoveWithoutSchema(t *testing.T) {
+	agtMgr, cleanup := setupEmptyManager(t)
+	defer cleanup()
+
+	safe, tables, err := agtMgr.CanSafelyRemove(uuid.FromStringOrNil(testutils.ExistingAgentUUID))
+	require.NoError(t, err)
+	assert.True(t, safe)
+	assert.Len(t, tables, 0)
+}
+
+func TestGetUnderReplicatedTables(t *testing.T) {
+	_, agtMgr, _, cleanup := setupManager(t)
+	defer cleanup()
+
+	// a_table is served by all three agents.
+	tables, err := agtMgr.GetUnderReplicatedTables(4)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"a_table": 3}, tables)
+
+	tables, err = agtMgr.GetUnderReplicatedTables(3)
+	require.NoError(t, err)
+	assert.Empty(t, tables)
+}
+
+func TestGetUnderReplicatedTablesWithoutSchema(t *testing.T) {
+	agtMgr, cleanup := setupEmptyManager(t)
+	defer cleanup()
+
+	tables, err := agtMgr.GetUnderReplicatedTables(1)
+	require.NoError(t, err)
+	assert.Empty(t, tables)
+}
+
+func TestAgent_GetAgentUpdate(t *testing.T) {
+	_, agtMgr, _, cleanup := setupManager(t)
+	defer cleanup()
+
+	agUUID0, err := uuid.FromString(testutils.UnhealthyKelvinAgentUUID)
+	require.NoError(t, err)
+	agUUID1, err := uuid.FromString(testutils.UnhealthyAgentUUID)
+	require.NoError(t, err)
+	agUUID2, err := uuid.FromString(testutils.ExistingAgentUUID)
+	require.NoError(t, err)
+	agUUID3, err := uuid.FromString(testutils.NewAgentUUID)
+	require.NoError(t, err)
+
+	// Read the initial agent state.
+	cursor := agtMgr.NewAgentUpdateCursor()
+	updates, schema, err := agtMgr.GetAgentUpdates(cursor)
+	require.NoError(t, err)
+	assert.Len(t, updates, 3)
+	assert.Equal(t, agUUID0, utils.UUIDFromProtoOrNil(updates[0].AgentID))
+	assert.NotNil(t, updates[0].GetAgent())
+	assert.Equal(t, agUUID2, utils.UUIDFromProtoOrNil(updates[1].AgentID))
+	assert.NotNil(t, updates[1].GetAgent())
+	assert.Equal(t, agUUID1, utils.UUIDFromProtoOrNil(updates[2].AgentID))
+	assert.NotNil(t, updates[2].GetAgent())
+	assert.Len(t, schema.Tables, 1)
+	assert.Len(t, schema.TableNameToAgentIDs, 1)
+	assert.Len(t, schema.TableNameToAgentIDs["a_table"].AgentID, 3)
+
+	newAgentInfo := &agentpb.Agent{
+		Info: &agentpb.AgentInfo{
+			HostInfo: &agentpb.HostInfo{
+				Hostname: "localhost",
+				HostIP:   "127.0.0.7",
+			},
+			AgentID: utils.ProtoFromUUID(agUUID3),
+			Capabilities: &agentpb.AgentCapabilities{
+				CollectsData: true,
+			},
+		},
+	}
+
+	oldAgentDataInfo := &messagespb.AgentDataInfo{
+		MetadataInfo: &distributedpb.MetadataInfo{
+			MetadataFields: []metadatapb.MetadataType{
+				metadatapb.CONTAINER_ID,
+				metadatapb.POD_NAME,
+			},
+			Filter: &distributedpb.MetadataInfo_XXHash64BloomFilter{
+				XXHash64BloomFilter: &bloomfilterpb.XXHash64BloomFilter{
+					Data:      []byte("1234"),
+					NumHashes: 4,
+				},
+			},
+		},
+	}
+
+	// Register a new agt.
+	_, err = agtMgr.RegisterAgent(newAgentInfo)
+	require.NoError(t, err)
+
+	schema2 := new(storepb.TableInfo)
+	if err := proto.UnmarshalText(testutils.SchemaInfo2PB, schema2); err != nil {
+		t.Fatal("Cannot Unmarshal protobuf.")
+	}
+
+	// Update data info on agent #2.
+	agentUpdate := agent.Update{
+		UpdateInfo: &messagespb.AgentUpdateInfo{
+			Schema:           []*storepb.TableInfo{schema2},
+			ProcessCreated:   []*k8s_metadatapb.ProcessCreated{},
+			Data:             oldAgentDataInfo,
+			DoesUpdateSchema: true,
+		},
+		AgentID: agUUID2,
+	}
+	err = agtMgr.ApplyAgentUpdate(&agentUpdate)
+	require.NoError(t, err)
+
+	// Check results of first call to GetAgentUpdates.
+	updates, schema, err = agtMgr.GetAgentUpdates(cursor)
+	require.NoError(t, err)
+	assert.Len(t, updates, 2)
+	assert.Equal(t, agUUID3, utils.UUIDFromProtoOrNil(updates[0].AgentID))
+	assert.Equal(t, newAgentInfo.Info, updates[0].GetAgent().Info)
+	assert.Equal(t, agUUID2, utils.UUIDFromProtoOrNil(updates[1].AgentID))
+	assert.Equal(t, oldAgentDataInfo, updates[1].GetDataInfo())
+	assert.Len(t, schema.Tables, 2)
+
+	// Update the heartbeat of an agt.
+	err = agtMgr.UpdateHeartbeat(agUUID2)
+	require.NoError(t, err)
+
+	// Now expire it
+	err = agtMgr.DeleteAgent(agUUID0)
+	require.NoError(t, err)
+	err = agtMgr.DeleteAgent(agUUID1)
+	require.NoError(t, err)
+
+	// Check results of second call to GetAgentUpdates. Deleting the last agents with a_table drops it
+	// from the schema.
+	updates, schema, err = agtMgr.GetAgentUpdates(cursor)
+	require.NoError(t, err)
+	require.NotNil(t, schema)
+	require.Len(t, schema.Tables, 1)
+	assert.Equal(t, "b_table", schema.Tables[0].Name)
+	assert.NotContains(t, schema.TableNameToAgentIDs, "a_table")
+	assert.Len(t, updates, 3)
+	assert.Equal(t, agUUID2, utils.UUIDFromProtoOrNil(updates[0].AgentID))
+	assert.NotNil(t, updates[0].GetAgent())
+	assert.Equal(t, agUUID0, utils.UUIDFromProtoOrNil(updates[1].AgentID))
+	assert.True(t, updates[1].GetDeleted())
+	assert.Equal(t, agUUID1, utils.UUIDFromProtoOrNil(updates[2].AgentID))
+	assert.True(t, updates[2].GetDeleted())
+
+	agtMgr.DeleteAgentUpdateCursor(cursor)
+	// This should throw an error because the cursor has been deleted.
+	_, _, err = agtMgr.GetAgentUpdates(cursor)
+	assert.ErrorIs(t, err, agent.ErrCursorNotFound)
+}
+
+func TestAgent_GetAgentUpdateDroppedTables(t *testing.T) {
+	_, agtMgr, _, cleanup := setupManager(t)
+	defer cleanup()
+
+	u, err := uuid.FromString(testutils.NewAgentUUID)
+	require.NoError(t, err)
+	schema2 := new(storepb.TableInfo)
+	if err := proto.UnmarshalText(testutils.SchemaInfo2PB, schema2); err != nil {
+		t.Fatal("Cannot Unmarshal protobuf.")
+	}
+	registerAgent := func() {
+		_, err := agtMgr.RegisterAgent(&agentpb.Agent{
+			Info: &agentpb.AgentInfo{
+				HostInfo: &agentpb.HostInfo{
+					Hostname: "localhost",
+					HostIP:   "127.0.0.10",
+				},
+				AgentID: utils.ProtoFromUUID(u),
+				Capabilities: &agentpb.AgentCapabilities{
+					CollectsData: true,
+				},
+			},
+		})
+		require.NoError(t, err)
+		err = agtMgr.ApplyAgentUpdate(&agent.Update{
+			AgentID: u,
+			UpdateInfo: &messagespb.AgentUpdateInfo{
+				Schema:           []*storepb.TableInfo{schema2},
+				DoesUpdateSchema: true,
+			},
+		})
+		require.NoError(t, err)
+	}
+
+	registerAgent()
+	cursor := agtMgr.NewAgentUpdateCursor()
+	_, schema, err := agtMgr.GetAgentUpdates(cursor)
+	require.NoError(t, err)
+	assert.Len(t, schema.Tables, 2)
+
+	// Deleting an agent which shares all of its tables doesn't change the schema.
+	err = agtMgr.DeleteAgent(uuid.FromStringOrNil(testutils.UnhealthyAgentUUID))
+	require.NoError(t, err)
+	_, schema, err = agtMgr.GetAgentUpdates(cursor)
+	require.NoError(t, err)
+	assert.Nil(t, schema)
+
+	// Deleting the only agent with b_table drops the table from the schema.
+	err = agtMgr.DeleteAgent(u)
+	require.NoError(t, err)
+	updates, schema, err := agtMgr.GetAgentUpdates(cursor)
+	require.NoError(t, err)
+	require.Len(t, updates, 1)
+	assert.True(t, updates[0].GetDeleted())
+	require.NotNil(t, schema)
+	require.Len(t, schema.Tables, 1)
+	assert.Equal(t, "a_table", schema.Tables[0].Name)
+	assert.NotContains(t, schema.TableNameToAgentIDs, "b_table")
+
+	// If the agent comes back before the cursor is read, the table does not flap out of the schema.
+	registerAgent()
+	err = agtMgr.DeleteAgent(u)
+	require.NoError(t, err)
+	registerAgent()
+	updates, schema, err = agtMgr.GetAgentUpdates(cursor)
+	require.NoError(t, err)
+	assert.Len(t, updates, 3)
+	require.NotNil(t, schema)
+	assert.Len(t, schema.Tables, 2)
+	assert.Contains(t, schema.TableNameToAgentIDs, "b_table")
+}
+
+func TestAgent_GetAgentUpdateTombstones(t *testing.T) {
+	_, agtMgr, _, cleanup := setupManager(t)
+	defer cleanup()
+
+	oldCursor := agtMgr.NewAgentUpdateCursor()
+	_, _, err := agtMgr.GetAgentUpdates(oldCursor)
+	require.NoError(t, err)
+
+	deletedID := uuid.FromStringOrNil(testutils.UnhealthyAgentUUID)
+	err = agtMgr.DeleteAgent(deletedID)
+	require.NoError(t, err)
+
+	// A cursor created after the deletion reads the initial state, which never includes the tombstone.
+	newCursor := agtMgr.NewAgentUpdateCursor()
+	updates, _, err := agtMgr.GetAgentUpdates(newCursor)
+	require.NoError(t, err)
+	assert.Len(t, updates, 2)
+	for _, update := range updates {
+		assert.False(t, update.GetDeleted())
+	}
+
+	// A cursor which hasn't observed the deletion yet still receives the tombstone, exactly once.
+	updates, _, err = agtMgr.GetAgentUpdates(oldCursor)
+	require.NoError(t, err)
+	require.Len(t, updates, 1)
+	assert.True(t, updates[0].GetDeleted())
+	assert.Equal(t, utils.ProtoFromUUID(deletedID), updates[0].AgentID)
+
+	updates, _, err = agtMgr.GetAgentUpdates(oldCursor)
+	require.NoError(t, err)
+	assert.Len(t, updates, 0)
+}
+
+func TestAgent_GetAgentUpdatesLimit(t *testing.T) {
+	_, agtMgr, _, cleanup := setupManager(t)
+	defer cleanup()
+
+	cursor := agtMgr.NewAgentUpdateCursor()
+
+	// The initial state is split across reads.
+	updates, schema, err := agtMgr.GetAgentUpdatesLimit(cursor, 2)
+	require.NoError(t, err)
+	assert.Len(t, updates, 2)
+	assert.NotNil(t, schema)
+	seen := []*uuidpb.UUID{updates[0].AgentID, updates[1].AgentID}
+
+	updates, schema, err = agtMgr.GetAgentUpdatesLimit(cursor, 2)
+	require.NoError(t, err)
+	require.Len(t, updates, 1)
+	assert.Nil(t, schema)
+	seen = append(seen, updates[0].AgentID)
+	assert.ElementsMatch(t, []*uuidpb.UUID{
+		utils.ProtoFromUUID(uuid.FromStringOrNil(testutils.ExistingAgentUUID)),
+		utils.ProtoFromUUID(uuid.FromStringOrNil(testutils.UnhealthyAgentUUID)),
+		utils.ProtoFromUUID(uuid.FromStringOrNil(testutils.UnhealthyKelvinAgentUUID)),
+	}, seen)
+
+	u1, err := uuid.FromString(testutils.NewAgentUUID)
+	require.NoError(t, err)
+	u2 := uuid.Must(uuid.NewV4())
+	for _, u := range []uuid.UUID{u1, u2} {
+		_, err = agtMgr.RegisterAgent(&agentpb.Agent{
+			Info: &agentpb.AgentInfo{
+				HostInfo: &agentpb.HostInfo{
+					Hostname: u.String(),
+					HostIP:   u.String(),
+				},
+				AgentID: utils.ProtoFromUUID(u),
+				Capabilities: &agentpb.AgentCapabilities{
+					CollectsData: true,
+				},
+			},
+		})
+		require.NoError(t, err)
+	}
+
+	schema2 := new(storepb.TableInfo)
+	if err := proto.UnmarshalText(testutils.SchemaInfo2PB, schema2); err != nil {
+		t.Fatal("Cannot Unmarshal protobuf.")
 	}
+	err = agtMgr.ApplyAgentUpdate(&agent.Update{
+		AgentID: u1,
+		UpdateInfo: &messagespb.AgentUpdateInfo{
+			Schema:           []*storepb.TableInfo{schema2},
+			DoesUpdateSchema: true,
+		},
+	})
+	require.NoError(t, err)
+
+	// The updates are returned in order, and the schema is only returned once.
+	updates, schema, err = agtMgr.GetAgentUpdatesLimit(cursor, 1)
+	require.NoError(t, err)
+	require.Len(t, updates, 1)
+	assert.Equal(t, u1, utils.UUIDFromProtoOrNil(updates[0].AgentID))
+	assert.NotNil(t, schema)
+
+	updates, schema, err = agtMgr.GetAgentUpdatesLimit(cursor, 1)
+	require.NoError(t, err)
+	require.Len(t, updates, 1)
+	assert.Equal(t, u2, utils.UUIDFromProtoOrNil(updates[0].AgentID))
+	assert.Nil(t, schema)
+
+	updates, schema, err = agtMgr.GetAgentUpdatesLimit(cursor, 1)
+	require.NoError(t, err)
+	assert.Len(t, updates, 0)
+	assert.Nil(t, schema)
+}
+
+func TestAgent_GetAgentUpdatesAfterRestart(t *testing.T) {
+	ads, agtMgr, nc, cleanup := setupManager(t)
+	defer cleanup()
+
+	cursor := agtMgr.NewAgentUpdateCursor(agent.CursorID(uuid.Must(uuid.NewV4())))
+	updates, _, err := agtMgr.GetAgentUpdates(cursor)
+	require.NoError(t, err)
+	assert.Len(t, updates, 3)
+
+	u, err := uuid.FromString(testutils.NewAgentUUID)
+	require.NoError(t, err)
+	_, err = agtMgr.RegisterAgent(&agentpb.Agent{
+		Info: &agentpb.AgentInfo{
+			HostInfo: &agentpb.HostInfo{
+				Hostname: "localhost",
+				HostIP:   "127.0.0.10",
+			},
+			AgentID: utils.ProtoFromUUID(u),
+			Capabilities: &agentpb.AgentCapabilities{
+				CollectsData: true,
+			},
+		},
+	})
+	require.NoError(t, err)
 
-	agentUpdate := agent.Update{
-		UpdateInfo: update,
-		AgentID:    u,
-	}
+	// A new manager picks up the cursor where the old one left off.
+	restartedMgr := agent.NewManager(ads, nil, nc)
+	assert.Equal(t, cursor, restartedMgr.NewAgentUpdateCursor(agent.CursorID(cursor)))
 
-	err = agtMgr.ApplyAgentUpdate(&agentUpdate)
+	updates, schema, err := restartedMgr.GetAgentUpdates(cursor)
 	require.NoError(t, err)
+	require.Len(t, updates, 1)
+	assert.Equal(t, u, utils.UUIDFromProtoOrNil(updates[0].AgentID))
+	assert.Nil(t, schema)
 
-	update = &messagespb.AgentUpdateInfo{
-		Schema:            schemas,
-		ProcessTerminated: terminatedProcesses,
-	}
+	restartedMgr.DeleteAgentUpdateCursor(cursor)
+	restartedMgr = agent.NewManager(ads, nil, nc)
+	_, _, err = restartedMgr.GetAgentUpdates(cursor)
+	assert.ErrorIs(t, err, agent.ErrCursorNotFound)
+}
 
-	agentUpdate = agent.Update{
-		UpdateInfo: update,
-		AgentID:    u,
-	}
+func TestAgent_OnlyNamedCursorsPersisted(t *testing.T) {
+	ads, agtMgr, nc, cleanup := setupManager(t)
+	defer cleanup()
 
-	err = agtMgr.ApplyAgentUpdate(&agentUpdate)
+	anonymous := agtMgr.NewAgentUpdateCursor()
+	named := agtMgr.NewAgentUpdateCursor(agent.CursorID(uuid.Must(uuid.NewV4())))
+	_, _, err := agtMgr.GetAgentUpdates(anonymous)
+	require.NoError(t, err)
+	_, _, err = agtMgr.GetAgentUpdates(named)
 	require.NoError(t, err)
 
-	upid1 := &types.UInt128{
-		Low:  uint64(89101),
-		High: uint64(528280977975),
-	}
+	cursors, err := ads.GetAgentUpdateCursors()
+	require.NoError(t, err)
+	require.Len(t, cursors, 1)
+	assert.Equal(t, named, cursors[0].ID)
+
+	// Only the named cursor is restored after a restart.
+	restartedMgr := agent.NewManager(ads, nil, nc)
+	_, _, err = restartedMgr.GetAgentUpdates(anonymous)
+	assert.ErrorIs(t, err, agent.ErrCursorNotFound)
+	_, _, err = restartedMgr.GetAgentUpdates(named)
+	require.NoError(t, err)
+}
 
-	upid2 := &types.UInt128{
-		Low:  uint64(468),
-		High: uint64(528280977975),
-	}
+func TestAgent_GetZombieCursors(t *testing.T) {
+	ads, _, nc, cleanup := setupManager(t)
+	defer cleanup()
 
-	pInfos, err := ads.GetProcesses([]*types.UInt128{upid1, upid2})
+	fakeClock := clock.NewFakeClock(time.Now())
+	agtMgr := agent.NewManager(ads, nil, nc, agent.Clock(fakeClock))
+
+	readCursor := agtMgr.NewAgentUpdateCursor()
+	idleCursor := agtMgr.NewAgentUpdateCursor()
+
+	cursors, err := agtMgr.GetZombieCursors(time.Minute)
 	require.NoError(t, err)
-	assert.Len(t, pInfos, 2)
+	assert.Len(t, cursors, 0)
 
-	assert.Equal(t, updatedInfo[0], pInfos[0])
-	assert.Equal(t, updatedInfo[1], pInfos[1])
+	fakeClock.Step(2 * time.Minute)
+	_, _, err = agtMgr.GetAgentUpdates(readCursor)
+	require.NoError(t, err)
+
+	cursors, err = agtMgr.GetZombieCursors(time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, []uuid.UUID{idleCursor}, cursors)
 }
 
-func TestAgent_GetAgentUpdate(t *testing.T) {
-	_, agtMgr, _, cleanup := setupManager(t)
+func TestAgent_ListCursors(t *testing.T) {
+	ads, _, nc, cleanup := setupManager(t)
 	defer cleanup()
 
-	agUUID0, err := uuid.FromString(testutils.UnhealthyKelvinAgentUUID)
+	startTime := time.Unix(0, 1000)
+	fakeClock := clock.NewFakeClock(startTime)
+	agtMgr := agent.NewManager(ads, nil, nc, agent.Clock(fakeClock))
+	assert.Empty(t, agtMgr.ListCursors())
+
+	readCursor := agtMgr.NewAgentUpdateCursor(agent.CursorID(uuid.Must(uuid.NewV4())))
+	fakeClock.Step(time.Minute)
+	idleCursor := agtMgr.NewAgentUpdateCursor(agent.CursorID(uuid.Must(uuid.NewV4())))
+
+	_, _, err := agtMgr.GetAgentUpdates(readCursor)
 	require.NoError(t, err)
-	agUUID1, err := uuid.FromString(testutils.UnhealthyAgentUUID)
+	_, _, err = agtMgr.GetAgentUpdates(idleCursor)
 	require.NoError(t, err)
-	agUUID2, err := uuid.FromString(testutils.ExistingAgentUUID)
+
+	fakeClock.Step(time.Minute)
+	err = agtMgr.ApplyAgentUpdate(&agent.Update{
+		UpdateInfo: &messagespb.AgentUpdateInfo{
+			Data: &messagespb.AgentDataInfo{},
+		},
+		AgentID: uuid.FromStringOrNil(testutils.ExistingAgentUUID),
+	})
 	require.NoError(t, err)
-	agUUID3, err := uuid.FromString(testutils.NewAgentUUID)
+	_, _, err = agtMgr.GetAgentUpdates(readCursor)
 	require.NoError(t, err)
 
-	// Read the initial agent state.
-	cursor := agtMgr.NewAgentUpdateCursor()
-	updates, schema, err := agtMgr.GetAgentUpdates(cursor)
-	require.NoError(t, err)
-	assert.Len(t, updates, 3)
-	assert.Equal(t, agUUID0, utils.UUIDFromProtoOrNil(updates[0].AgentID))
-	assert.NotNil(t, updates[0].GetAgent())
-	assert.Equal(t, agUUID2, utils.UUIDFromProtoOrNil(updates[1].AgentID))
-	assert.NotNil(t, updates[1].GetAgent())
-	assert.Equal(t, agUUID1, utils.UUIDFromProtoOrNil(updates[2].AgentID))
-	assert.NotNil(t, updates[2].GetAgent())
-	assert.Len(t, schema.Tables, 1)
-	assert.Len(t, schema.TableNameToAgentIDs, 1)
-	assert.Len(t, schema.TableNameToAgentIDs["a_table"].AgentID, 3)
+	expected := []agent.CursorInfo{
+		{
+			ID:                  readCursor,
+			CreateTime:          startTime,
+			LastReadTime:        startTime.Add(2 * time.Minute),
+			HasReadInitialState: true,
+		},
+		{
+			ID:                  idleCursor,
+			CreateTime:          startTime.Add(time.Minute),
+			LastReadTime:        startTime.Add(time.Minute),
+			HasReadInitialState: true,
+			PendingUpdates:      1,
+		},
+	}
+	assert.Equal(t, expected, agtMgr.ListCursors())
+
+	// The creation time should survive a restart.
+	restarted := agent.NewManager(ads, nil, nc, agent.Clock(fakeClock))
+	cursors := restarted.ListCursors()
+	require.Len(t, cursors, 2)
+	assert.Equal(t, readCursor, cursors[0].ID)
+	assert.Equal(t, startTime, cursors[0].CreateTime)
+	assert.Equal(t, idleCursor, cursors[1].ID)
+	assert.Equal(t, startTime.Add(time.Minute), cursors[1].CreateTime)
+
+	agtMgr.DeleteAgentUpdateCursor(idleCursor)
+	cursors = agtMgr.ListCursors()
+	require.Len(t, cursors, 1)
+	assert.Equal(t, readCursor, cursors[0].ID)
+}
 
-	newAgentInfo := &agentpb.Agent{
+func TestRegisterSyntheticAgent(t *testing.T) {
+	ads, _, nc, cleanup := setupManager(t)
+	defer cleanup()
+
+	fakeClock := clock.NewFakeClock(time.Now())
+	agtMgr := agent.NewManager(ads, nil, nc, agent.Clock(fakeClock))
+
+	u, err := uuid.FromString(testutils.NewAgentUUID)
+	require.NoError(t, err)
+	_, err = agtMgr.RegisterSyntheticAgent(&agentpb.Agent{
 		Info: &agentpb.AgentInfo{
 			HostInfo: &agentpb.HostInfo{
 				Hostname: "localhost",
-				HostIP:   "127.0.0.7",
+				HostIP:   "127.0.0.10",
 			},
-			AgentID: utils.ProtoFromUUID(agUUID3),
+			AgentID: utils.ProtoFromUUID(u),
 			Capabilities: &agentpb.AgentCapabilities{
 				CollectsData: true,
 			},
 		},
-	}
-
-	oldAgentDataInfo := &messagespb.AgentDataInfo{
-		MetadataInfo: &distributedpb.MetadataInfo{
-			MetadataFields: []metadatapb.MetadataType{
-				metadatapb.CONTAINER_ID,
-				metadatapb.POD_NAME,
-			},
-			Filter: &distributedpb.MetadataInfo_XXHash64BloomFilter{
-				XXHash64BloomFilter: &bloomfilterpb.XXHash64BloomFilter{
-					Data:      []byte("1234"),
-					NumHashes: 4,
-				},
-			},
-		},
-	}
+	})
+	require.NoError(t, err)
 
-	// Register a new agt.
-	_, err = agtMgr.RegisterAgent(newAgentInfo)
+	pinned, err := agtMgr.IsAgentPinned(u)
+	require.NoError(t, err)
+	assert.True(t, pinned)
+	pinned, err = agtMgr.IsAgentPinned(uuid.FromStringOrNil(testutils.ExistingAgentUUID))
 	require.NoError(t, err)
+	assert.False(t, pinned)
 
-	schema2 := new(storepb.TableInfo)
-	if err := proto.UnmarshalText(testutils.SchemaInfo2PB, schema2); err != nil {
-		t.Fatal("Cannot Unmarshal protobuf.")
+	// Long after it would have expired, the synthetic agent is still present with a current heartbeat.
+	fakeClock.Step(24 * time.Hour)
+	agents, err := agtMgr.GetActiveAgents()
+	require.NoError(t, err)
+	var synthetic *agentpb.Agent
+	for _, agt := range agents {
+		if utils.UUIDFromProtoOrNil(agt.Info.AgentID) == u {
+			synthetic = agt
+		}
 	}
+	require.NotNil(t, synthetic)
+	assert.Equal(t, fakeClock.Now().UnixNano(), synthetic.LastHeartbeatNS)
 
-	// Update data info on agent #2.
-	agentUpdate := agent.Update{
-		UpdateInfo: &messagespb.AgentUpdateInfo{
-			Schema:           []*storepb.TableInfo{schema2},
-			ProcessCreated:   []*k8s_metadatapb.ProcessCreated{},
-			Data:             oldAgentDataInfo,
-			DoesUpdateSchema: true,
-		},
-		AgentID: agUUID2,
-	}
-	err = agtMgr.ApplyAgentUpdate(&agentUpdate)
+	// The synthetic agent can still be deleted explicitly.
+	err = agtMgr.DeleteAgent(u)
+	require.NoError(t, err)
+	agents, err = agtMgr.GetActiveAgents()
 	require.NoError(t, err)
+	assert.Len(t, agents, 3)
+	pinned, err = agtMgr.IsAgentPinned(u)
+	require.NoError(t, err)
+	assert.False(t, pinned)
 
-	// Check results of first call to GetAgentUpdates.
-	updates, schema, err = agtMgr.GetAgentUpdates(cursor)
+	// Registering an agent which already exists as a synthetic agent pins it.
+	existingAgent := new(agentpb.Agent)
+	require.NoError(t, proto.UnmarshalText(testutils.ExistingAgentInfo, existingAgent))
+	asid, err := agtMgr.RegisterSyntheticAgent(existingAgent)
 	require.NoError(t, err)
-	assert.Len(t, updates, 2)
-	assert.Equal(t, agUUID3, utils.UUIDFromProtoOrNil(updates[0].AgentID))
-	assert.Equal(t, newAgentInfo.Info, updates[0].GetAgent().Info)
-	assert.Equal(t, agUUID2, utils.UUIDFromProtoOrNil(updates[1].AgentID))
-	assert.Equal(t, oldAgentDataInfo, updates[1].GetDataInfo())
-	assert.Len(t, schema.Tables, 2)
+	assert.Equal(t, uint32(123), asid)
+	pinned, err = agtMgr.IsAgentPinned(uuid.FromStringOrNil(testutils.ExistingAgentUUID))
+	require.NoError(t, err)
+	assert.True(t, pinned)
+}
 
-	// Update the heartbeat of an agt.
-	err = agtMgr.UpdateHeartbeat(agUUID2)
+func TestAgent_Metrics(t *testing.T) {
+	ads, _, nc, cleanup := setupManager(t)
+	defer cleanup()
+
+	reg := prometheus.NewRegistry()
+	agtMgr := agent.NewManager(ads, nil, nc, agent.MetricsRegisterer(reg))
+
+	u, err := uuid.FromString(testutils.NewAgentUUID)
+	require.NoError(t, err)
+	_, err = agtMgr.RegisterAgent(&agentpb.Agent{
+		Info: &agentpb.AgentInfo{
+			HostInfo: &agentpb.HostInfo{
+				Hostname: "localhost",
+				HostIP:   "127.0.0.10",
+			},
+			AgentID: utils.ProtoFromUUID(u),
+			Capabilities: &agentpb.AgentCapabilities{
+				CollectsData: true,
+			},
+		},
+	})
 	require.NoError(t, err)
 
-	// Now expire it
-	err = agtMgr.DeleteAgent(agUUID0)
+	err = agtMgr.UpdateHeartbeat(u)
 	require.NoError(t, err)
-	err = agtMgr.DeleteAgent(agUUID1)
+	err = agtMgr.UpdateHeartbeat(u)
 	require.NoError(t, err)
 
-	// Check results of second call to GetAgentUpdates.
-	updates, schema, err = agtMgr.GetAgentUpdates(cursor)
+	err = agtMgr.ApplyAgentUpdate(&agent.Update{
+		AgentID:    u,
+		UpdateInfo: &messagespb.AgentUpdateInfo{},
+	})
 	require.NoError(t, err)
-	assert.Nil(t, schema)
-	assert.Len(t, updates, 3)
-	assert.Equal(t, agUUID2, utils.UUIDFromProtoOrNil(updates[0].AgentID))
-	assert.NotNil(t, updates[0].GetAgent())
-	assert.Equal(t, agUUID0, utils.UUIDFromProtoOrNil(updates[1].AgentID))
-	assert.True(t, updates[1].GetDeleted())
-	assert.Equal(t, agUUID1, utils.UUIDFromProtoOrNil(updates[2].AgentID))
-	assert.True(t, updates[2].GetDeleted())
 
-	agtMgr.DeleteAgentUpdateCursor(cursor)
-	// This should throw an error because the cursor has been deleted.
-	_, _, err = agtMgr.GetAgentUpdates(cursor)
-	assert.NotNil(t, err)
+	err = agtMgr.DeleteAgent(uuid.FromStringOrNil(testutils.UnhealthyAgentUUID))
+	require.NoError(t, err)
+	// Only the agent which exists should be counted as deleted.
+	err = agtMgr.DeleteAgents([]uuid.UUID{
+		uuid.FromStringOrNil(testutils.UnhealthyAgentUUID),
+		uuid.FromStringOrNil(testutils.UnhealthyKelvinAgentUUID),
+	})
+	require.NoError(t, err)
+
+	expected := `
+# HELP metadata_active_agents Number of agents that are currently active
+# TYPE metadata_active_agents gauge
+metadata_active_agents 2
+# HELP metadata_agent_heartbeats_total Number of agent heartbeats that were processed
+# TYPE metadata_agent_heartbeats_total counter
+metadata_agent_heartbeats_total 2
+# HELP metadata_agent_updates_applied_total Number of calls to apply an agent update
+# TYPE metadata_agent_updates_applied_total counter
+metadata_agent_updates_applied_total 1
+# HELP metadata_agents_deleted_total Number of agents that were deleted, including agents that were deleted because they expired
+# TYPE metadata_agents_deleted_total counter
+metadata_agents_deleted_total 2
+# HELP metadata_agents_registered_total Number of agents that were registered
+# TYPE metadata_agents_registered_total counter
+metadata_agents_registered_total 1
+`
+	err = testutil.GatherAndCompare(reg, strings.NewReader(expected))
+	assert.NoError(t, err)
 }
 
 func TestAgent_UpdateConfig(t *testing.T) {
-	_, agtMgr, nc, cleanup := setupManager(t)
+	tests := []struct {
+		name          string
+		subjectPrefix string
+		subject       string
+	}{
+		{"no prefix", "", "Agent/" + testutils.ExistingAgentUUID},
+		{"prefix", "tenant1", "tenant1/Agent/" + testutils.ExistingAgentUUID},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ads, _, nc, cleanup := setupManager(t)
+			defer cleanup()
+
+			agtMgr := agent.NewManager(ads, nil, nc, agent.SubjectPrefix(test.subjectPrefix))
+
+			var wg sync.WaitGroup
+			wg.Add(1)
+
+			adsub, err := nc.Subscribe(test.subject, func(msg *nats.Msg) {
+				vzMsg := &messagespb.VizierMessage{}
+				err := proto.Unmarshal(msg.Data, vzMsg)
+				require.NoError(t, err)
+				req := vzMsg.GetConfigUpdateMessage().GetConfigUpdateRequest()
+				assert.NotNil(t, req)
+				assert.Equal(t, "gprof", req.Key)
+				assert.Equal(t, "true", req.Value)
+				wg.Done()
+			})
+			require.NoError(t, err)
+			defer func() {
+				err := adsub.Unsubscribe()
+				require.NoError(t, err)
+			}()
+
+			err = agtMgr.UpdateConfig("pl", "pem-existing", "gprof", "true")
+			require.NoError(t, err)
+
+			defer wg.Wait()
+		})
+	}
+}
+
+func TestAgent_UpdateConfigByID(t *testing.T) {
+	ads, agtMgr, nc, cleanup := setupManager(t)
 	defer cleanup()
 
 	var wg sync.WaitGroup
 	wg.Add(1)
 
-	adsub, err := nc.Subscribe("Agent/"+testutils.ExistingAgentUUID, func(msg *nats.Msg) {
+	adsub, err := nc.Subscribe("Agent/"+testutils.UnhealthyAgentUUID, func(msg *nats.Msg) {
 		vzMsg := &messagespb.VizierMessage{}
 		err := proto.Unmarshal(msg.Data, vzMsg)
 		require.NoError(t, err)
@@ -759,8 +2975,158 @@ func TestAgent_UpdateConfig(t *testing.T) {
 		require.NoError(t, err)
 	}()
 
-	err = agtMgr.UpdateConfig("pl", "pem-existing", "gprof", "true")
+	u := uuid.FromStringOrNil(testutils.UnhealthyAgentUUID)
+	err = agtMgr.UpdateConfigByID(u, "gprof", "true")
+	require.NoError(t, err)
+	wg.Wait()
+
+	config, err := ads.GetAgentConfig(u)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"gprof": "true"}, config)
+
+	err = agtMgr.UpdateConfigByID(uuid.FromStringOrNil(testutils.NewAgentUUID), "gprof", "true")
+	assert.Equal(t, agent.ErrAgentNotFound, err)
+}
+
+func TestAgent_GetAgentConfig(t *testing.T) {
+	ads, agtMgr, _, cleanup := setupManager(t)
+	defer cleanup()
+
+	u := uuid.FromStringOrNil(testutils.ExistingAgentUUID)
+	config, err := ads.GetAgentConfig(u)
 	require.NoError(t, err)
+	assert.Empty(t, config)
+
+	require.NoError(t, agtMgr.UpdateConfig("pl", "pem-existing", "gprof", "true"))
+	require.NoError(t, agtMgr.UpdateConfig("pl", "pem-existing", "debug/level", "2"))
+	require.NoError(t, agtMgr.UpdateConfig("pl", "pem-existing", "gprof", "false"))
+
+	config, err = ads.GetAgentConfig(u)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"gprof": "false", "debug/level": "2"}, config)
+
+	// Other agents should not see the config.
+	config, err = ads.GetAgentConfig(uuid.FromStringOrNil(testutils.UnhealthyAgentUUID))
+	require.NoError(t, err)
+	assert.Empty(t, config)
+
+	// The config should be cleared when the agent is deleted, so it is not replayed if the agent registers again.
+	require.NoError(t, agtMgr.DeleteAgent(u))
+	createAgentInADS(t, testutils.ExistingAgentUUID, ads, testutils.ExistingAgentInfo)
+	config, err = ads.GetAgentConfig(u)
+	require.NoError(t, err)
+	assert.Empty(t, config)
+}
+
+func TestAgent_UpdateConfigAll(t *testing.T) {
+	_, agtMgr, nc, cleanup := setupManager(t)
+	defer cleanup()
+
+	adsub, err := nc.SubscribeSync(">")
+	require.NoError(t, err)
+	defer func() {
+		err := adsub.Unsubscribe()
+		require.NoError(t, err)
+	}()
+
+	err = agtMgr.UpdateConfigAll("gprof", "true")
+	require.NoError(t, err)
+
+	// Only the PEMs should receive the config update.
+	var subjects []string
+	for {
+		msg, err := adsub.NextMsg(100 * time.Millisecond)
+		if err == nats.ErrTimeout {
+			break
+		}
+		require.NoError(t, err)
+		vzMsg := &messagespb.VizierMessage{}
+		require.NoError(t, proto.Unmarshal(msg.Data, vzMsg))
+		req := vzMsg.GetConfigUpdateMessage().GetConfigUpdateRequest()
+		require.NotNil(t, req)
+		assert.Equal(t, "gprof", req.Key)
+		assert.Equal(t, "true", req.Value)
+		subjects = append(subjects, msg.Subject)
+	}
+	assert.ElementsMatch(t, []string{
+		"Agent/" + testutils.ExistingAgentUUID,
+		"Agent/" + testutils.UnhealthyAgentUUID,
+	}, subjects)
+}
+
+func TestAgent_SwapConfigAtomic(t *testing.T) {
+	nc, natsCleanup := testingutils.MustStartTestNATS(t)
+	defer natsCleanup()
+	c, err := pebble.Open("test", &pebble.Options{
+		FS: vfs.NewMem(),
+	})
+	require.NoError(t, err)
+	// Limit the value size, so that a large config value fails the write.
+	db := pebbledb.NewWithMaxValueSize(c, 3*time.Second, 256)
+	defer db.Close()
+	ads := agent.NewDatastore(db, 1*time.Minute)
+	createAgentInADS(t, testutils.ExistingAgentUUID, ads, testutils.ExistingAgentInfo)
+	createAgentInADS(t, testutils.UnhealthyAgentUUID, ads, testutils.UnhealthyAgentInfo)
+	agtMgr := agent.NewManager(ads, nil, nc)
+
+	agentIDs := []uuid.UUID{
+		uuid.FromStringOrNil(testutils.ExistingAgentUUID),
+		uuid.FromStringOrNil(testutils.UnhealthyAgentUUID),
+	}
+
+	adsub, err := nc.SubscribeSync(">")
+	require.NoError(t, err)
+	defer func() {
+		err := adsub.Unsubscribe()
+		require.NoError(t, err)
+	}()
+	countMessages := func() int {
+		count := 0
+		for {
+			_, err := adsub.NextMsg(100 * time.Millisecond)
+			if err == nats.ErrTimeout {
+				return count
+			}
+			require.NoError(t, err)
+			count++
+		}
+	}
+
+	err = agtMgr.SwapConfigAtomic(agentIDs, "gprof", "true")
+	require.NoError(t, err)
+	assert.Equal(t, 2, countMessages())
+
+	// If the config can't be persisted, it is neither persisted nor sent for any of the agents.
+	err = agtMgr.SwapConfigAtomic(agentIDs, "gprof", strings.Repeat("a", 1000))
+	assert.ErrorIs(t, err, pebbledb.ErrValueTooLarge)
+	assert.Equal(t, 0, countMessages())
+	for _, agentID := range agentIDs {
+		config, err := ads.GetAgentConfig(agentID)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{"gprof": "true"}, config)
+	}
+}
+
+func TestAgent_UpdateConfigAgentNotFound(t *testing.T) {
+	_, agtMgr, nc, cleanup := setupManager(t)
+	defer cleanup()
+
+	adsub, err := nc.SubscribeSync(">")
+	require.NoError(t, err)
+	defer func() {
+		err := adsub.Unsubscribe()
+		require.NoError(t, err)
+	}()
+
+	err = agtMgr.UpdateConfig("pl", "pem-nonexistent", "gprof", "true")
+	assert.Equal(t, agent.ErrAgentNotFound, err)
+
+	// The pod name index should not resolve to the agent once it is deleted.
+	err = agtMgr.DeleteAgent(uuid.FromStringOrNil(testutils.ExistingAgentUUID))
+	require.NoError(t, err)
+	err = agtMgr.UpdateConfig("pl", "pem-existing", "gprof", "true")
+	assert.Equal(t, agent.ErrAgentNotFound, err)
 
-	defer wg.Wait()
+	_, err = adsub.NextMsg(100 * time.Millisecond)
+	assert.Equal(t, nats.ErrTimeout, err)
 }
@@ -0,0 +1,72 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package agent
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+// The operations which are recorded in the audit log.
+const (
+	AuditOpRegister     = "register"
+	AuditOpDelete       = "delete"
+	AuditOpUpdateConfig = "update_config"
+	AuditOpUpdateSchema = "update_schema"
+	AuditOpReassignASID = "reassign_asid"
+)
+
+// AuditEntry is a single entry in the audit log, describing a mutation made by the agent manager.
+type AuditEntry struct {
+	Time      time.Time `json:"time"`
+	AgentID   uuid.UUID `json:"agentID"`
+	Operation string    `json:"operation"`
+	// Detail is additional information about the operation, such as the config key that was updated.
+	Detail string `json:"detail,omitempty"`
+}
+
+// AuditLog writes an audit entry to w for each agent registration, deletion, config update and schema update.
+// The entries are written as JSON, one per line. There is no audit log by default.
+func AuditLog(w io.Writer) ManagerOption {
+	return func(m *ManagerImpl) {
+		m.auditEncoder = json.NewEncoder(w)
+	}
+}
+
+// audit writes an entry for the operation to the audit log, if there is one.
+func (m *ManagerImpl) audit(agentID uuid.UUID, operation string, detail string) {
+	m.auditMutex.Lock()
+	defer m.auditMutex.Unlock()
+
+	if m.auditEncoder == nil {
+		return
+	}
+	err := m.auditEncoder.Encode(&AuditEntry{
+		Time:      m.clock.Now(),
+		AgentID:   agentID,
+		Operation: operation,
+		Detail:    detail,
+	})
+	if err != nil {
+		m.logger.WithError(err).Error("Failed to write audit log entry")
+	}
+}
@@ -0,0 +1,73 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package agent
+
+import (
+	"math"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// managerMetrics are the metrics tracked by the agent manager. The metrics are always updated, but are
+// only exported if they are registered.
+type managerMetrics struct {
+	agentsRegistered    prometheus.Counter
+	heartbeatsProcessed prometheus.Counter
+	agentsDeleted       prometheus.Counter
+	updatesApplied      prometheus.Counter
+}
+
+func newManagerMetrics() *managerMetrics {
+	return &managerMetrics{
+		agentsRegistered: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "metadata_agents_registered_total",
+			Help: "Number of agents that were registered",
+		}),
+		heartbeatsProcessed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "metadata_agent_heartbeats_total",
+			Help: "Number of agent heartbeats that were processed",
+		}),
+		agentsDeleted: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "metadata_agents_deleted_total",
+			Help: "Number of agents that were deleted, including agents that were deleted because they expired",
+		}),
+		updatesApplied: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "metadata_agent_updates_applied_total",
+			Help: "Number of calls to apply an agent update",
+		}),
+	}
+}
+
+// register registers the metrics, along with a gauge of the number of active agents in the store.
+func (m *managerMetrics) register(reg prometheus.Registerer, agtStore Store) {
+	activeAgents := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "metadata_active_agents",
+		Help: "Number of agents that are currently active",
+	}, func() float64 {
+		count, err := agtStore.GetAgentCount()
+		if err != nil {
+			log.WithError(err).Warn("Failed to get agent count")
+			return math.NaN()
+		}
+		return float64(count)
+	})
+
+	reg.MustRegister(m.agentsRegistered, m.heartbeatsProcessed, m.agentsDeleted, m.updatesApplied, activeAgents)
+}
@@ -0,0 +1,65 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package agent
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrQuiesced is returned by the mutating operations of the agent manager while its writes are quiesced.
+var ErrQuiesced = errors.New("Agent manager writes are quiesced")
+
+// Quiesce stops the agent manager from accepting any new writes, such as agent registrations, deletions,
+// updates and heartbeats, so that the store is stable for maintenance. Writes made while quiesced fail with
+// ErrQuiesced, while reads continue as normal. Quiesce waits for any writes which are in flight to complete
+// before returning. The returned func re-enables writes. ErrQuiesced is returned if the writes are already
+// quiesced.
+func (m *ManagerImpl) Quiesce() (func(), error) {
+	m.quiesceMutex.Lock()
+	if m.quiesced {
+		m.quiesceMutex.Unlock()
+		return nil, ErrQuiesced
+	}
+	m.quiesced = true
+	m.quiesceMutex.Unlock()
+
+	m.inflightWrites.Wait()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			m.quiesceMutex.Lock()
+			defer m.quiesceMutex.Unlock()
+			m.quiesced = false
+		})
+	}, nil
+}
+
+// beginWrite starts a mutating operation, failing with ErrQuiesced if the writes are quiesced. The returned func
+// must be called once the operation completes.
+func (m *ManagerImpl) beginWrite() (func(), error) {
+	m.quiesceMutex.Lock()
+	defer m.quiesceMutex.Unlock()
+	if m.quiesced {
+		return nil, ErrQuiesced
+	}
+	m.inflightWrites.Add(1)
+	return m.inflightWrites.Done, nil
+}
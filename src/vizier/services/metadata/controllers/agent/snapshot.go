@@ -0,0 +1,200 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// snapshotVersion is the version of the snapshot format written by Snapshot.
+const snapshotVersion = 1
+
+// ErrDatastoreNotEmpty is returned when restoring a snapshot into a datastore which already has agent state,
+// without overwriting it.
+var ErrDatastoreNotEmpty = errors.New("Datastore already contains agent state")
+
+// The key prefixes, and the single keys, which hold the agent state. The datastore may be shared with other
+// stores, so only these keys are included in a snapshot.
+var (
+	snapshotPrefixes = []string{
+		agentKeyPrefix,
+		agentConfigPrefix,
+		agentModifiedPrefix,
+		agentStatusPrefix,
+		agentRegisterTimePrefix,
+		agentVersionPrefix,
+		agentDataInfoPrefix,
+		agentDescriptionPrefix,
+		agentUpdateCursorPrefix,
+		asidToAgentIDPrefix,
+		hostnameToAgentIDPrefix,
+		kelvinAgentPrefix,
+		pinnedAgentPrefix,
+		processKeyPrefix,
+		hostnameIPPrefix,
+		podToAgentIDPrefix,
+		processLabelsPrefix,
+		processParentPrefix,
+	}
+	snapshotKeys = []string{
+		agentVersionCounterKey,
+		asidKey,
+		computedSchemaKey,
+	}
+)
+
+type snapshotHeader struct {
+	Version int `json:"version"`
+}
+
+type snapshotEntry struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// Snapshot writes all of the agent state in the datastore to w, so that it can be restored into another
+// datastore with Restore. TTLs are not included, so keys which were set to expire, such as terminated
+// processes, are restored without one. The state is read from a single snapshot of the datastore if the
+// datastore supports it, so that it is consistent.
+func (a *Datastore) Snapshot(w io.Writer) error {
+	reader, closeReader := a.newReader()
+	defer closeReader()
+
+	enc := json.NewEncoder(w)
+	err := enc.Encode(&snapshotHeader{Version: snapshotVersion})
+	if err != nil {
+		return err
+	}
+
+	for _, prefix := range snapshotPrefixes {
+		keys, vals, err := reader.GetWithPrefix(prefix)
+		if err != nil {
+			return err
+		}
+		for i, key := range keys {
+			err = enc.Encode(&snapshotEntry{Key: key, Value: vals[i]})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	vals, err := reader.GetAll(snapshotKeys)
+	if err != nil {
+		return err
+	}
+	for i, key := range snapshotKeys {
+		if vals[i] == nil {
+			continue
+		}
+		err = enc.Encode(&snapshotEntry{Key: key, Value: vals[i]})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Restore reads a snapshot written by Snapshot from r, and writes its agent state to the datastore. If the
+// datastore already has agent state, ErrDatastoreNotEmpty is returned unless overwrite is set, in which case
+// the existing agent state is deleted first. The snapshot is read in full before anything is written, so a
+// malformed snapshot leaves the datastore unchanged.
+func (a *Datastore) Restore(r io.Reader, overwrite bool) error {
+	dec := json.NewDecoder(r)
+	var header snapshotHeader
+	err := dec.Decode(&header)
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot header: %w", err)
+	}
+	if header.Version != snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", header.Version)
+	}
+
+	var keys []string
+	var values []string
+	for {
+		var entry snapshotEntry
+		err = dec.Decode(&entry)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read snapshot entry: %w", err)
+		}
+		keys = append(keys, entry.Key)
+		values = append(values, string(entry.Value))
+	}
+
+	empty, err := a.isEmpty()
+	if err != nil {
+		return err
+	}
+	if !empty {
+		if !overwrite {
+			return ErrDatastoreNotEmpty
+		}
+		err = a.deleteAgentState()
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+	return a.ds.SetAll(keys, values)
+}
+
+// isEmpty returns whether the datastore has no agent state.
+func (a *Datastore) isEmpty() (bool, error) {
+	for _, prefix := range snapshotPrefixes {
+		keys, _, err := a.ds.GetWithPrefix(prefix)
+		if err != nil {
+			return false, err
+		}
+		if len(keys) > 0 {
+			return false, nil
+		}
+	}
+
+	vals, err := a.ds.GetAll(snapshotKeys)
+	if err != nil {
+		return false, err
+	}
+	for _, val := range vals {
+		if val != nil {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// deleteAgentState deletes all of the agent state in the datastore.
+func (a *Datastore) deleteAgentState() error {
+	for _, prefix := range snapshotPrefixes {
+		err := a.ds.DeleteWithPrefix(prefix)
+		if err != nil {
+			return err
+		}
+	}
+	return a.ds.DeleteAll(snapshotKeys)
+}
@@ -41,6 +41,19 @@ const (
 	agentExpirationTimeout = 1 * time.Minute
 )
 
+// AgentExpirationFn returns how long the agent with the given info may go without sending a message before
+// it is expired.
+type AgentExpirationFn func(info *agentpb.AgentInfo) time.Duration
+
+// AgentExpiredFn is called with the ID of an agent which has been expired for not sending a message within its
+// timeout, along with the time of its last heartbeat.
+type AgentExpiredFn func(agentID uuid.UUID, lastHeartbeatNS int64)
+
+// defaultAgentExpiration expires every agent after the same timeout.
+func defaultAgentExpiration(*agentpb.AgentInfo) time.Duration {
+	return agentExpirationTimeout
+}
+
 type concurrentAgentMap struct {
 	unsafeMap map[uuid.UUID]*AgentHandler
 	mapMu     sync.RWMutex
@@ -81,10 +94,16 @@ type AgentTopicListener struct {
 	agtMgr      agent.Manager
 	tpMgr       *tracepoint.Manager
 	sendMessage SendMessageFn
+	expiration  AgentExpirationFn
 
 	// Map from agent ID -> the agentHandler that's responsible for handling that particular
 	// agent's messagespb.
 	agentMap *concurrentAgentMap
+
+	// The functions called when an agent is expired.
+	expiredFns []AgentExpiredFn
+	// Protects expiredFns.
+	expiredFnsMutex sync.Mutex
 }
 
 // AgentHandler is responsible for handling messages for a specific agent.
@@ -93,6 +112,10 @@ type AgentHandler struct {
 	agtMgr agent.Manager
 	tpMgr  *tracepoint.Manager
 	atl    *AgentTopicListener
+	// How long the agent may go without sending a message before it is expired.
+	expiration time.Duration
+	// The time of the agent's last heartbeat. It is only accessed by processMessages.
+	lastHeartbeatNS int64
 
 	MsgChannel chan *nats.Msg
 	quitCh     chan struct{}
@@ -104,10 +127,19 @@ type AgentHandler struct {
 // NewAgentTopicListener creates a new agent topic listener.
 func NewAgentTopicListener(agtMgr agent.Manager, tpMgr *tracepoint.Manager,
 	sendMsgFn SendMessageFn) (*AgentTopicListener, error) {
+	return NewAgentTopicListenerWithExpiration(agtMgr, tpMgr, sendMsgFn, defaultAgentExpiration)
+}
+
+// NewAgentTopicListenerWithExpiration creates a new agent topic listener, which expires each agent after
+// the timeout returned by the given function. This allows, for example, Kelvins to be given a longer
+// timeout than PEMs.
+func NewAgentTopicListenerWithExpiration(agtMgr agent.Manager, tpMgr *tracepoint.Manager,
+	sendMsgFn SendMessageFn, expirationFn AgentExpirationFn) (*AgentTopicListener, error) {
 	atl := &AgentTopicListener{
 		agtMgr:      agtMgr,
 		tpMgr:       tpMgr,
 		sendMessage: sendMsgFn,
+		expiration:  expirationFn,
 		agentMap:    &concurrentAgentMap{unsafeMap: make(map[uuid.UUID]*AgentHandler)},
 	}
 
@@ -133,7 +165,7 @@ func (a *AgentTopicListener) Initialize() error {
 			return err
 		}
 
-		a.createAgentHandler(agentID)
+		a.createAgentHandler(agentID, agt.Info, agt.LastHeartbeatNS)
 	}
 
 	return nil
@@ -180,19 +212,21 @@ func (a *AgentTopicListener) SendMessageToAgent(agentID uuid.UUID, msg messagesp
 }
 
 // This function should only be called when the mutex is already held. It creates a new agent handler for the given id.
-func (a *AgentTopicListener) createAgentHandler(agentID uuid.UUID) *AgentHandler {
+func (a *AgentTopicListener) createAgentHandler(agentID uuid.UUID, info *agentpb.AgentInfo, lastHeartbeatNS int64) *AgentHandler {
 	if ah := a.agentMap.read(agentID); ah != nil {
 		log.WithField("agentID", agentID.String()).Info("Trying to create agent handler that already exists")
 		return ah
 	}
 
 	newAgentHandler := &AgentHandler{
-		id:         agentID,
-		agtMgr:     a.agtMgr,
-		tpMgr:      a.tpMgr,
-		atl:        a,
-		MsgChannel: make(chan *nats.Msg, 10),
-		quitCh:     make(chan struct{}),
+		id:              agentID,
+		agtMgr:          a.agtMgr,
+		tpMgr:           a.tpMgr,
+		atl:             a,
+		expiration:      a.expiration(info),
+		lastHeartbeatNS: lastHeartbeatNS,
+		MsgChannel:      make(chan *nats.Msg, 10),
+		quitCh:          make(chan struct{}),
 	}
 	a.agentMap.write(agentID, newAgentHandler)
 	go newAgentHandler.processMessages()
@@ -239,7 +273,7 @@ func (a *AgentTopicListener) forwardAgentRegisterRequest(m *messagespb.RegisterA
 
 	agentHandler := a.agentMap.read(agentID)
 	if agentHandler == nil {
-		agentHandler = a.createAgentHandler(agentID)
+		agentHandler = a.createAgentHandler(agentID, m.Info, time.Now().UnixNano())
 	}
 	// Add to agent handler to process.
 	agentHandler.MsgChannel <- msg
@@ -253,6 +287,60 @@ func (a *AgentTopicListener) StopAgent(agentID uuid.UUID) {
 	}
 }
 
+// OnAgentExpired registers a function which is called whenever an agent is expired, once it has been deleted.
+// The functions are called synchronously, in the order that they were registered. A function which panics does
+// not stop the others from being called.
+func (a *AgentTopicListener) OnAgentExpired(fn AgentExpiredFn) {
+	a.expiredFnsMutex.Lock()
+	defer a.expiredFnsMutex.Unlock()
+
+	a.expiredFns = append(a.expiredFns, fn)
+}
+
+// notifyAgentExpired calls each of the functions registered with OnAgentExpired.
+func (a *AgentTopicListener) notifyAgentExpired(agentID uuid.UUID, lastHeartbeatNS int64) {
+	a.expiredFnsMutex.Lock()
+	fns := make([]AgentExpiredFn, len(a.expiredFns))
+	copy(fns, a.expiredFns)
+	a.expiredFnsMutex.Unlock()
+
+	for _, fn := range fns {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					log.WithField("agentID", agentID.String()).Errorf("Agent expired callback panicked: %v", r)
+				}
+			}()
+			fn(agentID, lastHeartbeatNS)
+		}()
+	}
+}
+
+// GetStaleAgents returns the agents whose last heartbeat is older than their expiration timeout as of asOfNS.
+// These are the agents which will be expired unless they send a message first. Pinned agents are never
+// expired, so they are not included. No agents are deleted.
+func (a *AgentTopicListener) GetStaleAgents(asOfNS int64) ([]*agentpb.Agent, error) {
+	agents, err := a.agtMgr.GetActiveAgents()
+	if err != nil {
+		return nil, err
+	}
+
+	var staleAgents []*agentpb.Agent
+	for _, agt := range agents {
+		if asOfNS-agt.LastHeartbeatNS <= a.expiration(agt.Info).Nanoseconds() {
+			continue
+		}
+		pinned, err := a.agtMgr.IsAgentPinned(utils.UUIDFromProtoOrNil(agt.Info.AgentID))
+		if err != nil {
+			return nil, err
+		}
+		if !pinned {
+			staleAgents = append(staleAgents, agt)
+		}
+	}
+	return staleAgents, nil
+}
+
 // DeleteAgent deletes the agent from the map. The agent should already be deleted in the agent manager.
 func (a *AgentTopicListener) deleteAgent(agentID uuid.UUID) {
 	// Sends a NACK to the agent with reregister set to false.
@@ -306,8 +394,14 @@ func (a *AgentTopicListener) Stop() {
 func (ah *AgentHandler) processMessages() {
 	ah.wg.Add(1)
 
+	expired := false
 	defer func() {
-		err := ah.agtMgr.DeleteAgent(ah.id)
+		var err error
+		if expired {
+			err = ah.agtMgr.ExpireAgent(ah.id)
+		} else {
+			err = ah.agtMgr.DeleteAgent(ah.id)
+		}
 		if err != nil {
 			log.WithError(err).Error("Failed to delete agent from agent manager")
 		}
@@ -316,10 +410,13 @@ func (ah *AgentHandler) processMessages() {
 		if err != nil {
 			log.WithError(err).Error("Failed to delete agent from tracepoint manager")
 		}
+		if expired {
+			ah.atl.notifyAgentExpired(ah.id, ah.lastHeartbeatNS)
+		}
 		ah.wg.Done()
 	}()
 
-	timer := time.NewTimer(agentExpirationTimeout)
+	timer := time.NewTimer(ah.expiration)
 	for {
 		select {
 		case <-ah.quitCh: // Prioritize the quitChannel.
@@ -352,9 +449,19 @@ func (ah *AgentHandler) processMessages() {
 			if !timer.Stop() {
 				<-timer.C
 			}
-			timer.Reset(agentExpirationTimeout)
+			timer.Reset(ah.expiration)
 		case <-timer.C:
+			pinned, err := ah.agtMgr.IsAgentPinned(ah.id)
+			if err != nil {
+				log.WithError(err).Error("Failed to check whether agent is pinned")
+			}
+			if pinned {
+				// Pinned agents never expire, they are only removed when they are explicitly deleted.
+				timer.Reset(ah.expiration)
+				continue
+			}
 			log.WithField("agentID", ah.id.String()).Info("AgentHandler timed out, deleting agent")
+			expired = true
 			return
 		}
 	}
@@ -365,6 +472,19 @@ func (ah *AgentHandler) onAgentRegisterRequest(m *messagespb.RegisterAgentReques
 	agentID := ah.id
 	log.WithField("agent", agentID.String()).Infof("Received AgentRegisterRequest for agent")
 
+	// Create agent in agent manager.
+	agentInfo := &agentpb.Agent{
+		Info:            m.Info,
+		LastHeartbeatNS: time.Now().UnixNano(),
+		CreateTimeNS:    time.Now().UnixNano(),
+		// This will be set if this is an agent trying to reregister.
+		ASID: m.ASID,
+	}
+	if _, err := agent.ValidateAgent(agentInfo); err != nil {
+		log.WithError(err).Error("Received invalid AgentRegisterRequest")
+		return
+	}
+
 	// Delete agent with same hostname, if any.
 	hostname := ""
 	if !m.Info.Capabilities.CollectsData {
@@ -386,15 +506,6 @@ func (ah *AgentHandler) onAgentRegisterRequest(m *messagespb.RegisterAgentReques
 		}
 	}
 
-	// Create agent in agent manager.
-	agentInfo := &agentpb.Agent{
-		Info:            m.Info,
-		LastHeartbeatNS: time.Now().UnixNano(),
-		CreateTimeNS:    time.Now().UnixNano(),
-		// This will be set if this is an agent trying to reregister.
-		ASID: m.ASID,
-	}
-
 	asid, err := ah.agtMgr.RegisterAgent(agentInfo)
 	if err != nil {
 		log.WithError(err).Error("Could not create agent.")
@@ -455,6 +566,7 @@ func (ah *AgentHandler) onAgentHeartbeat(m *messagespb.Heartbeat) {
 		}
 		return
 	}
+	ah.lastHeartbeatNS = time.Now().UnixNano()
 
 	// Create heartbeat ACK message.
 	resp := messagespb.VizierMessage{
@@ -479,7 +591,7 @@ func (ah *AgentHandler) onAgentHeartbeat(m *messagespb.Heartbeat) {
 	if m.UpdateInfo != nil {
 		err = ah.agtMgr.ApplyAgentUpdate(&agent.Update{AgentID: agentID, UpdateInfo: m.UpdateInfo})
 		if err != nil {
-			log.WithError(err).Error("Could not apply agent updates")
+			log.WithError(err).WithField("agentID", agentID.String()).Error("Could not apply agent updates")
 		}
 	}
 }
@@ -586,3 +586,192 @@ func TestAgentStop(t *testing.T) {
 
 	atl.StopAgent(u)
 }
+
+func TestAgentExpiration(t *testing.T) {
+	kelvinID, err := uuid.FromString(testutils.UnhealthyKelvinAgentUUID)
+	require.NoError(t, err)
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockAgtMgr := mock_agent.NewMockManager(ctrl)
+	mockTracepointStore := mock_tracepoint.NewMockStore(ctrl)
+
+	agentInfo := new(agentpb.Agent)
+	if err := proto.UnmarshalText(testutils.UnhealthyKelvinAgentInfo, agentInfo); err != nil {
+		t.Fatalf("Cannot Unmarshal protobuf for unhealthy kelvin agent")
+	}
+	mockAgtMgr.
+		EXPECT().
+		GetActiveAgents().
+		Return([]*agentpb.Agent{agentInfo}, nil)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	mockAgtMgr.
+		EXPECT().
+		IsAgentPinned(kelvinID).
+		Return(false, nil)
+	mockAgtMgr.
+		EXPECT().
+		ExpireAgent(kelvinID).
+		Return(nil)
+	mockTracepointStore.
+		EXPECT().
+		DeleteTracepointsForAgent(kelvinID).
+		DoAndReturn(func(uuid.UUID) error {
+			wg.Done()
+			return nil
+		})
+
+	sendMsg := assertSendMessageCalledWith(t, "Agent/"+testutils.UnhealthyKelvinAgentUUID,
+		messagespb.VizierMessage{
+			Msg: &messagespb.VizierMessage_HeartbeatNack{
+				HeartbeatNack: &messagespb.HeartbeatNack{
+					Reregister: false,
+				},
+			},
+		})
+
+	// Kelvins expire quickly, while all other agents use the default timeout.
+	expirationFn := func(info *agentpb.AgentInfo) time.Duration {
+		if !info.Capabilities.CollectsData {
+			return 100 * time.Millisecond
+		}
+		return 1 * time.Minute
+	}
+
+	tracepointMgr := tracepoint.NewManager(mockTracepointStore, mockAgtMgr, 5*time.Second)
+	defer tracepointMgr.Close()
+	_, err = controllers.NewAgentTopicListenerWithExpiration(mockAgtMgr, tracepointMgr, sendMsg, expirationFn)
+	require.NoError(t, err)
+
+	wg.Wait()
+}
+
+func TestAgentExpirationCallback(t *testing.T) {
+	kelvinID, err := uuid.FromString(testutils.UnhealthyKelvinAgentUUID)
+	require.NoError(t, err)
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockAgtMgr := mock_agent.NewMockManager(ctrl)
+	mockTracepointStore := mock_tracepoint.NewMockStore(ctrl)
+
+	agentInfo := new(agentpb.Agent)
+	if err := proto.UnmarshalText(testutils.UnhealthyKelvinAgentInfo, agentInfo); err != nil {
+		t.Fatalf("Cannot Unmarshal protobuf for unhealthy kelvin agent")
+	}
+	agentInfo.LastHeartbeatNS = 10
+	mockAgtMgr.
+		EXPECT().
+		GetActiveAgents().
+		Return([]*agentpb.Agent{agentInfo}, nil)
+	mockAgtMgr.
+		EXPECT().
+		IsAgentPinned(kelvinID).
+		Return(false, nil)
+	mockAgtMgr.
+		EXPECT().
+		ExpireAgent(kelvinID).
+		Return(nil)
+	mockTracepointStore.
+		EXPECT().
+		DeleteTracepointsForAgent(kelvinID).
+		Return(nil)
+
+	sendMsg := func(topic string, b []byte) error {
+		return nil
+	}
+	expirationFn := func(info *agentpb.AgentInfo) time.Duration {
+		return 100 * time.Millisecond
+	}
+
+	type expiredAgent struct {
+		id              uuid.UUID
+		lastHeartbeatNS int64
+	}
+	expiredCh := make(chan expiredAgent, 1)
+
+	tracepointMgr := tracepoint.NewManager(mockTracepointStore, mockAgtMgr, 5*time.Second)
+	defer tracepointMgr.Close()
+	atl, err := controllers.NewAgentTopicListenerWithExpiration(mockAgtMgr, tracepointMgr, sendMsg, expirationFn)
+	require.NoError(t, err)
+	// A callback which panics should not stop the others from being called.
+	atl.OnAgentExpired(func(uuid.UUID, int64) {
+		panic("callback failed")
+	})
+	atl.OnAgentExpired(func(id uuid.UUID, lastHeartbeatNS int64) {
+		expiredCh <- expiredAgent{id, lastHeartbeatNS}
+	})
+
+	select {
+	case expired := <-expiredCh:
+		assert.Equal(t, expiredAgent{kelvinID, 10}, expired)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Agent expired callback was not called")
+	}
+}
+
+func TestGetStaleAgents(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockAgtMgr := mock_agent.NewMockManager(ctrl)
+	mockTracepointStore := mock_tracepoint.NewMockStore(ctrl)
+
+	newAgent := func(collectsData bool, lastHeartbeat time.Duration) (uuid.UUID, *agentpb.Agent) {
+		agentID := uuid.Must(uuid.NewV4())
+		return agentID, &agentpb.Agent{
+			Info: &agentpb.AgentInfo{
+				AgentID: utils.ProtoFromUUID(agentID),
+				Capabilities: &agentpb.AgentCapabilities{
+					CollectsData: collectsData,
+				},
+			},
+			LastHeartbeatNS: lastHeartbeat.Nanoseconds(),
+		}
+	}
+	asOf := 10 * time.Minute
+	staleID, staleAgent := newAgent(true, asOf-90*time.Second)
+	_, freshAgent := newAgent(true, asOf-30*time.Second)
+	// Kelvins have a longer timeout, so this one isn't stale yet.
+	_, kelvinAgent := newAgent(false, asOf-90*time.Second)
+	pinnedID, pinnedAgent := newAgent(true, 0)
+
+	// No agents are loaded on initialization, so that none of them are expired during the test.
+	mockAgtMgr.
+		EXPECT().
+		GetActiveAgents().
+		Return(nil, nil)
+	mockAgtMgr.
+		EXPECT().
+		GetActiveAgents().
+		Return([]*agentpb.Agent{staleAgent, freshAgent, kelvinAgent, pinnedAgent}, nil)
+	mockAgtMgr.
+		EXPECT().
+		IsAgentPinned(staleID).
+		Return(false, nil)
+	mockAgtMgr.
+		EXPECT().
+		IsAgentPinned(pinnedID).
+		Return(true, nil)
+
+	expirationFn := func(info *agentpb.AgentInfo) time.Duration {
+		if !info.Capabilities.CollectsData {
+			return 2 * time.Minute
+		}
+		return 1 * time.Minute
+	}
+
+	tracepointMgr := tracepoint.NewManager(mockTracepointStore, mockAgtMgr, 5*time.Second)
+	defer tracepointMgr.Close()
+	atl, err := controllers.NewAgentTopicListenerWithExpiration(mockAgtMgr, tracepointMgr, assertSendMessageUncalled(t),
+		expirationFn)
+	require.NoError(t, err)
+
+	agents, err := atl.GetStaleAgents(asOf.Nanoseconds())
+	require.NoError(t, err)
+	assert.Equal(t, []*agentpb.Agent{staleAgent}, agents)
+}
@@ -26,6 +26,7 @@ import (
 
 	"github.com/cockroachdb/pebble"
 	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
@@ -38,6 +39,7 @@ import (
 	"px.dev/pixie/src/shared/services/election"
 	"px.dev/pixie/src/shared/services/healthz"
 	"px.dev/pixie/src/shared/services/httpmiddleware"
+	"px.dev/pixie/src/shared/services/metrics"
 	"px.dev/pixie/src/shared/services/server"
 	"px.dev/pixie/src/vizier/services/metadata/controllers"
 	"px.dev/pixie/src/vizier/services/metadata/controllers/agent"
@@ -110,7 +112,9 @@ func mustInitPebbleDatastore() *pebbledb.DataStore {
 	if err != nil {
 		log.WithError(err).Fatal("Failed to open pebble database.")
 	}
-	return pebbledb.New(pebbleDb, pebbledbTTLDuration)
+	ds := pebbledb.New(pebbleDb, pebbledbTTLDuration)
+	ds.RegisterMetrics(prometheus.DefaultRegisterer)
+	return ds
 }
 
 func etcdTLSConfig() (*tls.Config, error) {
@@ -209,7 +213,7 @@ func main() {
 	defer k8sMc.Stop()
 
 	ads := agent.NewDatastore(dataStore, 24*time.Hour)
-	agtMgr := agent.NewManager(ads, mdh, nc)
+	agtMgr := agent.NewManager(ads, mdh, nc, agent.MetricsRegisterer(prometheus.DefaultRegisterer))
 
 	schemaQuitCh := make(chan struct{})
 	defer close(schemaQuitCh)
@@ -248,7 +252,13 @@ func main() {
 		log.WithError(err).Fatal("Failed to create api environment")
 	}
 	mux := http.NewServeMux()
-	healthz.RegisterDefaultChecks(mux)
+	var checks []healthz.Checker
+	// Report the service as unhealthy if its datastore stops being usable.
+	if p, ok := dataStore.(datastore.Pinger); ok {
+		checks = append(checks, healthz.NamedCheck("datastore", p.Ping))
+	}
+	healthz.RegisterDefaultChecks(mux, checks...)
+	metrics.MustRegisterMetricsHandler(mux)
 
 	svr := controllers.NewServer(env, dataStore, agtMgr, tracepointMgr)
 	log.Infof("Metadata Server: %s", version.GetVersion().ToString())
@@ -20,6 +20,7 @@ package badgerdb
 
 import (
 	"bytes"
+	"errors"
 	"time"
 
 	"github.com/dgraph-io/badger/v3"
@@ -55,6 +56,29 @@ func (w *DataStore) Get(key string) ([]byte, error) {
 	return item.ValueCopy(nil)
 }
 
+// GetAll gets the values for all of the given keys in a single transaction.
+// The value is nil for any key that does not exist.
+func (w *DataStore) GetAll(keys []string) ([][]byte, error) {
+	txn := w.db.NewTransaction(false)
+	defer txn.Discard()
+
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		item, err := txn.Get([]byte(key))
+		if err == badger.ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		values[i], err = item.ValueCopy(nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
 // GetWithRange gets all keys and values within the given range.
 // Treats this as [from, to) i.e. includes the key from, but excludes the key to.
 func (w *DataStore) GetWithRange(from string, to string) ([]string, [][]byte, error) {
@@ -126,6 +150,24 @@ func (w *DataStore) Set(key string, value string) error {
 	return txn.Commit()
 }
 
+// SetAll puts all of the given keys and values in the datastore in a single transaction.
+func (w *DataStore) SetAll(keys []string, values []string) error {
+	if len(keys) != len(values) {
+		return errors.New("number of keys and values must match")
+	}
+	txn := w.db.NewTransaction(true)
+	defer txn.Discard()
+
+	for i, key := range keys {
+		err := txn.Set([]byte(key), []byte(values[i]))
+		if err != nil {
+			return err
+		}
+	}
+
+	return txn.Commit()
+}
+
 // SetWithTTL puts the given key and value into the datastore with a TTL.
 // Once the TTL expires the datastore is expected to delete the given key and value.
 func (w *DataStore) SetWithTTL(key string, value string, ttl time.Duration) error {
@@ -19,6 +19,7 @@
 package buntdb
 
 import (
+	"errors"
 	"time"
 
 	"github.com/tidwall/buntdb"
@@ -55,6 +56,29 @@ func (w *DataStore) Get(key string) ([]byte, error) {
 	return val, err
 }
 
+// GetAll gets the values for all of the given keys in a single transaction.
+// The value is nil for any key that does not exist.
+func (w *DataStore) GetAll(keys []string) ([][]byte, error) {
+	vals := make([][]byte, len(keys))
+	err := w.db.View(func(tx *buntdb.Tx) error {
+		for i, key := range keys {
+			v, err := tx.Get(key)
+			if err == buntdb.ErrNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			vals[i] = []byte(v)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return vals, nil
+}
+
 // GetWithRange gets all keys and values within the given range.
 // Treats this as [from, to) i.e. includes the key from, but excludes the key to.
 func (w *DataStore) GetWithRange(from string, to string) ([]string, [][]byte, error) {
@@ -102,6 +126,22 @@ func (w *DataStore) Set(key string, value string) error {
 	})
 }
 
+// SetAll puts all of the given keys and values in the datastore in a single transaction.
+func (w *DataStore) SetAll(keys []string, values []string) error {
+	if len(keys) != len(values) {
+		return errors.New("number of keys and values must match")
+	}
+	return w.db.Update(func(tx *buntdb.Tx) error {
+		for i, key := range keys {
+			_, _, err := tx.Set(key, values[i], nil)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 // SetWithTTL puts the given key and value into the datastore with a TTL.
 // Once the TTL expires the datastore is expected to delete the given key and value.
 func (w *DataStore) SetWithTTL(key string, value string, ttl time.Duration) error {
@@ -26,17 +26,41 @@ type Getter interface {
 }
 
 // MultiGetter is a datastore that implements methods that get multiple keys at once.
+// GetAll reads all of the keys from a single consistent view of the datastore, and returns nil for any
+// key that does not exist. etcd splits reads of more than 128 keys into several transactions, so they may see
+// different revisions.
 type MultiGetter interface {
 	Getter
+	GetAll(keys []string) ([][]byte, error)
 	GetWithRange(from string, to string) ([]string, [][]byte, error)
 	GetWithPrefix(prefix string) ([]string, [][]byte, error)
 }
 
+// PrefixIterator is a datastore that can stream the keys and values with a prefix, instead of reading them all
+// at once. Iteration stops at the first error returned by fn.
+type PrefixIterator interface {
+	IteratePrefix(prefix string, fn func(key, value []byte) error) error
+}
+
+// RangeIterator is a datastore that can stream the keys and values in the range [from, to) in key order,
+// instead of reading them all at once. Iteration stops at the first error returned by fn.
+type RangeIterator interface {
+	IterateRange(from string, to string, fn func(key, value []byte) error) error
+}
+
 // Setter is a datastore that implements a simple way to set values.
 type Setter interface {
 	Set(key string, value string) error
 }
 
+// MultiSetter is a datastore that implements a way to set multiple keys at once.
+// Either all of the keys are set, or none of them are, unless the write is too large for the datastore to
+// make in one transaction. etcd splits writes of more than 128 keys into several transactions.
+type MultiSetter interface {
+	Setter
+	SetAll(keys []string, values []string) error
+}
+
 // TTLSetter is a datastore that implements a setter with a TTL.
 // The set key and value should be purged form the datastore once the TTL expires.
 type TTLSetter interface {
@@ -44,6 +68,28 @@ type TTLSetter interface {
 	SetWithTTL(key string, value string, ttl time.Duration) error
 }
 
+// Batch accumulates sets and deletes which are written to the datastore atomically by Commit. Either all of the
+// operations in the batch are applied, or none of them are. Errors from adding an operation are returned by Commit.
+type Batch interface {
+	Set(key string, value string)
+	SetWithTTL(key string, value string, ttl time.Duration)
+	Delete(key string)
+	DeleteWithPrefix(prefix string)
+	Commit() error
+	Close() error
+}
+
+// Batcher is a datastore that can write a batch of sets and deletes atomically.
+type Batcher interface {
+	NewBatch() Batch
+}
+
+// TTLGetter is a datastore that can get how long is left until a key set with a TTL expires. The returned bool
+// is false if the key has no TTL.
+type TTLGetter interface {
+	GetTTL(key string) (time.Duration, bool, error)
+}
+
 // Deleter is a datastore that implements a simple way to delete values.
 type Deleter interface {
 	Delete(key string) error
@@ -56,14 +102,39 @@ type MultiDeleter interface {
 	DeleteWithPrefix(prefix string) error
 }
 
+// Pinger is a datastore that can check that it is usable, by making a round-trip to its storage.
+type Pinger interface {
+	Ping() error
+}
+
 // Closer is a datastore that can be closed commit changes and cleanup any pending resources.
 type Closer interface {
 	Close() error
 }
 
-// MultiGetterSetterDeleterCloser combines MultiGetter, TTLSetter, MultiDeleter, and Closer.
+// Snapshot is a read-only view of a datastore as it was when the snapshot was taken. Writes made to the
+// datastore afterwards are not visible in it. It must be closed once it is no longer used.
+type Snapshot interface {
+	MultiGetter
+	Closer
+}
+
+// Snapshotter is a datastore that can take a snapshot of its contents, so that several reads can be made from
+// a single consistent view.
+type Snapshotter interface {
+	NewSnapshot() Snapshot
+}
+
+// Compacter is a datastore that can compact the storage of a range of keys, to reclaim the space used by
+// deleted keys. The range is [from, to).
+type Compacter interface {
+	Compact(from string, to string) error
+}
+
+// MultiGetterSetterDeleterCloser combines MultiGetter, MultiSetter, TTLSetter, MultiDeleter, and Closer.
 type MultiGetterSetterDeleterCloser interface {
 	MultiGetter
+	MultiSetter
 	TTLSetter
 	MultiDeleter
 	Closer
@@ -16,7 +16,7 @@
  * SPDX-License-Identifier: Apache-2.0
  */
 
-package datastore
+package datastore_test
 
 import (
 	"testing"
@@ -30,13 +30,15 @@ import (
 	bunt "github.com/tidwall/buntdb"
 
 	"px.dev/pixie/src/utils/testingutils"
+	"px.dev/pixie/src/vizier/utils/datastore"
 	"px.dev/pixie/src/vizier/utils/datastore/badgerdb"
 	"px.dev/pixie/src/vizier/utils/datastore/buntdb"
 	"px.dev/pixie/src/vizier/utils/datastore/etcd"
+	"px.dev/pixie/src/vizier/utils/datastore/memstore"
 	"px.dev/pixie/src/vizier/utils/datastore/pebbledb"
 )
 
-func setupDatastore(t *testing.T, db Setter) {
+func setupDatastore(t *testing.T, db datastore.Setter) {
 	err := db.Set("jam1", "neg")
 	require.NoError(t, err)
 	err = db.Set("key1", "val1")
@@ -74,7 +76,7 @@ func TestDatastore(t *testing.T) {
 	defer cleanup()
 
 	tests := []struct {
-		db          MultiGetterSetterDeleterCloser
+		db          datastore.MultiGetterSetterDeleterCloser
 		name        string
 		runTTLTests bool
 	}{
@@ -82,6 +84,7 @@ func TestDatastore(t *testing.T) {
 		{badgerdb.New(bgr), "BadgerDB", false},
 		{pebbledb.New(pbbl, 2*time.Second), "PebbleDB", true},
 		{etcd.New(et), "etcd", false},
+		{memstore.New(), "MemStore", false},
 	}
 
 	for _, tc := range tests {
@@ -109,8 +112,30 @@ func TestDatastore(t *testing.T) {
 				assert.Nil(t, v)
 			})
 
+			t.Run("SetAll", func(t *testing.T) {
+				err := db.SetAll([]string{"multi1", "multi2"}, []string{"mval1", "mval2"})
+				require.NoError(t, err)
+
+				v, err := db.Get("multi1")
+				require.NoError(t, err)
+				assert.Equal(t, "mval1", string(v))
+
+				v, err = db.Get("multi2")
+				require.NoError(t, err)
+				assert.Equal(t, "mval2", string(v))
+
+				err = db.SetAll([]string{"multi3"}, nil)
+				require.Error(t, err)
+			})
+
 			t.Run("Get", func(t *testing.T) {
 				setupDatastore(t, db)
+				t.Run("All", func(t *testing.T) {
+					vals, err := db.GetAll([]string{"key2", "nonexistent", "key1"})
+					require.NoError(t, err)
+					assert.Equal(t, [][]byte{[]byte("val2"), nil, []byte("val1")}, vals)
+				})
+
 				t.Run("Range", func(t *testing.T) {
 					keys, vals, err := db.GetWithRange("key1", "key1.1")
 					require.NoError(t, err)
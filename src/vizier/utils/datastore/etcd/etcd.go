@@ -20,6 +20,7 @@ package etcd
 
 import (
 	"context"
+	"errors"
 	"sync"
 	"time"
 
@@ -44,6 +45,21 @@ func (w *DataStore) Set(key string, value string) error {
 	return err
 }
 
+// SetAll puts all of the given keys and values in the datastore. Like DeleteAll, the operations are split into
+// multiple transactions to stay within etcd's limits, so the write is only atomic if it fits in a single transaction.
+func (w *DataStore) SetAll(keys []string, values []string) error {
+	if len(keys) != len(values) {
+		return errors.New("number of keys and values must match")
+	}
+	ops := make([]clientv3.Op, len(keys))
+	for i, k := range keys {
+		ops[i] = clientv3.OpPut(k, values[i])
+	}
+
+	_, err := batchOps(context.Background(), w.client, ops)
+	return err
+}
+
 // SetWithTTL puts the given key and value into the datastore with a TTL.
 // Once the TTL expires the datastore is expected to delete the given key and value.
 func (w *DataStore) SetWithTTL(key string, value string, ttl time.Duration) error {
@@ -69,6 +85,30 @@ func (w *DataStore) Get(key string) ([]byte, error) {
 	return resp.Kvs[0].Value, nil
 }
 
+// GetAll gets the values for all of the given keys. The value is nil for any key that does not exist. Like
+// SetAll, the reads are split into multiple transactions to stay within etcd's limits, so the values are only
+// read at the same revision if they fit in a single transaction.
+func (w *DataStore) GetAll(keys []string) ([][]byte, error) {
+	ops := make([]clientv3.Op, len(keys))
+	for i, k := range keys {
+		ops[i] = clientv3.OpGet(k)
+	}
+
+	responses, err := batchOps(context.Background(), w.client, ops)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([][]byte, len(keys))
+	for i, r := range responses {
+		kvs := r.GetResponseRange().Kvs
+		if len(kvs) > 0 {
+			values[i] = kvs[0].Value
+		}
+	}
+	return values, nil
+}
+
 func kvsToSlices(kvs []*mvccpb.KeyValue) ([]string, [][]byte, error) {
 	if len(kvs) == 0 {
 		return nil, nil, nil
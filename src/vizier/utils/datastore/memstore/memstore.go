@@ -0,0 +1,204 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package memstore
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DataStore is a datastore which is kept entirely in memory. It is intended for tests, which don't need the
+// persistence of the other datastores.
+type DataStore struct {
+	mu     sync.RWMutex
+	values map[string]string
+	// The time at which each key that was set with a TTL expires. Expired keys are treated as deleted, and are
+	// removed on the next write.
+	expiresAt map[string]time.Time
+}
+
+// New creates a new, empty in-memory datastore.
+func New() *DataStore {
+	return &DataStore{
+		values:    make(map[string]string),
+		expiresAt: make(map[string]time.Time),
+	}
+}
+
+// get gets the value for the key, if it exists and has not expired. This should only be called when mu is held.
+func (w *DataStore) get(key string, now time.Time) ([]byte, bool) {
+	v, ok := w.values[key]
+	if !ok {
+		return nil, false
+	}
+	if expiresAt, ok := w.expiresAt[key]; ok && !now.Before(expiresAt) {
+		return nil, false
+	}
+	return []byte(v), true
+}
+
+// removeExpired removes all of the expired keys. This should only be called when mu is held for writing.
+func (w *DataStore) removeExpired(now time.Time) {
+	for key, expiresAt := range w.expiresAt {
+		if !now.Before(expiresAt) {
+			delete(w.values, key)
+			delete(w.expiresAt, key)
+		}
+	}
+}
+
+// Get gets the value for the given key from the datastore.
+func (w *DataStore) Get(key string) ([]byte, error) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	v, _ := w.get(key, time.Now())
+	return v, nil
+}
+
+// GetAll gets the values for all of the given keys. The value is nil for any key that does not exist.
+func (w *DataStore) GetAll(keys []string) ([][]byte, error) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	now := time.Now()
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		values[i], _ = w.get(key, now)
+	}
+	return values, nil
+}
+
+// getMatching gets all of the keys that match, and their values, in key order.
+func (w *DataStore) getMatching(match func(key string) bool) ([]string, [][]byte) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	var keys []string
+	for key := range w.values {
+		if match(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	now := time.Now()
+	var retKeys []string
+	var values [][]byte
+	for _, key := range keys {
+		if v, ok := w.get(key, now); ok {
+			retKeys = append(retKeys, key)
+			values = append(values, v)
+		}
+	}
+	return retKeys, values
+}
+
+// GetWithRange gets all keys and values within the given range.
+// Treats this as [from, to) i.e. includes the key from, but excludes the key to.
+func (w *DataStore) GetWithRange(from string, to string) ([]string, [][]byte, error) {
+	keys, values := w.getMatching(func(key string) bool {
+		return key >= from && key < to
+	})
+	return keys, values, nil
+}
+
+// GetWithPrefix gets all keys and values with the given prefix.
+func (w *DataStore) GetWithPrefix(prefix string) ([]string, [][]byte, error) {
+	keys, values := w.getMatching(func(key string) bool {
+		return strings.HasPrefix(key, prefix)
+	})
+	return keys, values, nil
+}
+
+// Set puts the given key and value in the datastore.
+func (w *DataStore) Set(key string, value string) error {
+	return w.SetAll([]string{key}, []string{value})
+}
+
+// SetAll puts all of the given keys and values in the datastore.
+func (w *DataStore) SetAll(keys []string, values []string) error {
+	if len(keys) != len(values) {
+		return errors.New("number of keys and values must match")
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.removeExpired(time.Now())
+	for i, key := range keys {
+		w.values[key] = values[i]
+		delete(w.expiresAt, key)
+	}
+	return nil
+}
+
+// SetWithTTL puts the given key and value into the datastore with a TTL.
+// Once the TTL expires the key is treated as deleted.
+func (w *DataStore) SetWithTTL(key string, value string, ttl time.Duration) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	w.removeExpired(now)
+	w.values[key] = value
+	w.expiresAt[key] = now.Add(ttl)
+	return nil
+}
+
+// Delete deletes the value for the given key from the datastore.
+func (w *DataStore) Delete(key string) error {
+	return w.DeleteAll([]string{key})
+}
+
+// DeleteAll deletes all of the given keys from the datastore.
+func (w *DataStore) DeleteAll(keys []string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.removeExpired(time.Now())
+	for _, key := range keys {
+		delete(w.values, key)
+		delete(w.expiresAt, key)
+	}
+	return nil
+}
+
+// DeleteWithPrefix deletes all keys and values with the given prefix.
+func (w *DataStore) DeleteWithPrefix(prefix string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.removeExpired(time.Now())
+	for key := range w.values {
+		if strings.HasPrefix(key, prefix) {
+			delete(w.values, key)
+			delete(w.expiresAt, key)
+		}
+	}
+	return nil
+}
+
+// Close does nothing, since there is nothing to persist or clean up.
+func (w *DataStore) Close() error {
+	return nil
+}
@@ -0,0 +1,55 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package memstore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetWithTTL(t *testing.T) {
+	db := New()
+
+	require.NoError(t, db.SetWithTTL("timed1", "limited1", 100*time.Millisecond))
+	require.NoError(t, db.SetWithTTL("timed2", "limited2", 100*time.Millisecond))
+	// Setting the key again without a TTL removes its TTL.
+	require.NoError(t, db.Set("timed2", "unlimited2"))
+
+	v, err := db.Get("timed1")
+	require.NoError(t, err)
+	assert.Equal(t, "limited1", string(v))
+
+	assert.Eventually(t, func() bool {
+		v, err := db.Get("timed1")
+		return err == nil && v == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	keys, vals, err := db.GetWithPrefix("timed")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"timed2"}, keys)
+	assert.Equal(t, [][]byte{[]byte("unlimited2")}, vals)
+
+	// Expired keys are removed on the next write.
+	require.NoError(t, db.Set("other", "val"))
+	assert.Len(t, db.values, 2)
+	assert.Len(t, db.expiresAt, 0)
+}
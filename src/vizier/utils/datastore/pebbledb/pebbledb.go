@@ -19,12 +19,17 @@
 package pebbledb
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cockroachdb/pebble"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"px.dev/pixie/src/vizier/utils/datastore"
 )
 
 const (
@@ -32,19 +37,67 @@ const (
 	ttlByTimePrefix = "___ttl_time___"
 )
 
+// pingData is written to the WAL by Ping. It is never added to the datastore's keys.
+var pingData = []byte("ping")
+
+// pingTimeout is how long Ping waits for the round-trip before reporting the datastore as unresponsive.
+var pingTimeout = 5 * time.Second
+
+// ErrValueTooLarge is returned when a value is larger than the maximum value size of the datastore.
+var ErrValueTooLarge = errors.New("value is larger than the max value size")
+
+// ErrClosed is returned by Ping once the datastore has been closed.
+var ErrClosed = errors.New("datastore is closed")
+
+// ErrPingTimeout is returned by Ping when the datastore does not complete the round-trip in time.
+var ErrPingTimeout = errors.New("datastore did not respond to ping in time")
+
+// ErrStopIteration can be returned by the callback passed to IteratePrefix to stop the iteration early.
+// IteratePrefix does not return it to the caller.
+var ErrStopIteration = errors.New("stop iteration")
+
 // DataStore wraps a pebbledb datastore.
 type DataStore struct {
+	// The number of snapshots which are currently open. This is accessed atomically, so it is kept first
+	// in the struct to keep it aligned.
+	openSnapshots int64
+
 	db *pebble.DB
+	// Guards db, so that Ping, Stats and Metrics can run concurrently with Close.
+	dbMu sync.RWMutex
+	// The maximum size in bytes of a value that can be set. A size of 0 means there is no limit.
+	maxValueSize int
+
+	done    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+
+	// The round-trip started by Ping which has not completed yet, if any.
+	probe *pingProbe
+	// Protects probe.
+	probeMu sync.Mutex
+}
 
+// pingProbe is a round-trip to the datastore made by Ping. A probe which is still running is shared by any
+// later calls to Ping, so that a stalled datastore does not pile up probes.
+type pingProbe struct {
 	done chan struct{}
-	once sync.Once
+	err  error
 }
 
 // New creates a new pebbledb for use as a KVStore.
 func New(db *pebble.DB, ttlReaperDuration time.Duration) *DataStore {
+	return NewWithMaxValueSize(db, ttlReaperDuration, 0)
+}
+
+// NewWithMaxValueSize creates a new pebbledb for use as a KVStore, which rejects any value larger than
+// maxValueSize bytes. A maxValueSize of 0 means there is no limit.
+func NewWithMaxValueSize(db *pebble.DB, ttlReaperDuration time.Duration, maxValueSize int) *DataStore {
 	wrap := &DataStore{
-		db:   db,
-		done: make(chan struct{}),
+		db:           db,
+		maxValueSize: maxValueSize,
+		done:         make(chan struct{}),
+		stopped:      make(chan struct{}),
 	}
 
 	go wrap.ttlWatcher(ttlReaperDuration)
@@ -52,7 +105,89 @@ func New(db *pebble.DB, ttlReaperDuration time.Duration) *DataStore {
 	return wrap
 }
 
+// Stats are statistics about the datastore.
+type Stats struct {
+	// OpenSnapshots is the number of snapshots which are currently open. A count which keeps climbing
+	// means that snapshots are being leaked.
+	OpenSnapshots int64
+	// DiskSizeBytes is the number of bytes used on disk by the sstables and WAL of the datastore,
+	// including obsolete files which have not been deleted yet.
+	DiskSizeBytes uint64
+	// PendingCompactionBytes is the estimated number of bytes which need to be compacted for the
+	// datastore to reach a stable state.
+	PendingCompactionBytes uint64
+	// Compactions is the total number of compactions run since the datastore was opened.
+	Compactions int64
+}
+
+// Stats returns the current statistics of the datastore.
+func (w *DataStore) Stats() Stats {
+	stats := Stats{
+		OpenSnapshots: atomic.LoadInt64(&w.openSnapshots),
+	}
+	w.dbMu.RLock()
+	defer w.dbMu.RUnlock()
+	if w.db == nil {
+		return stats
+	}
+	m := w.db.Metrics()
+	stats.DiskSizeBytes = uint64(m.Total().Size) + m.WAL.Size + m.Table.ObsoleteSize + m.Table.ZombieSize
+	stats.PendingCompactionBytes = m.Compact.EstimatedDebt
+	stats.Compactions = m.Compact.Count
+	return stats
+}
+
+// Metrics returns the metrics of the underlying pebble DB, or nil once the datastore has been closed.
+func (w *DataStore) Metrics() *pebble.Metrics {
+	w.dbMu.RLock()
+	defer w.dbMu.RUnlock()
+	if w.db == nil {
+		return nil
+	}
+	return w.db.Metrics()
+}
+
+// RegisterMetrics registers gauges of the datastore's statistics with the registerer.
+func (w *DataStore) RegisterMetrics(reg prometheus.Registerer) {
+	reg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "pebbledb_open_snapshots",
+		Help: "Number of pebbledb snapshots that are currently open",
+	}, func() float64 {
+		return float64(atomic.LoadInt64(&w.openSnapshots))
+	}))
+	reg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "pebbledb_disk_size_bytes",
+		Help: "Number of bytes used on disk by pebbledb",
+	}, func() float64 {
+		return float64(w.Stats().DiskSizeBytes)
+	}))
+	reg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "pebbledb_pending_compaction_bytes",
+		Help: "Estimated number of bytes that pebbledb needs to compact",
+	}, func() float64 {
+		return float64(w.Stats().PendingCompactionBytes)
+	}))
+	reg.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Name: "pebbledb_compactions_total",
+		Help: "Number of compactions run by pebbledb",
+	}, func() float64 {
+		return float64(w.Stats().Compactions)
+	}))
+}
+
+// newSnapshot opens a snapshot of the datastore. The snapshot is counted as open until the returned
+// function is called to close it.
+func (w *DataStore) newSnapshot() (*pebble.Snapshot, func() error) {
+	atomic.AddInt64(&w.openSnapshots, 1)
+	snapshot := w.db.NewSnapshot()
+	return snapshot, func() error {
+		atomic.AddInt64(&w.openSnapshots, -1)
+		return snapshot.Close()
+	}
+}
+
 func (w *DataStore) ttlWatcher(ttlReaperDuration time.Duration) {
+	defer close(w.stopped)
 	ticker := time.NewTicker(ttlReaperDuration)
 	defer ticker.Stop()
 	for {
@@ -60,117 +195,365 @@ func (w *DataStore) ttlWatcher(ttlReaperDuration time.Duration) {
 		case <-w.done:
 			return
 		case <-ticker.C:
-			now := time.Now()
-
-			from := fmt.Sprintf("%s/", ttlByTimePrefix)
-			to := fmt.Sprintf("%s/%20d/", ttlByTimePrefix, now.Unix()+1)
-
-			iter := w.db.NewIter(&pebble.IterOptions{
-				LowerBound: []byte(from),
-				UpperBound: []byte(to),
-			})
-
-			var deleteKeys []string
-
-			for iter.First(); iter.Valid(); iter.Next() {
-				if iter.Error() != nil {
-					break
-				}
-				// Casting to a string causes a implicit copy, making
-				// ensuring that this is valid across iterations.
-				k := string(iter.Key())
-
-				sp := strings.Split(k, "/")
-				if len(sp) < 3 {
-					continue
-				}
-
-				keyToDelete := sp[2]
-				ttlByKey := fmt.Sprintf("%s/%s", ttlByKeyPrefix, keyToDelete)
-
-				v, err := w.Get(ttlByKey)
-				if err != nil {
-					continue
-				}
-
-				var expiresAt time.Time
-				err = expiresAt.UnmarshalBinary(v)
-				if err != nil {
-					continue
-				}
-				if expiresAt.Before(now) {
-					deleteKeys = append(deleteKeys, ttlByKey)
-					deleteKeys = append(deleteKeys, keyToDelete)
-				}
-			}
-			err := w.DeleteAll(deleteKeys)
+			err := w.reapExpiredKeys(time.Now())
 			if err != nil {
 				continue
 			}
-			err = w.db.DeleteRange([]byte(from), []byte(to), pebble.Sync)
-			if err != nil {
-				continue
-			}
-			iter.Close()
 		}
 	}
 }
 
+// reapExpiredKeys deletes all keys whose TTL has expired as of the given time.
+func (w *DataStore) reapExpiredKeys(now time.Time) error {
+	from := fmt.Sprintf("%s/", ttlByTimePrefix)
+	to := fmt.Sprintf("%s/%20d/", ttlByTimePrefix, now.Unix()+1)
+
+	iter := w.db.NewIter(&pebble.IterOptions{
+		LowerBound: []byte(from),
+		UpperBound: []byte(to),
+	})
+	defer iter.Close()
+
+	var deleteKeys []string
+
+	for iter.First(); iter.Valid(); iter.Next() {
+		if iter.Error() != nil {
+			break
+		}
+		// Casting to a string causes a implicit copy, making
+		// ensuring that this is valid across iterations.
+		k := string(iter.Key())
+
+		// The key itself may contain slashes, so only split off the prefix and expiry time.
+		sp := strings.SplitN(k, "/", 3)
+		if len(sp) < 3 {
+			continue
+		}
+
+		keyToDelete := sp[2]
+		ttlByKey := fmt.Sprintf("%s/%s", ttlByKeyPrefix, keyToDelete)
+
+		v, err := w.Get(ttlByKey)
+		if err != nil {
+			continue
+		}
+
+		var expiresAt time.Time
+		err = expiresAt.UnmarshalBinary(v)
+		if err != nil || fmt.Sprintf("%20d", expiresAt.Unix()) != sp[1] {
+			// The TTL for this key was removed or replaced by a later one, so this entry is stale.
+			deleteKeys = append(deleteKeys, k)
+			continue
+		}
+		if expiresAt.Before(now) {
+			deleteKeys = append(deleteKeys, k)
+			deleteKeys = append(deleteKeys, ttlByKey)
+			deleteKeys = append(deleteKeys, keyToDelete)
+		}
+	}
+	return w.DeleteAll(deleteKeys)
+}
+
+// checkValueSize returns an error if the value is larger than the max value size.
+func (w *DataStore) checkValueSize(key string, value string) error {
+	if w.maxValueSize > 0 && len(value) > w.maxValueSize {
+		return fmt.Errorf("%w: key '%s' has a %d byte value, the max is %d bytes", ErrValueTooLarge, key,
+			len(value), w.maxValueSize)
+	}
+	return nil
+}
+
 // Set puts the given key and value in the datastore.
 func (w *DataStore) Set(key string, value string) error {
+	if err := w.checkValueSize(key, value); err != nil {
+		return err
+	}
 	return w.db.Set([]byte(key), []byte(value), pebble.Sync)
 }
 
+// SetAll puts all of the given keys and values in the datastore in a single batch.
+func (w *DataStore) SetAll(keys []string, values []string) error {
+	if len(keys) != len(values) {
+		return errors.New("number of keys and values must match")
+	}
+	for i, key := range keys {
+		if err := w.checkValueSize(key, values[i]); err != nil {
+			return err
+		}
+	}
+	batch := w.db.NewBatch()
+	for i, key := range keys {
+		err := batch.Set([]byte(key), []byte(values[i]), pebble.Sync)
+		if err != nil {
+			batch.Close()
+			return err
+		}
+	}
+	return batch.Commit(pebble.Sync)
+}
+
+// Batch accumulates sets and deletes which are written to the datastore atomically by Commit.
+// Either all of the operations in the batch are applied, or none of them are.
+type Batch struct {
+	w     *DataStore
+	batch *pebble.Batch
+	// The first error from adding an operation to the batch. It is returned by Commit.
+	err error
+}
+
+// NewBatch creates a new empty batch. The batch must be either committed or closed.
+func (w *DataStore) NewBatch() datastore.Batch {
+	return &Batch{
+		w:     w,
+		batch: w.db.NewBatch(),
+	}
+}
+
+// Set adds a set of the given key and value to the batch.
+func (b *Batch) Set(key string, value string) {
+	if b.err != nil {
+		return
+	}
+	if err := b.w.checkValueSize(key, value); err != nil {
+		b.err = err
+		return
+	}
+	b.err = b.batch.Set([]byte(key), []byte(value), nil)
+}
+
+// SetWithTTL adds a set of the given key and value to the batch, which expires after the TTL.
+// A TTL of 0 means that the key does not expire.
+func (b *Batch) SetWithTTL(key string, value string, ttl time.Duration) {
+	b.Set(key, value)
+	if b.err != nil || ttl == 0 {
+		return
+	}
+	b.err = setTTL(b.batch, key, time.Now().Add(ttl))
+}
+
+// Delete adds a delete of the given key to the batch.
+func (b *Batch) Delete(key string) {
+	if b.err != nil {
+		return
+	}
+	b.err = b.batch.Delete([]byte(key), nil)
+}
+
+// DeleteWithPrefix adds a delete of all keys with the given prefix to the batch.
+func (b *Batch) DeleteWithPrefix(prefix string) {
+	if b.err != nil {
+		return
+	}
+	b.err = b.batch.DeleteRange([]byte(prefix), keyUpperBound([]byte(prefix)), nil)
+}
+
+// Commit writes all of the operations in the batch to the datastore in a single write, and releases the
+// batch. If any operation could not be added to the batch, nothing is written and that error is returned.
+func (b *Batch) Commit() error {
+	if b.err != nil {
+		b.batch.Close()
+		return b.err
+	}
+	err := b.batch.Commit(pebble.Sync)
+	b.batch.Close()
+	return err
+}
+
+// Close discards the batch without writing any of its operations.
+func (b *Batch) Close() error {
+	return b.batch.Close()
+}
+
 // SetWithTTL puts the given key and value into the datastore with a TTL.
 // Once the TTL expires the datastore is expected to delete the given key and value.
 func (w *DataStore) SetWithTTL(key string, value string, ttl time.Duration) error {
+	if err := w.checkValueSize(key, value); err != nil {
+		return err
+	}
 	batch := w.db.NewBatch()
-	expiresAt := time.Now().Add(ttl)
-	encodedExpiry, err := expiresAt.MarshalBinary()
+	err := batch.Set([]byte(key), []byte(value), pebble.Sync)
 	if err != nil {
 		batch.Close()
 		return err
 	}
-	err = batch.Set([]byte(key), []byte(value), pebble.Sync)
+	err = setTTL(batch, key, time.Now().Add(ttl))
 	if err != nil {
 		batch.Close()
 		return err
 	}
+	return batch.Commit(pebble.Sync)
+}
+
+// setTTL adds the TTL index entries for the key to the batch, so that the TTL watcher deletes the key once
+// it expires.
+func setTTL(batch *pebble.Batch, key string, expiresAt time.Time) error {
+	encodedExpiry, err := expiresAt.MarshalBinary()
+	if err != nil {
+		return err
+	}
 
 	ttlByKey := fmt.Sprintf("%s/%s", ttlByKeyPrefix, key)
 	ttlByTime := fmt.Sprintf("%s/%20d/%s", ttlByTimePrefix, expiresAt.Unix(), key)
 
 	err = batch.Set([]byte(ttlByKey), encodedExpiry, pebble.Sync)
 	if err != nil {
-		batch.Close()
 		return err
 	}
-	err = batch.Set([]byte(ttlByTime), nil, pebble.Sync)
+	return batch.Set([]byte(ttlByTime), nil, pebble.Sync)
+}
+
+// GetTTL gets how long is left until the given key expires. The returned bool is false if the key was not set
+// with a TTL. The duration is negative if the key has expired but has not been deleted yet.
+func (w *DataStore) GetTTL(key string) (time.Duration, bool, error) {
+	v, err := w.Get(fmt.Sprintf("%s/%s", ttlByKeyPrefix, key))
 	if err != nil {
-		batch.Close()
-		return err
+		return 0, false, err
 	}
-	return batch.Commit(pebble.Sync)
+	if v == nil {
+		return 0, false, nil
+	}
+	var expiresAt time.Time
+	err = expiresAt.UnmarshalBinary(v)
+	if err != nil {
+		return 0, false, err
+	}
+	return time.Until(expiresAt), true, nil
+}
+
+// Ping checks that the datastore is usable, by making a synced write to its WAL. The write does not add any key
+// to the datastore. ErrPingTimeout is returned if the round-trip does not complete in time, such as when pebble
+// is stalled on a write. Concurrent calls share a single round-trip.
+func (w *DataStore) Ping() error {
+	w.probeMu.Lock()
+	probe := w.probe
+	if probe == nil {
+		probe = &pingProbe{done: make(chan struct{})}
+		w.probe = probe
+		go w.runProbe(probe)
+	}
+	w.probeMu.Unlock()
+
+	select {
+	case <-probe.done:
+		return probe.err
+	case <-time.After(pingTimeout):
+		return ErrPingTimeout
+	}
+}
+
+// runProbe makes the round-trip for the probe. The round-trip is left running if Ping times out, since a stalled
+// write can't be cancelled. It holds the lock on db until it is done, so that Close waits for it instead of
+// closing db underneath it.
+func (w *DataStore) runProbe(probe *pingProbe) {
+	w.dbMu.RLock()
+	if w.db == nil {
+		probe.err = ErrClosed
+	} else {
+		probe.err = w.db.LogData(pingData, pebble.Sync)
+	}
+	w.dbMu.RUnlock()
+
+	w.probeMu.Lock()
+	w.probe = nil
+	w.probeMu.Unlock()
+	close(probe.done)
 }
 
 // Get gets the value for the given key from the datastore.
 func (w *DataStore) Get(key string) ([]byte, error) {
-	v, closer, err := w.db.Get([]byte(key))
+	return get(w.db, key)
+}
+
+// GetAll gets the values for all of the given keys from a single snapshot of the datastore.
+// The value is nil for any key that does not exist.
+func (w *DataStore) GetAll(keys []string) ([][]byte, error) {
+	snapshot, closeSnapshot := w.newSnapshot()
+	defer closeSnapshot()
+	return getAll(snapshot, keys)
+}
+
+// GetWithRange gets all keys and values within the given range.
+// Treats this as [from, to) i.e. includes the key from, but excludes the key to.
+func (w *DataStore) GetWithRange(from string, to string) ([]string, [][]byte, error) {
+	return getWithRange(w.db, from, to)
+}
+
+// GetWithPrefix gets all keys and values with the given prefix.
+func (w *DataStore) GetWithPrefix(prefix string) ([]string, [][]byte, error) {
+	return w.GetWithRange(prefix, string(keyUpperBound([]byte(prefix))))
+}
+
+// Snapshot is a read-only view of the datastore as it was when the snapshot was taken.
+type Snapshot struct {
+	snapshot      *pebble.Snapshot
+	closeSnapshot func() error
+}
+
+// NewSnapshot takes a snapshot of the datastore. The snapshot must be closed once it is no longer used.
+func (w *DataStore) NewSnapshot() datastore.Snapshot {
+	snapshot, closeSnapshot := w.newSnapshot()
+	return &Snapshot{
+		snapshot:      snapshot,
+		closeSnapshot: closeSnapshot,
+	}
+}
+
+// Get gets the value for the given key from the snapshot.
+func (s *Snapshot) Get(key string) ([]byte, error) {
+	return get(s.snapshot, key)
+}
+
+// GetAll gets the values for all of the given keys from the snapshot. The value is nil for any key that does
+// not exist.
+func (s *Snapshot) GetAll(keys []string) ([][]byte, error) {
+	return getAll(s.snapshot, keys)
+}
+
+// GetWithRange gets all keys and values within the range [from, to) from the snapshot.
+func (s *Snapshot) GetWithRange(from string, to string) ([]string, [][]byte, error) {
+	return getWithRange(s.snapshot, from, to)
+}
+
+// GetWithPrefix gets all keys and values with the given prefix from the snapshot.
+func (s *Snapshot) GetWithPrefix(prefix string) ([]string, [][]byte, error) {
+	return s.GetWithRange(prefix, string(keyUpperBound([]byte(prefix))))
+}
+
+// Close releases the snapshot.
+func (s *Snapshot) Close() error {
+	return s.closeSnapshot()
+}
+
+func get(r pebble.Reader, key string) ([]byte, error) {
+	v, closer, err := r.Get([]byte(key))
 	if err == pebble.ErrNotFound {
 		return nil, nil
 	}
+	if err != nil {
+		return nil, err
+	}
 	value := make([]byte, len(v))
 	copy(value, v)
 	return value, closer.Close()
 }
 
-// GetWithRange gets all keys and values within the given range.
-// Treats this as [from, to) i.e. includes the key from, but excludes the key to.
-func (w *DataStore) GetWithRange(from string, to string) ([]string, [][]byte, error) {
+func getAll(r pebble.Reader, keys []string) ([][]byte, error) {
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		v, err := get(r, key)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+func getWithRange(r pebble.Reader, from string, to string) ([]string, [][]byte, error) {
 	var keys []string
 	var values [][]byte
 
-	iter := w.db.NewIter(&pebble.IterOptions{
+	iter := r.NewIter(&pebble.IterOptions{
 		LowerBound: []byte(from),
 		UpperBound: []byte(to),
 	})
@@ -189,9 +572,32 @@ func (w *DataStore) GetWithRange(from string, to string) ([]string, [][]byte, er
 	return keys, values, iter.Close()
 }
 
-// GetWithPrefix gets all keys and values with the given prefix.
-func (w *DataStore) GetWithPrefix(prefix string) ([]string, [][]byte, error) {
-	return w.GetWithRange(prefix, string(keyUpperBound([]byte(prefix))))
+// IteratePrefix calls fn for each key and value with the given prefix, in key order. The key and value
+// are only valid for the duration of the call, so fn must copy them if they are retained. Iteration stops
+// at the first error returned by fn, which is returned unless it is ErrStopIteration.
+// Like the other operations on the datastore, the scan has no timeout.
+func (w *DataStore) IteratePrefix(prefix string, fn func(key, value []byte) error) error {
+	return w.IterateRange(prefix, string(keyUpperBound([]byte(prefix))), fn)
+}
+
+// IterateRange calls fn for each key and value in the range [from, to), in key order. It behaves like
+// IteratePrefix otherwise.
+func (w *DataStore) IterateRange(from string, to string, fn func(key, value []byte) error) error {
+	iter := w.db.NewIter(&pebble.IterOptions{
+		LowerBound: []byte(from),
+		UpperBound: []byte(to),
+	})
+
+	for iter.First(); iter.Valid(); iter.Next() {
+		if err := fn(iter.Key(), iter.Value()); err != nil {
+			iter.Close()
+			if errors.Is(err, ErrStopIteration) {
+				return nil
+			}
+			return err
+		}
+	}
+	return iter.Close()
 }
 
 // Delete deletes the value for the given key from the datastore.
@@ -216,13 +622,21 @@ func (w *DataStore) DeleteWithPrefix(prefix string) error {
 	return w.db.DeleteRange([]byte(prefix), keyUpperBound([]byte(prefix)), pebble.Sync)
 }
 
+// Compact compacts the keys in the range [from, to), to reclaim the space used by deleted and expired keys.
+func (w *DataStore) Compact(from string, to string) error {
+	return w.db.Compact([]byte(from), []byte(to))
+}
+
 // Close stops the TTL watcher, and closes the underlying datastore.
 // All other operations will fail after calling Close.
 func (w *DataStore) Close() error {
 	w.once.Do(func() {
 		close(w.done)
+		<-w.stopped
 	})
 
+	w.dbMu.Lock()
+	defer w.dbMu.Unlock()
 	if w.db == nil {
 		return nil
 	}
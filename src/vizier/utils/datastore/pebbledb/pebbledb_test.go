@@ -0,0 +1,518 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+package pebbledb
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"px.dev/pixie/src/vizier/utils/datastore/pebbledb/pebbledbtest"
+)
+
+func TestReapExpiredKeys(t *testing.T) {
+	c, err := pebble.Open("test", &pebble.Options{
+		FS: vfs.NewMem(),
+	})
+	require.NoError(t, err)
+	db := New(c, time.Hour)
+	defer db.Close()
+
+	require.NoError(t, db.SetWithTTL("/key/with/slashes", "val1", 1*time.Second))
+	require.NoError(t, db.SetWithTTL("later", "val2", 1*time.Minute))
+
+	// Nothing has expired yet, so everything should survive the reaper.
+	require.NoError(t, db.reapExpiredKeys(time.Now()))
+	v, err := db.Get("/key/with/slashes")
+	require.NoError(t, err)
+	assert.Equal(t, "val1", string(v))
+
+	require.NoError(t, db.reapExpiredKeys(time.Now().Add(2*time.Second)))
+	v, err = db.Get("/key/with/slashes")
+	require.NoError(t, err)
+	assert.Nil(t, v)
+
+	v, err = db.Get("later")
+	require.NoError(t, err)
+	assert.Equal(t, "val2", string(v))
+
+	require.NoError(t, db.reapExpiredKeys(time.Now().Add(2*time.Minute)))
+	v, err = db.Get("later")
+	require.NoError(t, err)
+	assert.Nil(t, v)
+}
+
+func TestGetTTL(t *testing.T) {
+	c, err := pebble.Open("test", &pebble.Options{
+		FS: vfs.NewMem(),
+	})
+	require.NoError(t, err)
+	db := New(c, time.Hour)
+	defer db.Close()
+
+	require.NoError(t, db.SetWithTTL("/expires", "1", time.Minute))
+	require.NoError(t, db.Set("/forever", "2"))
+
+	ttl, ok, err := db.GetTTL("/expires")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, ttl > 50*time.Second && ttl <= time.Minute)
+
+	_, ok, err = db.GetTTL("/forever")
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestBatchWriteFailure(t *testing.T) {
+	fs := pebbledbtest.NewCrashFS()
+	c, err := fs.Open("test")
+	require.NoError(t, err)
+	db := New(c, time.Hour)
+
+	require.NoError(t, db.Set("/old", "1"))
+
+	// Pebble treats a failed commit as fatal, so the commit panics instead of returning an error.
+	fs.FailWrites()
+	b := db.NewBatch()
+	b.Set("/a", "1")
+	b.Set("/b", "2")
+	b.Delete("/old")
+	assert.PanicsWithValue(t, pebbledbtest.ErrFatal, func() {
+		_ = b.Commit()
+	})
+
+	// After a restart, none of the batch should have been written.
+	fs.Crash()
+	c, err = fs.Open("test")
+	require.NoError(t, err)
+	db = New(c, time.Hour)
+	defer db.Close()
+
+	keys, values, err := db.GetWithPrefix("/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/old"}, keys)
+	assert.Equal(t, [][]byte{[]byte("1")}, values)
+}
+
+func TestBatchSetWithTTL(t *testing.T) {
+	c, err := pebble.Open("test", &pebble.Options{
+		FS: vfs.NewMem(),
+	})
+	require.NoError(t, err)
+	db := NewWithMaxValueSize(c, time.Hour, 8)
+	defer db.Close()
+
+	b := db.NewBatch()
+	b.SetWithTTL("/forever", "val1", 0)
+	b.SetWithTTL("/expires", "val2", time.Second)
+	require.NoError(t, b.Commit())
+	_, values, err := db.GetWithPrefix("/")
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("val2"), []byte("val1")}, values)
+
+	// Only the key with a TTL should be reaped.
+	require.NoError(t, db.reapExpiredKeys(time.Now().Add(2*time.Second)))
+	v, err := db.Get("/expires")
+	require.NoError(t, err)
+	assert.Nil(t, v)
+	v, err = db.Get("/forever")
+	require.NoError(t, err)
+	assert.Equal(t, "val1", string(v))
+
+	// Nothing should be written if any of the values is rejected.
+	b = db.NewBatch()
+	b.SetWithTTL("/small", "1", time.Minute)
+	b.SetWithTTL("/large", "123456789", 0)
+	err = b.Commit()
+	assert.True(t, errors.Is(err, ErrValueTooLarge))
+	v, err = db.Get("/small")
+	require.NoError(t, err)
+	assert.Nil(t, v)
+	keys, _, err := db.GetWithPrefix(ttlByKeyPrefix)
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+}
+
+func TestPing(t *testing.T) {
+	c, err := pebble.Open("test", &pebble.Options{
+		FS: vfs.NewMem(),
+	})
+	require.NoError(t, err)
+	db := New(c, time.Hour)
+
+	require.NoError(t, db.Ping())
+	require.NoError(t, db.Ping())
+
+	// The ping key should not be visible among the datastore's keys.
+	keys, _, err := db.GetWithPrefix("/")
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+
+	require.NoError(t, db.Close())
+	assert.True(t, errors.Is(db.Ping(), ErrClosed))
+}
+
+func TestPingDuringClose(t *testing.T) {
+	c, err := pebble.Open("test", &pebble.Options{
+		FS: vfs.NewMem(),
+	})
+	require.NoError(t, err)
+	db := New(c, time.Hour)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := db.Ping()
+			if err != nil {
+				assert.True(t, errors.Is(err, ErrClosed))
+			}
+		}()
+	}
+	require.NoError(t, db.Close())
+	wg.Wait()
+	assert.True(t, errors.Is(db.Ping(), ErrClosed))
+}
+
+// stallFS blocks the syncs of the files that it creates while it is stalled, until it is released.
+type stallFS struct {
+	vfs.FS
+	stalled      int32
+	blockedSyncs int32
+	release      chan struct{}
+}
+
+func (fs *stallFS) Create(name string) (vfs.File, error) {
+	f, err := fs.FS.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &stallFile{File: f, fs: fs}, nil
+}
+
+type stallFile struct {
+	vfs.File
+	fs *stallFS
+}
+
+func (f *stallFile) Sync() error {
+	if atomic.LoadInt32(&f.fs.stalled) == 1 {
+		atomic.AddInt32(&f.fs.blockedSyncs, 1)
+		<-f.fs.release
+	}
+	return f.File.Sync()
+}
+
+func TestPingStalled(t *testing.T) {
+	oldTimeout := pingTimeout
+	pingTimeout = 10 * time.Millisecond
+	defer func() { pingTimeout = oldTimeout }()
+
+	fs := &stallFS{FS: vfs.NewMem(), release: make(chan struct{})}
+	c, err := pebble.Open("test", &pebble.Options{
+		FS: fs,
+	})
+	require.NoError(t, err)
+	db := New(c, time.Hour)
+	require.NoError(t, db.Ping())
+
+	// While the write is stalled, every ping times out, but they all wait on the same probe instead of each
+	// leaving another one behind.
+	atomic.StoreInt32(&fs.stalled, 1)
+	goroutines := runtime.NumGoroutine()
+	for i := 0; i < 5; i++ {
+		assert.True(t, errors.Is(db.Ping(), ErrPingTimeout))
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fs.blockedSyncs))
+	assert.LessOrEqual(t, runtime.NumGoroutine(), goroutines+1)
+
+	atomic.StoreInt32(&fs.stalled, 0)
+	close(fs.release)
+	require.NoError(t, db.Ping())
+	require.NoError(t, db.Close())
+}
+
+func TestMaxValueSize(t *testing.T) {
+	c, err := pebble.Open("test", &pebble.Options{
+		FS: vfs.NewMem(),
+	})
+	require.NoError(t, err)
+	db := NewWithMaxValueSize(c, time.Hour, 8)
+	defer db.Close()
+
+	require.NoError(t, db.Set("small", "12345678"))
+	v, err := db.Get("small")
+	require.NoError(t, err)
+	assert.Equal(t, "12345678", string(v))
+
+	err = db.Set("large", "123456789")
+	assert.True(t, errors.Is(err, ErrValueTooLarge))
+	err = db.SetWithTTL("large", "123456789", time.Minute)
+	assert.True(t, errors.Is(err, ErrValueTooLarge))
+	err = db.SetAll([]string{"small2", "large"}, []string{"1", "123456789"})
+	assert.True(t, errors.Is(err, ErrValueTooLarge))
+
+	// Nothing should have been written for the rejected values.
+	for _, key := range []string{"large", "small2"} {
+		v, err = db.Get(key)
+		require.NoError(t, err)
+		assert.Nil(t, v)
+	}
+}
+
+func TestOpenSnapshots(t *testing.T) {
+	c, err := pebble.Open("test", &pebble.Options{
+		FS: vfs.NewMem(),
+	})
+	require.NoError(t, err)
+	db := New(c, time.Hour)
+	defer db.Close()
+
+	reg := prometheus.NewRegistry()
+	db.RegisterMetrics(reg)
+	assertOpenSnapshots := func(expected int64) {
+		assert.Equal(t, expected, db.Stats().OpenSnapshots)
+		err := testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP pebbledb_open_snapshots Number of pebbledb snapshots that are currently open
+# TYPE pebbledb_open_snapshots gauge
+pebbledb_open_snapshots `+fmt.Sprint(expected)+`
+`), "pebbledb_open_snapshots")
+		assert.NoError(t, err)
+	}
+
+	assertOpenSnapshots(0)
+	_, close1 := db.newSnapshot()
+	_, close2 := db.newSnapshot()
+	assertOpenSnapshots(2)
+
+	require.NoError(t, close1())
+	assertOpenSnapshots(1)
+	require.NoError(t, close2())
+	assertOpenSnapshots(0)
+
+	// Reads from a snapshot should not leave it open.
+	_, err = db.GetAll([]string{"a", "b"})
+	require.NoError(t, err)
+	assertOpenSnapshots(0)
+}
+
+func TestStats(t *testing.T) {
+	c, err := pebble.Open("test", &pebble.Options{
+		FS: vfs.NewMem(),
+	})
+	require.NoError(t, err)
+	db := New(c, time.Hour)
+	defer db.Close()
+
+	reg := prometheus.NewRegistry()
+	db.RegisterMetrics(reg)
+
+	for i := 0; i < 100; i++ {
+		require.NoError(t, db.Set(fmt.Sprintf("/key/%d", i), strings.Repeat("a", 1024)))
+	}
+	require.NoError(t, db.Compact("/key/", "/key0"))
+
+	stats := db.Stats()
+	assert.Greater(t, stats.DiskSizeBytes, uint64(0))
+	assert.Greater(t, stats.Compactions, int64(0))
+	assert.Equal(t, db.Metrics().Compact.Count, stats.Compactions)
+
+	count, err := testutil.GatherAndCount(reg, "pebbledb_disk_size_bytes", "pebbledb_pending_compaction_bytes",
+		"pebbledb_compactions_total")
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+
+	// The stats should still be readable once the datastore is closed.
+	require.NoError(t, db.Close())
+	assert.Equal(t, Stats{}, db.Stats())
+	assert.Nil(t, db.Metrics())
+}
+
+func TestSnapshot(t *testing.T) {
+	c, err := pebble.Open("test", &pebble.Options{
+		FS: vfs.NewMem(),
+	})
+	require.NoError(t, err)
+	db := New(c, time.Hour)
+	defer db.Close()
+
+	require.NoError(t, db.SetAll([]string{"/a/1", "/a/2"}, []string{"1", "2"}))
+	snapshot := db.NewSnapshot()
+	assert.Equal(t, int64(1), db.Stats().OpenSnapshots)
+
+	// Writes after the snapshot was taken should not be visible in it.
+	require.NoError(t, db.Set("/a/3", "3"))
+	require.NoError(t, db.Delete("/a/1"))
+
+	v, err := snapshot.Get("/a/1")
+	require.NoError(t, err)
+	assert.Equal(t, "1", string(v))
+	values, err := snapshot.GetAll([]string{"/a/2", "/a/3"})
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("2"), nil}, values)
+	keys, _, err := snapshot.GetWithPrefix("/a/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/a/1", "/a/2"}, keys)
+
+	require.NoError(t, snapshot.Close())
+	assert.Equal(t, int64(0), db.Stats().OpenSnapshots)
+}
+
+func TestIteratePrefix(t *testing.T) {
+	c, err := pebble.Open("test", &pebble.Options{
+		FS: vfs.NewMem(),
+	})
+	require.NoError(t, err)
+	db := New(c, time.Hour)
+	defer db.Close()
+
+	require.NoError(t, db.SetAll(
+		[]string{"/a/1", "/a/2", "/a/3", "/ab/1", "/b/1"},
+		[]string{"1", "2", "3", "4", "5"}))
+
+	var keys, values []string
+	err = db.IteratePrefix("/a/", func(key, value []byte) error {
+		keys = append(keys, string(key))
+		values = append(values, string(value))
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/a/1", "/a/2", "/a/3"}, keys)
+	assert.Equal(t, []string{"1", "2", "3"}, values)
+
+	// Returning ErrStopIteration should stop the iteration without an error.
+	keys = nil
+	err = db.IteratePrefix("/a/", func(key, value []byte) error {
+		keys = append(keys, string(key))
+		if len(keys) == 2 {
+			return ErrStopIteration
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/a/1", "/a/2"}, keys)
+
+	// Any other error should stop the iteration and be returned.
+	errBad := errors.New("bad")
+	keys = nil
+	err = db.IteratePrefix("/", func(key, value []byte) error {
+		keys = append(keys, string(key))
+		return errBad
+	})
+	assert.True(t, errors.Is(err, errBad))
+	assert.Equal(t, []string{"/a/1"}, keys)
+
+	called := false
+	err = db.IteratePrefix("/c/", func(key, value []byte) error {
+		called = true
+		return nil
+	})
+	require.NoError(t, err)
+	assert.False(t, called)
+}
+
+func TestIterateRange(t *testing.T) {
+	c, err := pebble.Open("test", &pebble.Options{
+		FS: vfs.NewMem(),
+	})
+	require.NoError(t, err)
+	db := New(c, time.Hour)
+	defer db.Close()
+
+	require.NoError(t, db.SetAll(
+		[]string{"/a/1", "/a/2", "/a/3", "/b/1"},
+		[]string{"1", "2", "3", "4"}))
+
+	var keys []string
+	err = db.IterateRange("/a/2", "/b/1", func(key, value []byte) error {
+		keys = append(keys, string(key))
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/a/2", "/a/3"}, keys)
+}
+
+func TestBatch(t *testing.T) {
+	c, err := pebble.Open("test", &pebble.Options{
+		FS: vfs.NewMem(),
+	})
+	require.NoError(t, err)
+	db := NewWithMaxValueSize(c, time.Hour, 8)
+	defer db.Close()
+
+	require.NoError(t, db.Set("/old", "1"))
+
+	b := db.NewBatch()
+	b.Set("/a", "1")
+	b.Set("/b", "2")
+	b.Delete("/old")
+	// Nothing should be visible before the batch is committed.
+	v, err := db.Get("/a")
+	require.NoError(t, err)
+	assert.Nil(t, v)
+	require.NoError(t, b.Commit())
+
+	keys, values, err := db.GetWithPrefix("/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/a", "/b"}, keys)
+	assert.Equal(t, [][]byte{[]byte("1"), []byte("2")}, values)
+
+	// A batch with an operation that can't be applied should write nothing.
+	b = db.NewBatch()
+	b.Set("/c", "3")
+	b.Delete("/a")
+	b.Set("/large", "123456789")
+	b.Set("/d", "4")
+	err = b.Commit()
+	assert.True(t, errors.Is(err, ErrValueTooLarge))
+
+	keys, _, err = db.GetWithPrefix("/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/a", "/b"}, keys)
+
+	// A prefix delete should only delete the keys with the prefix.
+	require.NoError(t, db.SetAll([]string{"/p/1", "/p/2", "/q"}, []string{"1", "2", "3"}))
+	b = db.NewBatch()
+	b.DeleteWithPrefix("/p/")
+	b.Set("/p/3", "3")
+	require.NoError(t, b.Commit())
+	keys, _, err = db.GetWithPrefix("/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/a", "/b", "/p/3", "/q"}, keys)
+
+	// A closed batch should write nothing.
+	b = db.NewBatch()
+	b.Set("/c", "3")
+	require.NoError(t, b.Close())
+	v, err = db.Get("/c")
+	require.NoError(t, err)
+	assert.Nil(t, v)
+}
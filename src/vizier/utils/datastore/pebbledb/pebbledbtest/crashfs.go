@@ -0,0 +1,137 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package pebbledbtest
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
+)
+
+// ErrInjected is the error returned by the writes which a CrashFS fails.
+var ErrInjected = errors.New("injected write failure")
+
+// ErrFatal is the panic raised by a pebble DB opened on a CrashFS when it hits a fatal error. Pebble treats a
+// failed commit as fatal, and would otherwise exit the process.
+var ErrFatal = errors.New("pebble fatal error")
+
+// CrashFS is an in-memory filesystem for pebble which can fail writes and simulate a crash, so that tests can
+// check what survives a write that fails at the I/O level.
+type CrashFS struct {
+	mem *vfs.MemFS
+	// syncsLeft is the number of syncs which succeed before writes start to fail, or -1 if writes never fail.
+	syncsLeft int32
+}
+
+// NewCrashFS creates an empty CrashFS.
+func NewCrashFS() *CrashFS {
+	return &CrashFS{mem: vfs.NewStrictMem(), syncsLeft: -1}
+}
+
+// Open opens a pebble DB in dirname on the filesystem. Fatal errors in the DB panic with ErrFatal.
+func (f *CrashFS) Open(dirname string) (*pebble.DB, error) {
+	// The strict filesystem drops any directory which was not synced, so the directory is synced into its
+	// parent before pebble uses it.
+	err := f.mem.MkdirAll(dirname, 0755)
+	if err != nil {
+		return nil, err
+	}
+	root, err := f.mem.OpenDir("")
+	if err != nil {
+		return nil, err
+	}
+	err = root.Sync()
+	if err != nil {
+		return nil, err
+	}
+	err = root.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return pebble.Open(dirname, &pebble.Options{
+		FS:     &failingFS{FS: f.mem, syncsLeft: &f.syncsLeft},
+		Logger: panicLogger{},
+	})
+}
+
+// FailWrites makes all writes and syncs to the files created by the DB fail with ErrInjected.
+func (f *CrashFS) FailWrites() {
+	f.FailWritesAfter(0)
+}
+
+// FailWritesAfter makes the writes and syncs to the files created by the DB fail with ErrInjected, once n
+// more syncs have succeeded. Each commit is synced, so this fails the write of the n+1th commit.
+func (f *CrashFS) FailWritesAfter(n int) {
+	atomic.StoreInt32(&f.syncsLeft, int32(n))
+}
+
+// Crash discards everything which was not synced, and stops failing writes. The DBs opened before the crash
+// must not be used again, and the DB can be reopened with Open.
+func (f *CrashFS) Crash() {
+	f.mem.ResetToSyncedState()
+	atomic.StoreInt32(&f.syncsLeft, -1)
+}
+
+type failingFS struct {
+	vfs.FS
+	syncsLeft *int32
+}
+
+func (fs *failingFS) Create(name string) (vfs.File, error) {
+	file, err := fs.FS.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &failingFile{File: file, syncsLeft: fs.syncsLeft}, nil
+}
+
+type failingFile struct {
+	vfs.File
+	syncsLeft *int32
+}
+
+func (f *failingFile) Write(p []byte) (int, error) {
+	if atomic.LoadInt32(f.syncsLeft) == 0 {
+		return 0, ErrInjected
+	}
+	return f.File.Write(p)
+}
+
+func (f *failingFile) Sync() error {
+	for {
+		left := atomic.LoadInt32(f.syncsLeft)
+		if left == 0 {
+			return ErrInjected
+		}
+		if left < 0 || atomic.CompareAndSwapInt32(f.syncsLeft, left, left-1) {
+			return f.File.Sync()
+		}
+	}
+}
+
+type panicLogger struct{}
+
+func (panicLogger) Infof(format string, args ...interface{}) {}
+
+func (panicLogger) Fatalf(format string, args ...interface{}) {
+	panic(ErrFatal)
+}